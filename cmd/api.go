@@ -18,6 +18,7 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -27,12 +28,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	kclient "k8s.io/client-go/tools/clientcmd"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -89,59 +94,366 @@ type GetClusterUsageHistoryResp struct {
 	ListOfUsageHistory map[string]*UsageHistory `json:"usageHistory,omitempty"`
 }
 
+// GetBudgetsResp holds the message returned by the GetBudgetsHandler API callback
+type GetBudgetsResp struct {
+	Status  string          `json:"status,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Budgets []*BudgetStatus `json:"budgets,omitempty"`
+}
+
+// KubeConfigUploadResp holds the message returned by the KubeConfigHandler and ReplaceKubeConfigHandler API callbacks
+type KubeConfigUploadResp struct {
+	Status     string                     `json:"status,omitempty"`
+	Message    string                     `json:"message,omitempty"`
+	Name       string                     `json:"name,omitempty"`
+	Validation []*ClusterValidationReport `json:"validation,omitempty"`
+}
+
+// GetUsageComparisonResp holds the message returned by the GetUsageComparisonHandler API callback
+type GetUsageComparisonResp struct {
+	Status      string             `json:"status,omitempty"`
+	Message     string             `json:"message,omitempty"`
+	Comparisons []*UsageComparison `json:"comparisons"`
+}
+
+// GetKubeConfigsResp holds the message returned by the ListKubeConfigsHandler API callback
+type GetKubeConfigsResp struct {
+	Status      string                `json:"status,omitempty"`
+	Message     string                `json:"message,omitempty"`
+	KubeConfigs []*KubeConfigFileInfo `json:"kubeconfigs"`
+}
+
+// GetKubeConfigResp holds the message returned by the GetKubeConfigHandler API callback
+type GetKubeConfigResp struct {
+	Status     string              `json:"status,omitempty"`
+	Message    string              `json:"message,omitempty"`
+	KubeConfig *KubeConfigFileInfo `json:"kubeconfig"`
+	Content    string              `json:"content"`
+}
+
+// GetClustersResp holds the message returned by the GetClustersHandler API callback
+type GetClustersResp struct {
+	Status   string                  `json:"status,omitempty"`
+	Message  string                  `json:"message,omitempty"`
+	Clusters []*ClusterInventoryItem `json:"clusters"`
+}
+
+// GetRecommendationsResp holds the message returned by the GetRecommendationsHandler API callback
+type GetRecommendationsResp struct {
+	Status          string                 `json:"status,omitempty"`
+	Message         string                 `json:"message,omitempty"`
+	Recommendations *ClusterRecommendation `json:"recommendations,omitempty"`
+}
+
+// GetForecastResp holds the message returned by the GetForecastHandler API callback
+type GetForecastResp struct {
+	Status   string         `json:"status,omitempty"`
+	Message  string         `json:"message,omitempty"`
+	Cluster  string         `json:"cluster,omitempty"`
+	Forecast *UsageForecast `json:"forecast,omitempty"`
+}
+
+// GetAnomaliesResp holds the message returned by the GetAnomaliesHandler API callback
+type GetAnomaliesResp struct {
+	Status    string     `json:"status,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Anomalies []*Anomaly `json:"anomalies"`
+}
+
+// GetUsageHeatmapResp holds the message returned by the GetUsageHeatmapHandler API callback
+type GetUsageHeatmapResp struct {
+	Status       string        `json:"status,omitempty"`
+	Message      string        `json:"message,omitempty"`
+	StartDateUTC time.Time     `json:"startDateUTC,omitempty"`
+	EndDateUTC   time.Time     `json:"endDateUTC,omitempty"`
+	Heatmap      *UsageHeatmap `json:"heatmap,omitempty"`
+}
+
+// routes are keyed by path template, or by method and path template when several methods are served on a path,
+// in which case the path template is set in the "path" field
 var routes = map[string]map[string]interface{}{
+	"/metrics": {
+		"method":   "GET",
+		"handler":  MetricsHandler,
+		"summary":  "Current usage of clusters and nodes in the Prometheus text format",
+		"produces": prometheusContentType,
+	},
+	"/healthz": {
+		"method":   "GET",
+		"handler":  HealthzHandler,
+		"scope":    AuthScopePublic,
+		"summary":  "Liveness of the API process",
+		"response": GetHealthResp{},
+	},
+	"/readyz": {
+		"method":   "GET",
+		"handler":  ReadyzHandler,
+		"scope":    AuthScopePublic,
+		"summary":  "Readiness of the API, with the status of each dependency check",
+		"response": GetHealthResp{},
+	},
+	"/api/openapi.json": {
+		"method":   "GET",
+		"handler":  GetOpenAPIHandler,
+		"scope":    AuthScopePublic,
+		"summary":  "OpenAPI document of the API",
+		"response": map[string]interface{}{},
+	},
 	"/api/dataset/{filename}": {
 		"method":  "GET",
 		"handler": GetDatasetHandler,
+		"summary": "Download a dataset from the kube-opex-analytics instance of a cluster",
+		"parameters": []*OpenAPIParameter{
+			{Name: "filename", In: "path", Required: true, Schema: &OpenAPISchema{Type: "string"}},
+			{Name: "X-Krossboard-Cluster", In: "header", Required: true, Description: "Name of the cluster", Schema: &OpenAPISchema{Type: "string"}},
+		},
 	},
 	"/api/discovery": {
-		"method":  "GET",
-		"handler": DiscoveryHandler,
+		"method":   "GET",
+		"handler":  DiscoveryHandler,
+		"summary":  "List the kube-opex-analytics instances of managed clusters",
+		"response": DiscoveryResp{},
 	},
 	"/api/currentusage": {
-		"method":  "GET",
-		"handler": GetAllClustersCurrentUsageHandler,
+		"method":   "GET",
+		"handler":  GetAllClustersCurrentUsageHandler,
+		"summary":  "Current usage of all clusters",
+		"response": GetAllClustersCurrentUsageResp{},
 	},
 	"/api/usagehistory": {
 		"method":  "GET",
 		"handler": GetClustersUsageHistoryHandler,
+		"summary": "Usage history of all clusters, or of the namespaces of a cluster",
+		"parameters": []*OpenAPIParameter{
+			clusterQueryParam,
+			startDateUTCParam,
+			endDateUTCParam,
+			tzParam,
+			stepParam,
+			exportFormatParam,
+			csvLayoutParam,
+			csvDelimiterParam,
+			{Name: "period", In: "query", Schema: &OpenAPISchema{Type: "string", Enum: []string{"hourly", "monthly"}}},
+		},
+		"response": GetClusterUsageHistoryResp{},
 	},
 	"/api/nodesusage/{clustername}": {
 		"method":  "GET",
 		"handler": GetNodesUsageHandler,
+		"summary": "Capacity, allocatable and usage history of the nodes of a cluster",
+		"parameters": []*OpenAPIParameter{
+			clusterNamePathParam,
+			startDateUTCParam,
+			endDateUTCParam,
+			tzParam,
+			stepParam,
+			exportFormatParam,
+			csvLayoutParam,
+			csvDelimiterParam,
+		},
+		"response": map[string]*NodeUsageHistory{},
+	},
+	"/api/stream/usage": {
+		"method":    "GET",
+		"handler":   StreamUsageHandler,
+		"streaming": true,
+		"summary":   "Server-Sent Events pushing the updated usage of clusters",
+		"parameters": []*OpenAPIParameter{
+			streamClusterParam,
+			streamLastEventIDParam,
+			{Name: "Last-Event-ID", In: "header", Description: "Id of the last event received before a reconnection", Schema: &OpenAPISchema{Type: "string"}},
+		},
+		"produces": "text/event-stream",
+	},
+	"/api/stream/usage/ws": {
+		"method":     "GET",
+		"handler":    StreamUsageWebSocketHandler,
+		"streaming":  true,
+		"summary":    "WebSocket pushing the updated usage of clusters as JSON messages",
+		"parameters": []*OpenAPIParameter{streamClusterParam, streamLastEventIDParam},
 	},
 	"/api/kubeconfig": {
-		"method":  "POST",
-		"handler": KubeConfigHandler,
+		"method":      "POST",
+		"handler":     KubeConfigHandler,
+		"scope":       AuthScopeAdmin,
+		"summary":     "Upload a KUBECONFIG file",
+		"parameters":  []*OpenAPIParameter{kubeConfigValidationParam},
+		"requestBody": kubeConfigRequestBody,
+		"response":    KubeConfigUploadResp{},
+	},
+	"/api/kubeconfigs": {
+		"method":   "GET",
+		"handler":  ListKubeConfigsHandler,
+		"scope":    AuthScopeAdmin,
+		"summary":  "List the files of the KUBECONFIG directory with the clusters and contexts they define",
+		"response": GetKubeConfigsResp{},
+	},
+	"/api/kubeconfigs/{name}": {
+		"method":     "GET",
+		"handler":    GetKubeConfigHandler,
+		"scope":      AuthScopeAdmin,
+		"summary":    "Content of a file of the KUBECONFIG directory, with credentials redacted",
+		"parameters": []*OpenAPIParameter{kubeConfigNamePathParam},
+		"response":   GetKubeConfigResp{},
+	},
+	"PUT /api/kubeconfigs/{name}": {
+		"path":        "/api/kubeconfigs/{name}",
+		"method":      "PUT",
+		"handler":     ReplaceKubeConfigHandler,
+		"scope":       AuthScopeAdmin,
+		"summary":     "Replace the content of a file of the KUBECONFIG directory",
+		"parameters":  []*OpenAPIParameter{kubeConfigNamePathParam, kubeConfigValidationParam},
+		"requestBody": kubeConfigRequestBody,
+		"response":    KubeConfigUploadResp{},
+	},
+	"DELETE /api/kubeconfigs/{name}": {
+		"path":       "/api/kubeconfigs/{name}",
+		"method":     "DELETE",
+		"handler":    DeleteKubeConfigHandler,
+		"scope":      AuthScopeAdmin,
+		"summary":    "Delete a file of the KUBECONFIG directory",
+		"parameters": []*OpenAPIParameter{kubeConfigNamePathParam},
+		"response":   ErrorResp{},
+	},
+	"/api/clusters": {
+		"method":   "GET",
+		"handler":  GetClustersHandler,
+		"summary":  "Inventory of the clusters found in KUBECONFIG or managed by the operator",
+		"response": GetClustersResp{},
+	},
+	"/api/clusters/{clustername}/enable": {
+		"method":     "POST",
+		"handler":    EnableClusterHandler,
+		"scope":      AuthScopeAdmin,
+		"summary":    "Resume the processing of a cluster found in KUBECONFIG",
+		"parameters": []*OpenAPIParameter{clusterNamePathParam},
+		"response":   ErrorResp{},
+	},
+	"/api/clusters/{clustername}/disable": {
+		"method":     "POST",
+		"handler":    DisableClusterHandler,
+		"scope":      AuthScopeAdmin,
+		"summary":    "Stop processing a cluster found in KUBECONFIG, its data being kept",
+		"parameters": []*OpenAPIParameter{clusterNamePathParam},
+		"response":   ErrorResp{},
+	},
+	"/api/budgets": {
+		"method":   "GET",
+		"handler":  GetBudgetsHandler,
+		"summary":  "Status of budgets as evaluated by the last consolidation",
+		"response": GetBudgetsResp{},
+	},
+	"/api/recommendations/{clustername}": {
+		"method":     "GET",
+		"handler":    GetRecommendationsHandler,
+		"summary":    "Node rightsizing and consolidation recommendations for a cluster",
+		"parameters": []*OpenAPIParameter{clusterNamePathParam, startDateUTCParam, endDateUTCParam, tzParam},
+		"response":   GetRecommendationsResp{},
+	},
+	"/api/forecast": {
+		"method":  "GET",
+		"handler": GetForecastHandler,
+		"summary": "Forecast of the CPU and memory usage of a cluster, answered with status 422 until enough history is collected",
+		"parameters": []*OpenAPIParameter{
+			{Name: "cluster", In: "query", Required: true, Description: "Name of the cluster", Schema: &OpenAPISchema{Type: "string"}},
+			{Name: "horizon", In: "query", Description: "Forecast horizon in hours, days or weeks (e.g. 12h, 30d, 2w)", Schema: &OpenAPISchema{Type: "string", Pattern: `^\d+[hdwHDW]$`}},
+			{Name: "method", In: "query", Schema: &OpenAPISchema{Type: "string", Enum: []string{ForecastMethodLinear, ForecastMethodHoltWinters}}},
+			{Name: "threshold", In: "query", Description: "Usage percentage whose crossing is reported", Schema: &OpenAPISchema{Type: "number"}},
+		},
+		"response": GetForecastResp{},
+	},
+	"/api/usagecomparison": {
+		"method":  "GET",
+		"handler": GetUsageComparisonHandler,
+		"summary": "Average, peak and total usage of clusters over a period compared with the previous period or the same period last year",
+		"parameters": []*OpenAPIParameter{
+			{Name: "cluster", In: "query", Description: "Name of the cluster, all clusters by default", Schema: &OpenAPISchema{Type: "string"}},
+			startDateUTCParam,
+			endDateUTCParam,
+			tzParam,
+			{Name: "compareTo", In: "query", Description: "Period to compare with, the previous period by default. It must start within the last 800 days, usage being compared daily beyond 370 days", Schema: &OpenAPISchema{Type: "string", Enum: []string{UsageComparisonPreviousPeriod, UsageComparisonPreviousYear}}},
+		},
+		"response": GetUsageComparisonResp{},
+	},
+	"/api/anomalies": {
+		"method":  "GET",
+		"handler": GetAnomaliesHandler,
+		"summary": "Usage anomaly episodes detected by the consolidator, each merging the consecutive detections of a series",
+		"parameters": []*OpenAPIParameter{
+			clusterQueryParam,
+			{Name: "kind", In: "query", Schema: &OpenAPISchema{Type: "string", Enum: []string{AnomalyKindCluster, AnomalyKindNamespace, AnomalyKindNode}}},
+			{Name: "severity", In: "query", Schema: &OpenAPISchema{Type: "string", Enum: []string{AnomalySeverityWarning, AnomalySeverityCritical}}},
+			startDateUTCParam,
+			tzParam,
+		},
+		"response": GetAnomaliesResp{},
+	},
+	"/api/heatmap": {
+		"method":  "GET",
+		"handler": GetUsageHeatmapHandler,
+		"summary": "Day-of-week by hour-of-day usage heatmap of a cluster, a namespace or a node",
+		"parameters": []*OpenAPIParameter{
+			clusterQueryParam,
+			{Name: "namespace", In: "query", Schema: &OpenAPISchema{Type: "string"}},
+			{Name: "node", In: "query", Description: "Name of the node, which must belong to the cluster when set", Schema: &OpenAPISchema{Type: "string"}},
+			startDateUTCParam,
+			endDateUTCParam,
+			{Name: "tz", In: "query", Description: "Time zone of the days and hours of the heatmap, and of the dates without offset, such as Europe/Paris. UTC by default", Schema: &OpenAPISchema{Type: "string"}},
+			formatParam,
+		},
+		"response": GetUsageHeatmapResp{},
 	},
 }
 
+// apiWriteTimeout is the maximum time to serve a request, except for streams
+const apiWriteTimeout = 15 * time.Second
+
 func startAPI() {
 	var wait time.Duration
 	flag.DurationVar(&wait, "graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish")
 	flag.Parse()
 
-	router := mux.NewRouter()
-	for r, h := range routes {
-		router.HandleFunc(r, h["handler"].(func(http.ResponseWriter, *http.Request))).Methods(h["method"].(string), "OPTIONS")
+	router, err := newAPIRouter()
+	if err != nil {
+		log.WithError(err).Fatalln("failed initializing API router")
 	}
 
 	appCors := cors.New(cors.Options{
 		AllowedOrigins:   []string{viper.GetString("krossboard_cors_origins")},
-		AllowedHeaders:   []string{"Authorization", "X-Krossboard-Cluster"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Authorization", "X-API-Key", "X-Krossboard-Cluster"},
 		AllowCredentials: true,
 	})
+	tlsConfig, err := newAPITLSConfig()
+	if err != nil {
+		log.WithError(err).Fatalln("failed initializing API TLS configuration")
+	}
+	// the write timeout is enforced by the router on all routes but streams, which stay open
 	srv := &http.Server{
-		Addr:         viper.GetString("krossboard_api_addr"),
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
-		Handler:      appCors.Handler(router),
+		Addr:        viper.GetString("krossboard_api_addr"),
+		TLSConfig:   tlsConfig,
+		ReadTimeout: time.Second * 15,
+		IdleTimeout: time.Second * 60,
+		Handler:     appCors.Handler(router),
 	}
 
+	stopUsageStream := make(chan struct{})
+	go func() {
+		if err := apiUsageStream.watch(stopUsageStream); err != nil {
+			log.WithError(err).Errorln("failed watching current usage, usage streams won't be updated")
+		}
+	}()
+
 	// Run the server in a goroutine so that it doesn't block.
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		var err error
+		if tlsConfig != nil {
+			// certificates are provided by the TLS configuration, which reloads them on change
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
 			log.Errorln(err)
 		}
 	}()
@@ -150,6 +462,7 @@ func startAPI() {
 	signal.Notify(c, os.Interrupt)
 	<-c
 
+	close(stopUsageStream)
 	ctx, cancel := context.WithTimeout(context.Background(), wait)
 	defer cancel()
 	srv.Shutdown(ctx) //nolint:errcheck
@@ -157,8 +470,91 @@ func startAPI() {
 	os.Exit(0)
 }
 
+// newAPIRouter creates the API router, along with the authentication middleware when API keys or JWT validation are configured,
+// and the validation of requests against the OpenAPI document
+func newAPIRouter() (*mux.Router, error) {
+	apiSpec = newOpenAPIDocument(routes)
+	router := mux.NewRouter()
+	router.Use(newHTTPMetricsMiddleware())
+	router.Use(newCompressionMiddleware())
+	timeoutResp, _ := json.Marshal(&ErrorResp{Status: "error", Message: "request timed out"})
+	for r, h := range routes {
+		var handler http.Handler = http.HandlerFunc(h["handler"].(func(http.ResponseWriter, *http.Request)))
+		if streaming, _ := h["streaming"].(bool); !streaming {
+			handler = newWriteTimeoutHandler(handler, string(timeoutResp))
+		}
+		router.Handle(getRoutePath(r, h), handler).Methods(h["method"].(string), "OPTIONS")
+	}
+
+	var authenticators []authenticator
+	if viper.GetString("krossboard_jwt_issuer") != "" {
+		jwtAuth, err := newJWTValidator()
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwtAuth)
+	}
+	if apiKeysFile := viper.GetString("krossboard_api_keys_file"); apiKeysFile != "" {
+		apiKeys, err := newAPIKeyStore(apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, apiKeys)
+	}
+	if accessControlFile := viper.GetString("krossboard_access_control_file"); accessControlFile != "" {
+		policy, err := newAccessPolicy(accessControlFile)
+		if err != nil {
+			return nil, err
+		}
+		apiAccessPolicy = policy
+	}
+	if len(authenticators) == 0 {
+		log.Warnln("neither API keys nor JWT validation are set, the API is not authenticated and admin routes are disabled")
+		router.Use(newAdminRoutesLockMiddleware())
+	} else {
+		router.Use(newAuthMiddleware(authenticators...))
+	}
+	router.Use(newRequestValidationMiddleware(apiSpec))
+	return router, nil
+}
+
+// getRoutePath returns the path template of a route from its key
+func getRoutePath(key string, route map[string]interface{}) string {
+	if path, found := route["path"]; found {
+		return path.(string)
+	}
+	return key
+}
+
+// findRoute returns the route serving a method on a path template, if any
+func findRoute(pathTemplate string, method string) map[string]interface{} {
+	if route, found := routes[pathTemplate]; found && route["method"] == method {
+		return route
+	}
+	if route, found := routes[method+" "+pathTemplate]; found {
+		return route
+	}
+	return nil
+}
+
+// newWriteTimeoutHandler bounds the time to serve requests to apiWriteTimeout, except for bulk exports which
+// are streamed for as long as needed
+func newWriteTimeoutHandler(handler http.Handler, timeoutResp string) http.Handler {
+	timeoutHandler := http.TimeoutHandler(handler, apiWriteTimeout, timeoutResp)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isBulkExportRequest(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		timeoutHandler.ServeHTTP(w, req)
+	})
+}
+
 // GetKrossboardInstances queries Krossboard instanes from Kubernetes API
-func GetKrossboardInstances() (*KbInstancesK8sList, error) {
+func GetKrossboardInstances() (_ *KbInstancesK8sList, err error) {
+	defer func(start time.Time) {
+		observeUpstreamCall(UpstreamKubernetes, "list_krossboard_instances", start, err)
+	}(time.Now())
 	k8sApi := viper.GetString("krossboard_k8s_api_endpoint")
 	kbOperatorVersion := viper.GetString("krossboard_operator_api_version")
 
@@ -220,7 +616,7 @@ func GetDatasetHandler(w http.ResponseWriter, req *http.Request) {
 	koaInst := KoaInstance{}
 	for _, kbInstanceItem := range kbInstances.Items {
 		for _, koaInstanceItem := range kbInstanceItem.Status.KoaInstances {
-			if clusterName == koaInstanceItem.ClusterName {
+			if clusterName == koaInstanceItem.ClusterName && isClusterAllowed(req, clusterName) {
 				koaInstanceFound = true
 				koaInst = koaInstanceItem
 				break
@@ -232,9 +628,9 @@ func GetDatasetHandler(w http.ResponseWriter, req *http.Request) {
 		log.Errorln("requested cluster not found =>", clusterName)
 		b, _ := json.Marshal(&ErrorResp{
 			Status:  "error",
-			Message: fmt.Sprintf("requested cluster not found => %s", clusterName),
+			Message: fmt.Sprintf("cluster not found => %s", clusterName),
 		})
-		http.Error(w, string(b), http.StatusBadRequest)
+		http.Error(w, string(b), http.StatusNotFound)
 		return
 	}
 
@@ -261,7 +657,9 @@ func GetDatasetHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	httpClient := http.Client{}
+	proxyStart := time.Now()
 	resp, err := httpClient.Do(proxyReq)
+	observeUpstreamCall(UpstreamKOA, "dataset", proxyStart, err)
 	if err != nil {
 		log.WithError(err).Errorln("httpClient.Do failed on URL", koaDatasetUrl)
 		b, _ := json.Marshal(&ErrorResp{
@@ -312,6 +710,9 @@ func DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
 	discoveryResp.Status = "ok"
 	for _, kbInstanceItem := range kbInstances.Items {
 		for _, koaInstance := range kbInstanceItem.Status.KoaInstances {
+			if !isClusterAllowed(r, koaInstance.ClusterName) {
+				continue
+			}
 			discoveryResp.Instances = append(discoveryResp.Instances, &KOAAPI{
 				ClusterName: koaInstance.ClusterName,
 				Endpoint:    fmt.Sprintf("http://127.0.0.1:%v", koaInstance.ContainerPort),
@@ -346,7 +747,11 @@ func GetAllClustersCurrentUsageHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			respHTTPStatus = http.StatusOK
 			currentUsageResp.Status = "ok"
-			currentUsageResp.ClusterUsage = currentUsage
+			for _, clusterUsage := range currentUsage {
+				if isClusterAllowed(r, clusterUsage.ClusterName) {
+					currentUsageResp.ClusterUsage = append(currentUsageResp.ClusterUsage, clusterUsage)
+				}
+			}
 		}
 	}
 
@@ -359,7 +764,7 @@ func GetAllClustersCurrentUsageHandler(w http.ResponseWriter, r *http.Request) {
 func GetClustersUsageHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	kbInstances, err := GetKrossboardInstances()
+	kbInstances, err := apiInstancesCache.get()
 	if err != nil {
 		log.WithError(err).Errorln("cannot load system status")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -373,14 +778,12 @@ func GetClustersUsageHistoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	queryParams := r.URL.Query()
 	queryCluster := queryParams.Get("cluster")
-	queryStartDate := queryParams.Get("startDateUTC")
-	queryEndDate := queryParams.Get("endDateUTC")
 	queryFormat := strings.ToLower(queryParams.Get("format"))
 	queryPeriod := strings.ToLower(queryParams.Get("period"))
 
 	// process format
-	if queryFormat != "" && queryFormat != "json" && queryFormat != "csv" {
-		err := fmt.Errorf("invalid value '%s' for query parameter 'format'. Valid values are: 'json', 'csv'", queryFormat)
+	if queryFormat != "" && queryFormat != ExportFormatJSON && queryFormat != ExportFormatCSV && !isBulkExportFormat(queryFormat) {
+		err := fmt.Errorf("invalid value '%s' for query parameter 'format'. Valid values are: 'json', 'csv', 'ndjson', 'parquet'", queryFormat)
 		log.WithError(err).WithField("param", "format").Warnln("Bad request")
 		w.WriteHeader(http.StatusBadRequest)
 		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
@@ -390,11 +793,23 @@ func GetClustersUsageHistoryHandler(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(apiResp)
 		return
 	}
+	csvLayout, csvDelimiter, err := parseCSVOptions(queryParams)
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
 
 	// process period
 	if queryPeriod != "" && queryPeriod != "hourly" && queryPeriod != "monthly" {
 		err := fmt.Errorf("invalid value '%s' for query parameter 'period'. Valid values are: 'hourly', 'monthly'", queryPeriod)
 		log.WithError(err).WithField("param", "period").Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
 		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
 			Status:  "error",
 			Message: err.Error(),
@@ -406,59 +821,76 @@ func GetClustersUsageHistoryHandler(w http.ResponseWriter, r *http.Request) {
 		queryPeriod = "hourly"
 	}
 
-	// process  end date parameter
-	parametersAreInvalid := false
-	now := time.Now().UTC()
-	actualEndDateUTC := now
-	if queryEndDate != "" {
-		queryParsedEndTime, err := time.Parse(queryTimeLayout, queryEndDate)
-		if err != nil {
-			parametersAreInvalid = true
-			log.WithError(err).Errorln("failed parsing query end date", queryEndDate)
-		} else {
-			actualEndDateUTC = queryParsedEndTime
-		}
+	// process period and step parameters
+	timeRange, err := parseQueryTimeRange(queryParams, 24*time.Hour)
+	if err == nil && timeRange.Step > 0 && queryPeriod == "monthly" {
+		err = fmt.Errorf("query parameter 'step' is not supported with the 'monthly' period")
 	}
-
-	// process start date parameter
-	const durationMinus24Hours = -1 * 24 * time.Hour
-	actualStartDateUTC := actualEndDateUTC.Add(durationMinus24Hours)
-	if queryStartDate != "" {
-		queryParsedStartTime, err := time.Parse(queryTimeLayout, queryStartDate)
-		if err != nil {
-			parametersAreInvalid = true
-			log.WithError(err).Errorln("failed parsing query end date ", queryStartDate)
-		} else {
-			actualStartDateUTC = queryParsedStartTime
-		}
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+	actualStartDateUTC, actualEndDateUTC := timeRange.StartDateUTC, timeRange.EndDateUTC
+	resolution := queryPeriod
+	if timeRange.Step > 0 {
+		resolution = timeRange.Step.String()
 	}
 
 	// process cluster parameter
+	parametersAreInvalid := false
+	clusterIsNotFound := false
 	historyDbs := make(map[string]string)
 	koaInstancesCount := 0
 	if queryCluster == "" || strings.ToLower(queryCluster) == "all" {
 		for _, kbInstanceItem := range kbInstances.Items {
 			for _, koaInstance := range kbInstanceItem.Status.KoaInstances {
+				if !isClusterAllowed(r, koaInstance.ClusterName) {
+					continue
+				}
 				historyDbs[koaInstance.ClusterName] = getHistoryDbPath(koaInstance.ClusterName)
 				koaInstancesCount += 1
 			}
 		}
-	} else {
+	} else if err := validateQueryItemName("cluster", queryCluster); err != nil {
+		parametersAreInvalid = true
+	} else if isAnyNamespaceAllowed(r, queryCluster) {
+		// namespace-restricted callers only get the namespaces they are granted
 		dbdir := fmt.Sprintf("%s/%s", viper.GetString("krossboard_rawdb_dir"), queryCluster)
 		dbfiles, err := listRegularFiles(dbdir)
-		if err != nil {
+		if os.IsNotExist(err) {
+			clusterIsNotFound = true
+		} else if err != nil {
 			log.WithError(err).Errorln("failed listing dbs for cluster", queryCluster)
 			parametersAreInvalid = true
 		} else {
 			for _, dbfile := range dbfiles {
-				historyDbs[dbfile] = dbfile
+				if isNamespaceAllowed(r, queryCluster, filepath.Base(dbfile)) {
+					historyDbs[dbfile] = dbfile
+				}
 			}
 		}
+	} else {
+		clusterIsNotFound = true
 	}
 
 	// finalizing parameters validation before actually processing the request
-	if parametersAreInvalid || actualStartDateUTC.After(actualEndDateUTC) {
-		log.Errorln("invalid query parameters", queryCluster, queryStartDate, queryEndDate)
+	if clusterIsNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
+			Status:  "error",
+			Message: fmt.Sprintf("cluster not found => %s", queryCluster),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+	if parametersAreInvalid {
+		log.Errorln("invalid query parameters", queryCluster)
 		w.WriteHeader(http.StatusBadRequest)
 		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
 			Status:  "error",
@@ -468,6 +900,35 @@ func GetClustersUsageHistoryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag, lastModified, lastUpdates := usageValidators([]string{
+		r.URL.Path,
+		queryCluster,
+		queryFormat,
+		csvLayout,
+		string(csvDelimiter),
+		usageHistoryCacheKey("", resolution, actualStartDateUTC, actualEndDateUTC),
+	}, historyDbs)
+	if checkNotModified(w, r, etag, lastModified) {
+		return
+	}
+
+	if isBulkExportFormat(queryFormat) {
+		w.Header().Set("Content-Type", bulkExportContentType(queryFormat))
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"usagehistory_%v_FROM_%v_TO_%v.%v\"",
+				queryCluster,
+				actualStartDateUTC.Format(queryTimeLayout),
+				actualEndDateUTC.Format(queryTimeLayout),
+				queryFormat,
+			),
+		)
+		w.WriteHeader(http.StatusOK)
+		if err := exportUsageHistory(w, queryFormat, historyDbs, queryPeriod, actualStartDateUTC, actualEndDateUTC, timeRange.Step); err != nil {
+			log.WithError(err).Errorln("failed exporting usage history")
+		}
+		return
+	}
+
 	usageHistoryResult := &GetClusterUsageHistoryResp{
 		Status:             "ok",
 		ListOfUsageHistory: make(map[string]*UsageHistory, koaInstancesCount),
@@ -475,13 +936,10 @@ func GetClustersUsageHistoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	for dbname, dbfile := range historyDbs {
 		usageDb := NewUsageDb(dbfile, 100)
-		usageHistory, err := func() (*UsageHistory, error) {
-			if queryPeriod == "monthly" {
-				return usageDb.FetchUsageMonthly(actualStartDateUTC, actualEndDateUTC)
-			} else {
-				return usageDb.FetchUsageHourly(actualStartDateUTC, actualEndDateUTC)
-			}
-		}()
+		cacheKey := usageHistoryCacheKey(dbfile, resolution, actualStartDateUTC, actualEndDateUTC)
+		usageHistory, err := apiUsageHistoryCache.fetch(cacheKey, lastUpdates[dbname], func() (*UsageHistory, error) {
+			return fetchUsageHistory(usageDb, queryPeriod, actualStartDateUTC, actualEndDateUTC, timeRange.Step)
+		})
 		if err != nil {
 			log.WithError(err).Errorln("failed retrieving data from rrd file")
 		} else {
@@ -495,25 +953,19 @@ func GetClustersUsageHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	if queryFormat != "csv" {
 		respPayload, _ = json.Marshal(usageHistoryResult)
 	} else {
-		var csvBuf strings.Builder
+		var csvSeries []*usageSeries
 		for itemName, itemUsage := range usageHistoryResult.ListOfUsageHistory {
-			countUsageEntries := len(itemUsage.CPUUsage)
-			if countUsageEntries != len(itemUsage.MEMUsage) {
-				log.Errorf("usage entries for CPU and memory for entry %v don't match (%v != %v)\n",
-					itemUsage, countUsageEntries, len(itemUsage.MEMUsage))
-				continue
-			}
-			fmt.Fprintf(&csvBuf, "Name,Date UTC,CPU Usage,Memory usage\n")
-			for i := 0; i < countUsageEntries; i++ {
-				fmt.Fprintf(&csvBuf, "%v,%v,%v,%v\n",
-					itemName,
-					itemUsage.CPUUsage[i].DateUTC,
-					itemUsage.CPUUsage[i].Value,
-					itemUsage.MEMUsage[i].Value)
-			}
+			csvSeries = append(csvSeries, newUsageHistorySeries(itemName, itemUsage))
 		}
-		respPayload = []byte(csvBuf.String())
-		w.Header().Set("Content-Type", "text/csv")
+		var csvBuf bytes.Buffer
+		if err := writeUsageCSV(&csvBuf, csvSeries, usageHistoryColumns, csvLayout, csvDelimiter); err != nil {
+			log.WithError(err).Errorln("failed encoding usage history in CSV")
+			b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "server internal error"})
+			http.Error(w, string(b), http.StatusInternalServerError)
+			return
+		}
+		respPayload = csvBuf.Bytes()
+		w.Header().Set("Content-Type", usageCSVContentType)
 		w.Header().Set("Content-Disposition",
 			fmt.Sprintf("attachment; filename=\"usagehistory_%v_FROM_%v_TO_%v.csv\"",
 				queryCluster,
@@ -531,87 +983,174 @@ func GetNodesUsageHandler(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 	clusterName := params["clustername"]
 	queryParams := req.URL.Query()
-	queryStartDate := queryParams.Get("startDateUTC")
-	queryEndDate := queryParams.Get("endDateUTC")
+	queryFormat := strings.ToLower(queryParams.Get("format"))
 
-	// process  end date parameter
-	parametersAreInvalid := false
-	actualEndDateUTC := time.Now().UTC()
-	if queryEndDate != "" {
-		queryParsedEndTime, err := time.Parse(queryTimeLayout, queryEndDate)
-		if err != nil {
-			parametersAreInvalid = true
-			log.WithError(err).Errorln("failed parsing query end date", queryEndDate)
-		} else {
-			actualEndDateUTC = queryParsedEndTime
-		}
+	// process format
+	if queryFormat != "" && queryFormat != ExportFormatJSON && queryFormat != ExportFormatCSV && !isBulkExportFormat(queryFormat) {
+		err := fmt.Errorf("invalid value '%s' for query parameter 'format'. Valid values are: 'json', 'csv', 'ndjson', 'parquet'", queryFormat)
+		log.WithError(err).WithField("param", "format").Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
 	}
-
-	// process start date parameter
-	const durationMinus24Hours = -1 * 24 * time.Hour
-	actualStartDateUTC := actualEndDateUTC.Add(durationMinus24Hours)
-	if queryStartDate != "" {
-		queryParsedStartTime, err := time.Parse(queryTimeLayout, queryStartDate)
-		if err != nil {
-			parametersAreInvalid = true
-			log.WithError(err).Errorln("failed parsing query end date ", queryStartDate)
-		} else {
-			actualStartDateUTC = queryParsedStartTime
-		}
+	csvLayout, csvDelimiter, err := parseCSVOptions(queryParams)
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
 	}
 
-	if parametersAreInvalid || actualEndDateUTC.Before(actualStartDateUTC) {
-		log.Errorln("invalid query parameters", queryStartDate, queryEndDate)
+	// process period and step parameters
+	timeRange, err := parseQueryTimeRange(queryParams, 24*time.Hour)
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
 		w.WriteHeader(http.StatusBadRequest)
 		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
 			Status:  "error",
-			Message: "invalid query parameters",
+			Message: err.Error(),
 		})
 		_, _ = w.Write(apiResp)
 		return
 	}
+	actualStartDateUTC, actualEndDateUTC := timeRange.StartDateUTC, timeRange.EndDateUTC
 
-	recentNodesUsage, err := getRecentNodesUsage(clusterName)
+	if !isClusterAllowed(req, clusterName) {
+		w.WriteHeader(http.StatusNotFound)
+		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
+			Status:  "error",
+			Message: fmt.Sprintf("cluster not found => %s", clusterName),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	// nodes are listed from storage so that nodes removed since the period are still returned
+	nodeNames, nodesMetadata, err := listClusterNodes(clusterName, actualStartDateUTC, actualEndDateUTC)
 	if err != nil {
-		log.WithError(err).Errorln("failed getting recent cluster nodes")
+		log.WithError(err).Errorln("failed reading nodes metadata")
 		w.WriteHeader(http.StatusInternalServerError)
 		apiResp, _ := json.Marshal(&GetClusterUsageHistoryResp{
 			Status:  "error",
-			Message: "failed getting recent cluster nodes",
+			Message: "failed listing cluster nodes",
 		})
 		_, _ = w.Write(apiResp)
 		return
 	}
 
-	step := time.Duration(RRDStorageStep3600Secs) * time.Second
-	if actualEndDateUTC.Sub(actualStartDateUTC) <= time.Duration(24)*time.Hour {
-		step = time.Duration(RRDStorageStep300Secs) * time.Second
+	step := timeRange.Step
+	if step == 0 {
+		step = nodeUsageStep(actualStartDateUTC, actualEndDateUTC)
+	}
+
+	// nodes without databases are skipped, databases are not created on read
+	nodeUsageDbs := make(map[string]*NodeUsageDb, len(nodeNames))
+	nodeDbFiles := make(map[string]string, 3*len(nodeNames))
+	storedNodeNames := nodeNames[:0]
+	for _, nodeName := range nodeNames {
+		nodeUsageDb, err := openNodeUsageDB(nodeName)
+		if err != nil {
+			log.WithError(err).Debugln("skipping node without usage databases", nodeName)
+			continue
+		}
+		storedNodeNames = append(storedNodeNames, nodeName)
+		nodeUsageDbs[nodeName] = nodeUsageDb
+		for _, usageDb := range []*UsageDb{nodeUsageDb.CapacityDb, nodeUsageDb.AllocatableDb, nodeUsageDb.UsageByPodsDb} {
+			nodeDbFiles[usageDb.RRDFile] = usageDb.RRDFile
+		}
+	}
+	nodeNames = storedNodeNames
+	etag, lastModified, lastUpdates := usageValidators([]string{
+		req.URL.Path,
+		queryFormat,
+		csvLayout,
+		string(csvDelimiter),
+		usageHistoryCacheKey("", step.String(), actualStartDateUTC, actualEndDateUTC),
+	}, nodeDbFiles)
+	if checkNotModified(w, req, etag, lastModified) {
+		return
+	}
+
+	if isBulkExportFormat(queryFormat) {
+		w.Header().Set("Content-Type", bulkExportContentType(queryFormat))
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"nodesusage_%v_FROM_%v_TO_%v.%v\"",
+				clusterName,
+				actualStartDateUTC.Format(queryTimeLayout),
+				actualEndDateUTC.Format(queryTimeLayout),
+				queryFormat,
+			),
+		)
+		w.WriteHeader(http.StatusOK)
+		if err := exportNodesUsage(w, queryFormat, nodeNames, actualStartDateUTC, actualEndDateUTC, step); err != nil {
+			log.WithError(err).Errorln("failed exporting nodes usage")
+		}
+		return
+	}
+	fetchNodeUsage := func(usageDb *UsageDb) (*UsageHistory, error) {
+		cacheKey := usageHistoryCacheKey(usageDb.RRDFile, step.String(), actualStartDateUTC, actualEndDateUTC)
+		return apiUsageHistoryCache.fetch(cacheKey, lastUpdates[usageDb.RRDFile], func() (*UsageHistory, error) {
+			return usageDb.FetchUsage(actualStartDateUTC, actualEndDateUTC, step)
+		})
 	}
 
-	nodeUsageMap := make(map[string]map[string]UsageHistory)
-	for nodeName := range recentNodesUsage {
-		nodeUsageDb := NewNodeUsageDB(nodeName)
-		capacityHistory, err := nodeUsageDb.CapacityDb.FetchUsage(actualStartDateUTC, actualEndDateUTC, step)
+	nodeUsageMap := make(map[string]*NodeUsageHistory)
+	var csvSeries []*usageSeries
+	for _, nodeName := range nodeNames {
+		nodeUsageDb := nodeUsageDbs[nodeName]
+		capacityHistory, err := fetchNodeUsage(nodeUsageDb.CapacityDb)
 		if err != nil {
 			capacityHistory = &UsageHistory{}
 			log.WithError(err).Errorln("failed retrieving node capacity history", nodeUsageDb.CapacityDb.RRDFile)
 		}
-		allocatableHistory, err := nodeUsageDb.AllocatableDb.FetchUsage(actualStartDateUTC, actualEndDateUTC, step)
+		allocatableHistory, err := fetchNodeUsage(nodeUsageDb.AllocatableDb)
 		if err != nil {
 			allocatableHistory = &UsageHistory{}
 			log.WithError(err).Errorln("failed retrieving node allocatable history", nodeUsageDb.CapacityDb.RRDFile)
 		}
-		usageByPodsHistory, err := nodeUsageDb.UsageByPodsDb.FetchUsage(actualStartDateUTC, actualEndDateUTC, step)
+		usageByPodsHistory, err := fetchNodeUsage(nodeUsageDb.UsageByPodsDb)
 		if err != nil {
 			usageByPodsHistory = &UsageHistory{}
 			log.WithError(err).Errorln("failed retrieving usage by pods for node", nodeUsageDb.CapacityDb.RRDFile)
 		}
 
-		nodeUsageMap[nodeName] = map[string]UsageHistory{
-			"capacityItems":    *capacityHistory,
-			"allocatableItems": *allocatableHistory,
-			"usageByPodItems":  *usageByPodsHistory,
+		nodeUsageMap[nodeName] = &NodeUsageHistory{
+			FirstSeenUTC:     nodesMetadata[nodeName].FirstSeenUTC,
+			LastSeenUTC:      nodesMetadata[nodeName].LastSeenUTC,
+			CapacityItems:    *capacityHistory,
+			AllocatableItems: *allocatableHistory,
+			UsageByPodItems:  *usageByPodsHistory,
+		}
+		csvSeries = append(csvSeries, newNodeUsageSeries(nodeName, capacityHistory, allocatableHistory, usageByPodsHistory))
+	}
+
+	if queryFormat == "csv" {
+		var csvBuf bytes.Buffer
+		if err := writeUsageCSV(&csvBuf, csvSeries, nodeUsageColumns, csvLayout, csvDelimiter); err != nil {
+			log.WithError(err).Errorln("failed encoding nodes usage in CSV")
+			b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "server internal error"})
+			http.Error(w, string(b), http.StatusInternalServerError)
+			return
 		}
+		w.Header().Set("Content-Type", usageCSVContentType)
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"nodesusage_%v_FROM_%v_TO_%v.csv\"",
+				clusterName,
+				actualStartDateUTC.Format(queryTimeLayout),
+				actualEndDateUTC.Format(queryTimeLayout),
+			),
+		)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(csvBuf.Bytes())
+		return
 	}
 
 	var result []NodeUsage
@@ -627,17 +1166,15 @@ func GetNodesUsageHandler(w http.ResponseWriter, req *http.Request) {
 	_, _ = w.Write(encodedResult)
 }
 
-// KubeConfigHandler handles API calls to manage KUBECONFIG
-func KubeConfigHandler(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
+// readKubeConfigUpload reads the KUBECONFIG file posted in a multi-part form, writing an error response on failure
+func readKubeConfigUpload(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
 	maxUploadKb := viper.GetInt64("krossboard_kubeconfig_max_size_kb")
 	err := req.ParseMultipartForm(maxUploadKb * (1 << 10))
 	if err != nil {
 		log.WithError(err).Errorln("failed parsing multi-part form")
 		b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "failed parsing input"})
 		http.Error(w, string(b), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
 	uploadedFile, uploadHandler, err := req.FormFile("kubeconfig")
@@ -645,7 +1182,7 @@ func KubeConfigHandler(w http.ResponseWriter, req *http.Request) {
 		log.WithError(err).Errorln("error reading upload parameters")
 		b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "error reading file content"})
 		http.Error(w, string(b), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	defer uploadedFile.Close()
 
@@ -658,6 +1195,34 @@ func KubeConfigHandler(w http.ResponseWriter, req *http.Request) {
 		log.WithError(err).Errorln("Failed reading the uploaded file content")
 		b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "failed reading file content"})
 		http.Error(w, string(b), http.StatusBadRequest)
+		return nil, false
+	}
+	return uploadBytes, true
+}
+
+// KubeConfigHandler handles API calls to manage KUBECONFIG
+func KubeConfigHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uploadBytes, ok := readKubeConfigUpload(w, req)
+	if !ok {
+		return
+	}
+
+	// the upload is validated in memory, so that rejected files are never written
+	config, err := kclient.Load(uploadBytes)
+	if err != nil {
+		log.WithError(err).Errorln("failed parsing uploaded KUBECONFIG")
+		b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "invalid KUBECONFIG content"})
+		http.Error(w, string(b), http.StatusBadRequest)
+		return
+	}
+
+	queryParams := req.URL.Query()
+	validation, accepted := validateUploadedKubeConfig(req.Context(), queryParams.Get("validation"), config)
+	if !accepted {
+		b, _ := json.Marshal(&KubeConfigUploadResp{Status: "error", Message: "cluster validation failed", Validation: validation})
+		http.Error(w, string(b), http.StatusBadRequest)
 		return
 	}
 
@@ -679,16 +1244,701 @@ func KubeConfigHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	_, err = kclient.LoadFromFile(destFilename)
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(&KubeConfigUploadResp{
+		Status:     "success",
+		Message:    "upload completed successfully " + destFilename,
+		Name:       filepath.Base(destFilename),
+		Validation: validation,
+	})
+	_, _ = w.Write(b)
+}
+
+// ListKubeConfigsHandler lists the files of the KUBECONFIG directory
+func ListKubeConfigsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	kubeConfigs, err := listKubeConfigFiles()
 	if err != nil {
-		log.WithError(err).Errorln("failed parsing KUBECONFIG", destFilename)
-		b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "invalid KUBECONFIG content"})
-		http.Error(w, string(b), http.StatusBadRequest)
-		_ = os.Remove(destFilename)
+		log.WithError(err).Errorln("failed listing KUBECONFIG files")
+		b, _ := json.Marshal(&GetKubeConfigsResp{Status: "error", Message: "failed listing KUBECONFIG files"})
+		http.Error(w, string(b), http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	b, _ := json.Marshal(&ErrorResp{Status: "success", Message: "upload completed successfully " + destFilename})
+	b, _ := json.Marshal(&GetKubeConfigsResp{Status: "ok", KubeConfigs: kubeConfigs})
 	_, _ = w.Write(b)
 }
+
+// writeKubeConfigError writes the response of a failed operation on a file of the KUBECONFIG directory
+func writeKubeConfigError(w http.ResponseWriter, name string, err error, action string) {
+	status := http.StatusInternalServerError
+	message := "internal server error"
+	_, invalid := err.(*invalidKubeConfigError)
+	switch {
+	case os.IsNotExist(err):
+		status, message = http.StatusNotFound, fmt.Sprintf("KUBECONFIG '%s' not found", name)
+	case invalid:
+		status, message = http.StatusBadRequest, err.Error()
+	default:
+		log.WithError(err).Errorln("failed", action, "KUBECONFIG", name)
+	}
+	b, _ := json.Marshal(&ErrorResp{Status: "error", Message: message})
+	http.Error(w, string(b), status)
+}
+
+// GetKubeConfigHandler returns a file of the KUBECONFIG directory with credentials redacted
+func GetKubeConfigHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(req)
+	name := params["name"]
+	kubeConfig, content, err := showKubeConfig(name)
+	if err != nil {
+		writeKubeConfigError(w, name, err, "reading")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(&GetKubeConfigResp{Status: "ok", KubeConfig: kubeConfig, Content: content})
+	_, _ = w.Write(b)
+}
+
+// ReplaceKubeConfigHandler replaces the content of a file of the KUBECONFIG directory
+func ReplaceKubeConfigHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(req)
+	name := params["name"]
+	path, err := getKubeConfigFilePath(name)
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+	if err != nil {
+		writeKubeConfigError(w, name, err, "replacing")
+		return
+	}
+	uploadBytes, ok := readKubeConfigUpload(w, req)
+	if !ok {
+		return
+	}
+
+	// invalid content is reported by replaceKubeConfig
+	var validation []*ClusterValidationReport
+	if config, err := kclient.Load(uploadBytes); err == nil {
+		queryParams := req.URL.Query()
+		var accepted bool
+		validation, accepted = validateUploadedKubeConfig(req.Context(), queryParams.Get("validation"), config)
+		if !accepted {
+			b, _ := json.Marshal(&KubeConfigUploadResp{Status: "error", Message: "cluster validation failed", Validation: validation})
+			http.Error(w, string(b), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := replaceKubeConfig(name, uploadBytes); err != nil {
+		writeKubeConfigError(w, name, err, "replacing")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(&KubeConfigUploadResp{
+		Status:     "success",
+		Message:    "KUBECONFIG replaced successfully " + name,
+		Name:       name,
+		Validation: validation,
+	})
+	_, _ = w.Write(b)
+}
+
+// DeleteKubeConfigHandler removes a file of the KUBECONFIG directory
+func DeleteKubeConfigHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(req)
+	name := params["name"]
+	if err := deleteKubeConfig(name); err != nil {
+		writeKubeConfigError(w, name, err, "deleting")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(&ErrorResp{Status: "success", Message: "KUBECONFIG deleted successfully " + name})
+	_, _ = w.Write(b)
+}
+
+// EnableClusterHandler resumes the processing of a cluster
+func EnableClusterHandler(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	writeClusterEnabled(w, params["clustername"], true)
+}
+
+// DisableClusterHandler stops the processing of a cluster
+func DisableClusterHandler(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	writeClusterEnabled(w, params["clustername"], false)
+}
+
+// writeClusterEnabled enables or disables a cluster of KUBECONFIG and writes the response
+func writeClusterEnabled(w http.ResponseWriter, clusterName string, enabled bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// clusters removed from KUBECONFIG while disabled can still be enabled
+	if _, found := NewKubeConfig().ListClusters()[clusterName]; !found && !enabled {
+		b, _ := json.Marshal(&ErrorResp{Status: "error", Message: fmt.Sprintf("cluster '%s' not found in KUBECONFIG", clusterName)})
+		http.Error(w, string(b), http.StatusNotFound)
+		return
+	}
+	if err := setClusterEnabled(clusterName, enabled); err != nil {
+		log.WithError(err).Errorln("failed updating disabled clusters")
+		b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "internal server error"})
+		http.Error(w, string(b), http.StatusInternalServerError)
+		return
+	}
+
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(&ErrorResp{Status: "success", Message: fmt.Sprintf("cluster %s %s", clusterName, state)})
+	_, _ = w.Write(b)
+}
+
+// GetClustersHandler returns the inventory of the clusters managed by Krossboard
+func GetClustersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// the inventory is built from available sources, the operator is not reachable outside Kubernetes
+	kbInstances, err := apiInstancesCache.get()
+	if err != nil {
+		log.WithError(err).Warnln("failed listing Krossboard instances")
+		kbInstances = nil
+	}
+	currentUsage, err := loadCurrentUsage()
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warnln("failed reading current usage file")
+	}
+
+	clustersResp := &GetClustersResp{
+		Status:   "ok",
+		Clusters: []*ClusterInventoryItem{},
+	}
+	for _, item := range buildClusterInventory(NewKubeConfig().ListClusters(), kbInstances, currentUsage) {
+		if isClusterAllowed(r, item.Name) {
+			clustersResp.Clusters = append(clustersResp.Clusters, item)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	apiResp, _ := json.Marshal(clustersResp)
+	_, _ = w.Write(apiResp)
+}
+
+// GetBudgetsHandler returns the status of budgets as evaluated by the last consolidator run
+func GetBudgetsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	budgetsResp := &GetBudgetsResp{}
+	budgetsData, err := ioutil.ReadFile(getBudgetsStatusPath())
+	respHTTPStatus := http.StatusInternalServerError
+	if err != nil {
+		log.WithError(err).Errorln("failed reading budgets status file")
+		budgetsResp.Status = "error"
+		budgetsResp.Message = "failed reading budgets status file"
+	} else {
+		var budgets []*BudgetStatus
+		err := json.Unmarshal(budgetsData, &budgets)
+		if err != nil {
+			log.WithError(err).Errorln("failed decoding budgets status data")
+			budgetsResp.Status = "error"
+			budgetsResp.Message = "invalid budgets status data"
+		} else {
+			respHTTPStatus = http.StatusOK
+			budgetsResp.Status = "ok"
+			for _, budget := range budgets {
+				if isClusterAllowed(r, budget.Cluster) {
+					budgetsResp.Budgets = append(budgetsResp.Budgets, budget)
+				}
+			}
+		}
+	}
+
+	w.WriteHeader(respHTTPStatus)
+	apiResp, _ := json.Marshal(budgetsResp)
+	_, _ = w.Write(apiResp)
+}
+
+// GetRecommendationsHandler returns node rightsizing and consolidation recommendations for a cluster
+func GetRecommendationsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(req)
+	clusterName := params["clustername"]
+	queryParams := req.URL.Query()
+
+	lookbackDays := viper.GetInt("krossboard_recommendations_lookback_days")
+	timeRange, err := parseQueryTimeRange(queryParams, time.Duration(lookbackDays)*24*time.Hour)
+	if err == nil && !timeRange.EndDateUTC.After(timeRange.StartDateUTC) {
+		err = fmt.Errorf("the period is empty")
+	}
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetRecommendationsResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+	actualStartDateUTC, actualEndDateUTC := timeRange.StartDateUTC, timeRange.EndDateUTC
+
+	if !isClusterAllowed(req, clusterName) {
+		w.WriteHeader(http.StatusNotFound)
+		apiResp, _ := json.Marshal(&GetRecommendationsResp{
+			Status:  "error",
+			Message: fmt.Sprintf("cluster not found => %s", clusterName),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	// nodes are listed from storage so that nodes removed during the period account for the cluster usage
+	nodeNames, nodesMetadata, err := listClusterNodes(clusterName, actualStartDateUTC, actualEndDateUTC)
+	if err != nil {
+		log.WithError(err).Errorln("failed reading nodes metadata")
+		w.WriteHeader(http.StatusInternalServerError)
+		apiResp, _ := json.Marshal(&GetRecommendationsResp{
+			Status:  "error",
+			Message: "failed listing cluster nodes",
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	nodesHistory := fetchNodesUsageHistory(nodeNames, actualStartDateUTC, actualEndDateUTC)
+	flagRemovedNodes(nodesHistory, nodesMetadata, actualEndDateUTC)
+	recommendation := computeClusterRecommendation(
+		clusterName,
+		nodesHistory,
+		viper.GetFloat64("krossboard_recommendations_headroom_percent"),
+		viper.GetFloat64("krossboard_recommendations_underuse_percent"),
+	)
+	recommendation.StartDateUTC = actualStartDateUTC
+	recommendation.EndDateUTC = actualEndDateUTC
+
+	w.WriteHeader(http.StatusOK)
+	apiResp, _ := json.Marshal(&GetRecommendationsResp{
+		Status:          "ok",
+		Recommendations: recommendation,
+	})
+	_, _ = w.Write(apiResp)
+}
+
+// GetUsageComparisonHandler compares the usage of clusters over a period with a previous period
+func GetUsageComparisonHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	queryParams := r.URL.Query()
+	queryCluster := queryParams.Get("cluster")
+
+	writeError := func(status int, message string) {
+		w.WriteHeader(status)
+		apiResp, _ := json.Marshal(&GetUsageComparisonResp{
+			Status:  "error",
+			Message: message,
+		})
+		_, _ = w.Write(apiResp)
+	}
+
+	timeRange, err := parseQueryTimeRange(queryParams, 30*24*time.Hour)
+	if err == nil && !timeRange.EndDateUTC.After(timeRange.StartDateUTC) {
+		err = fmt.Errorf("the period is empty")
+	}
+	if err == nil {
+		err = validateQueryItemName("cluster", queryCluster)
+	}
+	var previousStartDateUTC, previousEndDateUTC time.Time
+	if err == nil {
+		previousStartDateUTC, previousEndDateUTC, err = getComparisonPeriod(timeRange.StartDateUTC, timeRange.EndDateUTC, queryParams.Get("compareTo"))
+	}
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
+		writeError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	historyDbs := make(map[string]string)
+	if queryCluster == "" || strings.ToLower(queryCluster) == "all" {
+		storedDbs, err := listStoredHistoryDbs("")
+		if err != nil {
+			log.WithError(err).Errorln("failed listing history databases")
+			writeError(http.StatusInternalServerError, "failed listing history databases")
+			return
+		}
+		for clusterName, dbfile := range storedDbs {
+			if isClusterAllowed(r, clusterName) {
+				historyDbs[clusterName] = dbfile
+			}
+		}
+	} else if dbfile := getHistoryDbPath(queryCluster); isClusterAllowed(r, queryCluster) && fileExists(dbfile) {
+		historyDbs[queryCluster] = dbfile
+	} else {
+		writeError(http.StatusNotFound, fmt.Sprintf("cluster not found => %s", queryCluster))
+		return
+	}
+
+	capacities, err := loadClusterCapacities()
+	if err != nil {
+		log.WithError(err).Warnln("failed loading cluster capacities, totals are not computed")
+		capacities = map[string]*ClusterCapacity{}
+	}
+
+	comparisonResp := &GetUsageComparisonResp{
+		Status:      "ok",
+		Comparisons: []*UsageComparison{},
+	}
+	for clusterName, dbfile := range historyDbs {
+		comparison, err := compareClusterUsage(clusterName, dbfile, timeRange.StartDateUTC, timeRange.EndDateUTC,
+			previousStartDateUTC, previousEndDateUTC, capacities[clusterName])
+		if err != nil {
+			log.WithError(err).Errorln("failed retrieving data from rrd file", dbfile)
+			continue
+		}
+		comparisonResp.Comparisons = append(comparisonResp.Comparisons, comparison)
+	}
+	sort.Slice(comparisonResp.Comparisons, func(i, j int) bool {
+		return comparisonResp.Comparisons[i].Cluster < comparisonResp.Comparisons[j].Cluster
+	})
+
+	w.WriteHeader(http.StatusOK)
+	apiResp, _ := json.Marshal(comparisonResp)
+	_, _ = w.Write(apiResp)
+}
+
+// GetForecastHandler returns the forecast of CPU and memory usage of a cluster
+func GetForecastHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	queryParams := r.URL.Query()
+	queryCluster := queryParams.Get("cluster")
+	queryHorizon := queryParams.Get("horizon")
+	queryMethod := strings.ToLower(queryParams.Get("method"))
+	queryThreshold := queryParams.Get("threshold")
+
+	writeBadRequest := func(err error) {
+		log.WithError(err).Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetForecastResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+	}
+
+	if queryCluster == "" {
+		writeBadRequest(fmt.Errorf("missing query parameter 'cluster'"))
+		return
+	}
+	if err := validateQueryItemName("cluster", queryCluster); err != nil {
+		writeBadRequest(err)
+		return
+	}
+	// the history database is only read here, unknown clusters must not create it
+	if !isClusterAllowed(r, queryCluster) || !fileExists(getHistoryDbPath(queryCluster)) {
+		w.WriteHeader(http.StatusNotFound)
+		apiResp, _ := json.Marshal(&GetForecastResp{
+			Status:  "error",
+			Message: fmt.Sprintf("cluster not found => %s", queryCluster),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	if queryHorizon == "" {
+		queryHorizon = "30d"
+	}
+	horizon, err := parseHorizon(queryHorizon)
+	if err != nil {
+		writeBadRequest(err)
+		return
+	}
+	if horizon > 365*24*time.Hour {
+		writeBadRequest(fmt.Errorf("horizon '%s' exceeds the maximum of 365d", queryHorizon))
+		return
+	}
+
+	threshold := viper.GetFloat64("krossboard_forecast_threshold_percent")
+	if queryThreshold != "" {
+		threshold, err = strconv.ParseFloat(queryThreshold, 64)
+		if err != nil {
+			writeBadRequest(fmt.Errorf("invalid value '%s' for query parameter 'threshold'", queryThreshold))
+			return
+		}
+	}
+
+	if queryMethod != "" && queryMethod != ForecastMethodLinear && queryMethod != ForecastMethodHoltWinters {
+		writeBadRequest(fmt.Errorf("invalid value '%s' for query parameter 'method'. Valid values are: 'linear', 'holtwinters'", queryMethod))
+		return
+	}
+
+	endDateUTC := now().UTC()
+	startDateUTC := endDateUTC.AddDate(0, 0, -viper.GetInt("krossboard_forecast_lookback_days"))
+	usageDb := NewUsageDb(getHistoryDbPath(queryCluster), 100)
+	usageHistory, err := usageDb.FetchUsage(startDateUTC, endDateUTC, time.Duration(RRDStorageStep3600Secs)*time.Second)
+	if err != nil {
+		log.WithError(err).Errorln("failed retrieving data from rrd file")
+		w.WriteHeader(http.StatusInternalServerError)
+		apiResp, _ := json.Marshal(&GetForecastResp{
+			Status:  "error",
+			Message: "failed retrieving usage history",
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	forecast, err := forecastUsage(usageHistory, horizon, queryMethod, viper.GetInt("krossboard_forecast_season_hours"), threshold)
+	if errors.Cause(err) == errNotEnoughHistory {
+		// the request is valid, the cluster has just not been tracked for long enough yet
+		log.WithError(err).WithField("cluster", queryCluster).Infoln("cannot forecast usage yet")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		apiResp, _ := json.Marshal(&GetForecastResp{
+			Status:  "error",
+			Message: fmt.Sprintf("not enough usage history to forecast, at least two hourly samples over the last %d days are required", viper.GetInt("krossboard_forecast_lookback_days")),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+	if err != nil {
+		writeBadRequest(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	apiResp, _ := json.Marshal(&GetForecastResp{
+		Status:   "ok",
+		Cluster:  queryCluster,
+		Forecast: forecast,
+	})
+	_, _ = w.Write(apiResp)
+}
+
+// GetAnomaliesHandler returns the usage anomalies detected by the consolidator, optionally filtered
+// by cluster, kind, severity and start date
+func GetAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	queryParams := r.URL.Query()
+	queryCluster := queryParams.Get("cluster")
+	queryKind := strings.ToLower(queryParams.Get("kind"))
+	querySeverity := strings.ToLower(queryParams.Get("severity"))
+
+	loc, err := parseQueryLocation(queryParams)
+	var actualStartDateUTC time.Time
+	if err == nil {
+		actualStartDateUTC, err = parseQueryDate(queryParams, "startDateUTC", time.Now().UTC(), loc)
+	}
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&ErrorResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	anomalies, err := loadAnomalies()
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Errorln("failed reading anomalies file")
+		w.WriteHeader(http.StatusInternalServerError)
+		apiResp, _ := json.Marshal(&GetAnomaliesResp{
+			Status:  "error",
+			Message: "failed reading anomalies",
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	anomaliesResp := &GetAnomaliesResp{
+		Status:    "ok",
+		Anomalies: []*Anomaly{},
+	}
+	for _, anomaly := range anomalies {
+		if (queryCluster != "" && anomaly.Cluster != queryCluster) ||
+			(queryKind != "" && anomaly.Kind != queryKind) ||
+			(querySeverity != "" && anomaly.Severity != querySeverity) ||
+			anomaly.EndDateUTC.Before(actualStartDateUTC) ||
+			!isNamespaceAllowed(r, anomaly.Cluster, anomalyNamespace(anomaly)) {
+			continue
+		}
+		anomaliesResp.Anomalies = append(anomaliesResp.Anomalies, anomaly)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	apiResp, _ := json.Marshal(anomaliesResp)
+	_, _ = w.Write(apiResp)
+}
+
+// validateQueryItemName rejects cluster, namespace and node names that would resolve database paths outside of the
+// data directories
+func validateQueryItemName(name string, value string) error {
+	if strings.ContainsAny(value, `/\`) || strings.Contains(value, "..") {
+		return &requestParameterError{In: "query", Name: name,
+			Err: fmt.Errorf("invalid value '%s' for query parameter '%s'", value, name)}
+	}
+	return nil
+}
+
+// GetUsageHeatmapHandler returns the usage of a cluster, a namespace or a node aggregated by day of week and hour of day
+func GetUsageHeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	queryParams := r.URL.Query()
+	queryCluster := queryParams.Get("cluster")
+	queryNamespace := queryParams.Get("namespace")
+	queryNode := queryParams.Get("node")
+	queryFormat := strings.ToLower(queryParams.Get("format"))
+
+	// process format
+	if queryFormat != "" && queryFormat != "json" && queryFormat != "csv" {
+		err := fmt.Errorf("invalid value '%s' for query parameter 'format'. Valid values are: 'json', 'csv'", queryFormat)
+		log.WithError(err).WithField("param", "format").Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetUsageHeatmapResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	// process period parameters
+	timeRange, err := parseQueryTimeRange(queryParams, 28*24*time.Hour)
+	if err == nil && !timeRange.EndDateUTC.After(timeRange.StartDateUTC) {
+		err = fmt.Errorf("the period is empty")
+	}
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetUsageHeatmapResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+	actualStartDateUTC, actualEndDateUTC := timeRange.StartDateUTC, timeRange.EndDateUTC
+
+	if queryNode == "" && queryCluster == "" {
+		log.Errorln("invalid query parameters, neither cluster nor node is set")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetUsageHeatmapResp{
+			Status:  "error",
+			Message: "one of the query parameters 'cluster' or 'node' is required",
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	err = validateQueryItemName("cluster", queryCluster)
+	if err == nil {
+		err = validateQueryItemName("namespace", queryNamespace)
+	}
+	if err == nil {
+		err = validateQueryItemName("node", queryNode)
+	}
+	if err != nil {
+		log.WithError(err).Warnln("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		apiResp, _ := json.Marshal(&GetUsageHeatmapResp{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+
+	writeNotFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		apiResp, _ := json.Marshal(&GetUsageHeatmapResp{
+			Status:  "error",
+			Message: "requested item not found",
+		})
+		_, _ = w.Write(apiResp)
+	}
+	allowed := isNamespaceAllowed(r, queryCluster, queryNamespace)
+	if queryNode != "" {
+		// node usage is cluster-level data, and the node must belong to the requested cluster. Nodes can only be
+		// requested without cluster by callers allowed on all clusters
+		allowed = isClusterAllowed(r, queryCluster)
+		if allowed && queryCluster != "" {
+			nodeNames, _, err := listClusterNodes(queryCluster, actualStartDateUTC, actualEndDateUTC)
+			allowed = err == nil && containsString(nodeNames, queryNode)
+		}
+	}
+	if !allowed {
+		writeNotFound()
+		return
+	}
+
+	// databases are only read here, unknown items must not create them
+	var usageDb *UsageDb
+	itemName := queryCluster
+	switch {
+	case queryNode != "":
+		nodeUsageDb, err := openNodeUsageDB(queryNode)
+		if err != nil {
+			writeNotFound()
+			return
+		}
+		usageDb = nodeUsageDb.UsageByPodsDb
+		itemName = queryNode
+	case queryNamespace != "":
+		usageDb = NewUsageDb(fmt.Sprintf("%s/%s/%s", viper.GetString("krossboard_rawdb_dir"), queryCluster, queryNamespace), 100)
+		itemName = fmt.Sprintf("%s_%s", queryCluster, queryNamespace)
+	default:
+		usageDb = NewUsageDb(getHistoryDbPath(queryCluster), 100)
+	}
+	if !fileExists(usageDb.RRDFile) {
+		writeNotFound()
+		return
+	}
+
+	usageHistory, err := usageDb.FetchUsage(actualStartDateUTC, actualEndDateUTC, time.Duration(RRDStorageStep3600Secs)*time.Second)
+	if err != nil {
+		log.WithError(err).Errorln("failed retrieving data from rrd file", usageDb.RRDFile)
+		w.WriteHeader(http.StatusInternalServerError)
+		apiResp, _ := json.Marshal(&GetUsageHeatmapResp{
+			Status:  "error",
+			Message: "failed retrieving usage history",
+		})
+		_, _ = w.Write(apiResp)
+		return
+	}
+	heatmap := computeUsageHeatmap(usageHistory, timeRange.Location)
+
+	var respPayload []byte
+	if queryFormat != "csv" {
+		respPayload, _ = json.Marshal(&GetUsageHeatmapResp{
+			Status:       "ok",
+			StartDateUTC: actualStartDateUTC,
+			EndDateUTC:   actualEndDateUTC,
+			Heatmap:      heatmap,
+		})
+	} else {
+		respPayload = []byte(formatHeatmapCSV(heatmap))
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"heatmap_%v_FROM_%v_TO_%v.csv\"",
+				itemName,
+				actualStartDateUTC.Format(queryTimeLayout),
+				actualEndDateUTC.Format(queryTimeLayout),
+			),
+		)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(respPayload)
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// accessWildcard matches any cluster or namespace in access rules
+const accessWildcard = "*"
+
+// AccessRule grants users, groups or API keys access to a set of clusters, and optionally restricts
+// them to a set of namespaces within those clusters
+type AccessRule struct {
+	Users      []string `json:"users,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	APIKeys    []string `json:"apiKeys,omitempty"`
+	Clusters   []string `json:"clusters"`
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// AccessControlFile holds the content of the access control file
+type AccessControlFile struct {
+	Rules []*AccessRule `json:"rules"`
+}
+
+// accessPolicy holds access rules, reloaded when the underlying file changes
+type accessPolicy struct {
+	path    string
+	mu      sync.RWMutex
+	modTime time.Time
+	rules   []*AccessRule
+}
+
+// apiAccessPolicy is the policy enforced by API handlers, nil when access control is disabled
+var apiAccessPolicy *accessPolicy
+
+// newAccessPolicy creates an access policy backed by the given file
+func newAccessPolicy(path string) (*accessPolicy, error) {
+	policy := &accessPolicy{path: path}
+	if err := policy.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// reloadIfChanged reloads the rules if the file has been modified since the last load
+func (m *accessPolicy) reloadIfChanged() error {
+	fileInfo, err := os.Stat(m.path)
+	if err != nil {
+		return errors.Wrap(err, "failed reading access control file")
+	}
+
+	m.mu.RLock()
+	upToDate := m.rules != nil && fileInfo.ModTime().Equal(m.modTime)
+	m.mu.RUnlock()
+	if upToDate {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return errors.Wrap(err, "failed reading access control file")
+	}
+	accessFile := &AccessControlFile{}
+	err = json.Unmarshal(data, accessFile)
+	if err != nil {
+		return errors.Wrap(err, "failed decoding access control file")
+	}
+
+	m.mu.Lock()
+	m.rules = append([]*AccessRule{}, accessFile.Rules...)
+	m.modTime = fileInfo.ModTime()
+	m.mu.Unlock()
+	log.WithField("count", len(accessFile.Rules)).Infoln("access rules loaded")
+	return nil
+}
+
+// matches tells whether a rule applies to the given principal
+func (m *AccessRule) matches(principal *Principal) bool {
+	if principal.AuthMethod == AuthMethodAPIKey {
+		return containsString(m.APIKeys, principal.Name)
+	}
+	if containsString(m.Users, principal.Name) {
+		return true
+	}
+	for _, group := range principal.Groups {
+		if containsString(m.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRule tells whether a rule granting the principal access to a cluster satisfies the given condition
+func (m *accessPolicy) hasRule(principal *Principal, cluster string, accept func(rule *AccessRule) bool) bool {
+	if err := m.reloadIfChanged(); err != nil {
+		log.WithError(err).Errorln("failed reloading access rules, keeping the previous ones")
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, rule := range m.rules {
+		if !rule.matches(principal) {
+			continue
+		}
+		if !containsString(rule.Clusters, cluster) && !containsString(rule.Clusters, accessWildcard) {
+			continue
+		}
+		if accept(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowed tells whether the principal can access a namespace of a cluster, or the whole cluster when namespace
+// is empty. Whole clusters require a rule without namespace restriction
+func (m *accessPolicy) isAllowed(principal *Principal, cluster string, namespace string) bool {
+	return m.hasRule(principal, cluster, func(rule *AccessRule) bool {
+		return len(rule.Namespaces) == 0 || containsString(rule.Namespaces, accessWildcard) ||
+			(namespace != "" && containsString(rule.Namespaces, namespace))
+	})
+}
+
+// isAnyNamespaceAllowed tells whether the principal can access at least one namespace of a cluster
+func (m *accessPolicy) isAnyNamespaceAllowed(principal *Principal, cluster string) bool {
+	return m.hasRule(principal, cluster, func(rule *AccessRule) bool { return true })
+}
+
+// isClusterAllowed tells whether the caller of a request can access a whole cluster, as required for
+// cluster-level data. Requests are not restricted when access control is disabled, the API is not authenticated,
+// or the caller has the admin scope
+func isClusterAllowed(req *http.Request, cluster string) bool {
+	return isNamespaceAllowed(req, cluster, "")
+}
+
+// isNamespaceAllowed tells whether the caller of a request can access a namespace of a cluster, or the whole
+// cluster when namespace is empty
+func isNamespaceAllowed(req *http.Request, cluster string, namespace string) bool {
+	principal := principalFromContext(req.Context())
+	if apiAccessPolicy == nil || principal == nil || principal.Scope == AuthScopeAdmin {
+		return true
+	}
+	return apiAccessPolicy.isAllowed(principal, cluster, namespace)
+}
+
+// isAnyNamespaceAllowed tells whether the caller of a request can access at least one namespace of a cluster
+func isAnyNamespaceAllowed(req *http.Request, cluster string) bool {
+	principal := principalFromContext(req.Context())
+	if apiAccessPolicy == nil || principal == nil || principal.Scope == AuthScopeAdmin {
+		return true
+	}
+	return apiAccessPolicy.isAnyNamespaceAllowed(principal, cluster)
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	Convey("Given access rules for a team, a user and an API key", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		rulesFile := path.Join(tempDir, "access.json")
+		data, _ := json.Marshal(&AccessControlFile{Rules: []*AccessRule{
+			{Groups: []string{"team-a"}, Clusters: []string{"prod"}, Namespaces: []string{"payments"}},
+			{Users: []string{"jane@example.com"}, Clusters: []string{"staging"}},
+			{APIKeys: []string{"ui"}, Clusters: []string{"*"}},
+		}})
+		So(ioutil.WriteFile(rulesFile, data, 0600), ShouldBeNil)
+
+		policy, err := newAccessPolicy(rulesFile)
+		So(err, ShouldBeNil)
+		apiAccessPolicy = policy
+
+		withPrincipal := func(principal *Principal) context.Context {
+			return context.WithValue(context.Background(), principalContextKey{}, principal)
+		}
+
+		Convey("Then group members only see their cluster and namespaces", func() {
+			req := httptest.NewRequest("GET", "/api/currentusage", nil).WithContext(withPrincipal(
+				&Principal{Name: "john@example.com", Groups: []string{"team-a"}, Scope: AuthScopeReadOnly, AuthMethod: AuthMethodJWT}))
+			So(isAnyNamespaceAllowed(req, "prod"), ShouldBeTrue)
+			So(isAnyNamespaceAllowed(req, "staging"), ShouldBeFalse)
+			So(isNamespaceAllowed(req, "prod", "payments"), ShouldBeTrue)
+			So(isNamespaceAllowed(req, "prod", "billing"), ShouldBeFalse)
+		})
+
+		Convey("Then cluster-level data requires a rule without namespace restriction", func() {
+			req := httptest.NewRequest("GET", "/api/currentusage", nil).WithContext(withPrincipal(
+				&Principal{Name: "john@example.com", Groups: []string{"team-a"}, Scope: AuthScopeReadOnly, AuthMethod: AuthMethodJWT}))
+			So(isClusterAllowed(req, "prod"), ShouldBeFalse)
+			So(isNamespaceAllowed(req, "prod", ""), ShouldBeFalse)
+		})
+
+		Convey("Then users and API keys are matched by name", func() {
+			req := httptest.NewRequest("GET", "/api/currentusage", nil).WithContext(withPrincipal(
+				&Principal{Name: "jane@example.com", Scope: AuthScopeReadOnly, AuthMethod: AuthMethodJWT}))
+			So(isClusterAllowed(req, "staging"), ShouldBeTrue)
+			So(isNamespaceAllowed(req, "staging", "billing"), ShouldBeTrue)
+			So(isClusterAllowed(req, "prod"), ShouldBeFalse)
+
+			req = httptest.NewRequest("GET", "/api/currentusage", nil).WithContext(withPrincipal(
+				&Principal{Name: "ui", Scope: AuthScopeReadOnly, AuthMethod: AuthMethodAPIKey}))
+			So(isClusterAllowed(req, "any-cluster"), ShouldBeTrue)
+		})
+
+		Convey("Then admins and unauthenticated deployments are not restricted", func() {
+			req := httptest.NewRequest("GET", "/api/currentusage", nil).WithContext(withPrincipal(
+				&Principal{Name: "ops", Scope: AuthScopeAdmin, AuthMethod: AuthMethodAPIKey}))
+			So(isClusterAllowed(req, "prod"), ShouldBeTrue)
+			So(isClusterAllowed(httptest.NewRequest("GET", "/api/currentusage", nil), "prod"), ShouldBeTrue)
+		})
+
+		Reset(func() {
+			apiAccessPolicy = nil
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
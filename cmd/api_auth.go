@@ -0,0 +1,287 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AuthScopeReadOnly = "read-only"
+	AuthScopeAdmin    = "admin"
+	// AuthScopePublic marks routes served without authentication
+	AuthScopePublic = "public"
+
+	// StreamTokenQueryParam is the query parameter holding the credentials of stream requests
+	StreamTokenQueryParam = "access_token"
+	// StreamTokenCookie is the cookie holding the credentials of stream requests
+	StreamTokenCookie = "krossboard_token"
+
+	AuthMethodAPIKey = "api-key"
+)
+
+// Principal holds the identity of an authenticated API consumer
+type Principal struct {
+	Name       string   `json:"name"`
+	Groups     []string `json:"groups,omitempty"`
+	Scope      string   `json:"scope"`
+	AuthMethod string   `json:"authMethod"`
+}
+
+// APIKey holds an API key as defined in the API keys file. The key is given either in clear
+// or as the hex-encoded SHA-256 digest of its value
+type APIKey struct {
+	Name      string `json:"name"`
+	Key       string `json:"key,omitempty"`
+	KeySHA256 string `json:"keySha256,omitempty"`
+	Scope     string `json:"scope"`
+}
+
+// APIKeysFile holds the content of the API keys file
+type APIKeysFile struct {
+	Keys []*APIKey `json:"keys"`
+}
+
+// apiKeyStore holds API keys indexed by digest, reloaded when the underlying file changes
+type apiKeyStore struct {
+	path    string
+	mu      sync.RWMutex
+	modTime time.Time
+	keys    map[[sha256.Size]byte]*APIKey
+}
+
+// authenticator validates request credentials
+type authenticator interface {
+	// authenticate returns the identity matching the credentials, or nil when they're not valid
+	authenticate(credentials string) *Principal
+}
+
+type principalContextKey struct{}
+
+// newAPIKeyStore creates an API keys store backed by the given file
+func newAPIKeyStore(path string) (*apiKeyStore, error) {
+	store := &apiKeyStore{path: path}
+	if err := store.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reloadIfChanged reloads the keys if the file has been modified since the last load, so that keys can be
+// rotated without restarting the API
+func (m *apiKeyStore) reloadIfChanged() error {
+	fileInfo, err := os.Stat(m.path)
+	if err != nil {
+		return errors.Wrap(err, "failed reading API keys file")
+	}
+
+	m.mu.RLock()
+	upToDate := m.keys != nil && fileInfo.ModTime().Equal(m.modTime)
+	m.mu.RUnlock()
+	if upToDate {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return errors.Wrap(err, "failed reading API keys file")
+	}
+	keysFile := &APIKeysFile{}
+	err = json.Unmarshal(data, keysFile)
+	if err != nil {
+		return errors.Wrap(err, "failed decoding API keys file")
+	}
+
+	keys := make(map[[sha256.Size]byte]*APIKey)
+	for _, key := range keysFile.Keys {
+		if key.Scope != AuthScopeReadOnly && key.Scope != AuthScopeAdmin {
+			return fmt.Errorf("invalid scope '%s' for API key '%s'. Valid values are: 'read-only', 'admin'", key.Scope, key.Name)
+		}
+		var digest [sha256.Size]byte
+		switch {
+		case key.Key != "":
+			digest = sha256.Sum256([]byte(key.Key))
+		case key.KeySHA256 != "":
+			decoded, err := hex.DecodeString(key.KeySHA256)
+			if err != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("invalid SHA-256 digest for API key '%s'", key.Name)
+			}
+			copy(digest[:], decoded)
+		default:
+			return fmt.Errorf("no value set for API key '%s'", key.Name)
+		}
+		keys[digest] = key
+	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.modTime = fileInfo.ModTime()
+	m.mu.Unlock()
+	log.WithField("count", len(keys)).Infoln("API keys loaded")
+	return nil
+}
+
+// lookup returns the API key matching the given value, or nil if there is none
+func (m *apiKeyStore) lookup(value string) *APIKey {
+	if err := m.reloadIfChanged(); err != nil {
+		log.WithError(err).Errorln("failed reloading API keys, keeping the previous ones")
+	}
+
+	digest := sha256.Sum256([]byte(value))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for keyDigest, key := range m.keys {
+		if subtle.ConstantTimeCompare(keyDigest[:], digest[:]) == 1 {
+			return key
+		}
+	}
+	return nil
+}
+
+// authenticate returns the identity bound to a valid API key
+func (m *apiKeyStore) authenticate(credentials string) *Principal {
+	key := m.lookup(credentials)
+	if key == nil {
+		return nil
+	}
+	return &Principal{Name: key.Name, Scope: key.Scope, AuthMethod: AuthMethodAPIKey}
+}
+
+// getRequestCredentials returns the credentials set in the Authorization (Bearer) or the X-API-Key header.
+// Browsers can't set headers on EventSource and WebSocket requests, so streams also accept the credentials
+// from the access_token query parameter or the krossboard_token cookie
+func getRequestCredentials(req *http.Request) string {
+	if authHeader := req.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	}
+	if apiKey := strings.TrimSpace(req.Header.Get("X-API-Key")); apiKey != "" {
+		return apiKey
+	}
+	if streaming, _ := getCurrentRoute(req)["streaming"].(bool); !streaming {
+		return ""
+	}
+	if token := strings.TrimSpace(req.URL.Query().Get(StreamTokenQueryParam)); token != "" {
+		return token
+	}
+	if cookie, err := req.Cookie(StreamTokenCookie); err == nil {
+		return strings.TrimSpace(cookie.Value)
+	}
+	return ""
+}
+
+// getCurrentRoute returns the route matching the request, if any
+func getCurrentRoute(req *http.Request) map[string]interface{} {
+	if route := mux.CurrentRoute(req); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return findRoute(tpl, req.Method)
+		}
+	}
+	return nil
+}
+
+// getRouteScope returns the scope required by the route matching the request
+func getRouteScope(req *http.Request) string {
+	if scope, found := getCurrentRoute(req)["scope"]; found {
+		return scope.(string)
+	}
+	return AuthScopeReadOnly
+}
+
+// principalFromContext returns the authenticated API consumer attached to a request context, if any
+func principalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// writeAuthError writes an authentication or authorization failure
+func writeAuthError(w http.ResponseWriter, req *http.Request, status int, message string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="krossboard"`)
+	}
+	if isAPIv2Request(req) {
+		writeV2Error(w, status, message, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	b, _ := json.Marshal(&ErrorResp{Status: "error", Message: message})
+	_, _ = w.Write(b)
+}
+
+// newAdminRoutesLockMiddleware returns a middleware rejecting the requests to admin routes, which can't be served
+// when the API is not authenticated
+func newAdminRoutesLockMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if getRouteScope(req) == AuthScopeAdmin {
+				writeAuthError(w, req, http.StatusForbidden, "admin routes require API keys or JWT validation to be set")
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// newAuthMiddleware returns a middleware checking that requests hold credentials accepted by one of the
+// authenticators, with the scope required by the route
+func newAuthMiddleware(authenticators ...authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if getRouteScope(req) == AuthScopePublic {
+				next.ServeHTTP(w, req)
+				return
+			}
+			credentials := getRequestCredentials(req)
+			if credentials == "" {
+				writeAuthError(w, req, http.StatusUnauthorized, "missing credentials")
+				return
+			}
+			var principal *Principal
+			for _, auth := range authenticators {
+				if principal = auth.authenticate(credentials); principal != nil {
+					break
+				}
+			}
+			if principal == nil {
+				log.WithField("remote", req.RemoteAddr).Warnln("request with invalid credentials")
+				writeAuthError(w, req, http.StatusUnauthorized, "invalid credentials")
+				return
+			}
+			if getRouteScope(req) == AuthScopeAdmin && principal.Scope != AuthScopeAdmin {
+				writeAuthError(w, req, http.StatusForbidden, "insufficient scope")
+				return
+			}
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), principalContextKey{}, principal)))
+		})
+	}
+}
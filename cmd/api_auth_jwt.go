@@ -0,0 +1,205 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	AuthMethodJWT = "jwt"
+
+	// jwksMinRefreshInterval limits JWKS reloads triggered by tokens signed with unknown keys, or retrying failed reloads
+	jwksMinRefreshInterval = time.Minute
+	// jwksFetchTimeout bounds the time to load a JWKS
+	jwksFetchTimeout = 10 * time.Second
+	// jwtClockLeeway is the clock skew tolerated when checking token validity dates
+	jwtClockLeeway = time.Minute
+)
+
+// jwtSigningAlgorithms lists the asymmetric algorithms accepted to sign tokens
+var jwtSigningAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// jwtValidator validates JSON Web Tokens issued by an OpenID Connect provider
+type jwtValidator struct {
+	issuer        string
+	audience      string
+	usernameClaim string
+	groupsClaim   string
+	adminGroups   []string
+	jwks          *keyfunc.JWKS
+	parser        *jwt.Parser
+}
+
+// newJWTValidator creates a JWT validator from the krossboard_jwt_* settings
+func newJWTValidator() (*jwtValidator, error) {
+	validator := &jwtValidator{
+		issuer:        viper.GetString("krossboard_jwt_issuer"),
+		audience:      viper.GetString("krossboard_jwt_audience"),
+		usernameClaim: viper.GetString("krossboard_jwt_username_claim"),
+		groupsClaim:   viper.GetString("krossboard_jwt_groups_claim"),
+		adminGroups:   strings.Fields(viper.GetString("krossboard_jwt_admin_groups")),
+		// validity dates are checked along with the other claims, with some leeway
+		parser: jwt.NewParser(jwt.WithValidMethods(jwtSigningAlgorithms), jwt.WithoutClaimsValidation()),
+	}
+	source := viper.GetString("krossboard_jwt_jwks")
+	if validator.issuer == "" || validator.audience == "" || source == "" {
+		return nil, errors.New("JWT validation requires an issuer, an audience and a JWKS")
+	}
+	jwksURL, err := getJWKSURL(source)
+	if err != nil {
+		return nil, err
+	}
+
+	// keys are reloaded in the background once expired, or when a token is signed with an unknown key. Reloads,
+	// failed or not, are rate limited and the previous keys are kept when they fail
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	validator.jwks, err = keyfunc.Get(jwksURL, keyfunc.Options{
+		Client:            &http.Client{Transport: transport, Timeout: jwksFetchTimeout},
+		RefreshInterval:   viper.GetDuration("krossboard_jwt_jwks_cache_ttl"),
+		RefreshRateLimit:  jwksMinRefreshInterval,
+		RefreshTimeout:    jwksFetchTimeout,
+		RefreshUnknownKID: true,
+		RefreshErrorHandler: func(err error) {
+			log.WithError(err).Errorln("failed reloading JWKS, keeping the previous keys")
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed loading JWKS")
+	}
+	return validator, nil
+}
+
+// getJWKSURL returns the URL of a JWKS set as a file path or an http(s) URL
+func getJWKSURL(source string) (string, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return source, nil
+	}
+	path, err := filepath.Abs(source)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid JWKS path")
+	}
+	return "file://" + filepath.ToSlash(path), nil
+}
+
+// getKey returns the public key verifying a token. The JWKS checks the "use" and "alg" parameters of the key, the
+// curve of ECDSA keys is checked here as JWT libraries accept any curve whatever the algorithm
+func (m *jwtValidator) getKey(token *jwt.Token) (interface{}, error) {
+	key, err := m.jwks.Keyfunc(token)
+	if err != nil {
+		return nil, err
+	}
+	if ecKey, ok := key.(*ecdsa.PublicKey); ok {
+		method, ok := token.Method.(*jwt.SigningMethodECDSA)
+		if !ok || ecKey.Curve.Params().BitSize != method.CurveBits {
+			return nil, fmt.Errorf("key curve doesn't match algorithm '%s'", token.Method.Alg())
+		}
+	}
+	return key, nil
+}
+
+// validate verifies the signature and the claims of a token, and returns the caller's identity
+func (m *jwtValidator) validate(token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := m.parser.ParseWithClaims(token, claims, m.getKey); err != nil {
+		return nil, errors.Wrap(err, "invalid token")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != m.issuer {
+		return nil, fmt.Errorf("unexpected issuer '%s'", iss)
+	}
+	if !containsString(claimStrings(claims["aud"]), m.audience) {
+		return nil, errors.New("token not issued for this audience")
+	}
+	nowUTC := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || nowUTC.After(time.Unix(int64(exp), 0).Add(jwtClockLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && nowUTC.Add(jwtClockLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+
+	principal := &Principal{
+		Groups:     claimStrings(claims[m.groupsClaim]),
+		Scope:      AuthScopeReadOnly,
+		AuthMethod: AuthMethodJWT,
+	}
+	principal.Name, _ = claims[m.usernameClaim].(string)
+	if principal.Name == "" {
+		return nil, fmt.Errorf("no '%s' claim in token", m.usernameClaim)
+	}
+	for _, group := range principal.Groups {
+		if containsString(m.adminGroups, group) {
+			principal.Scope = AuthScopeAdmin
+			break
+		}
+	}
+	return principal, nil
+}
+
+// authenticate returns the identity of a valid token, or nil when the credentials are not a valid token
+func (m *jwtValidator) authenticate(credentials string) *Principal {
+	if strings.Count(credentials, ".") != 2 {
+		return nil
+	}
+	principal, err := m.validate(credentials)
+	if err != nil {
+		log.WithError(err).Warnln("invalid JWT")
+		return nil
+	}
+	return principal
+}
+
+// claimStrings returns a claim holding either a string or an array of strings as a list of strings
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
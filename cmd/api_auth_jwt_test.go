@@ -0,0 +1,293 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// signTestToken builds a JWT signed with the given RSA or EC private key, hashing with the SHA-2 function of the algorithm
+func signTestToken(alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signingInput := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	hasher := hash.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			signature, _ = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, _ = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		// r and s are padded to the size expected for the algorithm, whatever the curve of the key
+		size := map[string]int{"256": 32, "384": 48, "512": 66}[alg[2:]]
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest)
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newTestJWKS returns a JWKS holding the given keys, whose parameters are set along with their id
+func newTestJWKS(keys map[string]crypto.PublicKey, params map[string]map[string]string) []byte {
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	var jwks []map[string]string
+	for kid, key := range keys {
+		jwk := map[string]string{"kid": kid}
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"], jwk["n"], jwk["e"] = "RSA", b64(k.N), b64(big.NewInt(int64(k.E)))
+		case *ecdsa.PublicKey:
+			jwk["kty"], jwk["crv"], jwk["x"], jwk["y"] = "EC", k.Curve.Params().Name, b64(k.X), b64(k.Y)
+		}
+		for name, value := range params[kid] {
+			jwk[name] = value
+		}
+		jwks = append(jwks, jwk)
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": jwks})
+	return data
+}
+
+func TestJWTValidator(t *testing.T) {
+	Convey("Given a local JWKS holding a RSA and an EC key", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		jwks := newTestJWKS(map[string]crypto.PublicKey{
+			"rsa-1": &rsaKey.PublicKey, "ec-1": &ecKey.PublicKey, "rsa-rs512": &rsaKey.PublicKey, "rsa-enc": &rsaKey.PublicKey,
+		}, map[string]map[string]string{
+			"rsa-1": {"use": "sig"}, "rsa-rs512": {"alg": "RS512"}, "rsa-enc": {"use": "enc"},
+		})
+		jwksFile := path.Join(tempDir, "jwks.json")
+		So(ioutil.WriteFile(jwksFile, jwks, 0600), ShouldBeNil)
+
+		viper.Set("krossboard_jwt_issuer", "https://sso.example.com")
+		viper.Set("krossboard_jwt_audience", "krossboard")
+		viper.Set("krossboard_jwt_jwks", jwksFile)
+		viper.Set("krossboard_jwt_jwks_cache_ttl", "1h")
+		viper.Set("krossboard_jwt_username_claim", "email")
+		viper.Set("krossboard_jwt_groups_claim", "roles")
+		viper.Set("krossboard_jwt_admin_groups", "platform-admins sre")
+		validator, err := newJWTValidator()
+		So(err, ShouldBeNil)
+
+		newClaims := func() map[string]interface{} {
+			return map[string]interface{}{
+				"iss":   "https://sso.example.com",
+				"aud":   []string{"other", "krossboard"},
+				"email": "jane@example.com",
+				"roles": []string{"team-a", "sre"},
+				"exp":   time.Now().Add(time.Hour).Unix(),
+			}
+		}
+
+		Convey("When validating a token signed with the RSA key", func() {
+			principal, err := validator.validate(signTestToken("RS256", "rsa-1", rsaKey, newClaims()))
+
+			Convey("Then the identity and the groups are extracted", func() {
+				So(err, ShouldBeNil)
+				So(principal.Name, ShouldEqual, "jane@example.com")
+				So(principal.Groups, ShouldResemble, []string{"team-a", "sre"})
+				So(principal.Scope, ShouldEqual, AuthScopeAdmin)
+				So(principal.AuthMethod, ShouldEqual, AuthMethodJWT)
+			})
+		})
+
+		Convey("When validating tokens matching the algorithm set on their key", func() {
+			Convey("Then they are accepted", func() {
+				_, err := validator.validate(signTestToken("RS512", "rsa-rs512", rsaKey, newClaims()))
+				So(err, ShouldBeNil)
+				_, err = validator.validate(signTestToken("PS256", "rsa-1", rsaKey, newClaims()))
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When validating a token signed with the EC key and no admin group", func() {
+			claims := newClaims()
+			claims["roles"] = "team-a"
+			principal, err := validator.validate(signTestToken("ES256", "ec-1", ecKey, claims))
+
+			Convey("Then the caller gets a read-only scope", func() {
+				So(err, ShouldBeNil)
+				So(principal.Groups, ShouldResemble, []string{"team-a"})
+				So(principal.Scope, ShouldEqual, AuthScopeReadOnly)
+			})
+		})
+
+		Convey("When validating invalid tokens", func() {
+			expired := newClaims()
+			expired["exp"] = time.Now().Add(-time.Hour).Unix()
+			wrongIssuer := newClaims()
+			wrongIssuer["iss"] = "https://evil.example.com"
+			wrongAudience := newClaims()
+			wrongAudience["aud"] = "other"
+			otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+			Convey("Then they are all rejected, including tokens not matching the algorithm, the use or the curve of their key", func() {
+				for _, token := range []string{
+					signTestToken("RS256", "rsa-1", rsaKey, expired),
+					signTestToken("RS256", "rsa-1", rsaKey, wrongIssuer),
+					signTestToken("RS256", "rsa-1", rsaKey, wrongAudience),
+					signTestToken("RS256", "rsa-1", otherKey, newClaims()),
+					signTestToken("RS256", "unknown", rsaKey, newClaims()),
+					signTestToken("ES256", "rsa-1", ecKey, newClaims()),
+					signTestToken("HS256", "rsa-1", rsaKey, newClaims()),
+					signTestToken("RS256", "rsa-rs512", rsaKey, newClaims()),
+					signTestToken("RS256", "rsa-enc", rsaKey, newClaims()),
+					signTestToken("ES384", "ec-1", ecKey, newClaims()),
+					"not.a.token",
+				} {
+					_, err := validator.validate(token)
+					So(err, ShouldNotBeNil)
+				}
+			})
+		})
+
+		Convey("When the validator protects a router", func() {
+			var principal *Principal
+			router := mux.NewRouter()
+			router.HandleFunc("/api/currentusage", func(w http.ResponseWriter, req *http.Request) {
+				principal = principalFromContext(req.Context())
+			}).Methods("GET")
+			router.Use(newAuthMiddleware(validator))
+
+			req := httptest.NewRequest("GET", "/api/currentusage", nil)
+			req.Header.Set("Authorization", "Bearer "+signTestToken("RS256", "rsa-1", rsaKey, newClaims()))
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			Convey("Then the caller's identity is attached to the request context", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(principal, ShouldNotBeNil)
+				So(principal.Name, ShouldEqual, "jane@example.com")
+			})
+		})
+
+		Reset(func() {
+			validator.jwks.EndBackground()
+			viper.Set("krossboard_jwt_issuer", "")
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	Convey("Given a JWKS served over HTTP", t, func() {
+		oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+		newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+		var mu sync.Mutex
+		fetches, failing := 0, false
+		jwks := newTestJWKS(map[string]crypto.PublicKey{"old": &oldKey.PublicKey}, nil)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetches++
+			if failing {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write(jwks)
+		}))
+		getFetches := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return fetches
+		}
+
+		viper.Set("krossboard_jwt_issuer", "https://sso.example.com")
+		viper.Set("krossboard_jwt_audience", "krossboard")
+		viper.Set("krossboard_jwt_jwks", server.URL)
+		viper.Set("krossboard_jwt_jwks_cache_ttl", "1h")
+		viper.Set("krossboard_jwt_username_claim", "sub")
+		validator, err := newJWTValidator()
+		So(err, ShouldBeNil)
+		claims := map[string]interface{}{
+			"iss": "https://sso.example.com",
+			"aud": "krossboard",
+			"sub": "jane",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+
+		Convey("When the keys are rotated and then the JWKS fails", func() {
+			mu.Lock()
+			jwks = newTestJWKS(map[string]crypto.PublicKey{"old": &oldKey.PublicKey, "new": &newKey.PublicKey}, nil)
+			mu.Unlock()
+			_, rotatedErr := validator.validate(signTestToken("RS256", "new", newKey, claims))
+			mu.Lock()
+			failing = true
+			mu.Unlock()
+			var unknownErrs []error
+			for i := 0; i < 5; i++ {
+				_, err := validator.validate(signTestToken("RS256", "unknown", newKey, claims))
+				unknownErrs = append(unknownErrs, err)
+			}
+			_, knownErr := validator.validate(signTestToken("RS256", "old", oldKey, claims))
+
+			Convey("Then the new key is loaded, and reloads are rate limited while the known keys are kept", func() {
+				So(rotatedErr, ShouldBeNil)
+				for _, err := range unknownErrs {
+					So(err, ShouldNotBeNil)
+				}
+				So(getFetches(), ShouldEqual, 2)
+				So(knownErr, ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			validator.jwks.EndBackground()
+			server.Close()
+			viper.Set("krossboard_jwt_issuer", "")
+		})
+	})
+}
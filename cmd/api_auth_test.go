@@ -0,0 +1,177 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// testAdminAPIKey is the admin key set by useTestAdminAPIKey
+const testAdminAPIKey = "test-admin-secret"
+
+// useTestAdminAPIKey writes an API keys file holding testAdminAPIKey in a directory and sets it up for the API
+func useTestAdminAPIKey(c C, dir string) {
+	data, _ := json.Marshal(&APIKeysFile{Keys: []*APIKey{{Name: "test-admin", Key: testAdminAPIKey, Scope: AuthScopeAdmin}}})
+	keysFile := path.Join(dir, ".apikeys.json")
+	c.So(ioutil.WriteFile(keysFile, data, 0600), ShouldBeNil)
+	viper.Set("krossboard_api_keys_file", keysFile)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	Convey("Given an API keys file with a read-only and an admin key", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		keysFile := path.Join(tempDir, "apikeys.json")
+		adminDigest := sha256.Sum256([]byte("admin-secret"))
+		writeKeys := func(readOnlyKey string) {
+			data, _ := json.Marshal(&APIKeysFile{Keys: []*APIKey{
+				{Name: "ui", Key: readOnlyKey, Scope: AuthScopeReadOnly},
+				{Name: "ops", KeySHA256: hex.EncodeToString(adminDigest[:]), Scope: AuthScopeAdmin},
+			}})
+			So(ioutil.WriteFile(keysFile, data, 0600), ShouldBeNil)
+		}
+		writeKeys("read-secret")
+
+		store, err := newAPIKeyStore(keysFile)
+		So(err, ShouldBeNil)
+
+		var principal *Principal
+		handler := func(w http.ResponseWriter, req *http.Request) {
+			principal = principalFromContext(req.Context())
+		}
+		router := mux.NewRouter()
+		router.HandleFunc("/api/currentusage", handler).Methods("GET")
+		router.HandleFunc("/api/kubeconfig", handler).Methods("POST")
+		router.HandleFunc("/api/kubeconfigs/{name}", handler).Methods("GET", "DELETE")
+		router.Use(newAuthMiddleware(store))
+
+		serve := func(method string, url string, key string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, nil)
+			if key != "" {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("When no or an unknown key is provided", func() {
+			Convey("Then the request is rejected with a 401 error", func() {
+				resp := serve("GET", "/api/currentusage", "")
+				So(resp.Code, ShouldEqual, http.StatusUnauthorized)
+				So(resp.Header().Get("WWW-Authenticate"), ShouldNotBeEmpty)
+				So(resp.Body.String(), ShouldEqual, `{"status":"error","message":"missing credentials"}`)
+				So(serve("GET", "/api/currentusage", "unknown").Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+
+		Convey("When a read-only key is provided", func() {
+			Convey("Then read routes are allowed and admin routes are forbidden", func() {
+				So(serve("GET", "/api/currentusage", "read-secret").Code, ShouldEqual, http.StatusOK)
+				So(principal.Name, ShouldEqual, "ui")
+				So(principal.Scope, ShouldEqual, AuthScopeReadOnly)
+				resp := serve("POST", "/api/kubeconfig", "read-secret")
+				So(resp.Code, ShouldEqual, http.StatusForbidden)
+				So(resp.Body.String(), ShouldEqual, `{"status":"error","message":"insufficient scope"}`)
+				So(serve("DELETE", "/api/kubeconfigs/kubeconfig-uploaded-1", "read-secret").Code, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When an admin key is provided through the X-API-Key header", func() {
+			req := httptest.NewRequest("POST", "/api/kubeconfig", nil)
+			req.Header.Set("X-API-Key", "admin-secret")
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			Convey("Then admin routes are allowed", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(principal.Name, ShouldEqual, "ops")
+			})
+		})
+
+		Convey("When the keys file is updated", func() {
+			writeKeys("rotated-secret")
+			future := time.Now().Add(time.Minute)
+			So(os.Chtimes(keysFile, future, future), ShouldBeNil)
+
+			Convey("Then the new key is accepted and the old one is rejected without a restart", func() {
+				So(serve("GET", "/api/currentusage", "rotated-secret").Code, ShouldEqual, http.StatusOK)
+				So(serve("GET", "/api/currentusage", "read-secret").Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
+
+func TestUnauthenticatedAPI(t *testing.T) {
+	Convey("Given an API router without API keys nor JWT validation", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_run_dir", tempDir)
+		viper.Set("krossboard_kubeconfig_dir", tempDir)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(method string, target string) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(method, target, nil))
+			return resp
+		}
+
+		Convey("When admin routes are requested", func() {
+			Convey("Then they are forbidden", func() {
+				for _, route := range [][]string{
+					{"POST", "/api/kubeconfig"},
+					{"GET", "/api/kubeconfigs"},
+					{"PUT", "/api/kubeconfigs/kubeconfig-uploaded-1"},
+					{"DELETE", "/api/kubeconfigs/kubeconfig-uploaded-1"},
+					{"POST", "/api/clusters/prod/disable"},
+					{"DELETE", "/api/v2/kubeconfigs/kubeconfig-uploaded-1"},
+				} {
+					So(route[0]+" "+route[1]+" => "+strconv.Itoa(serve(route[0], route[1]).Code), ShouldEqual,
+						route[0]+" "+route[1]+" => 403")
+				}
+				So(serve("GET", "/api/clusters").Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,329 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/ziutek/rrd"
+)
+
+const (
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+// rrdLastUpdate returns the time of the last update of a RRD file
+var rrdLastUpdate = func(rrdFile string) (time.Time, error) {
+	info, err := rrd.Info(rrdFile)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "unable to read rrd file info")
+	}
+	lastUpdate, ok := info["last_update"].(uint)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no last update found in %s", rrdFile)
+	}
+	return time.Unix(int64(lastUpdate), 0).UTC(), nil
+}
+
+// cachedUsageHistory holds a usage history along with the last update of the RRD file it was read from
+type cachedUsageHistory struct {
+	lastUpdate time.Time
+	lastAccess time.Time
+	history    *UsageHistory
+}
+
+// usageHistoryCache holds usage histories read from RRD files, keyed on the file and the normalized query.
+// An entry is reused as long as its RRD file has not been updated
+type usageHistoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedUsageHistory
+}
+
+// apiUsageHistoryCache is the cache shared by the history API handlers
+var apiUsageHistoryCache = &usageHistoryCache{entries: make(map[string]*cachedUsageHistory)}
+
+// usageHistoryCacheKey returns the key of a query, with dates rounded to the storage step so that
+// queries returning the same samples share the same entry
+func usageHistoryCacheKey(rrdFile string, resolution string, startTimeUTC time.Time, endTimeUTC time.Time) string {
+	step := time.Duration(RRDStorageStep300Secs) * time.Second
+	return fmt.Sprintf("%s|%s|%d|%d", rrdFile, resolution, RoundTime(startTimeUTC, step).Unix(), RoundTime(endTimeUTC, step).Unix())
+}
+
+// fetch returns the cached history matching the key, or reads it from the RRD file when it's not cached
+// or the file has been updated since. Caching is disabled when krossboard_api_cache_max_entries is zero
+func (m *usageHistoryCache) fetch(key string, lastUpdate time.Time, read func() (*UsageHistory, error)) (*UsageHistory, error) {
+	maxEntries := viper.GetInt("krossboard_api_cache_max_entries")
+	if maxEntries <= 0 || lastUpdate.IsZero() {
+		return read()
+	}
+
+	m.mu.Lock()
+	entry, found := m.entries[key]
+	if found && entry.lastUpdate.Equal(lastUpdate) {
+		entry.lastAccess = time.Now()
+		m.mu.Unlock()
+		return entry.history, nil
+	}
+	m.mu.Unlock()
+
+	history, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.entries[key]; !found && len(m.entries) >= maxEntries {
+		m.evictLeastRecentlyUsed()
+	}
+	m.entries[key] = &cachedUsageHistory{lastUpdate: lastUpdate, lastAccess: time.Now(), history: history}
+	return history, nil
+}
+
+// evictLeastRecentlyUsed removes the entry that has not been accessed for the longest time
+func (m *usageHistoryCache) evictLeastRecentlyUsed() {
+	oldestKey := ""
+	var oldestAccess time.Time
+	for key, entry := range m.entries {
+		if oldestKey == "" || entry.lastAccess.Before(oldestAccess) {
+			oldestKey = key
+			oldestAccess = entry.lastAccess
+		}
+	}
+	delete(m.entries, oldestKey)
+}
+
+// krossboardInstancesCache holds the Krossboard instances listed from the Kubernetes API for a short while,
+// so that polling clients don't query the Kubernetes API on each call
+type krossboardInstancesCache struct {
+	list      func() (*KbInstancesK8sList, error)
+	mu        sync.Mutex
+	fetchedAt time.Time
+	instances *KbInstancesK8sList
+}
+
+// apiInstancesCache is the cache of Krossboard instances shared by the API handlers
+var apiInstancesCache = &krossboardInstancesCache{list: GetKrossboardInstances}
+
+// get returns the cached instances, listing them again once krossboard_api_cache_instances_ttl has elapsed
+func (m *krossboardInstancesCache) get() (*KbInstancesK8sList, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.instances != nil && time.Since(m.fetchedAt) < viper.GetDuration("krossboard_api_cache_instances_ttl") {
+		return m.instances, nil
+	}
+	instances, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	m.instances = instances
+	m.fetchedAt = time.Now()
+	return instances, nil
+}
+
+// newUsageETag returns a weak entity tag derived from the given validators. Tags are weak since
+// the same representation may be sent with different content encodings
+func newUsageETag(validators ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(validators, "\n")))
+	return fmt.Sprintf(`W/"%s"`, hex.EncodeToString(hash[:16]))
+}
+
+// usageValidators returns the entity tag and the last modification of a response built from the given RRD files
+// for a normalized query, along with the last update of each file indexed like the files. The entity tag is empty
+// when the last update of a file is unknown, so that such responses are never reported as not modified
+func usageValidators(normalizedQuery []string, dbFiles map[string]string) (string, time.Time, map[string]time.Time) {
+	lastUpdates := make(map[string]time.Time, len(dbFiles))
+	validators := append([]string{}, normalizedQuery...)
+	lastModified := time.Time{}
+	complete := true
+	for dbName, dbFile := range dbFiles {
+		lastUpdate, err := rrdLastUpdate(dbFile)
+		if err != nil {
+			// the file is still read, so that the error is handled as usual
+			complete = false
+			continue
+		}
+		lastUpdates[dbName] = lastUpdate
+		validators = append(validators, fmt.Sprintf("%s=%d", dbName, lastUpdate.Unix()))
+		if lastUpdate.After(lastModified) {
+			lastModified = lastUpdate
+		}
+	}
+	if !complete {
+		return "", lastModified, lastUpdates
+	}
+	sort.Strings(validators[len(normalizedQuery):])
+	return newUsageETag(validators...), lastModified, lastUpdates
+}
+
+// etagMatches tells whether an If-None-Match header matches an entity tag, using the weak comparison
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the validators of a response, and writes a 304 response when the conditional headers
+// of the request match them. If-None-Match takes precedence over If-Modified-Since. Responses without
+// entity tag are not cacheable
+func checkNotModified(w http.ResponseWriter, req *http.Request, etag string, lastModified time.Time) bool {
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	notModified := false
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		notModified = etagMatches(ifNoneMatch, etag)
+	} else if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		modifiedSince, err := http.ParseTime(ifModifiedSince)
+		notModified = err == nil && !lastModified.Truncate(time.Second).After(modifiedSince)
+	}
+	if notModified {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// negotiateEncoding returns the preferred content encoding accepted by a client, brotli first, or an
+// empty string when the response must not be compressed
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		accepted[coding] = quality > 0
+	}
+	for _, coding := range []string{EncodingBrotli, EncodingGzip} {
+		if accepted[coding] {
+			return coding
+		}
+	}
+	return ""
+}
+
+// compressResponseWriter compresses the body of a response, unless it has no content or it's already encoded
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding      string
+	headerWritten bool
+	compressor    io.WriteCloser
+}
+
+// isUncompressedContentType tells whether responses of a media type are sent as is: streams of events must be
+// delivered as they come, and Parquet files are already compressed
+func isUncompressedContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, usageParquetContentType)
+}
+
+func (m *compressResponseWriter) WriteHeader(status int) {
+	if m.headerWritten {
+		return
+	}
+	m.headerWritten = true
+	header := m.ResponseWriter.Header()
+	header.Add("Vary", "Accept-Encoding")
+	noContent := status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified
+	if !noContent && header.Get("Content-Encoding") == "" && !isUncompressedContentType(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", m.encoding)
+		header.Del("Content-Length")
+		if m.encoding == EncodingBrotli {
+			m.compressor = brotli.NewWriter(m.ResponseWriter)
+		} else {
+			m.compressor = gzip.NewWriter(m.ResponseWriter)
+		}
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *compressResponseWriter) Write(data []byte) (int, error) {
+	if !m.headerWritten {
+		m.WriteHeader(http.StatusOK)
+	}
+	if m.compressor == nil {
+		return m.ResponseWriter.Write(data)
+	}
+	return m.compressor.Write(data)
+}
+
+// Flush sends the data compressed so far, so that streaming responses keep working
+func (m *compressResponseWriter) Flush() {
+	if flusher, ok := m.compressor.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	if flusher, ok := m.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close completes the compressed stream
+func (m *compressResponseWriter) close() error {
+	if m.compressor == nil {
+		return nil
+	}
+	return m.compressor.Close()
+}
+
+// newCompressionMiddleware compresses responses with brotli or gzip according to the Accept-Encoding header
+func newCompressionMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+			if encoding == "" || req.Method == http.MethodHead || req.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			compressWriter := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+			defer compressWriter.close() //nolint:errcheck
+			next.ServeHTTP(compressWriter, req)
+		})
+	}
+}
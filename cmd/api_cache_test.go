@@ -0,0 +1,218 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestUsageHistoryCache(t *testing.T) {
+	Convey("Given a usage history cache limited to two entries", t, func(c C) {
+		viper.Set("krossboard_api_cache_max_entries", 2)
+		cache := &usageHistoryCache{entries: make(map[string]*cachedUsageHistory)}
+		reads := 0
+		read := func() (*UsageHistory, error) {
+			reads++
+			return &UsageHistory{CPUUsage: []*ResourceUsageItem{{Value: float64(reads)}}}, nil
+		}
+		lastUpdate := date(c, "2020-06-01T10:00:00Z")
+
+		Convey("When the same query is fetched twice without update of the RRD file", func() {
+			first, _ := cache.fetch("prod", lastUpdate, read)
+			second, _ := cache.fetch("prod", lastUpdate, read)
+
+			Convey("Then the RRD file is read once", func() {
+				So(reads, ShouldEqual, 1)
+				So(second, ShouldEqual, first)
+			})
+		})
+
+		Convey("When the RRD file is updated between two fetches", func() {
+			_, _ = cache.fetch("prod", lastUpdate, read)
+			second, _ := cache.fetch("prod", lastUpdate.Add(5*time.Minute), read)
+
+			Convey("Then the cached history is invalidated", func() {
+				So(reads, ShouldEqual, 2)
+				So(second.CPUUsage[0].Value, ShouldEqual, 2)
+			})
+		})
+
+		Convey("When more queries than the cache limit are fetched", func() {
+			_, _ = cache.fetch("prod", lastUpdate, read)
+			_, _ = cache.fetch("staging", lastUpdate, read)
+			_, _ = cache.fetch("prod", lastUpdate, read)
+			_, _ = cache.fetch("dev", lastUpdate, read)
+
+			Convey("Then the least recently used entry is evicted", func() {
+				So(cache.entries, ShouldHaveLength, 2)
+				So(cache.entries, ShouldContainKey, "prod")
+				So(cache.entries, ShouldContainKey, "dev")
+			})
+		})
+
+		Convey("When dates within the same storage step are normalized", func() {
+			start := date(c, "2020-06-01T10:00:10Z")
+			end := date(c, "2020-06-01T12:01:00Z")
+
+			Convey("Then they give the same cache key", func() {
+				So(usageHistoryCacheKey("prod", "hourly", start, end),
+					ShouldEqual, usageHistoryCacheKey("prod", "hourly", start.Add(time.Minute), end.Add(2*time.Minute)))
+				So(usageHistoryCacheKey("prod", "hourly", start, end),
+					ShouldNotEqual, usageHistoryCacheKey("prod", "hourly", start, end.Add(5*time.Minute)))
+			})
+		})
+	})
+}
+
+func TestConditionalAndCompressedHistory(t *testing.T) {
+	Convey("Given an API router and two clusters whose history was updated at a known time", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_historydb_dir", tempDir)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		viper.Set("krossboard_api_cache_instances_ttl", time.Minute)
+		apiAccessPolicy = nil
+
+		lastUpdate := date(c, "2020-06-01T10:00:00Z")
+		origLastUpdate, origInstancesCache := rrdLastUpdate, apiInstancesCache
+		rrdLastUpdate = func(string) (time.Time, error) { return lastUpdate, nil }
+		instancesListed := 0
+		apiInstancesCache = &krossboardInstancesCache{list: func() (*KbInstancesK8sList, error) {
+			instancesListed++
+			instances := &KbInstancesK8sList{}
+			_ = json.Unmarshal([]byte(`{"items":[{"status":{"koaInstances":[{"clusterName":"prod"},{"clusterName":"staging"}]}}]}`), instances)
+			return instances, nil
+		}}
+
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(target string, headers map[string]string) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", target, nil)
+			for key, value := range headers {
+				req.Header.Set(key, value)
+			}
+			router.ServeHTTP(resp, req)
+			return resp
+		}
+		const target = "/api/usagehistory?startDateUTC=2020-06-01T00:00:00&endDateUTC=2020-06-01T12:00:00"
+
+		Convey("When the history is requested twice", func() {
+			first := serve(target, nil)
+			second := serve(target, nil)
+
+			Convey("Then validators are set and the Kubernetes API is queried once", func() {
+				So(first.Code, ShouldEqual, http.StatusOK)
+				So(first.Header().Get("ETag"), ShouldStartWith, `W/"`)
+				So(first.Header().Get("ETag"), ShouldEqual, second.Header().Get("ETag"))
+				So(first.Header().Get("Last-Modified"), ShouldEqual, "Mon, 01 Jun 2020 10:00:00 GMT")
+				So(instancesListed, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the history is requested again with its entity tag", func() {
+			etag := serve(target, nil).Header().Get("ETag")
+			resp := serve(target, map[string]string{"If-None-Match": etag})
+
+			Convey("Then the response is not modified", func() {
+				So(resp.Code, ShouldEqual, http.StatusNotModified)
+				So(resp.Body.Len(), ShouldEqual, 0)
+			})
+
+			Convey("And it's modified once a RRD file is updated", func() {
+				lastUpdate = lastUpdate.Add(5 * time.Minute)
+				So(serve(target, map[string]string{"If-None-Match": etag}).Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When the history is requested with an up to date If-Modified-Since", func() {
+			resp := serve(target, map[string]string{"If-Modified-Since": "Mon, 01 Jun 2020 10:00:00 GMT"})
+			older := serve(target, map[string]string{"If-Modified-Since": "Mon, 01 Jun 2020 09:55:00 GMT"})
+
+			Convey("Then the response is not modified unless the date is older", func() {
+				So(resp.Code, ShouldEqual, http.StatusNotModified)
+				So(older.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When the v2 history is requested again with its entity tag", func() {
+			const v2Target = "/api/v2/usagehistory?startDateUTC=2020-06-01T00:00:00Z&endDateUTC=2020-06-01T12:00:00Z"
+			etag := serve(v2Target, nil).Header().Get("ETag")
+			resp := serve(v2Target, map[string]string{"If-None-Match": etag})
+
+			Convey("Then the response is not modified", func() {
+				So(etag, ShouldNotBeEmpty)
+				So(resp.Code, ShouldEqual, http.StatusNotModified)
+			})
+		})
+
+		Convey("When the client accepts gzip", func() {
+			resp := serve(target, map[string]string{"Accept-Encoding": "gzip, deflate"})
+			reader, err := gzip.NewReader(resp.Body)
+			So(err, ShouldBeNil)
+			body, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+
+			Convey("Then the response is gzip-compressed", func() {
+				So(resp.Header().Get("Content-Encoding"), ShouldEqual, EncodingGzip)
+				So(resp.Header().Get("Vary"), ShouldEqual, "Accept-Encoding")
+				So(string(body), ShouldStartWith, `{"status":"ok"`)
+			})
+		})
+
+		Convey("When the client prefers brotli", func() {
+			resp := serve(target, map[string]string{"Accept-Encoding": "gzip, br"})
+			body, err := ioutil.ReadAll(brotli.NewReader(resp.Body))
+			So(err, ShouldBeNil)
+
+			Convey("Then the response is brotli-compressed", func() {
+				So(resp.Header().Get("Content-Encoding"), ShouldEqual, EncodingBrotli)
+				So(string(body), ShouldStartWith, `{"status":"ok"`)
+			})
+		})
+
+		Convey("When the client refuses brotli and the response is not modified", func() {
+			etag := serve(target, nil).Header().Get("ETag")
+			resp := serve(target, map[string]string{"Accept-Encoding": "br;q=0", "If-None-Match": etag})
+
+			Convey("Then nothing is compressed", func() {
+				So(negotiateEncoding("br;q=0"), ShouldBeEmpty)
+				So(resp.Code, ShouldEqual, http.StatusNotModified)
+				So(resp.Header().Get("Content-Encoding"), ShouldBeEmpty)
+			})
+		})
+
+		Reset(func() {
+			rrdLastUpdate, apiInstancesCache = origLastUpdate, origInstancesCache
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
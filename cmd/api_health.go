@@ -0,0 +1,175 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/ziutek/rrd"
+)
+
+const (
+	HealthCheckOk      = "ok"
+	HealthCheckFailed  = "failed"
+	HealthCheckSkipped = "skipped"
+)
+
+// HealthCheck holds the result of a readiness check
+type HealthCheck struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+// GetHealthResp holds the message returned by the liveness and readiness API callbacks
+type GetHealthResp struct {
+	Status  string         `json:"status,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Checks  []*HealthCheck `json:"checks,omitempty"`
+}
+
+// readinessCheck describes a dependency check, which returns a message and whether the check was skipped
+type readinessCheck struct {
+	name  string
+	check func() (message string, skipped bool, err error)
+}
+
+// readinessChecks lists the dependencies checked before declaring the service ready
+var readinessChecks = []*readinessCheck{
+	{name: "data_dirs", check: checkDataDirsWritable},
+	{name: "current_usage", check: checkCurrentUsageFresh},
+	{name: "history_db", check: checkHistoryDbReadable},
+	{name: "operator", check: checkOperatorReachable},
+}
+
+// checkDataDirsWritable checks that a file can be created in each data directory
+func checkDataDirsWritable() (string, bool, error) {
+	for _, key := range []string{"krossboard_rawdb_dir", "krossboard_historydb_dir", "krossboard_run_dir"} {
+		dir := viper.GetString(key)
+		tmpFile, err := ioutil.TempFile(dir, ".readyz_*")
+		if err != nil {
+			return "", false, fmt.Errorf("directory %s is not writable: %v", dir, err)
+		}
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+	}
+	return "data directories are writable", false, nil
+}
+
+// checkCurrentUsageFresh checks that the consolidator has recently updated the current usage file
+func checkCurrentUsageFresh() (string, bool, error) {
+	info, err := os.Stat(getCurrentClusterUsagePath())
+	if err != nil {
+		return "", false, fmt.Errorf("current usage file not available: %v", err)
+	}
+	age := time.Since(info.ModTime())
+	maxAge := time.Duration(viper.GetInt("krossboard_readiness_max_usage_age_minutes")) * time.Minute
+	if age > maxAge {
+		return "", false, fmt.Errorf("current usage file not updated for %s (max %s)", age.Round(time.Second), maxAge)
+	}
+	return fmt.Sprintf("current usage file updated %s ago", age.Round(time.Second)), false, nil
+}
+
+// checkHistoryDbReadable checks that a sample history database can be read
+func checkHistoryDbReadable() (string, bool, error) {
+	dbFiles, err := filepath.Glob(getHistoryDbPath("*"))
+	if err != nil {
+		return "", false, err
+	}
+	if len(dbFiles) == 0 {
+		return "no history database created yet", true, nil
+	}
+	if _, err = rrd.Info(dbFiles[0]); err != nil {
+		return "", false, fmt.Errorf("failed reading %s: %v", dbFiles[0], err)
+	}
+	return fmt.Sprintf("%s is readable", filepath.Base(dbFiles[0])), false, nil
+}
+
+// checkOperatorReachable checks that the Krossboard instances can be listed from the Kubernetes API
+func checkOperatorReachable() (string, bool, error) {
+	if !viper.GetBool("krossboard_readiness_check_operator") {
+		return "operator check disabled", true, nil
+	}
+	if _, err := GetKrossboardInstances(); err != nil {
+		return "", false, err
+	}
+	return "operator API is reachable", false, nil
+}
+
+// runReadinessChecks runs the given checks and tells whether all of them succeeded or were skipped
+func runReadinessChecks(checks []*readinessCheck) ([]*HealthCheck, bool) {
+	results := make([]*HealthCheck, 0, len(checks))
+	ready := true
+	for _, c := range checks {
+		start := time.Now()
+		message, skipped, err := c.check()
+		result := &HealthCheck{Name: c.name, Status: HealthCheckOk, Message: message, Duration: time.Since(start).Seconds()}
+		switch {
+		case err != nil:
+			result.Status = HealthCheckFailed
+			result.Message = err.Error()
+			ready = false
+		case skipped:
+			result.Status = HealthCheckSkipped
+		}
+		results = append(results, result)
+	}
+	return results, ready
+}
+
+// HealthzHandler tells that the process is alive
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	outRaw, _ := json.Marshal(&GetHealthResp{Status: "ok"})
+	_, _ = w.Write(outRaw)
+}
+
+// ReadyzHandler tells whether the service dependencies are available, with the status of each check. As the
+// endpoint is public, check messages disclosing paths and cluster names are only logged
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks, ready := runReadinessChecks(readinessChecks)
+	for _, check := range checks {
+		if check.Status == HealthCheckFailed {
+			log.WithField("check", check.Name).Warnln("readiness check failed:", check.Message)
+		}
+		check.Message = ""
+	}
+	resp := &GetHealthResp{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	if !ready {
+		resp.Status = "error"
+		resp.Message = "one or more readiness checks failed"
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	outRaw, _ := json.Marshal(resp)
+	_, _ = w.Write(outRaw)
+}
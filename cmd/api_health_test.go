@@ -0,0 +1,125 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	Convey("Given an API router and fresh consolidated data", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		for _, key := range []string{"krossboard_rawdb_dir", "krossboard_historydb_dir", "krossboard_run_dir"} {
+			dir := filepath.Join(tempDir, key)
+			So(os.Mkdir(dir, 0755), ShouldBeNil)
+			viper.Set(key, dir)
+		}
+		viper.Set("krossboard_readiness_max_usage_age_minutes", 15)
+		viper.Set("krossboard_readiness_check_operator", false)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		So(ioutil.WriteFile(getCurrentClusterUsagePath(), []byte("[]"), 0644), ShouldBeNil)
+
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(target string) (*httptest.ResponseRecorder, *GetHealthResp) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+			health := &GetHealthResp{}
+			_ = json.Unmarshal(resp.Body.Bytes(), health)
+			return resp, health
+		}
+		checkStatuses := func(health *GetHealthResp) map[string]string {
+			statuses := make(map[string]string)
+			for _, check := range health.Checks {
+				statuses[check.Name] = check.Status
+			}
+			return statuses
+		}
+
+		Convey("When the liveness endpoint is probed", func() {
+			resp, health := serve("/healthz")
+
+			Convey("Then the process is reported alive without dependency checks", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(health.Status, ShouldEqual, "ok")
+				So(health.Checks, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When all dependencies are available", func() {
+			resp, health := serve("/readyz")
+
+			Convey("Then the service is ready and optional checks are skipped", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(checkStatuses(health), ShouldResemble, map[string]string{
+					"data_dirs":     HealthCheckOk,
+					"current_usage": HealthCheckOk,
+					"history_db":    HealthCheckSkipped,
+					"operator":      HealthCheckSkipped,
+				})
+			})
+		})
+
+		Convey("When the current usage is stale and a history database is corrupted", func() {
+			staleTime := time.Now().Add(-time.Hour)
+			So(os.Chtimes(getCurrentClusterUsagePath(), staleTime, staleTime), ShouldBeNil)
+			So(ioutil.WriteFile(getHistoryDbPath("prod"), []byte("not a RRD file"), 0644), ShouldBeNil)
+			resp, health := serve("/readyz")
+
+			Convey("Then the service is not ready and failed checks are listed without details", func() {
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(health.Status, ShouldEqual, "error")
+				statuses := checkStatuses(health)
+				So(statuses["data_dirs"], ShouldEqual, HealthCheckOk)
+				So(statuses["current_usage"], ShouldEqual, HealthCheckFailed)
+				So(statuses["history_db"], ShouldEqual, HealthCheckFailed)
+				for _, check := range health.Checks {
+					So(check.Message, ShouldBeEmpty)
+				}
+				So(resp.Body.String(), ShouldNotContainSubstring, tempDir)
+				So(resp.Body.String(), ShouldNotContainSubstring, "historydb-prod")
+			})
+		})
+
+		Convey("When a data directory is missing", func() {
+			So(os.RemoveAll(viper.GetString("krossboard_rawdb_dir")), ShouldBeNil)
+			resp, health := serve("/readyz")
+
+			Convey("Then the data directories check fails", func() {
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(checkStatuses(health)["data_dirs"], ShouldEqual, HealthCheckFailed)
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadCurrentUsage reads the current usage of clusters recorded by the consolidator
+func loadCurrentUsage() ([]*K8sClusterUsage, error) {
+	data, err := ioutil.ReadFile(getCurrentClusterUsagePath())
+	if err != nil {
+		return nil, err
+	}
+	var currentUsage []*K8sClusterUsage
+	err = json.Unmarshal(data, &currentUsage)
+	return currentUsage, err
+}
+
+// loadNodesUsage reads the latest usage of nodes recorded by the consolidator, indexed by cluster and node names
+func loadNodesUsage() (map[string]map[string]NodeUsage, error) {
+	data, err := ioutil.ReadFile(getNodesUsagePath())
+	if err != nil {
+		return nil, err
+	}
+	nodesUsage := make(map[string]map[string]NodeUsage)
+	err = json.Unmarshal(data, &nodesUsage)
+	return nodesUsage, err
+}
+
+// boolToFloat returns 1 for true and 0 for false
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// Gauges exposing the current usage of clusters and nodes
+var (
+	clusterCPUUsedDesc = prometheus.NewDesc("krossboard_cluster_cpu_used_percent",
+		"Percentage of the cluster CPU capacity used by pods.", []string{"cluster"}, nil)
+	clusterMemUsedDesc = prometheus.NewDesc("krossboard_cluster_memory_used_percent",
+		"Percentage of the cluster memory capacity used by pods.", []string{"cluster"}, nil)
+	clusterCPUNonAllocatableDesc = prometheus.NewDesc("krossboard_cluster_cpu_non_allocatable_percent",
+		"Percentage of the cluster CPU capacity that is not allocatable.", []string{"cluster"}, nil)
+	clusterMemNonAllocatableDesc = prometheus.NewDesc("krossboard_cluster_memory_non_allocatable_percent",
+		"Percentage of the cluster memory capacity that is not allocatable.", []string{"cluster"}, nil)
+	clusterOutToDateDesc = prometheus.NewDesc("krossboard_cluster_out_to_date",
+		"Whether the cluster usage has not been updated recently (1) or not (0).", []string{"cluster"}, nil)
+	nodeCPUCapacityDesc = prometheus.NewDesc("krossboard_node_cpu_capacity_cores",
+		"CPU capacity of the node.", []string{"cluster", "node"}, nil)
+	nodeCPUAllocatableDesc = prometheus.NewDesc("krossboard_node_cpu_allocatable_cores",
+		"Allocatable CPU of the node.", []string{"cluster", "node"}, nil)
+	nodeCPUUsageByPodsDesc = prometheus.NewDesc("krossboard_node_cpu_usage_by_pods_cores",
+		"CPU used by the pods running on the node.", []string{"cluster", "node"}, nil)
+	nodeMemCapacityDesc = prometheus.NewDesc("krossboard_node_memory_capacity_bytes",
+		"Memory capacity of the node.", []string{"cluster", "node"}, nil)
+	nodeMemAllocatableDesc = prometheus.NewDesc("krossboard_node_memory_allocatable_bytes",
+		"Allocatable memory of the node.", []string{"cluster", "node"}, nil)
+	nodeMemUsageByPodsDesc = prometheus.NewDesc("krossboard_node_memory_usage_by_pods_bytes",
+		"Memory used by the pods running on the node.", []string{"cluster", "node"}, nil)
+	nodeLastUpdateDesc = prometheus.NewDesc("krossboard_node_last_update_timestamp_seconds",
+		"Time of the last update of the node usage.", []string{"cluster", "node"}, nil)
+)
+
+// usageCollector exposes the current usage of clusters and nodes recorded by the consolidator, restricted to
+// the clusters accepted by a filter
+type usageCollector struct {
+	currentUsage []*K8sClusterUsage
+	nodesUsage   map[string]map[string]NodeUsage
+	isAllowed    func(cluster string) bool
+}
+
+func (m *usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		clusterCPUUsedDesc, clusterMemUsedDesc, clusterCPUNonAllocatableDesc, clusterMemNonAllocatableDesc, clusterOutToDateDesc,
+		nodeCPUCapacityDesc, nodeCPUAllocatableDesc, nodeCPUUsageByPodsDesc, nodeMemCapacityDesc, nodeMemAllocatableDesc,
+		nodeMemUsageByPodsDesc, nodeLastUpdateDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (m *usageCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, value float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+	}
+	for _, clusterUsage := range m.currentUsage {
+		if !m.isAllowed(clusterUsage.ClusterName) {
+			continue
+		}
+		gauge(clusterCPUUsedDesc, clusterUsage.CPUUsed, clusterUsage.ClusterName)
+		gauge(clusterMemUsedDesc, clusterUsage.MemUsed, clusterUsage.ClusterName)
+		gauge(clusterCPUNonAllocatableDesc, clusterUsage.CPUNonAllocatable, clusterUsage.ClusterName)
+		gauge(clusterMemNonAllocatableDesc, clusterUsage.MemNonAllocatable, clusterUsage.ClusterName)
+		gauge(clusterOutToDateDesc, boolToFloat(clusterUsage.OutToDate), clusterUsage.ClusterName)
+	}
+	for clusterName, nodes := range m.nodesUsage {
+		if !m.isAllowed(clusterName) {
+			continue
+		}
+		for nodeName, nodeUsage := range nodes {
+			gauge(nodeCPUCapacityDesc, nodeUsage.CPUCapacity, clusterName, nodeName)
+			gauge(nodeCPUAllocatableDesc, nodeUsage.CPUAllocatable, clusterName, nodeName)
+			gauge(nodeCPUUsageByPodsDesc, nodeUsage.CPUUsageByPods, clusterName, nodeName)
+			gauge(nodeMemCapacityDesc, nodeUsage.MEMCapacity, clusterName, nodeName)
+			gauge(nodeMemAllocatableDesc, nodeUsage.MEMAllocatable, clusterName, nodeName)
+			gauge(nodeMemUsageByPodsDesc, nodeUsage.MEMUsageByPods, clusterName, nodeName)
+			if !nodeUsage.DateUTC.IsZero() {
+				gauge(nodeLastUpdateDesc, float64(nodeUsage.DateUTC.Unix()), clusterName, nodeName)
+			}
+		}
+	}
+}
+
+// MetricsHandler exposes the current usage of clusters and nodes, and the metrics of the data processor itself,
+// in the Prometheus text format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	currentUsage, err := loadCurrentUsage()
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Errorln("failed reading current usage file")
+	}
+	nodesUsage, err := loadNodesUsage()
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Errorln("failed reading nodes usage file")
+	}
+
+	// usage metrics are restricted to the clusters the caller is allowed on, so they are gathered per request
+	usageRegistry := prometheus.NewRegistry()
+	usageRegistry.MustRegister(&usageCollector{
+		currentUsage: currentUsage,
+		nodesUsage:   nodesUsage,
+		isAllowed:    func(cluster string) bool { return isClusterAllowed(r, cluster) },
+	})
+	promhttp.HandlerFor(prometheus.Gatherers{usageRegistry, selfMetricsRegistry}, promhttp.HandlerOpts{
+		ErrorLog: log.StandardLogger(),
+		// responses are compressed by the API router
+		DisableCompression: true,
+	}).ServeHTTP(w, r)
+}
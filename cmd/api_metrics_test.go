@@ -0,0 +1,85 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	Convey("Given the current usage of two clusters and their nodes", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_run_dir", tempDir)
+		apiAccessPolicy = nil
+
+		currentUsage, _ := json.Marshal([]*K8sClusterUsage{
+			{ClusterName: "prod", CPUUsed: 42.5, MemUsed: 27, CPUNonAllocatable: 5, MemNonAllocatable: 8},
+			{ClusterName: "dev", OutToDate: true},
+		})
+		So(ioutil.WriteFile(getCurrentClusterUsagePath(), currentUsage, 0644), ShouldBeNil)
+		nodesUsage, _ := json.Marshal(map[string]map[string]NodeUsage{
+			"prod": {"node-1": {Name: "node-1", DateUTC: date(c, "2020-06-01T10:00:00Z"), CPUCapacity: 4, CPUAllocatable: 3.9,
+				CPUUsageByPods: 1.25, MEMCapacity: 16e9, MEMAllocatable: 15e9, MEMUsageByPods: 4e9}},
+		})
+		So(ioutil.WriteFile(getNodesUsagePath(), nodesUsage, 0644), ShouldBeNil)
+
+		Convey("When Prometheus scrapes the metrics endpoint", func() {
+			resp := httptest.NewRecorder()
+			MetricsHandler(resp, httptest.NewRequest("GET", "/metrics", nil))
+			body := resp.Body.String()
+
+			Convey("Then cluster and node values are exposed as labeled gauges", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(resp.Header().Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+				So(body, ShouldContainSubstring, "# TYPE krossboard_cluster_cpu_used_percent gauge\n")
+				So(body, ShouldContainSubstring, `krossboard_cluster_cpu_used_percent{cluster="prod"} 42.5`+"\n")
+				So(body, ShouldContainSubstring, `krossboard_cluster_memory_non_allocatable_percent{cluster="prod"} 8`+"\n")
+				So(body, ShouldContainSubstring, `krossboard_cluster_out_to_date{cluster="dev"} 1`+"\n")
+				So(body, ShouldContainSubstring, `krossboard_node_cpu_usage_by_pods_cores{cluster="prod",node="node-1"} 1.25`+"\n")
+				So(body, ShouldContainSubstring, `krossboard_node_memory_allocatable_bytes{cluster="prod",node="node-1"} 1.5e+10`+"\n")
+				So(body, ShouldContainSubstring, `krossboard_node_last_update_timestamp_seconds{cluster="prod",node="node-1"} 1.5910056e+09`+"\n")
+			})
+		})
+
+		Convey("When the consolidator has not run yet", func() {
+			So(os.Remove(getCurrentClusterUsagePath()), ShouldBeNil)
+			So(os.Remove(getNodesUsagePath()), ShouldBeNil)
+			resp := httptest.NewRecorder()
+			MetricsHandler(resp, httptest.NewRequest("GET", "/metrics", nil))
+
+			Convey("Then no usage metric is exposed", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(resp.Body.String(), ShouldNotContainSubstring, "krossboard_cluster_")
+				So(resp.Body.String(), ShouldNotContainSubstring, "krossboard_node_")
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,647 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const openAPIComponentsPrefix = "#/components/schemas/"
+
+// OpenAPISchema holds the subset of the OpenAPI 3.0 schema object used to describe the API
+type OpenAPISchema struct {
+	Ref         string                    `json:"$ref,omitempty"`
+	AllOf       []*OpenAPISchema          `json:"allOf,omitempty"`
+	Type        string                    `json:"type,omitempty"`
+	Format      string                    `json:"format,omitempty"`
+	Description string                    `json:"description,omitempty"`
+	Pattern     string                    `json:"pattern,omitempty"`
+	Enum        []string                  `json:"enum,omitempty"`
+	Nullable    bool                      `json:"nullable,omitempty"`
+	Items       *OpenAPISchema            `json:"items,omitempty"`
+	MinItems    *int                      `json:"minItems,omitempty"`
+	MaxItems    *int                      `json:"maxItems,omitempty"`
+	Required    []string                  `json:"required,omitempty"`
+	Properties  map[string]*OpenAPISchema `json:"properties,omitempty"`
+	// AdditionalProperties is either false, to reject undeclared properties, or the schema of map values
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+	// patternRegexp is Pattern compiled once when the document is built
+	patternRegexp *regexp.Regexp
+}
+
+// OpenAPIParameter describes a path, query or header parameter
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIMediaType describes the content of a request or a response for a given media type
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema,omitempty"`
+}
+
+// OpenAPIRequestBody describes the body expected by an operation
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content"`
+}
+
+// OpenAPIResponse describes a response of an operation
+type OpenAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// OpenAPIOperation describes an API route
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+// OpenAPIComponents holds the schemas and security schemes referenced by operations
+type OpenAPIComponents struct {
+	Schemas         map[string]*OpenAPISchema         `json:"schemas"`
+	SecuritySchemes map[string]map[string]interface{} `json:"securitySchemes"`
+}
+
+// OpenAPIDocument holds the OpenAPI 3.0 description of the API
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       map[string]string                       `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components *OpenAPIComponents                      `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+// apiSpec is the OpenAPI document of the routes served by the API, set when the router is created
+var apiSpec *OpenAPIDocument
+
+// kubeConfigRequestBody is the multipart form of the routes receiving a KUBECONFIG file
+var kubeConfigRequestBody = &OpenAPIRequestBody{
+	Required: true,
+	Content: map[string]*OpenAPIMediaType{
+		"multipart/form-data": {Schema: &OpenAPISchema{
+			Type:       "object",
+			Required:   []string{"kubeconfig"},
+			Properties: map[string]*OpenAPISchema{"kubeconfig": {Type: "string", Format: "binary"}},
+		}},
+	},
+}
+
+// Parameters shared by API routes
+var (
+	startDateUTCParam = &OpenAPIParameter{
+		Name:        "startDateUTC",
+		In:          "query",
+		Description: "Start of the period, formatted as 2006-01-02T15:04:05 or 2006-01-02 in the tz time zone, as a RFC 3339 date, a Unix timestamp in seconds, or relative to now (e.g. -7d, now-1h)",
+		Schema:      &OpenAPISchema{Type: "string"},
+	}
+	endDateUTCParam = &OpenAPIParameter{
+		Name:        "endDateUTC",
+		In:          "query",
+		Description: "End of the period, formatted as 2006-01-02T15:04:05 or 2006-01-02 in the tz time zone, as a RFC 3339 date, a Unix timestamp in seconds, or relative to now (e.g. now, now-1h)",
+		Schema:      &OpenAPISchema{Type: "string"},
+	}
+	tzParam = &OpenAPIParameter{
+		Name:        "tz",
+		In:          "query",
+		Description: "Time zone of the dates without offset, such as Europe/Paris. UTC by default",
+		Schema:      &OpenAPISchema{Type: "string"},
+	}
+	stepParam = &OpenAPIParameter{
+		Name:        "step",
+		In:          "query",
+		Description: "Resolution of the history, as a multiple of 5m (e.g. 5m, 1h, 1d) or a number of seconds, samples being averaged over each step. Chosen from the length of the period by default",
+		Schema:      &OpenAPISchema{Type: "string", Pattern: `^(\d+|(\d+[smhdw])+)$`},
+	}
+	clusterQueryParam = &OpenAPIParameter{
+		Name:        "cluster",
+		In:          "query",
+		Description: "Name of the cluster",
+		Schema:      &OpenAPISchema{Type: "string"},
+	}
+	clusterNamePathParam = &OpenAPIParameter{
+		Name:     "clustername",
+		In:       "path",
+		Required: true,
+		Schema:   &OpenAPISchema{Type: "string"},
+	}
+	kubeConfigNamePathParam = &OpenAPIParameter{
+		Name:        "name",
+		In:          "path",
+		Required:    true,
+		Description: "Name of the file in the KUBECONFIG directory",
+		Schema:      &OpenAPISchema{Type: "string"},
+	}
+	kubeConfigValidationParam = &OpenAPIParameter{
+		Name:        "validation",
+		In:          "query",
+		Description: "Check the connectivity and the permissions of each cluster of the KUBECONFIG: none (default), warn to accept the file with a report, or strict to reject it when a check fails",
+		Schema:      &OpenAPISchema{Type: "string", Enum: []string{KubeConfigValidationNone, KubeConfigValidationWarn, KubeConfigValidationStrict}},
+	}
+	streamClusterParam = &OpenAPIParameter{
+		Name:        "cluster",
+		In:          "query",
+		Description: "Comma-separated names of the clusters to follow, all by default",
+		Schema:      &OpenAPISchema{Type: "string"},
+	}
+	streamLastEventIDParam = &OpenAPIParameter{
+		Name:        "lastEventId",
+		In:          "query",
+		Description: "Id of the last event received, to resume a stream after a reconnection",
+		Schema:      &OpenAPISchema{Type: "string", Pattern: `^\d+$`},
+	}
+	formatParam = &OpenAPIParameter{
+		Name:        "format",
+		In:          "query",
+		Description: "Format of the response",
+		Schema:      &OpenAPISchema{Type: "string", Enum: []string{"json", "csv"}},
+	}
+	exportFormatParam = &OpenAPIParameter{
+		Name:        "format",
+		In:          "query",
+		Description: "Format of the response. ndjson and parquet stream one row per item and date, for bulk exports",
+		Schema:      &OpenAPISchema{Type: "string", Enum: []string{ExportFormatJSON, ExportFormatCSV, ExportFormatNDJSON, ExportFormatParquet}},
+	}
+	csvLayoutParam = &OpenAPIParameter{
+		Name:        "layout",
+		In:          "query",
+		Description: "Layout of CSV responses: one row per item and date (long), or one row per date (wide)",
+		Schema:      &OpenAPISchema{Type: "string", Enum: []string{CSVLayoutLong, CSVLayoutWide}},
+	}
+	csvDelimiterParam = &OpenAPIParameter{
+		Name:        "delimiter",
+		In:          "query",
+		Description: "Field delimiter of CSV responses",
+		Schema:      &OpenAPISchema{Type: "string", Enum: []string{"comma", "semicolon", "tab", "pipe"}},
+	}
+)
+
+// openAPISchemaBuilder generates schemas from Go types, registering named structs as reusable components
+type openAPISchemaBuilder struct {
+	components map[string]*OpenAPISchema
+}
+
+// schemaOf returns the schema matching the JSON encoding of a Go type
+func (m *openAPISchemaBuilder) schemaOf(t reflect.Type) *OpenAPISchema {
+	if t == reflect.TypeOf(time.Time{}) {
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elemSchema := m.schemaOf(t.Elem())
+		if elemSchema.Ref != "" {
+			return &OpenAPISchema{AllOf: []*OpenAPISchema{elemSchema}, Nullable: true}
+		}
+		elemSchema.Nullable = true
+		return elemSchema
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &OpenAPISchema{Type: "number"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Slice:
+		return &OpenAPISchema{Type: "array", Items: m.schemaOf(t.Elem()), Nullable: true}
+	case reflect.Array:
+		length := t.Len()
+		return &OpenAPISchema{Type: "array", Items: m.schemaOf(t.Elem()), MinItems: &length, MaxItems: &length}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: m.schemaOf(t.Elem()), Nullable: true}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return m.structSchema(t)
+		}
+		if _, found := m.components[t.Name()]; !found {
+			// register a placeholder first to support recursive types
+			m.components[t.Name()] = &OpenAPISchema{}
+			*m.components[t.Name()] = *m.structSchema(t)
+		}
+		return &OpenAPISchema{Ref: openAPIComponentsPrefix + t.Name()}
+	}
+	return &OpenAPISchema{}
+}
+
+// structSchema returns the schema of a struct from its exported fields and their json tags
+func (m *openAPISchemaBuilder) structSchema(t reflect.Type) *OpenAPISchema {
+	schema := &OpenAPISchema{
+		Type:                 "object",
+		Properties:           make(map[string]*OpenAPISchema),
+		AdditionalProperties: false,
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tagParts := strings.Split(field.Tag.Get("json"), ",")
+		name := tagParts[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = m.schemaOf(field.Type)
+
+		omitEmpty := false
+		for _, opt := range tagParts[1:] {
+			omitEmpty = omitEmpty || opt == "omitempty"
+		}
+		if !omitEmpty {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+// v2DataSchema returns the schema of the data wrapped by v2 responses, built from the matching v1 response type
+func (m *openAPISchemaBuilder) v2DataSchema(t reflect.Type, dataFields []string, unwrap bool) *OpenAPISchema {
+	v1Schema := m.schemaOf(t)
+	if dataFields == nil {
+		return v1Schema
+	}
+	v1Schema = m.components[strings.TrimPrefix(v1Schema.Ref, openAPIComponentsPrefix)]
+	if unwrap {
+		dataSchema := *v1Schema.Properties[dataFields[0]]
+		dataSchema.Nullable = true
+		return &dataSchema
+	}
+	dataSchema := &OpenAPISchema{
+		Type:                 "object",
+		Properties:           make(map[string]*OpenAPISchema),
+		AdditionalProperties: false,
+		Nullable:             true,
+	}
+	for _, field := range dataFields {
+		dataSchema.Properties[field] = v1Schema.Properties[field]
+		if containsString(v1Schema.Required, field) {
+			dataSchema.Required = append(dataSchema.Required, field)
+		}
+	}
+	return dataSchema
+}
+
+// newOpenAPIDocument builds the OpenAPI document of the given routes
+func newOpenAPIDocument(apiRoutes map[string]map[string]interface{}) *OpenAPIDocument {
+	builder := &openAPISchemaBuilder{components: make(map[string]*OpenAPISchema)}
+	errorSchema := builder.schemaOf(reflect.TypeOf(ErrorResp{}))
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    map[string]string{"title": "Krossboard API", "version": "1"},
+		Paths:   make(map[string]map[string]*OpenAPIOperation),
+		Components: &OpenAPIComponents{
+			Schemas: builder.components,
+			SecuritySchemes: map[string]map[string]interface{}{
+				"bearerAuth":      {"type": "http", "scheme": "bearer"},
+				"apiKeyAuth":      {"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"queryTokenAuth":  {"type": "apiKey", "in": "query", "name": StreamTokenQueryParam},
+				"cookieTokenAuth": {"type": "apiKey", "in": "cookie", "name": StreamTokenCookie},
+			},
+		},
+		Security: []map[string][]string{{"bearerAuth": {}}, {"apiKeyAuth": {}}},
+	}
+
+	for key, route := range apiRoutes {
+		path, method := getRoutePath(key, route), route["method"].(string)
+		op := &OpenAPIOperation{
+			OperationID: strings.TrimSuffix(runtimeFuncName(route["handler"]), "Handler"),
+			Responses: map[string]*OpenAPIResponse{
+				"default": {
+					Description: "Error",
+					Content:     map[string]*OpenAPIMediaType{"application/json": {Schema: errorSchema}},
+				},
+			},
+		}
+		if operationID, found := route["operationId"]; found {
+			op.OperationID = operationID.(string)
+		}
+		if summary, found := route["summary"]; found {
+			op.Summary = summary.(string)
+		}
+		if params, found := route["parameters"]; found {
+			op.Parameters = params.([]*OpenAPIParameter)
+			for _, param := range op.Parameters {
+				if param.Schema.Pattern != "" && param.Schema.patternRegexp == nil {
+					param.Schema.patternRegexp = regexp.MustCompile(param.Schema.Pattern)
+				}
+			}
+		}
+		if body, found := route["requestBody"]; found {
+			op.RequestBody = body.(*OpenAPIRequestBody)
+		}
+		if scope, found := route["scope"]; found && scope.(string) == AuthScopePublic {
+			op.Security = []map[string][]string{{}}
+		}
+		if streaming, _ := route["streaming"].(bool); streaming {
+			// streams also accept credentials browsers can set on EventSource and WebSocket requests
+			op.Security = []map[string][]string{{"bearerAuth": {}}, {"apiKeyAuth": {}}, {"queryTokenAuth": {}}, {"cookieTokenAuth": {}}}
+		}
+
+		successResp := &OpenAPIResponse{Description: "Success", Content: make(map[string]*OpenAPIMediaType)}
+		if respType, found := route["envelope"]; found {
+			envelopeSchema := builder.structSchema(reflect.TypeOf(APIv2Envelope{}))
+			envelopeSchema.Properties["data"] = builder.v2DataSchema(reflect.TypeOf(respType), route["dataFields"].([]string), route["unwrapData"].(bool))
+			successResp.Content["application/json"] = &OpenAPIMediaType{Schema: envelopeSchema}
+			op.Responses["default"].Content["application/json"].Schema = builder.schemaOf(reflect.TypeOf(APIv2Envelope{}))
+		} else if respType, found := route["response"]; found && respType != nil {
+			successResp.Content["application/json"] = &OpenAPIMediaType{Schema: builder.schemaOf(reflect.TypeOf(respType))}
+		} else if contentType, found := route["produces"]; found {
+			successResp.Content[contentType.(string)] = &OpenAPIMediaType{Schema: &OpenAPISchema{Type: "string"}}
+		} else {
+			successResp.Content["application/octet-stream"] = &OpenAPIMediaType{}
+		}
+		for _, param := range op.Parameters {
+			if param == formatParam || param == exportFormatParam {
+				successResp.Content["text/csv"] = &OpenAPIMediaType{Schema: &OpenAPISchema{Type: "string"}}
+			}
+			if param == exportFormatParam {
+				successResp.Content[usageNDJSONContentType] = &OpenAPIMediaType{Schema: &OpenAPISchema{Type: "string"}}
+				successResp.Content[usageParquetContentType] = &OpenAPIMediaType{Schema: &OpenAPISchema{Type: "string", Format: "binary"}}
+			}
+		}
+		op.Responses[strconv.Itoa(http.StatusOK)] = successResp
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*OpenAPIOperation)
+		}
+		doc.Paths[path][strings.ToLower(method)] = op
+	}
+	return doc
+}
+
+// runtimeFuncName returns the unqualified name of a function
+func runtimeFuncName(fn interface{}) string {
+	fullName := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	return fullName[strings.LastIndex(fullName, ".")+1:]
+}
+
+// operation returns the operation matching a route template and a HTTP method
+func (m *OpenAPIDocument) operation(pathTemplate string, method string) *OpenAPIOperation {
+	return m.Paths[pathTemplate][strings.ToLower(method)]
+}
+
+// resolve returns the component referenced by a schema, or the schema itself
+func (m *OpenAPIDocument) resolve(schema *OpenAPISchema) *OpenAPISchema {
+	for schema.Ref != "" {
+		schema = m.Components.Schemas[strings.TrimPrefix(schema.Ref, openAPIComponentsPrefix)]
+	}
+	return schema
+}
+
+// validateValue checks that a decoded JSON value matches a schema
+func (m *OpenAPIDocument) validateValue(schema *OpenAPISchema, value interface{}, path string) error {
+	schema = m.resolve(schema)
+	if value == nil {
+		if schema.Nullable || (schema.Type == "" && len(schema.AllOf) == 0) {
+			return nil
+		}
+		return fmt.Errorf("%s: unexpected null value", path)
+	}
+	for _, subSchema := range schema.AllOf {
+		if err := m.validateValue(subSchema, value, path); err != nil {
+			return err
+		}
+	}
+
+	switch schema.Type {
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean", path)
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s: expected a number", path)
+		}
+		if schema.Type == "integer" && number != math.Trunc(number) {
+			return fmt.Errorf("%s: expected an integer", path)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string", path)
+		}
+		return validateStringValue(schema, str, path)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array", path)
+		}
+		if (schema.MinItems != nil && len(items) < *schema.MinItems) || (schema.MaxItems != nil && len(items) > *schema.MaxItems) {
+			return fmt.Errorf("%s: unexpected number of items (%d)", path, len(items))
+		}
+		for i, item := range items {
+			if err := m.validateValue(schema.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object", path)
+		}
+		for _, name := range schema.Required {
+			if _, found := object[name]; !found {
+				return fmt.Errorf("%s: missing required property '%s'", path, name)
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propSchema, found := schema.Properties[name]
+			if !found {
+				additional, isSchema := schema.AdditionalProperties.(*OpenAPISchema)
+				if !isSchema {
+					return fmt.Errorf("%s: undeclared property '%s'", path, name)
+				}
+				propSchema = additional
+			}
+			if err := m.validateValue(propSchema, object[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateStringValue checks a string against the enum, pattern and format of a schema.
+// Enum values are matched case-insensitively, as handlers do
+func validateStringValue(schema *OpenAPISchema, value string, path string) error {
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			found = found || strings.EqualFold(allowed, value)
+		}
+		if !found {
+			return fmt.Errorf("invalid value '%s' for %s. Valid values are: '%s'", value, path, strings.Join(schema.Enum, "', '"))
+		}
+	}
+	if schema.patternRegexp != nil && !schema.patternRegexp.MatchString(value) {
+		return fmt.Errorf("invalid value '%s' for %s. Expected pattern: %s", value, path, schema.Pattern)
+	}
+	if schema.Format == "date-time" {
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("invalid value '%s' for %s. Expected a RFC 3339 date", value, path)
+		}
+	}
+	return nil
+}
+
+// validateParameter checks the raw value of a request parameter against its schema
+func validateParameter(param *OpenAPIParameter, value string) error {
+	path := fmt.Sprintf("%s parameter '%s'", param.In, param.Name)
+	switch param.Schema.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("invalid value '%s' for %s. Expected an integer", value, path)
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("invalid value '%s' for %s. Expected a number", value, path)
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid value '%s' for %s. Expected a boolean", value, path)
+		}
+	case "string":
+		return validateStringValue(param.Schema, value, path)
+	}
+	return nil
+}
+
+// requestParameterError describes an invalid request parameter
+type requestParameterError struct {
+	In   string
+	Name string
+	Err  error
+}
+
+func (m *requestParameterError) Error() string {
+	return m.Err.Error()
+}
+
+// validateRequest checks the parameters and the body content type of a request against an operation
+func validateRequest(op *OpenAPIOperation, req *http.Request) error {
+	query := req.URL.Query()
+	vars := mux.Vars(req)
+	for _, param := range op.Parameters {
+		var value string
+		var found bool
+		switch param.In {
+		case "query":
+			_, found = query[param.Name]
+			value = query.Get(param.Name)
+		case "header":
+			value = req.Header.Get(param.Name)
+			found = value != ""
+		case "path":
+			value, found = vars[param.Name]
+		}
+		if !found {
+			if param.Required {
+				return &requestParameterError{In: param.In, Name: param.Name,
+					Err: fmt.Errorf("missing %s parameter '%s'", param.In, param.Name)}
+			}
+			continue
+		}
+		if err := validateParameter(param, value); err != nil {
+			return &requestParameterError{In: param.In, Name: param.Name, Err: err}
+		}
+	}
+
+	if op.RequestBody != nil && op.RequestBody.Required {
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if _, supported := op.RequestBody.Content[mediaType]; err != nil || !supported {
+			return &requestParameterError{In: "header", Name: "Content-Type",
+				Err: fmt.Errorf("unsupported content type '%s'", req.Header.Get("Content-Type"))}
+		}
+	}
+	return nil
+}
+
+// newRequestValidationMiddleware rejects requests whose parameters do not match the OpenAPI document
+func newRequestValidationMiddleware(doc *OpenAPIDocument) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			route := mux.CurrentRoute(req)
+			if route == nil || req.Method == http.MethodOptions {
+				next.ServeHTTP(w, req)
+				return
+			}
+			tpl, err := route.GetPathTemplate()
+			if err != nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			op := doc.operation(tpl, req.Method)
+			if op == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if err := validateRequest(op, req); err != nil {
+				log.WithError(err).WithField("route", tpl).Warnln("Bad request")
+				if isAPIv2Request(req) {
+					writeV2ParameterError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				apiResp, _ := json.Marshal(&ErrorResp{Status: "error", Message: err.Error()})
+				_, _ = w.Write(apiResp)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// GetOpenAPIHandler returns the OpenAPI document of the API
+func GetOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	apiResp, _ := json.Marshal(apiSpec)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(apiResp)
+}
@@ -0,0 +1,260 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// handlerParameters scans the package sources and returns, per handler function, the query, header
+// and path parameters it reads
+func handlerParameters() (map[string]map[string]string, error) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]string)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				funcDecl, ok := decl.(*ast.FuncDecl)
+				if !ok || funcDecl.Body == nil {
+					continue
+				}
+				params := make(map[string]string)
+				ast.Inspect(funcDecl.Body, func(n ast.Node) bool {
+					switch node := n.(type) {
+					case *ast.CallExpr:
+						sel, ok := node.Fun.(*ast.SelectorExpr)
+						if !ok || sel.Sel.Name != "Get" || len(node.Args) != 1 {
+							return true
+						}
+						lit, ok := node.Args[0].(*ast.BasicLit)
+						if !ok || lit.Kind != token.STRING {
+							return true
+						}
+						name, _ := strconv.Unquote(lit.Value)
+						if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == "queryParams" {
+							params[name] = "query"
+						} else if inner, ok := sel.X.(*ast.SelectorExpr); ok && inner.Sel.Name == "Header" {
+							params[name] = "header"
+						}
+					case *ast.IndexExpr:
+						ident, ok := node.X.(*ast.Ident)
+						lit, isLit := node.Index.(*ast.BasicLit)
+						if ok && isLit && ident.Name == "params" {
+							name, _ := strconv.Unquote(lit.Value)
+							params[name] = "path"
+						}
+					}
+					return true
+				})
+				result[funcDecl.Name.Name] = params
+			}
+		}
+	}
+	return result, nil
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	Convey("Given the OpenAPI document of the API routes", t, func() {
+		doc := newOpenAPIDocument(routes)
+
+		Convey("Then every route is documented with its response", func() {
+			for tpl, route := range routes {
+				op := doc.operation(getRoutePath(tpl, route), route["method"].(string))
+				So(op, ShouldNotBeNil)
+				So(op.Responses["200"], ShouldNotBeNil)
+				So(op.Responses["default"], ShouldNotBeNil)
+			}
+		})
+
+		Convey("Then every parameter read by a handler is declared", func() {
+			handlersParams, err := handlerParameters()
+			So(err, ShouldBeNil)
+			for tpl, route := range routes {
+				op := doc.operation(getRoutePath(tpl, route), route["method"].(string))
+				declared := make(map[string]string)
+				for _, param := range op.Parameters {
+					declared[param.Name] = param.In
+				}
+				handler := route["handler"]
+				if legacyHandler, isV2 := route["legacyHandler"]; isV2 {
+					handler = legacyHandler
+				}
+				handlerName := runtimeFuncName(handler)
+				So(handlersParams, ShouldContainKey, handlerName)
+				for name, in := range handlersParams[handlerName] {
+					if _, isV2 := route["legacyHandler"]; isV2 && name == "format" {
+						// v2 routes only serve JSON
+						continue
+					}
+					So(tpl+" "+in+" "+name, ShouldEqual, tpl+" "+declared[name]+" "+name)
+				}
+				for _, match := range regexp.MustCompile(`{([^}]+)}`).FindAllStringSubmatch(tpl, -1) {
+					So(tpl+" path "+match[1], ShouldEqual, tpl+" "+declared[match[1]]+" "+match[1])
+				}
+			}
+		})
+
+		Convey("Then the response schemas are generated from the response types", func() {
+			schema := doc.resolve(doc.operation("/api/usagehistory", "GET").Responses["200"].Content["application/json"].Schema)
+			So(schema.Properties, ShouldContainKey, "usageHistory")
+			So(doc.Components.Schemas, ShouldContainKey, "UsageHistory")
+			So(doc.Components.Schemas, ShouldContainKey, "ResourceUsageItem")
+			So(doc.Components.Schemas["ResourceUsageItem"].Properties["dateUTC"].Format, ShouldEqual, "date-time")
+			So(doc.Components.Schemas["ResourceUsageItem"].Required, ShouldResemble, []string{"dateUTC", "value"})
+			So(doc.operation("/api/usagehistory", "GET").Responses["200"].Content, ShouldContainKey, "text/csv")
+		})
+
+		Convey("Then values that drift from a schema are rejected", func() {
+			itemSchema := &OpenAPISchema{Ref: openAPIComponentsPrefix + "ResourceUsageItem"}
+			So(doc.validateValue(itemSchema, map[string]interface{}{"dateUTC": "2020-06-01T10:00:00Z", "value": 12.5}, "item"), ShouldBeNil)
+			So(doc.validateValue(itemSchema, map[string]interface{}{"dateUTC": "2020-06-01T10:00:00Z"}, "item"), ShouldNotBeNil)
+			So(doc.validateValue(itemSchema, map[string]interface{}{"dateUTC": "yesterday", "value": 1.0}, "item"), ShouldNotBeNil)
+			So(doc.validateValue(itemSchema, map[string]interface{}{"dateUTC": "2020-06-01T10:00:00Z", "value": "1"}, "item"), ShouldNotBeNil)
+			So(doc.validateValue(itemSchema, map[string]interface{}{"dateUTC": "2020-06-01T10:00:00Z", "value": 1.0, "unit": "%"}, "item"), ShouldNotBeNil)
+		})
+
+		Convey("Then parameter patterns are compiled once and enforced", func() {
+			So(stepParam.Schema.patternRegexp, ShouldNotBeNil)
+			So(validateParameter(stepParam, "1h30m"), ShouldBeNil)
+			So(validateParameter(stepParam, "7x"), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestOpenAPIRequestsAndResponses(t *testing.T) {
+	Convey("Given an API router and consolidated data", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_run_dir", tempDir)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+
+		nowUTC := time.Now().UTC()
+		currentUsage, _ := json.Marshal([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 42, MemUsed: 27}})
+		So(ioutil.WriteFile(getCurrentClusterUsagePath(), currentUsage, 0644), ShouldBeNil)
+		budgets, _ := json.Marshal([]*BudgetStatus{{Name: "prod-cpu", Cluster: "prod", Metric: BudgetMetricCPU,
+			Limit: 1000, Consumed: 200, Status: BudgetStatusOk, PeriodStartUTC: nowUTC, PeriodEndUTC: nowUTC, UpdatedUTC: nowUTC}})
+		So(ioutil.WriteFile(getBudgetsStatusPath(), budgets, 0644), ShouldBeNil)
+		So(saveAnomalies([]*Anomaly{{StartDateUTC: nowUTC, EndDateUTC: nowUTC, Detections: 1, Cluster: "prod", Kind: AnomalyKindNamespace, Name: "payments",
+			Resource: "cpu", Value: 80, Baseline: 20, Deviation: 2, Score: 20, Severity: AnomalySeverityCritical}}, nowUTC), ShouldBeNil)
+
+		useTestAdminAPIKey(c, tempDir)
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(method string, target string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, nil)
+			req.Header.Set("X-API-Key", testAdminAPIKey)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			return resp
+		}
+		checkResponse := func(tpl string, resp *httptest.ResponseRecorder) error {
+			op := apiSpec.operation(tpl, "GET")
+			content := op.Responses[strconv.Itoa(resp.Code)]
+			if content == nil {
+				content = op.Responses["default"]
+			}
+			var payload interface{}
+			if err := json.Unmarshal(resp.Body.Bytes(), &payload); err != nil {
+				return err
+			}
+			return apiSpec.validateValue(content.Content["application/json"].Schema, payload, "response")
+		}
+
+		Convey("When querying routes backed by consolidated data", func() {
+			Convey("Then the responses match the documented schemas", func() {
+				for _, tpl := range []string{"/api/currentusage", "/api/budgets", "/api/anomalies"} {
+					resp := serve("GET", tpl)
+					So(resp.Code, ShouldEqual, http.StatusOK)
+					So(checkResponse(tpl, resp), ShouldBeNil)
+				}
+			})
+		})
+
+		Convey("When requests do not match the documented parameters", func() {
+			Convey("Then they are rejected with a documented error", func() {
+				for target, tpl := range map[string]string{
+					"/api/usagehistory?format=xml":             "/api/usagehistory",
+					"/api/usagehistory?period=weekly":          "/api/usagehistory",
+					"/api/anomalies?startDateUTC=yesterday":    "/api/anomalies",
+					"/api/forecast":                            "/api/forecast",
+					"/api/forecast?cluster=prod&threshold=lot": "/api/forecast",
+					"/api/heatmap?cluster=prod&format=pdf":     "/api/heatmap",
+				} {
+					resp := serve("GET", target)
+					So(target+" => "+strconv.Itoa(resp.Code), ShouldEqual, target+" => 400")
+					So(checkResponse(tpl, resp), ShouldBeNil)
+				}
+				So(serve("POST", "/api/kubeconfig").Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Convey("When valid requests are sent", func() {
+			resp := serve("GET", "/api/anomalies?kind=NAMESPACE&startDateUTC=2020-06-01T00:00:00")
+
+			Convey("Then they reach the handler", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(checkResponse("/api/anomalies", resp), ShouldBeNil)
+			})
+		})
+
+		Convey("When the OpenAPI document is requested", func() {
+			resp := serve("GET", "/api/openapi.json")
+			served := &OpenAPIDocument{}
+			err := json.Unmarshal(resp.Body.Bytes(), served)
+
+			Convey("Then it describes all the routes", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(err, ShouldBeNil)
+				So(served.OpenAPI, ShouldStartWith, "3.0")
+				operations := 0
+				for _, pathOperations := range served.Paths {
+					operations += len(pathOperations)
+				}
+				So(operations, ShouldEqual, len(routes))
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(path.Clean(tempDir))
+		})
+	})
+}
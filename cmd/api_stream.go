@@ -0,0 +1,395 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	StreamEventUsage     = "usage"
+	StreamEventHeartbeat = "heartbeat"
+
+	// streamSubscriberBuffer is the number of events kept for a subscriber that doesn't read fast enough.
+	// Beyond that, the subscriber is disconnected and expected to reconnect and resume
+	streamSubscriberBuffer = 64
+	// streamReconnectDelay is the reconnection delay advertised to Server-Sent Events clients
+	streamReconnectDelay = 5 * time.Second
+	// streamWriteTimeout is the maximum time to write an event to a WebSocket
+	streamWriteTimeout = 10 * time.Second
+)
+
+// UsageStreamEvent holds an update of the usage of a cluster pushed to stream subscribers
+type UsageStreamEvent struct {
+	ID      string           `json:"id,omitempty"`
+	Type    string           `json:"type"`
+	DateUTC time.Time        `json:"dateUTC"`
+	Usage   *K8sClusterUsage `json:"usage,omitempty"`
+}
+
+// usageStreamHub tracks the current usage of clusters and pushes the updated records to subscribers.
+// Recent events are kept so that subscribers can resume after a reconnection
+type usageStreamHub struct {
+	historySize int
+	mu          sync.Mutex
+	lastID      uint64
+	current     map[string]*K8sClusterUsage
+	history     []*UsageStreamEvent
+	subscribers map[chan *UsageStreamEvent]bool
+}
+
+// apiUsageStream is the hub serving the usage stream endpoints
+var apiUsageStream = newUsageStreamHub(256)
+
+// newUsageStreamHub creates a hub keeping the given number of events for resumption. Event ids start from
+// the creation time, so that they keep increasing across restarts of the API
+func newUsageStreamHub(historySize int) *usageStreamHub {
+	return &usageStreamHub{
+		historySize: historySize,
+		lastID:      uint64(time.Now().UnixNano()),
+		current:     make(map[string]*K8sClusterUsage),
+		subscribers: make(map[chan *UsageStreamEvent]bool),
+	}
+}
+
+// publish records the usage of clusters and pushes an event for each record that has changed.
+// Subscribers that can't keep up are disconnected
+func (m *usageStreamHub) publish(currentUsage []*K8sClusterUsage, dateUTC time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, clusterUsage := range currentUsage {
+		if previous, found := m.current[clusterUsage.ClusterName]; found && *previous == *clusterUsage {
+			continue
+		}
+		m.current[clusterUsage.ClusterName] = clusterUsage
+		m.lastID++
+		event := &UsageStreamEvent{
+			ID:      strconv.FormatUint(m.lastID, 10),
+			Type:    StreamEventUsage,
+			DateUTC: dateUTC,
+			Usage:   clusterUsage,
+		}
+		m.history = append(m.history, event)
+		if len(m.history) > m.historySize {
+			m.history = m.history[len(m.history)-m.historySize:]
+		}
+		for ch := range m.subscribers {
+			select {
+			case ch <- event:
+			default:
+				log.Warnln("disconnecting a slow usage stream subscriber")
+				delete(m.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns the events it has to receive first. These are the events
+// following lastEventID when they are still known, or else a snapshot of the current usage of all clusters
+func (m *usageStreamHub) subscribe(lastEventID string) (chan *UsageStreamEvent, []*UsageStreamEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan *UsageStreamEvent, streamSubscriberBuffer)
+	m.subscribers[ch] = true
+
+	if resumeID, err := strconv.ParseUint(lastEventID, 10, 64); err == nil && resumeID <= m.lastID {
+		firstKnownID := m.lastID + 1
+		if len(m.history) > 0 {
+			firstKnownID, _ = strconv.ParseUint(m.history[0].ID, 10, 64)
+		}
+		if resumeID+1 >= firstKnownID {
+			var backlog []*UsageStreamEvent
+			for _, event := range m.history {
+				if eventID, _ := strconv.ParseUint(event.ID, 10, 64); eventID > resumeID {
+					backlog = append(backlog, event)
+				}
+			}
+			return ch, backlog
+		}
+	}
+
+	clusterNames := make([]string, 0, len(m.current))
+	for clusterName := range m.current {
+		clusterNames = append(clusterNames, clusterName)
+	}
+	sort.Strings(clusterNames)
+	snapshot := make([]*UsageStreamEvent, 0, len(clusterNames))
+	for _, clusterName := range clusterNames {
+		snapshot = append(snapshot, &UsageStreamEvent{
+			ID:      strconv.FormatUint(m.lastID, 10),
+			Type:    StreamEventUsage,
+			DateUTC: time.Now().UTC(),
+			Usage:   m.current[clusterName],
+		})
+	}
+	return ch, snapshot
+}
+
+// unsubscribe removes a subscriber, unless it has already been disconnected
+func (m *usageStreamHub) unsubscribe(ch chan *UsageStreamEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subscribers[ch] {
+		delete(m.subscribers, ch)
+		close(ch)
+	}
+}
+
+// reload publishes the usage recorded in the current usage file
+func (m *usageStreamHub) reload() {
+	currentUsage, err := loadCurrentUsage()
+	if err != nil {
+		log.WithError(err).Debugln("failed reading current usage file")
+		return
+	}
+	m.publish(currentUsage, time.Now().UTC())
+}
+
+// watch publishes the usage of clusters each time the consolidator updates the current usage file, until
+// the stop channel is closed
+func (m *usageStreamHub) watch(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "failed creating file watcher")
+	}
+	defer watcher.Close()
+
+	currentUsageFile := filepath.Clean(getCurrentClusterUsagePath())
+	runDir := filepath.Dir(currentUsageFile)
+	if err = createDirIfNotExists(runDir); err != nil {
+		return errors.Wrap(err, "failed creating run directory")
+	}
+	// the directory is watched since the file is replaced on each consolidation
+	if err = watcher.Add(runDir); err != nil {
+		return errors.Wrap(err, "failed watching run directory")
+	}
+	m.reload()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == currentUsageFile && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+				m.reload()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.WithError(err).Errorln("failed watching current usage file")
+		}
+	}
+}
+
+// usageStreamFilter returns a function telling whether an event can be sent to the caller of a request,
+// according to the clusters it has access to and the optional 'cluster' parameter, a comma-separated list
+func usageStreamFilter(req *http.Request) func(event *UsageStreamEvent) bool {
+	selectedClusters := make(map[string]bool)
+	for _, value := range req.URL.Query()["cluster"] {
+		for _, cluster := range strings.Split(value, ",") {
+			if cluster = strings.TrimSpace(cluster); cluster != "" {
+				selectedClusters[cluster] = true
+			}
+		}
+	}
+	return func(event *UsageStreamEvent) bool {
+		if event.Usage == nil {
+			return true
+		}
+		if len(selectedClusters) > 0 && !selectedClusters[event.Usage.ClusterName] {
+			return false
+		}
+		return isClusterAllowed(req, event.Usage.ClusterName)
+	}
+}
+
+// streamLastEventID returns the id of the last event received by a reconnecting client, set by
+// EventSource clients in the Last-Event-ID header or by others in the 'lastEventId' parameter
+func streamLastEventID(req *http.Request) string {
+	if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+		return lastEventID
+	}
+	return req.URL.Query().Get("lastEventId")
+}
+
+// writeSSEEvent writes an event in the Server-Sent Events format
+func writeSSEEvent(w io.Writer, event *UsageStreamEvent) error {
+	data, _ := json.Marshal(event.Usage)
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// StreamUsageHandler pushes the updated usage of clusters as Server-Sent Events, with periodic heartbeats
+func StreamUsageHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		b, _ := json.Marshal(&ErrorResp{Status: "error", Message: "streaming is not supported"})
+		http.Error(w, string(b), http.StatusInternalServerError)
+		return
+	}
+
+	isAllowed := usageStreamFilter(req)
+	ch, backlog := apiUsageStream.subscribe(streamLastEventID(req))
+	defer apiUsageStream.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "retry: %d\n\n", streamReconnectDelay.Milliseconds())
+	for _, event := range backlog {
+		if isAllowed(event) {
+			_ = writeSSEEvent(w, event)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(viper.GetDuration("krossboard_stream_heartbeat_interval"))
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !isAllowed(event) {
+				continue
+			}
+			if err := writeSSEEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": %s %s\n\n", StreamEventHeartbeat, time.Now().UTC().Format(time.RFC3339)); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// checkStreamOrigin accepts WebSocket connections from the origins allowed by krossboard_cors_origins
+func checkStreamOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range strings.Fields(viper.GetString("krossboard_cors_origins")) {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	originURL, err := url.Parse(origin)
+	return err == nil && originURL.Host == req.Host
+}
+
+var usageStreamUpgrader = websocket.Upgrader{CheckOrigin: checkStreamOrigin}
+
+// StreamUsageWebSocketHandler pushes the updated usage of clusters as JSON messages over a WebSocket,
+// with periodic ping frames and heartbeat messages
+func StreamUsageWebSocketHandler(w http.ResponseWriter, req *http.Request) {
+	conn, err := usageStreamUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		log.WithError(err).Warnln("failed upgrading usage stream connection")
+		return
+	}
+	defer conn.Close()
+
+	isAllowed := usageStreamFilter(req)
+	ch, backlog := apiUsageStream.subscribe(streamLastEventID(req))
+	defer apiUsageStream.unsubscribe(ch)
+
+	heartbeatInterval := viper.GetDuration("krossboard_stream_heartbeat_interval")
+	closed := make(chan struct{})
+	go func() {
+		// reading is required to process control frames, clients are not expected to send messages
+		defer close(closed)
+		_ = conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	writeEvent := func(event *UsageStreamEvent) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(event)
+	}
+	for _, event := range backlog {
+		if isAllowed(event) {
+			if err := writeEvent(event); err != nil {
+				return
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case event, ok := <-ch:
+			if !ok {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber too slow"), time.Now().Add(streamWriteTimeout))
+				return
+			}
+			if isAllowed(event) {
+				if err := writeEvent(event); err != nil {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+			if err := writeEvent(&UsageStreamEvent{Type: StreamEventHeartbeat, DateUTC: time.Now().UTC()}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestUsageStreamHub(t *testing.T) {
+	Convey("Given a usage stream hub keeping two events and knowing two clusters", t, func() {
+		hub := newUsageStreamHub(2)
+		hub.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 10}, {ClusterName: "staging", CPUUsed: 20}}, time.Now())
+
+		Convey("When a client subscribes without last event id", func() {
+			_, backlog := hub.subscribe("")
+
+			Convey("Then it first receives a snapshot of all clusters", func() {
+				So(backlog, ShouldHaveLength, 2)
+				So(backlog[0].Usage.ClusterName, ShouldEqual, "prod")
+				So(backlog[1].Usage.ClusterName, ShouldEqual, "staging")
+			})
+		})
+
+		Convey("When a consolidation only changes one cluster", func() {
+			ch, _ := hub.subscribe("")
+			hub.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 10}, {ClusterName: "staging", CPUUsed: 25}}, time.Now())
+
+			Convey("Then only the changed record is pushed", func() {
+				So(ch, ShouldHaveLength, 1)
+				event := <-ch
+				So(event.Usage.ClusterName, ShouldEqual, "staging")
+				So(event.Usage.CPUUsed, ShouldEqual, 25)
+			})
+		})
+
+		Convey("When a client resumes from a known event", func() {
+			resumeID := hub.history[0].ID
+			hub.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 15}}, time.Now())
+			_, backlog := hub.subscribe(resumeID)
+
+			Convey("Then it receives the events it missed", func() {
+				So(backlog, ShouldHaveLength, 2)
+				So(backlog[0].Usage.ClusterName, ShouldEqual, "staging")
+				So(backlog[1].Usage.CPUUsed, ShouldEqual, 15)
+			})
+		})
+
+		Convey("When a client resumes from an event that is no longer kept", func() {
+			resumeID := hub.history[0].ID
+			hub.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 15}}, time.Now())
+			hub.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 18}}, time.Now())
+			_, backlog := hub.subscribe(resumeID)
+
+			Convey("Then it receives a snapshot", func() {
+				So(backlog, ShouldHaveLength, 2)
+				So(backlog[0].Usage.CPUUsed, ShouldEqual, 18)
+				So(backlog[0].ID, ShouldEqual, hub.history[1].ID)
+			})
+		})
+
+		Convey("When a subscriber doesn't read its events", func() {
+			ch, _ := hub.subscribe("")
+			for i := 0; i <= streamSubscriberBuffer; i++ {
+				hub.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: float64(i)}}, time.Now())
+			}
+
+			Convey("Then it's disconnected", func() {
+				So(hub.subscribers, ShouldNotContainKey, ch)
+				for range ch {
+				}
+				hub.unsubscribe(ch)
+			})
+		})
+	})
+}
+
+func TestUsageStreamEndpoints(t *testing.T) {
+	Convey("Given an API server streaming the usage of two clusters", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_run_dir", tempDir)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		viper.Set("krossboard_stream_heartbeat_interval", "100ms")
+		apiAccessPolicy = nil
+		origHub := apiUsageStream
+		apiUsageStream = newUsageStreamHub(16)
+		apiUsageStream.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 10}, {ClusterName: "staging", CPUUsed: 20}}, time.Now())
+
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		server := httptest.NewServer(router)
+
+		// waitSubscribers waits for the given number of subscribers, so that published events are not missed
+		waitSubscribers := func(count int) {
+			for i := 0; i < 100; i++ {
+				apiUsageStream.mu.Lock()
+				subscribed := len(apiUsageStream.subscribers)
+				apiUsageStream.mu.Unlock()
+				if subscribed >= count {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		openSSE := func(query string, lastEventID string) (*http.Response, *bufio.Reader) {
+			req, _ := http.NewRequest("GET", server.URL+"/api/stream/usage"+query, nil)
+			if lastEventID != "" {
+				req.Header.Set("Last-Event-ID", lastEventID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			c.So(err, ShouldBeNil)
+			return resp, bufio.NewReader(resp.Body)
+		}
+		// readSSE reads the next event of the stream, or the next heartbeat when heartbeat is set
+		readSSE := func(reader *bufio.Reader, heartbeat bool) string {
+			var lines []string
+			for {
+				line, err := reader.ReadString('\n')
+				c.So(err, ShouldBeNil)
+				line = strings.TrimSuffix(line, "\n")
+				if line != "" {
+					lines = append(lines, line)
+					continue
+				}
+				if len(lines) > 0 && strings.HasPrefix(lines[0], ": heartbeat") == heartbeat && !strings.HasPrefix(lines[0], "retry:") {
+					return strings.Join(lines, "\n")
+				}
+				lines = nil
+			}
+		}
+
+		Convey("When a client follows one cluster with Server-Sent Events", func() {
+			resp, reader := openSSE("?cluster=staging", "")
+			defer resp.Body.Close()
+			snapshot := readSSE(reader, false)
+			waitSubscribers(1)
+			apiUsageStream.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 12}, {ClusterName: "staging", CPUUsed: 22}}, time.Now())
+			update := readSSE(reader, false)
+			heartbeat := readSSE(reader, true)
+
+			Convey("Then it receives the snapshot, the updates and heartbeats of this cluster only", func() {
+				So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+				So(snapshot, ShouldContainSubstring, "event: usage\n")
+				So(snapshot, ShouldContainSubstring, `"clusterName":"staging","cpuUsed":20`)
+				So(update, ShouldContainSubstring, `"clusterName":"staging","cpuUsed":22`)
+				So(update, ShouldStartWith, "id: "+apiUsageStream.history[len(apiUsageStream.history)-1].ID)
+				So(heartbeat, ShouldStartWith, ": heartbeat")
+			})
+		})
+
+		Convey("When a client reconnects with the id of the last event it received", func() {
+			lastEventID := apiUsageStream.history[len(apiUsageStream.history)-1].ID
+			apiUsageStream.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 14}}, time.Now())
+			resp, reader := openSSE("", lastEventID)
+			defer resp.Body.Close()
+
+			Convey("Then it only receives the missed event", func() {
+				So(readSSE(reader, false), ShouldContainSubstring, `"clusterName":"prod","cpuUsed":14`)
+				So(readSSE(reader, true), ShouldStartWith, ": heartbeat")
+			})
+		})
+
+		Convey("When a client follows all clusters over a WebSocket", func() {
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/stream/usage/ws", nil)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			// readEvent reads the next message of the given type
+			readEvent := func(eventType string) *UsageStreamEvent {
+				for {
+					event := &UsageStreamEvent{}
+					c.So(conn.SetReadDeadline(time.Now().Add(5*time.Second)), ShouldBeNil)
+					c.So(conn.ReadJSON(event), ShouldBeNil)
+					if event.Type == eventType {
+						return event
+					}
+				}
+			}
+			first, second := readEvent(StreamEventUsage), readEvent(StreamEventUsage)
+			waitSubscribers(1)
+			apiUsageStream.publish([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 16}}, time.Now())
+			update := readEvent(StreamEventUsage)
+			heartbeat := readEvent(StreamEventHeartbeat)
+
+			Convey("Then it receives JSON messages for the snapshot, the updates and heartbeats", func() {
+				So(first.Usage.ClusterName, ShouldEqual, "prod")
+				So(second.Usage.ClusterName, ShouldEqual, "staging")
+				So(update.Type, ShouldEqual, StreamEventUsage)
+				So(update.Usage.CPUUsed, ShouldEqual, 16)
+				So(heartbeat.Type, ShouldEqual, StreamEventHeartbeat)
+			})
+		})
+
+		Convey("When the API is authenticated", func() {
+			useTestAdminAPIKey(c, tempDir)
+			authRouter, err := newAPIRouter()
+			So(err, ShouldBeNil)
+			authServer := httptest.NewServer(authRouter)
+			defer authServer.Close()
+			defer authServer.CloseClientConnections()
+			// get returns the status of a request, closing its body
+			get := func(path string, cookie *http.Cookie) int {
+				req, _ := http.NewRequest("GET", authServer.URL+path, nil)
+				if cookie != nil {
+					req.AddCookie(cookie)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				c.So(err, ShouldBeNil)
+				defer resp.Body.Close()
+				return resp.StatusCode
+			}
+
+			Convey("Then streams accept the token from the query or a cookie", func() {
+				So(get("/api/stream/usage", nil), ShouldEqual, http.StatusUnauthorized)
+				So(get("/api/stream/usage?access_token=wrong", nil), ShouldEqual, http.StatusUnauthorized)
+				So(get("/api/stream/usage?access_token="+testAdminAPIKey, nil), ShouldEqual, http.StatusOK)
+				So(get("/api/stream/usage", &http.Cookie{Name: StreamTokenCookie, Value: testAdminAPIKey}), ShouldEqual, http.StatusOK)
+				conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(authServer.URL, "http")+"/api/stream/usage/ws?access_token="+testAdminAPIKey, nil)
+				So(err, ShouldBeNil)
+				conn.Close()
+				_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(authServer.URL, "http")+"/api/stream/usage/ws", nil)
+				So(err, ShouldNotBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("Then other routes ignore the token from the query or a cookie", func() {
+				So(get("/api/currentusage?access_token="+testAdminAPIKey, nil), ShouldEqual, http.StatusUnauthorized)
+				So(get("/api/currentusage", &http.Cookie{Name: StreamTokenCookie, Value: testAdminAPIKey}), ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+
+		Convey("When the consolidator replaces the current usage file", func() {
+			stop := make(chan struct{})
+			defer close(stop)
+			ch, _ := apiUsageStream.subscribe("")
+			defer apiUsageStream.unsubscribe(ch)
+			go func() { _ = apiUsageStream.watch(stop) }()
+			time.Sleep(100 * time.Millisecond)
+			data, _ := json.Marshal([]*K8sClusterUsage{{ClusterName: "prod", CPUUsed: 10}, {ClusterName: "staging", CPUUsed: 30}})
+			So(writeFileAtomically(getCurrentClusterUsagePath(), data, 0644), ShouldBeNil)
+
+			Convey("Then the updated record is pushed", func() {
+				var event *UsageStreamEvent
+				select {
+				case event = <-ch:
+				case <-time.After(5 * time.Second):
+				}
+				So(event, ShouldNotBeNil)
+				So(event.Usage.ClusterName, ShouldEqual, "staging")
+				So(event.Usage.CPUUsed, ShouldEqual, 30)
+			})
+		})
+
+		Reset(func() {
+			server.CloseClientConnections()
+			server.Close()
+			apiUsageStream = origHub
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxQueryPoints is the maximum number of samples per series that a step can request, as in Prometheus
+const maxQueryPoints = 11000
+
+// queryDateFormats describes the accepted formats of dates, for error messages
+const queryDateFormats = "a date formatted as 2006-01-02T15:04:05 or 2006-01-02, a RFC 3339 date, a Unix timestamp " +
+	"in seconds, or a date relative to now such as -7d or now-1h"
+
+var (
+	queryDurationRegexp     = regexp.MustCompile(`^(\d+[smhdw])+$`)
+	queryDurationPartRegexp = regexp.MustCompile(`(\d+)([smhdw])`)
+	queryEpochRegexp        = regexp.MustCompile(`^\d+$`)
+
+	queryDurationUnits = map[string]time.Duration{
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+)
+
+// queryTimeRange holds the period and the resolution requested by a query. Step is zero when the
+// resolution is left to the handler
+type queryTimeRange struct {
+	StartDateUTC time.Time
+	EndDateUTC   time.Time
+	Step         time.Duration
+	Location     *time.Location
+}
+
+// parseQueryDuration parses a duration made of counts of seconds, minutes, hours, days or weeks (e.g. 90s, 1h30m, 7d)
+func parseQueryDuration(value string) (time.Duration, error) {
+	if !queryDurationRegexp.MatchString(value) {
+		return 0, fmt.Errorf("'%s' is not a duration such as 5m, 1h30m or 7d", value)
+	}
+	var duration time.Duration
+	for _, part := range queryDurationPartRegexp.FindAllStringSubmatch(value, -1) {
+		count, err := strconv.ParseInt(part[1], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("duration '%s' is out of range", value)
+		}
+		duration += time.Duration(count) * queryDurationUnits[part[2]]
+	}
+	return duration, nil
+}
+
+// parseQueryTime parses an absolute, epoch or relative date. Absolute dates without offset are in the given location
+func parseQueryTime(value string, now time.Time, loc *time.Location) (time.Time, error) {
+	relative := value
+	if strings.HasPrefix(relative, "now") {
+		relative = strings.TrimPrefix(relative, "now")
+		if relative == "" {
+			return now, nil
+		}
+		if !strings.HasPrefix(relative, "+") && !strings.HasPrefix(relative, "-") {
+			return time.Time{}, fmt.Errorf("'%s' is not %s", value, queryDateFormats)
+		}
+	}
+	if strings.HasPrefix(relative, "+") || strings.HasPrefix(relative, "-") {
+		offset, err := parseQueryDuration(relative[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("'%s' is not %s", value, queryDateFormats)
+		}
+		if relative[0] == '-' {
+			offset = -offset
+		}
+		return now.Add(offset), nil
+	}
+
+	if queryEpochRegexp.MatchString(value) {
+		epoch, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("timestamp '%s' is out of range", value)
+		}
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date.UTC(), nil
+	}
+	for _, layout := range []string{queryTimeLayout, "2006-01-02"} {
+		if date, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return date.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not %s", value, queryDateFormats)
+}
+
+// parseQueryLocation returns the time zone set by the tz parameter of a query, UTC by default
+func parseQueryLocation(query url.Values) (*time.Location, error) {
+	value := query.Get("tz")
+	if value == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(value)
+	if err != nil {
+		return nil, &requestParameterError{In: "query", Name: "tz",
+			Err: fmt.Errorf("invalid value '%s' for query parameter 'tz'. Expected a time zone name such as UTC or Europe/Paris", value)}
+	}
+	return loc, nil
+}
+
+// parseQueryDate parses a date parameter of a query, returning the zero time when it's not set
+func parseQueryDate(query url.Values, name string, now time.Time, loc *time.Location) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, err := parseQueryTime(value, now, loc)
+	if err != nil {
+		return time.Time{}, &requestParameterError{In: "query", Name: name,
+			Err: fmt.Errorf("invalid value for query parameter '%s': %v", name, err)}
+	}
+	return date, nil
+}
+
+// parseQueryStep parses the step parameter of a query, as a duration or a number of seconds. Steps are multiples
+// of the storage step and can't request more than maxQueryPoints samples over the period
+func parseQueryStep(query url.Values, startDateUTC time.Time, endDateUTC time.Time) (time.Duration, error) {
+	value := query.Get("step")
+	if value == "" {
+		return 0, nil
+	}
+	stepError := func(format string, args ...interface{}) error {
+		return &requestParameterError{In: "query", Name: "step",
+			Err: fmt.Errorf("invalid value '%s' for query parameter 'step'. %s", value, fmt.Sprintf(format, args...))}
+	}
+
+	var step time.Duration
+	if queryEpochRegexp.MatchString(value) {
+		seconds, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return 0, stepError("The step is out of range")
+		}
+		step = time.Duration(seconds) * time.Second
+	} else {
+		var err error
+		if step, err = parseQueryDuration(value); err != nil {
+			return 0, stepError("Expected a duration such as 5m or 1h, or a number of seconds")
+		}
+	}
+	storageStep := time.Duration(RRDStorageStep300Secs) * time.Second
+	if step <= 0 || step%storageStep != 0 {
+		return 0, stepError("Expected a multiple of %v", storageStep)
+	}
+	if endDateUTC.Sub(startDateUTC)/step > maxQueryPoints {
+		return 0, stepError("The period would hold more than %d samples", maxQueryPoints)
+	}
+	return step, nil
+}
+
+// parseQueryTimeRange parses the startDateUTC, endDateUTC, tz and step parameters of a query. The end date defaults
+// to now and the start date to defaultLookback before the end date
+func parseQueryTimeRange(query url.Values, defaultLookback time.Duration) (*queryTimeRange, error) {
+	loc, err := parseQueryLocation(query)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	timeRange := &queryTimeRange{Location: loc}
+	if timeRange.EndDateUTC, err = parseQueryDate(query, "endDateUTC", now, loc); err != nil {
+		return nil, err
+	}
+	if timeRange.EndDateUTC.IsZero() {
+		timeRange.EndDateUTC = now
+	}
+	if timeRange.StartDateUTC, err = parseQueryDate(query, "startDateUTC", now, loc); err != nil {
+		return nil, err
+	}
+	if timeRange.StartDateUTC.IsZero() {
+		timeRange.StartDateUTC = timeRange.EndDateUTC.Add(-defaultLookback)
+	}
+	if timeRange.StartDateUTC.After(timeRange.EndDateUTC) {
+		return nil, &requestParameterError{In: "query", Name: "startDateUTC",
+			Err: fmt.Errorf("the start date %s is after the end date %s",
+				timeRange.StartDateUTC.Format(time.RFC3339), timeRange.EndDateUTC.Format(time.RFC3339))}
+	}
+	if timeRange.Step, err = parseQueryStep(query, timeRange.StartDateUTC, timeRange.EndDateUTC); err != nil {
+		return nil, err
+	}
+	return timeRange, nil
+}
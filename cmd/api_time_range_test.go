@@ -0,0 +1,167 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestQueryTimeRange(t *testing.T) {
+	Convey("Given a reference time and a time zone", t, func(c C) {
+		now := date(c, "2020-06-10T12:00:00Z")
+		paris, err := time.LoadLocation("Europe/Paris")
+		So(err, ShouldBeNil)
+
+		Convey("When dates are parsed in the supported formats", func() {
+			Convey("Then they are converted to UTC", func() {
+				for value, expected := range map[string]string{
+					"2020-06-01T10:00:00":       "2020-06-01T08:00:00Z",
+					"2020-06-01":                "2020-05-31T22:00:00Z",
+					"2020-06-01T10:00:00Z":      "2020-06-01T10:00:00Z",
+					"2020-06-01T10:00:00+05:00": "2020-06-01T05:00:00Z",
+					"1591005600":                "2020-06-01T10:00:00Z",
+					"now":                       "2020-06-10T12:00:00Z",
+					"-7d":                       "2020-06-03T12:00:00Z",
+					"now-1h30m":                 "2020-06-10T10:30:00Z",
+					"now+1w":                    "2020-06-17T12:00:00Z",
+				} {
+					parsed, err := parseQueryTime(value, now, paris)
+					So(err, ShouldBeNil)
+					So(value+" => "+parsed.Format(time.RFC3339), ShouldEqual, value+" => "+expected)
+				}
+			})
+		})
+
+		Convey("When dates are invalid", func() {
+			Convey("Then the error describes the expected formats", func() {
+				for _, value := range []string{"yesterday", "now-", "nowadays", "-7y", "2020-13-01T00:00:00"} {
+					_, err := parseQueryTime(value, now, time.UTC)
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldContainSubstring, "Unix timestamp")
+				}
+			})
+		})
+
+		Convey("When a step is requested", func() {
+			start, end := date(c, "2020-06-01T00:00:00Z"), date(c, "2020-06-02T00:00:00Z")
+			step := func(value string) (time.Duration, error) {
+				return parseQueryStep(url.Values{"step": {value}}, start, end)
+			}
+
+			Convey("Then durations and seconds that are multiples of the storage step are accepted", func() {
+				for value, expected := range map[string]time.Duration{"5m": 5 * time.Minute, "1h": time.Hour, "3600": time.Hour, "1d": 24 * time.Hour} {
+					parsed, err := step(value)
+					So(err, ShouldBeNil)
+					So(parsed, ShouldEqual, expected)
+				}
+				parsed, err := parseQueryStep(url.Values{}, start, end)
+				So(err, ShouldBeNil)
+				So(parsed, ShouldEqual, 0)
+			})
+
+			Convey("Then other steps are rejected with the faulty parameter", func() {
+				for _, value := range []string{"0", "90s", "7m", "fast"} {
+					_, err := step(value)
+					So(err, ShouldHaveSameTypeAs, &requestParameterError{})
+					So(err.(*requestParameterError).Name, ShouldEqual, "step")
+				}
+				_, err := parseQueryStep(url.Values{"step": {"5m"}}, date(c, "2000-01-01T00:00:00Z"), end)
+				So(err.Error(), ShouldContainSubstring, "more than 11000 samples")
+			})
+		})
+
+		Convey("When a time range is parsed", func() {
+			Convey("Then defaults, time zones and ordering are applied", func() {
+				timeRange, err := parseQueryTimeRange(url.Values{"endDateUTC": {"2020-06-01T10:00:00"}, "tz": {"Europe/Paris"}, "step": {"1h"}}, 24*time.Hour)
+				So(err, ShouldBeNil)
+				So(timeRange.EndDateUTC, ShouldEqual, date(c, "2020-06-01T08:00:00Z"))
+				So(timeRange.StartDateUTC, ShouldEqual, date(c, "2020-05-31T08:00:00Z"))
+				So(timeRange.Step, ShouldEqual, time.Hour)
+
+				_, err = parseQueryTimeRange(url.Values{"tz": {"Mars/Olympus"}}, time.Hour)
+				So(err.Error(), ShouldContainSubstring, "query parameter 'tz'")
+				_, err = parseQueryTimeRange(url.Values{"startDateUTC": {"now"}, "endDateUTC": {"-1d"}}, time.Hour)
+				So(err.Error(), ShouldContainSubstring, "is after the end date")
+			})
+		})
+	})
+
+	Convey("Given an API router", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_historydb_dir", tempDir)
+		viper.Set("krossboard_rawdb_dir", tempDir)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+		origInstancesCache := apiInstancesCache
+		apiInstancesCache = &krossboardInstancesCache{list: func() (*KbInstancesK8sList, error) {
+			return &KbInstancesK8sList{}, nil
+		}}
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(target string) (*httptest.ResponseRecorder, *ErrorResp) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+			errorResp := &ErrorResp{}
+			_ = json.Unmarshal(resp.Body.Bytes(), errorResp)
+			return resp, errorResp
+		}
+
+		Convey("When history is requested with relative dates, a time zone and a step", func() {
+			resp, _ := serve("/api/usagehistory?startDateUTC=-2d&endDateUTC=now&tz=Europe/Paris&step=1h")
+
+			Convey("Then the request is accepted", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When the period or the step is invalid", func() {
+			Convey("Then a descriptive error is returned", func() {
+				for target, message := range map[string]string{
+					"/api/usagehistory?startDateUTC=yesterday":         "query parameter 'startDateUTC'",
+					"/api/usagehistory?step=7m":                        "Expected a multiple of 5m0s",
+					"/api/usagehistory?step=1h&period=monthly":         "not supported with the 'monthly' period",
+					"/api/nodesusage/prod?endDateUTC=2020-06-01T25:00": "query parameter 'endDateUTC'",
+					"/api/heatmap?cluster=prod&startDateUTC=now":       "the period is empty",
+					"/api/anomalies?startDateUTC=1d":                   "query parameter 'startDateUTC'",
+				} {
+					resp, errorResp := serve(target)
+					So(resp.Code, ShouldEqual, http.StatusBadRequest)
+					So(errorResp.Message, ShouldContainSubstring, message)
+				}
+			})
+		})
+
+		Reset(func() {
+			apiInstancesCache = origInstancesCache
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// tlsReloader serves the API certificate and client CA bundle, reloading them when the files change on disk
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	mu           sync.RWMutex
+	modTimes     map[string]time.Time
+	certificate  *tls.Certificate
+	clientCAs    *x509.CertPool
+}
+
+// newTLSReloader creates a reloader for the given certificate, key and optional client CA bundle
+func newTLSReloader(certFile string, keyFile string, clientCAFile string) (*tlsReloader, error) {
+	reloader := &tlsReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := reloader.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reloadIfChanged reloads the certificate and the CA bundle if any of the files has been modified since the last load
+func (m *tlsReloader) reloadIfChanged() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{m.certFile, m.keyFile, m.clientCAFile} {
+		if path == "" {
+			continue
+		}
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return errors.Wrap(err, "failed reading TLS file")
+		}
+		modTimes[path] = fileInfo.ModTime()
+	}
+
+	m.mu.RLock()
+	upToDate := m.certificate != nil
+	for path, modTime := range modTimes {
+		upToDate = upToDate && modTime.Equal(m.modTimes[path])
+	}
+	m.mu.RUnlock()
+	if upToDate {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed loading TLS certificate")
+	}
+	var clientCAs *x509.CertPool
+	if m.clientCAFile != "" {
+		caData, err := ioutil.ReadFile(m.clientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "failed reading client CA bundle")
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			return errors.New("no valid certificate found in client CA bundle")
+		}
+	}
+
+	m.mu.Lock()
+	m.certificate = &certificate
+	m.clientCAs = clientCAs
+	m.modTimes = modTimes
+	m.mu.Unlock()
+	log.WithField("certificate", m.certFile).Infoln("TLS certificate loaded")
+	return nil
+}
+
+// reload refreshes the TLS materials, keeping the previous ones when the new files are invalid
+// (e.g. while a certificate and its key are being replaced)
+func (m *tlsReloader) reload() {
+	if err := m.reloadIfChanged(); err != nil {
+		log.WithError(err).Errorln("failed reloading TLS materials, keeping the previous ones")
+	}
+}
+
+// getCertificate returns the current certificate, for use as tls.Config.GetCertificate
+func (m *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.reload()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.certificate, nil
+}
+
+// getClientCAs returns the current client CA bundle
+func (m *tlsReloader) getClientCAs() *x509.CertPool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.clientCAs
+}
+
+// parseTLSVersion returns the TLS version matching a version string such as "1.2"
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version '%s'. Valid values are: '1.0', '1.1', '1.2', '1.3'", version)
+}
+
+// parseTLSClientAuth returns the client certificate policy matching a krossboard_api_tls_client_auth value
+func parseTLSClientAuth(clientAuth string) (tls.ClientAuthType, error) {
+	switch clientAuth {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("invalid client auth '%s'. Valid values are: 'none', 'request', 'require'", clientAuth)
+}
+
+// newAPITLSConfig creates the TLS configuration of the API server from the krossboard_api_tls_* settings,
+// or returns nil when no certificate is set
+func newAPITLSConfig() (*tls.Config, error) {
+	certFile := viper.GetString("krossboard_api_tls_cert_file")
+	if certFile == "" {
+		return nil, nil
+	}
+
+	minVersion, err := parseTLSVersion(viper.GetString("krossboard_api_tls_min_version"))
+	if err != nil {
+		return nil, err
+	}
+	clientAuth, err := parseTLSClientAuth(viper.GetString("krossboard_api_tls_client_auth"))
+	if err != nil {
+		return nil, err
+	}
+	clientCAFile := viper.GetString("krossboard_api_tls_client_ca_file")
+	if clientAuth != tls.NoClientCert && clientCAFile == "" {
+		return nil, errors.New("client certificate verification requires a client CA bundle")
+	}
+
+	reloader, err := newTLSReloader(certFile, viper.GetString("krossboard_api_tls_key_file"), clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	baseConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.getCertificate,
+	}
+	if clientAuth == tls.NoClientCert {
+		return baseConfig, nil
+	}
+	baseConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		reloader.reload()
+		config := baseConfig.Clone()
+		config.GetConfigForClient = nil
+		config.ClientAuth = clientAuth
+		config.ClientCAs = reloader.getClientCAs()
+		return config, nil
+	}
+	return baseConfig, nil
+}
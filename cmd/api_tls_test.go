@@ -0,0 +1,174 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// writeTestCertificate generates a certificate signed by parent (self-signed when nil) and writes it
+// along with its key as PEM files
+func writeTestCertificate(certFile string, keyFile string, commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestAPITLSConfig(t *testing.T) {
+	Convey("Given a server certificate and a client CA on disk", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		certFile := path.Join(tempDir, "tls.crt")
+		keyFile := path.Join(tempDir, "tls.key")
+		caFile := path.Join(tempDir, "ca.crt")
+		caCert, caKey := writeTestCertificate(caFile, path.Join(tempDir, "ca.key"), "test-ca", true, nil, nil)
+		writeTestCertificate(certFile, keyFile, "server-1", false, nil, nil)
+
+		viper.Set("krossboard_api_tls_cert_file", certFile)
+		viper.Set("krossboard_api_tls_key_file", keyFile)
+		viper.Set("krossboard_api_tls_min_version", "1.2")
+		viper.Set("krossboard_api_tls_client_ca_file", "")
+		viper.Set("krossboard_api_tls_client_auth", "none")
+
+		Convey("When the certificate is replaced on disk", func() {
+			reloader, err := newTLSReloader(certFile, keyFile, "")
+			So(err, ShouldBeNil)
+			first, _ := reloader.getCertificate(nil)
+
+			writeTestCertificate(certFile, keyFile, "server-2", false, nil, nil)
+			later := time.Now().Add(time.Minute)
+			So(os.Chtimes(certFile, later, later), ShouldBeNil)
+			So(os.Chtimes(keyFile, later, later), ShouldBeNil)
+			second, _ := reloader.getCertificate(nil)
+
+			Convey("Then the new certificate is served without restart", func() {
+				So(second.Certificate[0], ShouldNotResemble, first.Certificate[0])
+				leaf, err := x509.ParseCertificate(second.Certificate[0])
+				So(err, ShouldBeNil)
+				So(leaf.Subject.CommonName, ShouldEqual, "server-2")
+			})
+		})
+
+		Convey("When the key is invalid after a change", func() {
+			reloader, err := newTLSReloader(certFile, keyFile, "")
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(keyFile, []byte("garbage"), 0600), ShouldBeNil)
+			later := time.Now().Add(time.Minute)
+			So(os.Chtimes(keyFile, later, later), ShouldBeNil)
+			cert, err := reloader.getCertificate(nil)
+
+			Convey("Then the previous certificate is kept", func() {
+				So(err, ShouldBeNil)
+				So(cert, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the settings are invalid", func() {
+			_, versionErr := parseTLSVersion("1.4")
+			_, authErr := parseTLSClientAuth("optional")
+			viper.Set("krossboard_api_tls_client_auth", "require")
+			_, caErr := newAPITLSConfig()
+
+			Convey("Then descriptive errors are returned", func() {
+				So(versionErr, ShouldNotBeNil)
+				So(authErr, ShouldNotBeNil)
+				So(caErr, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When client certificates are required", func() {
+			viper.Set("krossboard_api_tls_client_ca_file", caFile)
+			viper.Set("krossboard_api_tls_client_auth", "require")
+			tlsConfig, err := newAPITLSConfig()
+			So(err, ShouldBeNil)
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+			}))
+			server.TLS = tlsConfig
+			server.StartTLS()
+			defer server.Close()
+
+			clientCertFile := path.Join(tempDir, "client.crt")
+			clientKeyFile := path.Join(tempDir, "client.key")
+			writeTestCertificate(clientCertFile, clientKeyFile, "client-1", false, caCert, caKey)
+			clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+			So(err, ShouldBeNil)
+			newClient := func(certificates []tls.Certificate) *http.Client {
+				return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true, //nolint:gosec
+					Certificates:       certificates,
+				}}}
+			}
+
+			Convey("Then only clients presenting a certificate signed by the CA are accepted", func() {
+				resp, err := newClient([]tls.Certificate{clientCert}).Get(server.URL)
+				So(err, ShouldBeNil)
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				So(string(body), ShouldEqual, "client-1")
+
+				_, err = newClient(nil).Get(server.URL)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Reset(func() {
+			viper.Set("krossboard_api_tls_cert_file", "")
+			viper.Set("krossboard_api_tls_client_ca_file", "")
+			viper.Set("krossboard_api_tls_client_auth", "none")
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,422 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiV2Prefix      = "/api/v2"
+	apiV2Version     = "v2"
+	apiV2PageSize    = 100
+	apiV2MaxPageSize = 1000
+
+	ErrorCodeInvalidParameter = "INVALID_PARAMETER"
+	ErrorCodeUnauthenticated  = "UNAUTHENTICATED"
+	ErrorCodeForbidden        = "FORBIDDEN"
+	ErrorCodeNotFound         = "NOT_FOUND"
+	ErrorCodeInternal         = "INTERNAL_ERROR"
+	ErrorCodeUnavailable      = "UNAVAILABLE"
+	ErrorCodeInsufficientData = "INSUFFICIENT_DATA"
+)
+
+// APIv2Error holds a machine-readable error returned by the v2 API
+type APIv2Error struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// APIv2Pagination describes the page of a list returned by the v2 API
+type APIv2Pagination struct {
+	Page       int `json:"page"`
+	PageSize   int `json:"pageSize"`
+	TotalItems int `json:"totalItems"`
+	TotalPages int `json:"totalPages"`
+}
+
+// APIv2Meta holds the metadata of a v2 API response
+type APIv2Meta struct {
+	APIVersion  string           `json:"apiVersion"`
+	GeneratedAt time.Time        `json:"generatedAt"`
+	Pagination  *APIv2Pagination `json:"pagination,omitempty"`
+}
+
+// APIv2Envelope holds any response of the v2 API
+type APIv2Envelope struct {
+	Data  interface{} `json:"data"`
+	Meta  *APIv2Meta  `json:"meta"`
+	Error *APIv2Error `json:"error,omitempty"`
+}
+
+// v2 replacements of the v1 date parameters, expressed in RFC 3339
+var (
+	startDateParamV2 = &OpenAPIParameter{
+		Name:        "startDateUTC",
+		In:          "query",
+		Description: "Start of the period, as a RFC 3339 date",
+		Schema:      &OpenAPISchema{Type: "string", Format: "date-time"},
+	}
+	endDateParamV2 = &OpenAPIParameter{
+		Name:        "endDateUTC",
+		In:          "query",
+		Description: "End of the period, as a RFC 3339 date",
+		Schema:      &OpenAPISchema{Type: "string", Format: "date-time"},
+	}
+	pageParamV2 = &OpenAPIParameter{
+		Name:        "page",
+		In:          "query",
+		Description: "Page to return, starting at 1",
+		Schema:      &OpenAPISchema{Type: "integer"},
+	}
+	pageSizeParamV2 = &OpenAPIParameter{
+		Name:        "pageSize",
+		In:          "query",
+		Description: fmt.Sprintf("Number of items per page, up to %d", apiV2MaxPageSize),
+		Schema:      &OpenAPISchema{Type: "integer"},
+	}
+)
+
+// v2 routes wrap the v1 handlers, so they are derived from the v1 routes
+func init() {
+	v2Routes := make(map[string]map[string]interface{})
+	for key, route := range routes {
+		tpl := getRoutePath(key, route)
+		if !strings.HasPrefix(tpl, "/api/") || tpl == "/api/openapi.json" || tpl == "/api/dataset/{filename}" {
+			continue
+		}
+		if streaming, _ := route["streaming"].(bool); streaming {
+			// streams are not wrapped in envelopes
+			continue
+		}
+		v2Route := newV2Route(route)
+		v2Tpl := apiV2Prefix + strings.TrimPrefix(tpl, "/api")
+		if _, found := route["path"]; found {
+			v2Route["path"] = v2Tpl
+			v2Tpl = route["method"].(string) + " " + v2Tpl
+		}
+		v2Routes[v2Tpl] = v2Route
+	}
+	for tpl, route := range v2Routes {
+		routes[tpl] = route
+	}
+}
+
+// newV2Route derives a v2 route from a v1 route
+func newV2Route(route map[string]interface{}) map[string]interface{} {
+	handler := route["handler"].(func(http.ResponseWriter, *http.Request))
+	dataFields, unwrap, paginated := apiV2DataFields(route["response"])
+	v2Route := map[string]interface{}{
+		"method":        route["method"],
+		"handler":       newV2Handler(handler, dataFields, unwrap, paginated),
+		"legacyHandler": handler,
+		"operationId":   strings.TrimSuffix(runtimeFuncName(handler), "Handler") + "V2",
+		"envelope":      route["response"],
+		"dataFields":    dataFields,
+		"unwrapData":    unwrap,
+	}
+	for _, key := range []string{"scope", "summary", "requestBody"} {
+		if value, found := route[key]; found {
+			v2Route[key] = value
+		}
+	}
+
+	var params []*OpenAPIParameter
+	if v1Params, found := route["parameters"]; found {
+		for _, param := range v1Params.([]*OpenAPIParameter) {
+			switch param {
+			case formatParam, exportFormatParam, csvLayoutParam, csvDelimiterParam:
+				// the v2 API only serves JSON
+			case tzParam:
+				// v2 dates always have an offset
+			case startDateUTCParam:
+				params = append(params, startDateParamV2)
+			case endDateUTCParam:
+				params = append(params, endDateParamV2)
+			default:
+				params = append(params, param)
+			}
+		}
+	}
+	if paginated {
+		params = append(params, pageParamV2, pageSizeParamV2)
+	}
+	if len(params) > 0 {
+		v2Route["parameters"] = params
+	}
+	return v2Route
+}
+
+// apiV2DataFields returns the v1 response fields making the data of v2 responses, nil meaning the whole
+// v1 payload. unwrap is set when data is the value of a single field, and paginated when that value is a list
+func apiV2DataFields(response interface{}) (fields []string, unwrap bool, paginated bool) {
+	t := reflect.TypeOf(response)
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, false, false
+	}
+	if _, found := t.FieldByName("Status"); !found {
+		return nil, false, false
+	}
+	var fieldKinds []reflect.Kind
+	hasMessage := false
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		switch name {
+		case "status":
+		case "message":
+			hasMessage = true
+		default:
+			fields = append(fields, name)
+			fieldKinds = append(fieldKinds, t.Field(i).Type.Kind())
+		}
+	}
+	if len(fields) == 0 && hasMessage {
+		// responses only made of a status and a message, e.g. uploads
+		return []string{"message"}, false, false
+	}
+	if len(fields) == 1 {
+		return fields, true, fieldKinds[0] == reflect.Slice
+	}
+	return fields, false, false
+}
+
+// isAPIv2Request tells whether a request targets the v2 API
+func isAPIv2Request(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, apiV2Prefix+"/")
+}
+
+// apiV2ErrorCode returns the error code matching a HTTP status
+func apiV2ErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return ErrorCodeInvalidParameter
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthenticated
+	case http.StatusForbidden:
+		return ErrorCodeForbidden
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	case http.StatusUnprocessableEntity:
+		return ErrorCodeInsufficientData
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrorCodeUnavailable
+	}
+	return ErrorCodeInternal
+}
+
+// writeV2Response writes a v2 envelope
+func writeV2Response(w http.ResponseWriter, status int, envelope *APIv2Envelope) {
+	envelope.Meta.APIVersion = apiV2Version
+	envelope.Meta.GeneratedAt = time.Now().UTC()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	apiResp, _ := json.Marshal(envelope)
+	_, _ = w.Write(apiResp)
+}
+
+// writeV2Error writes a v2 error envelope
+func writeV2Error(w http.ResponseWriter, status int, message string, details map[string]interface{}) {
+	writeV2Response(w, status, &APIv2Envelope{
+		Meta:  &APIv2Meta{},
+		Error: &APIv2Error{Code: apiV2ErrorCode(status), Message: message, Details: details},
+	})
+}
+
+// bufferedResponseWriter captures the response of a v1 handler
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (m *bufferedResponseWriter) Header() http.Header {
+	return m.header
+}
+
+func (m *bufferedResponseWriter) Write(data []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	return m.body.Write(data)
+}
+
+func (m *bufferedResponseWriter) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+}
+
+// newV2LegacyRequest converts the parameters of a v2 request into the ones expected by v1 handlers
+func newV2LegacyRequest(req *http.Request) (*http.Request, error) {
+	query := req.URL.Query()
+	for _, param := range []string{"startDateUTC", "endDateUTC"} {
+		if value := query.Get(param); value != "" {
+			date, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, &requestParameterError{In: "query", Name: param,
+					Err: fmt.Errorf("invalid value '%s' for query parameter '%s'. Expected a RFC 3339 date", value, param)}
+			}
+			query.Set(param, date.UTC().Format(time.RFC3339))
+		}
+	}
+	query.Del("format")
+	query.Del("layout")
+	query.Del("delimiter")
+	query.Del("page")
+	query.Del("pageSize")
+
+	legacyReq := req.Clone(req.Context())
+	legacyReq.URL.RawQuery = query.Encode()
+	return legacyReq, nil
+}
+
+// paginateV2Data returns the requested page of a JSON list
+func paginateV2Data(data json.RawMessage, req *http.Request) (json.RawMessage, *APIv2Pagination, error) {
+	pagination := &APIv2Pagination{Page: 1, PageSize: apiV2PageSize}
+	query := req.URL.Query()
+	if value := query.Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return nil, nil, &requestParameterError{In: "query", Name: "page",
+				Err: fmt.Errorf("invalid value '%s' for query parameter 'page'. Expected a positive integer", value)}
+		}
+		pagination.Page = page
+	}
+	if value := query.Get("pageSize"); value != "" {
+		pageSize, err := strconv.Atoi(value)
+		if err != nil || pageSize < 1 || pageSize > apiV2MaxPageSize {
+			return nil, nil, &requestParameterError{In: "query", Name: "pageSize",
+				Err: fmt.Errorf("invalid value '%s' for query parameter 'pageSize'. Expected an integer between 1 and %d", value, apiV2MaxPageSize)}
+		}
+		pagination.PageSize = pageSize
+	}
+
+	var items []json.RawMessage
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, nil, err
+		}
+	}
+	pagination.TotalItems = len(items)
+	pagination.TotalPages = (len(items) + pagination.PageSize - 1) / pagination.PageSize
+	first := (pagination.Page - 1) * pagination.PageSize
+	if first > len(items) {
+		first = len(items)
+	}
+	last := first + pagination.PageSize
+	if last > len(items) {
+		last = len(items)
+	}
+	pageData, _ := json.Marshal(append([]json.RawMessage{}, items[first:last]...))
+	return pageData, pagination, nil
+}
+
+// newV2Handler wraps a v1 handler to serve its result in a v2 envelope
+func newV2Handler(handler func(http.ResponseWriter, *http.Request), dataFields []string, unwrap bool, paginated bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		legacyReq, err := newV2LegacyRequest(req)
+		if err != nil {
+			writeV2ParameterError(w, err)
+			return
+		}
+		legacyResp := &bufferedResponseWriter{header: make(http.Header)}
+		handler(legacyResp, legacyReq)
+		if legacyResp.status == 0 {
+			legacyResp.status = http.StatusOK
+		}
+		for _, key := range []string{"ETag", "Last-Modified", "Cache-Control"} {
+			if value := legacyResp.header.Get(key); value != "" {
+				w.Header().Set(key, value)
+			}
+		}
+		if legacyResp.status == http.StatusNotModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		var payload map[string]json.RawMessage
+		decodeErr := json.Unmarshal(legacyResp.body.Bytes(), &payload)
+		var legacyStatus, legacyMessage string
+		_ = json.Unmarshal(payload["status"], &legacyStatus)
+		_ = json.Unmarshal(payload["message"], &legacyMessage)
+
+		if legacyResp.status >= http.StatusBadRequest || legacyStatus == "error" {
+			status := legacyResp.status
+			if status < http.StatusBadRequest {
+				status = http.StatusInternalServerError
+			}
+			if legacyMessage == "" {
+				legacyMessage = http.StatusText(status)
+			}
+			writeV2Error(w, status, legacyMessage, nil)
+			return
+		}
+		if decodeErr != nil {
+			writeV2Error(w, http.StatusInternalServerError, "invalid response data", nil)
+			return
+		}
+
+		envelope := &APIv2Envelope{Meta: &APIv2Meta{}}
+		var data json.RawMessage
+		switch {
+		case dataFields == nil:
+			data = legacyResp.body.Bytes()
+		case unwrap:
+			data = payload[dataFields[0]]
+		default:
+			dataObject := make(map[string]json.RawMessage)
+			for _, field := range dataFields {
+				if value, found := payload[field]; found {
+					dataObject[field] = value
+				}
+			}
+			data, _ = json.Marshal(dataObject)
+		}
+		if paginated {
+			data, envelope.Meta.Pagination, err = paginateV2Data(data, req)
+			if err != nil {
+				writeV2ParameterError(w, err)
+				return
+			}
+		}
+		if len(data) > 0 {
+			envelope.Data = data
+		}
+		writeV2Response(w, legacyResp.status, envelope)
+	}
+}
+
+// writeV2ParameterError writes an error related to a request parameter
+func writeV2ParameterError(w http.ResponseWriter, err error) {
+	if paramErr, ok := err.(*requestParameterError); ok {
+		writeV2Error(w, http.StatusBadRequest, paramErr.Error(), map[string]interface{}{
+			"parameter": paramErr.Name,
+			"in":        paramErr.In,
+		})
+		return
+	}
+	writeV2Error(w, http.StatusInternalServerError, err.Error(), nil)
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestAPIv2(t *testing.T) {
+	Convey("Given an API router and consolidated data for three clusters", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_run_dir", tempDir)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		viper.Set("krossboard_anomalies_retention_days", 30)
+		apiAccessPolicy = nil
+
+		currentUsage, _ := json.Marshal([]*K8sClusterUsage{{ClusterName: "prod"}, {ClusterName: "staging"}, {ClusterName: "dev"}})
+		So(ioutil.WriteFile(getCurrentClusterUsagePath(), currentUsage, 0644), ShouldBeNil)
+		anomalyDate := date(c, "2020-06-01T10:00:00Z")
+		So(saveAnomalies([]*Anomaly{{StartDateUTC: anomalyDate, EndDateUTC: anomalyDate, Detections: 1, Cluster: "prod", Kind: AnomalyKindCluster, Name: "prod",
+			Resource: "cpu", Severity: AnomalySeverityWarning}}, anomalyDate), ShouldBeNil)
+
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(target string) (*httptest.ResponseRecorder, *APIv2Envelope, map[string]interface{}) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+			envelope := &APIv2Envelope{}
+			_ = json.Unmarshal(resp.Body.Bytes(), envelope)
+			var raw map[string]interface{}
+			_ = json.Unmarshal(resp.Body.Bytes(), &raw)
+			return resp, envelope, raw
+		}
+
+		Convey("When listing the current usage page by page", func() {
+			resp, envelope, raw := serve("/api/v2/currentusage?page=2&pageSize=2")
+
+			Convey("Then the data holds the requested page and the meta the pagination", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(envelope.Error, ShouldBeNil)
+				So(envelope.Data, ShouldHaveLength, 1)
+				So(envelope.Data.([]interface{})[0].(map[string]interface{})["clusterName"], ShouldEqual, "dev")
+				So(envelope.Meta.APIVersion, ShouldEqual, "v2")
+				So(envelope.Meta.Pagination, ShouldResemble, &APIv2Pagination{Page: 2, PageSize: 2, TotalItems: 3, TotalPages: 2})
+				So(apiSpec.validateValue(apiSpec.operation("/api/v2/currentusage", "GET").Responses["200"].Content["application/json"].Schema, raw, "response"), ShouldBeNil)
+			})
+		})
+
+		Convey("When filtering anomalies with a RFC 3339 date", func() {
+			resp, envelope, raw := serve("/api/v2/anomalies?startDateUTC=2020-06-01T11:00:00%2B02:00")
+
+			Convey("Then the date is honored and timestamps are RFC 3339", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(envelope.Data, ShouldHaveLength, 1)
+				dateUTC := envelope.Data.([]interface{})[0].(map[string]interface{})["startDateUTC"].(string)
+				_, err := time.Parse(time.RFC3339, dateUTC)
+				So(err, ShouldBeNil)
+				So(apiSpec.validateValue(apiSpec.operation("/api/v2/anomalies", "GET").Responses["200"].Content["application/json"].Schema, raw, "response"), ShouldBeNil)
+			})
+		})
+
+		Convey("When parameters are invalid", func() {
+			Convey("Then a typed error points to the faulty parameter", func() {
+				for target, param := range map[string]string{
+					"/api/v2/anomalies?startDateUTC=2020-06-01T00:00:00": "startDateUTC",
+					"/api/v2/anomalies?severity=fatal":                   "severity",
+					"/api/v2/currentusage?pageSize=5000":                 "pageSize",
+					"/api/v2/forecast":                                   "cluster",
+				} {
+					resp, envelope, raw := serve(target)
+					So(fmt.Sprint(target, " => ", resp.Code), ShouldEqual, fmt.Sprint(target, " => 400"))
+					So(envelope.Data, ShouldBeNil)
+					So(envelope.Error.Code, ShouldEqual, ErrorCodeInvalidParameter)
+					So(envelope.Error.Details["parameter"], ShouldEqual, param)
+					So(apiSpec.validateValue(apiSpec.operation("/api/v2/anomalies", "GET").Responses["default"].Content["application/json"].Schema, raw, "response"), ShouldBeNil)
+				}
+			})
+		})
+
+		Convey("When a v1 handler fails", func() {
+			So(os.Remove(getCurrentClusterUsagePath()), ShouldBeNil)
+			resp, envelope, _ := serve("/api/v2/currentusage")
+
+			Convey("Then the failure is mapped to an error code", func() {
+				So(resp.Code, ShouldEqual, http.StatusInternalServerError)
+				So(envelope.Error.Code, ShouldEqual, ErrorCodeInternal)
+				So(envelope.Error.Message, ShouldEqual, "failed reading current status file")
+			})
+		})
+
+		Convey("When the v1 route is queried", func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", "/api/currentusage", nil))
+			v1Resp := &GetAllClustersCurrentUsageResp{}
+			So(json.Unmarshal(resp.Body.Bytes(), v1Resp), ShouldBeNil)
+
+			Convey("Then it keeps its own format", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(v1Resp.Status, ShouldEqual, "ok")
+				So(v1Resp.ClusterUsage, ShouldHaveLength, 3)
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
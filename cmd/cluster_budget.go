@@ -0,0 +1,278 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	BudgetMetricCPU    = "cpu"
+	BudgetMetricMemory = "memory"
+	BudgetMetricCost   = "cost"
+
+	BudgetStatusOk       = "ok"
+	BudgetStatusWarning  = "warning"
+	BudgetStatusExceeded = "exceeded"
+	BudgetStatusError    = "error"
+)
+
+// ClusterCapacity holds the capacity and the unit prices of a cluster, used to turn
+// the usage ratios stored in RRD files into core-hours, GiB-hours and money
+type ClusterCapacity struct {
+	CPUCores        float64 `json:"cpuCores"`
+	MemGiB          float64 `json:"memGiB"`
+	CPUCoreHourCost float64 `json:"cpuCoreHourCost,omitempty"`
+	MemGiBHourCost  float64 `json:"memGiBHourCost,omitempty"`
+}
+
+// Budget holds a monthly budget set on a cluster, or on a set of its namespaces (e.g. a team)
+type Budget struct {
+	Name           string   `json:"name"`
+	Cluster        string   `json:"cluster"`
+	Namespaces     []string `json:"namespaces,omitempty"`
+	Metric         string   `json:"metric"`
+	Limit          float64  `json:"limit"`
+	WarningPercent float64  `json:"warningPercent,omitempty"`
+}
+
+// BudgetsConfig holds the content of the budgets configuration file
+type BudgetsConfig struct {
+	Clusters map[string]*ClusterCapacity `json:"clusters"`
+	Budgets  []*Budget                   `json:"budgets"`
+}
+
+// BudgetStatus holds the evaluation of a budget for the current month
+type BudgetStatus struct {
+	Name            string    `json:"name"`
+	Cluster         string    `json:"cluster"`
+	Namespaces      []string  `json:"namespaces,omitempty"`
+	Metric          string    `json:"metric"`
+	Limit           float64   `json:"limit"`
+	Consumed        float64   `json:"consumed"`
+	PercentConsumed float64   `json:"percentConsumed"`
+	Forecast        float64   `json:"forecast"`
+	PercentForecast float64   `json:"percentForecast"`
+	Status          string    `json:"status"`
+	Message         string    `json:"message,omitempty"`
+	PeriodStartUTC  time.Time `json:"periodStartUTC"`
+	PeriodEndUTC    time.Time `json:"periodEndUTC"`
+	UpdatedUTC      time.Time `json:"updatedUTC"`
+}
+
+// loadBudgetsConfig reads and validates a budgets configuration file
+func loadBudgetsConfig(path string) (*BudgetsConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading budgets file")
+	}
+
+	config := &BudgetsConfig{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed decoding budgets file")
+	}
+
+	for _, budget := range config.Budgets {
+		if budget.Name == "" || budget.Cluster == "" {
+			return nil, errors.New("budget entries require a name and a cluster")
+		}
+		if budget.Metric != BudgetMetricCPU && budget.Metric != BudgetMetricMemory && budget.Metric != BudgetMetricCost {
+			return nil, fmt.Errorf("invalid metric '%s' for budget '%s'. Valid values are: 'cpu', 'memory', 'cost'", budget.Metric, budget.Name)
+		}
+		if budget.Limit <= 0 {
+			return nil, fmt.Errorf("budget '%s' has no positive limit", budget.Name)
+		}
+	}
+	return config, nil
+}
+
+// loadClusterCapacities returns the cluster capacities set in the budgets file, none when there is no such file
+func loadClusterCapacities() (map[string]*ClusterCapacity, error) {
+	budgetsFile := viper.GetString("krossboard_budgets_file")
+	if _, err := os.Stat(budgetsFile); os.IsNotExist(err) {
+		return map[string]*ClusterCapacity{}, nil
+	}
+	config, err := loadBudgetsConfig(budgetsFile)
+	if err != nil {
+		return nil, err
+	}
+	return config.Clusters, nil
+}
+
+// processBudgets evaluates the configured budgets against month-to-date usage and
+// saves the result in the run directory, where it's served by the API
+func processBudgets() {
+	budgetsFile := viper.GetString("krossboard_budgets_file")
+	if _, err := os.Stat(budgetsFile); os.IsNotExist(err) {
+		log.Debugln("no budgets file found, skipping budgets evaluation", budgetsFile)
+		return
+	}
+
+	config, err := loadBudgetsConfig(budgetsFile)
+	if err != nil {
+		log.WithError(err).Errorln("failed loading budgets", budgetsFile)
+		return
+	}
+
+	nowUTC := time.Now().UTC()
+	periodStart := time.Date(nowUTC.Year(), nowUTC.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var allStatus []*BudgetStatus
+	for _, budget := range config.Budgets {
+		capacity, found := config.Clusters[budget.Cluster]
+		if !found {
+			allStatus = append(allStatus, newBudgetErrorStatus(budget, periodStart, nowUTC, "no capacity defined for cluster"))
+			continue
+		}
+		usage, err := fetchBudgetUsage(budget, periodStart, nowUTC)
+		if err != nil {
+			log.WithError(err).Errorln("failed retrieving usage for budget", budget.Name)
+			allStatus = append(allStatus, newBudgetErrorStatus(budget, periodStart, nowUTC, "failed retrieving usage data"))
+			continue
+		}
+		allStatus = append(allStatus, evaluateBudget(budget, capacity, usage, periodStart, nowUTC))
+	}
+
+	serializedData, _ := json.Marshal(allStatus)
+	err = writeFileAtomically(getBudgetsStatusPath(), serializedData, 0644)
+	if err != nil {
+		log.WithError(err).Errorln("failed writing budgets status file")
+	}
+}
+
+// fetchBudgetUsage retrieves the hourly usage covered by a budget, either from the cluster
+// history database, or by summing the usage of the budget's namespaces
+func fetchBudgetUsage(budget *Budget, startTimeUTC time.Time, endTimeUTC time.Time) (*UsageHistory, error) {
+	step := time.Duration(RRDStorageStep3600Secs) * time.Second
+	if len(budget.Namespaces) == 0 {
+		return NewUsageDb(getHistoryDbPath(budget.Cluster), 100).FetchUsage(startTimeUTC, endTimeUTC, step)
+	}
+
+	var histories []*UsageHistory
+	for _, namespace := range budget.Namespaces {
+		dbfile := fmt.Sprintf("%s/%s/%s", viper.GetString("krossboard_rawdb_dir"), budget.Cluster, namespace)
+		usage, err := NewUsageDb(dbfile, 100).FetchUsage(startTimeUTC, endTimeUTC, step)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed reading usage of namespace %s", namespace))
+		}
+		histories = append(histories, usage)
+	}
+	return sumUsageHistories(histories), nil
+}
+
+// sumUsageHistories merges several usage histories by adding values sharing the same timestamp
+func sumUsageHistories(histories []*UsageHistory) *UsageHistory {
+	sumItems := func(getItems func(*UsageHistory) []*ResourceUsageItem) []*ResourceUsageItem {
+		sums := make(map[int64]float64)
+		for _, history := range histories {
+			for _, item := range getItems(history) {
+				sums[item.DateUTC.Unix()] += item.Value
+			}
+		}
+		items := make([]*ResourceUsageItem, 0, len(sums))
+		for ts, value := range sums {
+			items = append(items, &ResourceUsageItem{DateUTC: time.Unix(ts, 0).UTC(), Value: value})
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].DateUTC.Before(items[j].DateUTC) })
+		return items
+	}
+
+	return &UsageHistory{
+		CPUUsage: sumItems(func(h *UsageHistory) []*ResourceUsageItem { return h.CPUUsage }),
+		MEMUsage: sumItems(func(h *UsageHistory) []*ResourceUsageItem { return h.MEMUsage }),
+	}
+}
+
+// evaluateBudget computes the month-to-date consumption of a budget from hourly usage ratios,
+// and projects it linearly to the end of the month
+func evaluateBudget(budget *Budget, capacity *ClusterCapacity, usage *UsageHistory, periodStart time.Time, nowUTC time.Time) *BudgetStatus {
+	status := &BudgetStatus{
+		Name:           budget.Name,
+		Cluster:        budget.Cluster,
+		Namespaces:     budget.Namespaces,
+		Metric:         budget.Metric,
+		Limit:          budget.Limit,
+		PeriodStartUTC: periodStart,
+		PeriodEndUTC:   periodStart.AddDate(0, 1, 0),
+		UpdatedUTC:     nowUTC,
+	}
+
+	cpuCoreHours := 0.0
+	for _, item := range usage.CPUUsage {
+		cpuCoreHours += item.Value / 100 * capacity.CPUCores
+	}
+	memGiBHours := 0.0
+	for _, item := range usage.MEMUsage {
+		memGiBHours += item.Value / 100 * capacity.MemGiB
+	}
+
+	switch budget.Metric {
+	case BudgetMetricCPU:
+		status.Consumed = cpuCoreHours
+	case BudgetMetricMemory:
+		status.Consumed = memGiBHours
+	case BudgetMetricCost:
+		status.Consumed = cpuCoreHours*capacity.CPUCoreHourCost + memGiBHours*capacity.MemGiBHourCost
+	}
+
+	status.Forecast = status.Consumed
+	elapsedHours := nowUTC.Sub(periodStart).Hours()
+	if elapsedHours >= 1 {
+		status.Forecast = status.Consumed / elapsedHours * status.PeriodEndUTC.Sub(periodStart).Hours()
+	}
+	status.PercentConsumed = 100 * status.Consumed / budget.Limit
+	status.PercentForecast = 100 * status.Forecast / budget.Limit
+
+	warningPercent := budget.WarningPercent
+	if warningPercent <= 0 {
+		warningPercent = viper.GetFloat64("krossboard_budget_warning_percent")
+	}
+	switch {
+	case status.PercentConsumed >= 100:
+		status.Status = BudgetStatusExceeded
+	case status.PercentConsumed >= warningPercent || status.PercentForecast >= 100:
+		status.Status = BudgetStatusWarning
+	default:
+		status.Status = BudgetStatusOk
+	}
+	return status
+}
+
+func newBudgetErrorStatus(budget *Budget, periodStart time.Time, nowUTC time.Time, message string) *BudgetStatus {
+	return &BudgetStatus{
+		Name:           budget.Name,
+		Cluster:        budget.Cluster,
+		Namespaces:     budget.Namespaces,
+		Metric:         budget.Metric,
+		Limit:          budget.Limit,
+		Status:         BudgetStatusError,
+		Message:        message,
+		PeriodStartUTC: periodStart,
+		PeriodEndUTC:   periodStart.AddDate(0, 1, 0),
+		UpdatedUTC:     nowUTC,
+	}
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestEvaluateBudget(t *testing.T) {
+	Convey("Given ten hours of usage at 50% of a 10 cores/40 GiB cluster", t, func() {
+		viper.Set("krossboard_budget_warning_percent", 80)
+		periodStart := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+		nowUTC := periodStart.Add(10 * time.Hour)
+		capacity := &ClusterCapacity{CPUCores: 10, MemGiB: 40, CPUCoreHourCost: 0.5, MemGiBHourCost: 0.1}
+		usage := &UsageHistory{}
+		for i := 1; i <= 10; i++ {
+			ts := periodStart.Add(time.Duration(i) * time.Hour)
+			usage.CPUUsage = append(usage.CPUUsage, &ResourceUsageItem{DateUTC: ts, Value: 50})
+			usage.MEMUsage = append(usage.MEMUsage, &ResourceUsageItem{DateUTC: ts, Value: 50})
+		}
+
+		Convey("When evaluating a CPU budget", func() {
+			status := evaluateBudget(&Budget{Name: "b", Cluster: "c", Metric: BudgetMetricCPU, Limit: 1000}, capacity, usage, periodStart, nowUTC)
+
+			Convey("Then consumption and forecast are expressed in core-hours", func() {
+				So(status.Consumed, ShouldEqual, 50)
+				So(status.PercentConsumed, ShouldEqual, 5)
+				So(status.Forecast, ShouldEqual, 50*30*24/10)
+				So(status.Status, ShouldEqual, BudgetStatusWarning)
+			})
+		})
+
+		Convey("When evaluating a memory budget far from its limit", func() {
+			status := evaluateBudget(&Budget{Name: "b", Cluster: "c", Metric: BudgetMetricMemory, Limit: 100000}, capacity, usage, periodStart, nowUTC)
+
+			Convey("Then the budget is ok", func() {
+				So(status.Consumed, ShouldEqual, 200)
+				So(status.Status, ShouldEqual, BudgetStatusOk)
+			})
+		})
+
+		Convey("When evaluating an exceeded cost budget", func() {
+			status := evaluateBudget(&Budget{Name: "b", Cluster: "c", Metric: BudgetMetricCost, Limit: 40}, capacity, usage, periodStart, nowUTC)
+
+			Convey("Then the cost combines CPU and memory prices", func() {
+				So(status.Consumed, ShouldEqual, 50*0.5+200*0.1)
+				So(status.Status, ShouldEqual, BudgetStatusExceeded)
+			})
+		})
+	})
+}
+
+func TestSumUsageHistories(t *testing.T) {
+	Convey("Given two namespaces usage histories", t, func(c C) {
+		first := &UsageHistory{
+			CPUUsage: []*ResourceUsageItem{{DateUTC: date(c, "2020-04-01T01:00:00Z"), Value: 10}, {DateUTC: date(c, "2020-04-01T02:00:00Z"), Value: 20}},
+			MEMUsage: []*ResourceUsageItem{{DateUTC: date(c, "2020-04-01T01:00:00Z"), Value: 1}},
+		}
+		second := &UsageHistory{
+			CPUUsage: []*ResourceUsageItem{{DateUTC: date(c, "2020-04-01T02:00:00Z"), Value: 5}},
+			MEMUsage: []*ResourceUsageItem{{DateUTC: date(c, "2020-04-01T01:00:00Z"), Value: 2}},
+		}
+
+		Convey("Then values sharing the same timestamp are added", func() {
+			sum := sumUsageHistories([]*UsageHistory{first, second})
+			So(sum.CPUUsage, ShouldResemble, []*ResourceUsageItem{
+				{DateUTC: date(c, "2020-04-01T01:00:00Z"), Value: 10},
+				{DateUTC: date(c, "2020-04-01T02:00:00Z"), Value: 25},
+			})
+			So(sum.MEMUsage, ShouldResemble, []*ResourceUsageItem{
+				{DateUTC: date(c, "2020-04-01T01:00:00Z"), Value: 3},
+			})
+		})
+	})
+}
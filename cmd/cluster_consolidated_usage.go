@@ -118,7 +118,8 @@ func getClusterCurrentUsage(clusterName string) (*K8sClusterUsage, error) {
 }
 
 // getRecentNodesUsage returns nodes usage for a given cluster
-func getRecentNodesUsage(clusterName string) (map[string]NodeUsage, error) {
+func getRecentNodesUsage(clusterName string) (_ map[string]NodeUsage, err error) {
+	defer func(start time.Time) { observeUpstreamCall(UpstreamKOA, "nodes_dataset", start, err) }(time.Now())
 	url := "http://127.0.0.1:1519/api/dataset/nodes.json"
 	httpReq, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -163,6 +164,7 @@ func getRecentNodesUsage(clusterName string) (map[string]NodeUsage, error) {
 }
 
 func processConsolidatedUsage() {
+	runStart := time.Now()
 	err := createDirIfNotExists(viper.GetString("krossboard_run_dir"))
 	if err != nil {
 		log.WithField("message", err.Error()).Fatalln("failed initializing status directory")
@@ -176,7 +178,10 @@ func processConsolidatedUsage() {
 		kubeconfig := NewKubeConfig()
 		managedClusters := kubeconfig.ListClusters()
 		clusterNames = make([]string, len(managedClusters))
-		for cname := range managedClusters {
+		for cname, managedCluster := range managedClusters {
+			if managedCluster.Disabled {
+				continue
+			}
 			clusterNames = append(clusterNames, cname)
 		}
 	}
@@ -187,7 +192,8 @@ func processConsolidatedUsage() {
 	} else {
 		currentUsageFile := getCurrentClusterUsagePath()
 		serializedData, _ := json.Marshal(allClustersUsage)
-		err = ioutil.WriteFile(currentUsageFile, serializedData, 0644)
+		// the file is replaced at once since the API watches it to push updates to usage streams
+		err = writeFileAtomically(currentUsageFile, serializedData, 0644)
 		if err != nil {
 			log.WithError(err).Errorln("failed writing current usage file")
 			return
@@ -195,11 +201,43 @@ func processConsolidatedUsage() {
 	}
 
 	sampleTimeUTC := time.Now().UTC()
+	var anomalies []*Anomaly
+	allNodesUsage := make(map[string]map[string]NodeUsage)
 	for _, clusterUsage := range allClustersUsage {
+		clusterStart := time.Now()
 		if !clusterUsage.OutToDate {
 			processClusterNamespaceUsage(clusterUsage)
+			anomalies = append(anomalies, detectClusterAnomalies(clusterUsage, sampleTimeUTC)...)
+		}
+		nodesUsage, nodesAnomalies := processClusterNodesUsage(clusterUsage, sampleTimeUTC)
+		if nodesUsage != nil {
+			allNodesUsage[clusterUsage.ClusterName] = nodesUsage
 		}
-		processClusterNodesUsage(clusterUsage, sampleTimeUTC)
+		anomalies = append(anomalies, nodesAnomalies...)
+		consolidatorClusterDuration.WithLabelValues(clusterUsage.ClusterName).Set(time.Since(clusterStart).Seconds())
+	}
+	serializedData, _ := json.Marshal(allNodesUsage)
+	err = writeFileAtomically(getNodesUsagePath(), serializedData, 0644)
+	if err != nil {
+		log.WithError(err).Errorln("failed writing nodes usage file")
+	}
+	err = saveNodesMetadata(allNodesUsage, sampleTimeUTC)
+	if err != nil {
+		log.WithError(err).Errorln("failed writing nodes metadata file")
+	}
+	for _, anomaly := range anomalies {
+		log.WithFields(log.Fields{"cluster": anomaly.Cluster, "kind": anomaly.Kind, "name": anomaly.Name, "resource": anomaly.Resource, "score": anomaly.Score}).Warnln("usage anomaly detected")
+	}
+	err = saveAnomalies(anomalies, sampleTimeUTC)
+	if err != nil {
+		log.WithError(err).Errorln("failed writing anomalies file")
+	}
+
+	processBudgets()
+
+	consolidatorDuration.Set(time.Since(runStart).Seconds())
+	if allClustersUsage != nil {
+		consolidatorLastSuccess.SetToCurrentTime()
 	}
 }
 
@@ -219,30 +257,43 @@ func processClusterNamespaceUsage(clusterUsage *K8sClusterUsage) {
 	memUsage := clusterUsage.MemUsed + clusterUsage.MemNonAllocatable
 	err = usageDb.UpdateRRD(time.Now(), cpuUsage, memUsage)
 	if err != nil {
+		rrdUpdateFailuresTotal.WithLabelValues(clusterUsage.ClusterName, "history").Inc()
 		log.WithError(err).Errorln("failed to update RRD file", rrdFile)
 	}
 
 }
 
-func processClusterNodesUsage(clusterUsage *K8sClusterUsage, sampleTimeUTC time.Time) {
+// processClusterNodesUsage saves the latest usage of the nodes of a cluster and returns it along with
+// the anomalies detected on the nodes
+func processClusterNodesUsage(clusterUsage *K8sClusterUsage, sampleTimeUTC time.Time) (map[string]NodeUsage, []*Anomaly) {
 	recentNodesUsage, err := getRecentNodesUsage(clusterUsage.ClusterName)
 	if err != nil {
 		log.WithError(err).Errorln("failed getting cluster nodes usage")
-		return
+		return nil, nil
 	}
+	var anomalies []*Anomaly
 	for nodeName, nodeUsage := range recentNodesUsage {
+		nodeUsage.Name = nodeName
+		nodeUsage.DateUTC = sampleTimeUTC
+		recentNodesUsage[nodeName] = nodeUsage
 		nodeUsageDb := NewNodeUsageDB(nodeName)
 		err = nodeUsageDb.CapacityDb.UpdateRRD(sampleTimeUTC, nodeUsage.CPUCapacity, nodeUsage.MEMCapacity)
 		if err != nil {
+			rrdUpdateFailuresTotal.WithLabelValues(clusterUsage.ClusterName, "node_capacity").Inc()
 			log.WithError(err).Errorln("failed saving node capacity =>", nodeName)
 		}
 		err = nodeUsageDb.AllocatableDb.UpdateRRD(sampleTimeUTC, nodeUsage.CPUAllocatable, nodeUsage.MEMAllocatable)
 		if err != nil {
+			rrdUpdateFailuresTotal.WithLabelValues(clusterUsage.ClusterName, "node_allocatable").Inc()
 			log.WithError(err).Errorln("failed saving allocatable capacity =>", nodeName)
 		}
 		err = nodeUsageDb.UsageByPodsDb.UpdateRRD(sampleTimeUTC, nodeUsage.CPUUsageByPods, nodeUsage.MEMUsageByPods)
 		if err != nil {
+			rrdUpdateFailuresTotal.WithLabelValues(clusterUsage.ClusterName, "node_usage_by_pods").Inc()
 			log.WithError(err).Errorln("failed saving capacity used by node =>", nodeName)
 		}
+		anomalies = append(anomalies, detectDbAnomalies(nodeUsageDb.UsageByPodsDb, AnomalyKindNode, clusterUsage.ClusterName, nodeName,
+			sampleTimeUTC, nodeUsage.CPUUsageByPods, nodeUsage.MEMUsageByPods)...)
 	}
+	return recentNodesUsage, anomalies
 }
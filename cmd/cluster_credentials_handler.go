@@ -40,8 +40,15 @@ func processClusterCredentials() {
 	for _, managedCluster := range managedClusters {
 		log.WithFields(log.Fields{"cluster": managedCluster.Name, "endpoint": managedCluster.APIEndpoint}).Debugln("processing new cluster")
 
+		if managedCluster.Disabled {
+			log.WithField("cluster", managedCluster.Name).Debugln("ignoring disabled cluster")
+			credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "skipped").Inc()
+			continue
+		}
+
 		if managedCluster.AuthInfo == nil {
 			log.WithField("cluster", managedCluster.Name).Warn("ignoring cluster with no AuthInfo")
+			credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "skipped").Inc()
 			continue
 		}
 
@@ -49,6 +56,7 @@ func processClusterCredentials() {
 		err := createDirIfNotExists(dataVol)
 		if err != nil {
 			log.WithFields(log.Fields{"path": dataVol, "message": err.Error()}).Errorln("failed creating data volume")
+			credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "failure").Inc()
 			continue
 		}
 
@@ -56,6 +64,7 @@ func processClusterCredentials() {
 		err = createDirIfNotExists(tokenVol)
 		if err != nil {
 			log.WithFields(log.Fields{"path": tokenVol, "message": err.Error()}).Errorln("failed creating token volume")
+			credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "failure").Inc()
 			continue
 		}
 
@@ -63,6 +72,7 @@ func processClusterCredentials() {
 		err = ioutil.WriteFile(caFile, managedCluster.CaData, 0600)
 		if err != nil {
 			log.WithError(err).Errorln("failed writing CA file")
+			credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "failure").Inc()
 			continue
 		}
 
@@ -76,6 +86,7 @@ func processClusterCredentials() {
 			err = ioutil.WriteFile(tokenFile, []byte(bearerToken), 0600)
 			if err != nil {
 				log.WithError(err).Errorln("failed writing bearer token file")
+				credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "failure").Inc()
 				continue
 			}
 			managedCluster.AuthType = AuthTypeBearerToken
@@ -84,11 +95,13 @@ func processClusterCredentials() {
 				err = ioutil.WriteFile(x509ClientCert, managedCluster.AuthInfo.ClientCertificateData, 0644)
 				if err != nil {
 					log.WithError(err).Errorln("failed writing client certificate file")
+					credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "failure").Inc()
 					continue
 				}
 				err = ioutil.WriteFile(x509ClientCertKey, managedCluster.AuthInfo.ClientKeyData, 0600)
 				if err != nil {
 					log.WithError(err).Errorln("failed writing client certificate key file")
+					credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "failure").Inc()
 					continue
 				}
 				managedCluster.AuthType = AuthTypeX509Cert
@@ -98,14 +111,17 @@ func processClusterCredentials() {
 			err = ioutil.WriteFile(tokenFile, []byte(basicToken), 0600)
 			if err != nil {
 				log.WithError(err).Errorln("failed writing basic token file")
+				credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "failure").Inc()
 				continue
 			}
 			managedCluster.AuthType = AuthTypeBasicToken
 		} else {
 			log.WithField("cluster", managedCluster.Name).Error("failed getting cluster credentials => ", err.Error())
+			credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "failure").Inc()
 			continue
 		}
 
+		credentialsRefreshTotal.WithLabelValues(managedCluster.Name, "success").Inc()
 		log.Infoln("cluster credentials updated =>", managedCluster.Name)
 	}
 }
@@ -0,0 +1,180 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Sources of the clusters listed in the inventory
+const (
+	ClusterSourceKubeConfig = "kubeconfig"
+	ClusterSourceOperator   = "operator"
+)
+
+// Status of the kube-opex-analytics instance of a cluster
+const (
+	KoaStatusReporting   = "reporting"
+	KoaStatusOutToDate   = "outToDate"
+	KoaStatusNotDeployed = "notDeployed"
+	KoaStatusUnknown     = "unknown"
+)
+
+// authTypeNames holds the names of the auth types returned by the API
+var authTypeNames = map[int]string{
+	AuthTypeUnknown:     "unknown",
+	AuthTypeBearerToken: "bearerToken",
+	AuthTypeX509Cert:    "x509Cert",
+	AuthTypeBasicToken:  "basicToken",
+}
+
+// ClusterInventoryItem describes a cluster managed by Krossboard
+type ClusterInventoryItem struct {
+	Name                  string       `json:"name"`
+	Sources               []string     `json:"sources"`
+	Enabled               bool         `json:"enabled"`
+	APIEndpoint           string       `json:"apiEndpoint,omitempty"`
+	KubeConfigFile        string       `json:"kubeconfigFile,omitempty"`
+	AuthType              string       `json:"authType,omitempty"`
+	CredentialsUpdatedUTC *time.Time   `json:"credentialsUpdatedUTC,omitempty"`
+	CredentialsFresh      bool         `json:"credentialsFresh"`
+	KoaInstance           *KoaInstance `json:"koaInstance,omitempty"`
+	KoaStatus             string       `json:"koaStatus"`
+	LastSampleUTC         *time.Time   `json:"lastSampleUTC,omitempty"`
+	DataSizeBytes         int64        `json:"dataSizeBytes"`
+}
+
+// getCredentialsUpdateTime returns when the credentials of a cluster have been last written by the cluster
+// credentials handler
+func getCredentialsUpdateTime(clusterName string) (time.Time, bool) {
+	var updatedAt time.Time
+	credentialsDir := fmt.Sprintf("%s/%s", viper.GetString("krossboard_credentials_dir"), clusterName)
+	for _, credentialsFile := range []string{"token", "cert.pem"} {
+		info, err := os.Stat(fmt.Sprintf("%s/%s", credentialsDir, credentialsFile))
+		if err == nil && info.ModTime().After(updatedAt) {
+			updatedAt = info.ModTime()
+		}
+	}
+	return updatedAt.UTC(), !updatedAt.IsZero()
+}
+
+// getClusterDataSize returns the size of the databases of a cluster, including the ones of its nodes
+func getClusterDataSize(clusterName string, nodesMetadata map[string]*NodeMetadata) int64 {
+	dbFiles := []string{getHistoryDbPath(clusterName)}
+	namespaceDbs, _ := filepath.Glob(fmt.Sprintf("%s/%s/*", viper.GetString("krossboard_rawdb_dir"), clusterName))
+	dbFiles = append(dbFiles, namespaceDbs...)
+	for nodeName := range nodesMetadata {
+		capacityDbPath, allocatableDbPath, usageByPodsDbPath := getNodeUsageDbPaths(nodeName)
+		dbFiles = append(dbFiles, capacityDbPath, allocatableDbPath, usageByPodsDbPath)
+	}
+
+	var size int64
+	for _, dbFile := range dbFiles {
+		if info, err := os.Stat(dbFile); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// buildClusterInventory describes the clusters found in KUBECONFIG or in the status of the operator. The
+// operator status is unknown when kbInstances is nil
+func buildClusterInventory(managedClusters map[string]*ManagedCluster, kbInstances *KbInstancesK8sList, currentUsage []*K8sClusterUsage) []*ClusterInventoryItem {
+	inventory := make(map[string]*ClusterInventoryItem)
+	getItem := func(clusterName string) *ClusterInventoryItem {
+		if _, found := inventory[clusterName]; !found {
+			inventory[clusterName] = &ClusterInventoryItem{Name: clusterName, Sources: []string{}, KoaStatus: KoaStatusNotDeployed}
+		}
+		return inventory[clusterName]
+	}
+
+	for clusterName, managedCluster := range managedClusters {
+		item := getItem(clusterName)
+		item.Sources = append(item.Sources, ClusterSourceKubeConfig)
+		item.Enabled = !managedCluster.Disabled
+		item.APIEndpoint = managedCluster.APIEndpoint
+		item.KubeConfigFile = managedCluster.KubeConfigPath
+		item.AuthType = authTypeNames[detectAuthType(managedCluster.AuthInfo)]
+	}
+	if kbInstances != nil {
+		for _, kbInstanceItem := range kbInstances.Items {
+			for _, koaInstance := range kbInstanceItem.Status.KoaInstances {
+				koaInstance := koaInstance
+				item := getItem(koaInstance.ClusterName)
+				item.Sources = append(item.Sources, ClusterSourceOperator)
+				item.KoaInstance = &koaInstance
+				if item.APIEndpoint == "" {
+					item.APIEndpoint = koaInstance.ClusterEndpointURL
+				}
+			}
+		}
+	}
+
+	usageByCluster := make(map[string]*K8sClusterUsage, len(currentUsage))
+	for _, clusterUsage := range currentUsage {
+		usageByCluster[clusterUsage.ClusterName] = clusterUsage
+	}
+	nodesMetadata, err := loadNodesMetadata()
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warnln("failed reading nodes metadata")
+	}
+	maxCredentialsAge := time.Duration(viper.GetInt("krossboard_credentials_max_age_minutes")) * time.Minute
+
+	items := make([]*ClusterInventoryItem, 0, len(inventory))
+	for clusterName, item := range inventory {
+		switch {
+		case kbInstances == nil:
+			item.KoaStatus = KoaStatusUnknown
+		case item.KoaInstance == nil:
+			item.KoaStatus = KoaStatusNotDeployed
+		case usageByCluster[clusterName] != nil && !usageByCluster[clusterName].OutToDate:
+			item.KoaStatus = KoaStatusReporting
+		default:
+			item.KoaStatus = KoaStatusOutToDate
+		}
+		if updatedAt, found := getCredentialsUpdateTime(clusterName); found {
+			item.CredentialsUpdatedUTC = &updatedAt
+			item.CredentialsFresh = time.Since(updatedAt) <= maxCredentialsAge
+		}
+		if historyDb := getHistoryDbPath(clusterName); fileExists(historyDb) {
+			if lastUpdate, err := rrdLastUpdate(historyDb); err == nil {
+				lastUpdate = lastUpdate.UTC()
+				item.LastSampleUTC = &lastUpdate
+			} else {
+				log.WithError(err).Warnln("failed reading the last update of", historyDb)
+			}
+		}
+		item.DataSizeBytes = getClusterDataSize(clusterName, nodesMetadata[clusterName])
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items
+}
+
+// fileExists tells whether a path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
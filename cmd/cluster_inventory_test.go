@@ -0,0 +1,149 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestClusterInventory(t *testing.T) {
+	Convey("Given clusters from KUBECONFIG and from the operator", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		for _, dir := range []string{"run", "cred/prod", "history", "raw/prod"} {
+			So(os.MkdirAll(fmt.Sprintf("%s/%s", tempDir, dir), 0755), ShouldBeNil)
+		}
+		viper.Set("krossboard_run_dir", tempDir+"/run")
+		viper.Set("krossboard_credentials_dir", tempDir+"/cred")
+		viper.Set("krossboard_historydb_dir", tempDir+"/history")
+		viper.Set("krossboard_rawdb_dir", tempDir+"/raw")
+		viper.Set("krossboard_credentials_max_age_minutes", 60)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+
+		kubeconfigFile := tempDir + "/kubeconfig"
+		So(ioutil.WriteFile(kubeconfigFile, []byte(`
+apiVersion: v1
+kind: Config
+clusters:
+- cluster: {server: "https://prod.example.com"}
+  name: prod
+- cluster: {server: "https://dev.example.com"}
+  name: dev
+contexts:
+- context: {cluster: prod, user: prod-admin}
+  name: prod
+- context: {cluster: dev, user: dev-admin}
+  name: dev
+users:
+- name: prod-admin
+  user: {token: secret}
+- name: dev-admin
+  user: {username: admin, password: secret}
+`), 0600), ShouldBeNil)
+		viper.Set(KubeConfigKey, kubeconfigFile)
+
+		So(ioutil.WriteFile(tempDir+"/cred/prod/token", []byte("secret"), 0600), ShouldBeNil)
+		So(ioutil.WriteFile(getHistoryDbPath("prod"), make([]byte, 100), 0644), ShouldBeNil)
+		So(ioutil.WriteFile(tempDir+"/raw/prod/default", make([]byte, 20), 0644), ShouldBeNil)
+		So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-1": {}}}, time.Now().UTC()), ShouldBeNil)
+		capacityDbPath, _, _ := getNodeUsageDbPaths("node-1")
+		So(ioutil.WriteFile(capacityDbPath, make([]byte, 3), 0644), ShouldBeNil)
+		currentUsage, _ := json.Marshal([]*K8sClusterUsage{{ClusterName: "prod"}, {ClusterName: "ops", OutToDate: true}})
+		So(ioutil.WriteFile(getCurrentClusterUsagePath(), currentUsage, 0644), ShouldBeNil)
+
+		origLastUpdate, origInstancesCache := rrdLastUpdate, apiInstancesCache
+		lastUpdate := date(c, "2020-06-01T10:00:00Z")
+		rrdLastUpdate = func(string) (time.Time, error) { return lastUpdate, nil }
+		apiInstancesCache = &krossboardInstancesCache{list: func() (*KbInstancesK8sList, error) {
+			instances := &KbInstancesK8sList{}
+			_ = json.Unmarshal([]byte(`{"items":[{"status":{"koaInstances":[
+				{"name":"koa-prod","clusterName":"prod","containerPort":5483},
+				{"name":"koa-ops","clusterName":"ops","containerPort":5484,"clusterEndpoint":"https://ops.example.com"}]}}]}`), instances)
+			return instances, nil
+		}}
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+
+		Convey("When the inventory is requested", func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", "/api/clusters", nil))
+			clustersResp := &GetClustersResp{}
+			err := json.Unmarshal(resp.Body.Bytes(), clustersResp)
+
+			Convey("Then every cluster is described from all sources", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(err, ShouldBeNil)
+				So(clustersResp.Clusters, ShouldHaveLength, 3)
+				dev, ops, prod := clustersResp.Clusters[0], clustersResp.Clusters[1], clustersResp.Clusters[2]
+
+				So(prod.Name, ShouldEqual, "prod")
+				So(prod.Sources, ShouldResemble, []string{ClusterSourceKubeConfig, ClusterSourceOperator})
+				So(prod.APIEndpoint, ShouldEqual, "https://prod.example.com")
+				So(prod.KubeConfigFile, ShouldEqual, kubeconfigFile)
+				So(prod.AuthType, ShouldEqual, "bearerToken")
+				So(prod.CredentialsUpdatedUTC, ShouldNotBeNil)
+				So(prod.CredentialsFresh, ShouldBeTrue)
+				So(prod.KoaInstance.ContainerPort, ShouldEqual, 5483)
+				So(prod.KoaStatus, ShouldEqual, KoaStatusReporting)
+				So(*prod.LastSampleUTC, ShouldEqual, lastUpdate)
+				So(prod.DataSizeBytes, ShouldEqual, 123)
+
+				So(dev.Sources, ShouldResemble, []string{ClusterSourceKubeConfig})
+				So(dev.AuthType, ShouldEqual, "basicToken")
+				So(dev.CredentialsUpdatedUTC, ShouldBeNil)
+				So(dev.CredentialsFresh, ShouldBeFalse)
+				So(dev.KoaStatus, ShouldEqual, KoaStatusNotDeployed)
+				So(dev.LastSampleUTC, ShouldBeNil)
+
+				So(ops.Sources, ShouldResemble, []string{ClusterSourceOperator})
+				So(ops.APIEndpoint, ShouldEqual, "https://ops.example.com")
+				So(ops.KubeConfigFile, ShouldBeEmpty)
+				So(ops.KoaStatus, ShouldEqual, KoaStatusOutToDate)
+			})
+		})
+
+		Convey("When the operator can't be reached", func() {
+			inventory := buildClusterInventory(NewKubeConfig().ListClusters(), nil, nil)
+
+			Convey("Then clusters from KUBECONFIG are still listed with an unknown status", func() {
+				So(inventory, ShouldHaveLength, 2)
+				So(inventory[1].Name, ShouldEqual, "prod")
+				So(inventory[1].KoaStatus, ShouldEqual, KoaStatusUnknown)
+			})
+		})
+
+		Reset(func() {
+			rrdLastUpdate, apiInstancesCache = origLastUpdate, origInstancesCache
+			viper.Set(KubeConfigKey, "")
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
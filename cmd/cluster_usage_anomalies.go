@@ -0,0 +1,258 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	AnomalyKindCluster   = "cluster"
+	AnomalyKindNamespace = "namespace"
+	AnomalyKindNode      = "node"
+
+	AnomalySeverityWarning  = "warning"
+	AnomalySeverityCritical = "critical"
+
+	// anomalyMinBaselineSamples is the minimum number of samples at the same hour of week required to
+	// evaluate a new sample
+	anomalyMinBaselineSamples = 3
+	// madToSigma is the scale factor between the median absolute deviation and the standard deviation
+	// of a normal distribution
+	madToSigma = 1.4826
+	// anomalyEpisodeMaxGap is the maximum time between two detections of the same series for them to belong to
+	// the same episode, which tolerates a missed consolidation run
+	anomalyEpisodeMaxGap = 2 * RRDStorageStep300Secs * time.Second
+)
+
+// Anomaly holds an episode of consecutive samples of a series that significantly deviate from their usual value at
+// the same hour of week. The value, the baseline and the score are those of the most deviating sample
+type Anomaly struct {
+	StartDateUTC time.Time `json:"startDateUTC"`
+	EndDateUTC   time.Time `json:"endDateUTC"`
+	Detections   int       `json:"detections"`
+	Cluster      string    `json:"cluster"`
+	Kind         string    `json:"kind"`
+	Name         string    `json:"name"`
+	Resource     string    `json:"resource"`
+	Value        float64   `json:"value"`
+	Baseline     float64   `json:"baseline"`
+	Deviation    float64   `json:"deviation"`
+	Score        float64   `json:"score"`
+	Severity     string    `json:"severity"`
+}
+
+// seriesKey identifies the series an anomaly was detected on
+func (m *Anomaly) seriesKey() string {
+	return strings.Join([]string{m.Cluster, m.Kind, m.Name, m.Resource}, "\xff")
+}
+
+// extend merges a later detection of the same series into the episode
+func (m *Anomaly) extend(detection *Anomaly) {
+	m.EndDateUTC = detection.EndDateUTC
+	m.Detections += detection.Detections
+	if math.Abs(detection.Score) > math.Abs(m.Score) {
+		m.Value, m.Baseline, m.Deviation, m.Score = detection.Value, detection.Baseline, detection.Deviation, detection.Score
+	}
+	if detection.Severity == AnomalySeverityCritical {
+		m.Severity = AnomalySeverityCritical
+	}
+}
+
+// hourOfWeekBaseline returns history values recorded at the same hour of week as ts
+func hourOfWeekBaseline(items []*ResourceUsageItem, ts time.Time) []float64 {
+	var values []float64
+	for _, item := range items {
+		if item.DateUTC.Weekday() == ts.Weekday() && item.DateUTC.Hour() == ts.Hour() {
+			values = append(values, item.Value)
+		}
+	}
+	return values
+}
+
+// computeAnomalyScore returns the baseline median and median absolute deviation, and the robust z-score
+// of value against them. ok is false when the baseline is too small to be meaningful
+func computeAnomalyScore(baseline []float64, value float64) (median float64, mad float64, score float64, ok bool) {
+	if len(baseline) < anomalyMinBaselineSamples {
+		return 0, 0, 0, false
+	}
+	median = percentile(baseline, 50)
+	deviations := make([]float64, len(baseline))
+	for i, v := range baseline {
+		deviations[i] = math.Abs(v - median)
+	}
+	mad = percentile(deviations, 50)
+
+	scale := madToSigma * mad
+	if scale == 0 {
+		// flat baseline, fall back on a relative deviation to avoid flagging noise as infinite scores
+		scale = math.Max(math.Abs(median)*0.1, 1e-9)
+	}
+	return median, mad, (value - median) / scale, true
+}
+
+// detectUsageAnomalies compares a new CPU and memory sample against the hour-of-week baseline
+// built from history
+func detectUsageAnomalies(kind string, cluster string, name string, history *UsageHistory, ts time.Time, cpu float64, mem float64, threshold float64) []*Anomaly {
+	var anomalies []*Anomaly
+	samples := []struct {
+		resource string
+		value    float64
+		history  []*ResourceUsageItem
+	}{
+		{"cpu", cpu, history.CPUUsage},
+		{"memory", mem, history.MEMUsage},
+	}
+	for _, sample := range samples {
+		median, mad, score, ok := computeAnomalyScore(hourOfWeekBaseline(sample.history, ts), sample.value)
+		if !ok || math.Abs(score) < threshold {
+			continue
+		}
+		severity := AnomalySeverityWarning
+		if math.Abs(score) >= 2*threshold {
+			severity = AnomalySeverityCritical
+		}
+		anomalies = append(anomalies, &Anomaly{
+			StartDateUTC: ts,
+			EndDateUTC:   ts,
+			Detections:   1,
+			Cluster:      cluster,
+			Kind:         kind,
+			Name:         name,
+			Resource:     sample.resource,
+			Value:        sample.value,
+			Baseline:     median,
+			Deviation:    mad,
+			Score:        score,
+			Severity:     severity,
+		})
+	}
+	return anomalies
+}
+
+// detectDbAnomalies evaluates a new sample against the baseline read from a usage database
+func detectDbAnomalies(usageDb *UsageDb, kind string, cluster string, name string, ts time.Time, cpu float64, mem float64) []*Anomaly {
+	lookback := time.Duration(viper.GetInt("krossboard_anomalies_lookback_weeks")) * 7 * 24 * time.Hour
+	history, err := usageDb.FetchUsage(ts.Add(-lookback), ts.Add(-time.Hour), time.Duration(RRDStorageStep3600Secs)*time.Second)
+	if err != nil {
+		log.WithError(err).Debugln("failed retrieving anomaly baseline", usageDb.RRDFile)
+		return nil
+	}
+	return detectUsageAnomalies(kind, cluster, name, history, ts, cpu, mem, viper.GetFloat64("krossboard_anomalies_threshold"))
+}
+
+// detectClusterAnomalies evaluates the latest usage of a cluster and of its namespaces
+func detectClusterAnomalies(clusterUsage *K8sClusterUsage, sampleTimeUTC time.Time) []*Anomaly {
+	anomalies := detectDbAnomalies(
+		NewUsageDb(getHistoryDbPath(clusterUsage.ClusterName), 100),
+		AnomalyKindCluster,
+		clusterUsage.ClusterName,
+		clusterUsage.ClusterName,
+		sampleTimeUTC,
+		clusterUsage.CPUUsed+clusterUsage.CPUNonAllocatable,
+		clusterUsage.MemUsed+clusterUsage.MemNonAllocatable)
+
+	rrdDir := fmt.Sprintf("%s/%s", viper.GetString("krossboard_rawdb_dir"), clusterUsage.ClusterName)
+	dbfiles, err := listRegularFiles(rrdDir)
+	if err != nil {
+		log.WithError(err).Debugln("failed listing namespaces dbs", rrdDir)
+		return anomalies
+	}
+	for _, dbfile := range dbfiles {
+		namespace := dbfile[len(rrdDir)+1:]
+		if namespace == "non-allocatable" {
+			continue
+		}
+		usageDb := NewUsageDb(dbfile, 100)
+		recentUsage, err := usageDb.FetchUsage5Minutes(sampleTimeUTC.Add(-3*RRDStorageStep300Secs*time.Second), sampleTimeUTC)
+		if err != nil || len(recentUsage.CPUUsage) == 0 {
+			continue
+		}
+		last := len(recentUsage.CPUUsage) - 1
+		anomalies = append(anomalies, detectDbAnomalies(usageDb, AnomalyKindNamespace, clusterUsage.ClusterName, namespace,
+			sampleTimeUTC, recentUsage.CPUUsage[last].Value, recentUsage.MEMUsage[last].Value)...)
+	}
+	return anomalies
+}
+
+// anomalyNamespace returns the namespace an anomaly relates to, if any
+func anomalyNamespace(anomaly *Anomaly) string {
+	if anomaly.Kind == AnomalyKindNamespace {
+		return anomaly.Name
+	}
+	return ""
+}
+
+// saveAnomalies records new detections in the anomalies file, extending the episode of their series when it was
+// still ongoing, and drops the episodes ended before the retention
+func saveAnomalies(newAnomalies []*Anomaly, nowUTC time.Time) error {
+	anomalies, err := loadAnomalies()
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warnln("resetting unreadable anomalies file")
+	}
+
+	lastEpisodes := make(map[string]*Anomaly)
+	for _, anomaly := range anomalies {
+		if last, found := lastEpisodes[anomaly.seriesKey()]; !found || anomaly.EndDateUTC.After(last.EndDateUTC) {
+			lastEpisodes[anomaly.seriesKey()] = anomaly
+		}
+	}
+	for _, detection := range newAnomalies {
+		last, found := lastEpisodes[detection.seriesKey()]
+		if found && !detection.StartDateUTC.Before(last.EndDateUTC) && detection.StartDateUTC.Sub(last.EndDateUTC) <= anomalyEpisodeMaxGap {
+			last.extend(detection)
+			continue
+		}
+		anomalies = append(anomalies, detection)
+		lastEpisodes[detection.seriesKey()] = detection
+	}
+
+	retentionLimit := nowUTC.AddDate(0, 0, -viper.GetInt("krossboard_anomalies_retention_days"))
+	var keptAnomalies []*Anomaly
+	for _, anomaly := range anomalies {
+		if anomaly.EndDateUTC.After(retentionLimit) {
+			keptAnomalies = append(keptAnomalies, anomaly)
+		}
+	}
+	sort.SliceStable(keptAnomalies, func(i, j int) bool { return keptAnomalies[i].StartDateUTC.Before(keptAnomalies[j].StartDateUTC) })
+
+	serializedData, _ := json.Marshal(keptAnomalies)
+	// the file is replaced at once so that the API never reads a partial file
+	return writeFileAtomically(getAnomaliesPath(), serializedData, 0644)
+}
+
+// loadAnomalies reads the anomalies recorded by the consolidator
+func loadAnomalies() ([]*Anomaly, error) {
+	data, err := ioutil.ReadFile(getAnomaliesPath())
+	if err != nil {
+		return nil, err
+	}
+	var anomalies []*Anomaly
+	err = json.Unmarshal(data, &anomalies)
+	return anomalies, err
+}
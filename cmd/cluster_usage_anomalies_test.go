@@ -0,0 +1,123 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestDetectUsageAnomalies(t *testing.T) {
+	Convey("Given four weeks of hourly usage, busier on Monday mornings", t, func() {
+		start := time.Date(2020, 4, 6, 0, 0, 0, 0, time.UTC) // a Monday
+		history := &UsageHistory{}
+		for i := 0; i < 4*7*24; i++ {
+			ts := start.Add(time.Duration(i) * time.Hour)
+			cpu := 20.0 + float64((i/168)%3)
+			if ts.Weekday() == time.Monday && ts.Hour() == 9 {
+				cpu = 60.0 + float64((i/168)%3)
+			}
+			history.CPUUsage = append(history.CPUUsage, &ResourceUsageItem{DateUTC: ts, Value: cpu})
+			history.MEMUsage = append(history.MEMUsage, &ResourceUsageItem{DateUTC: ts, Value: 30})
+		}
+		mondayMorning := start.AddDate(0, 0, 28).Add(9 * time.Hour)
+
+		Convey("When a Monday morning sample matches its usual level", func() {
+			anomalies := detectUsageAnomalies(AnomalyKindCluster, "c", "c", history, mondayMorning, 61, 30, 3.5)
+
+			Convey("Then no anomaly is reported", func() {
+				So(anomalies, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the same level is observed on a Monday night", func() {
+			anomalies := detectUsageAnomalies(AnomalyKindCluster, "c", "c", history, mondayMorning.Add(14*time.Hour), 61, 30, 3.5)
+
+			Convey("Then a critical CPU anomaly is reported", func() {
+				So(anomalies, ShouldHaveLength, 1)
+				So(anomalies[0].Resource, ShouldEqual, "cpu")
+				So(anomalies[0].Severity, ShouldEqual, AnomalySeverityCritical)
+				So(anomalies[0].Baseline, ShouldEqual, 20.5)
+				So(anomalies[0].Deviation, ShouldEqual, 0.5)
+			})
+		})
+
+		Convey("When memory deviates from a flat baseline", func() {
+			anomalies := detectUsageAnomalies(AnomalyKindNode, "c", "node", history, mondayMorning, 61, 45, 3.5)
+
+			Convey("Then the relative deviation is used to score the sample", func() {
+				So(anomalies, ShouldHaveLength, 1)
+				So(anomalies[0].Resource, ShouldEqual, "memory")
+				So(anomalies[0].Score, ShouldAlmostEqual, 5)
+				So(anomalies[0].Severity, ShouldEqual, AnomalySeverityWarning)
+			})
+		})
+	})
+}
+
+func TestSaveAnomalies(t *testing.T) {
+	Convey("Given an empty anomalies file", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tempDir)
+		viper.Set("krossboard_run_dir", tempDir)
+		viper.Set("krossboard_anomalies_retention_days", 7)
+
+		start := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+		detection := func(ts time.Time, name string, score float64, severity string) *Anomaly {
+			return &Anomaly{StartDateUTC: ts, EndDateUTC: ts, Detections: 1, Cluster: "prod", Kind: AnomalyKindNamespace,
+				Name: name, Resource: "cpu", Value: score, Score: score, Severity: severity}
+		}
+
+		Convey("When a series is detected on consecutive runs, then after a gap, next to another series", func() {
+			So(saveAnomalies([]*Anomaly{detection(start, "payments", 4, AnomalySeverityWarning)}, start), ShouldBeNil)
+			next := start.Add(RRDStorageStep300Secs * time.Second)
+			So(saveAnomalies([]*Anomaly{
+				detection(next, "payments", 8, AnomalySeverityCritical),
+				detection(next, "billing", 4, AnomalySeverityWarning),
+			}, next), ShouldBeNil)
+			last := next.Add(3 * anomalyEpisodeMaxGap)
+			So(saveAnomalies([]*Anomaly{detection(last, "payments", 5, AnomalySeverityWarning)}, last), ShouldBeNil)
+			anomalies, err := loadAnomalies()
+			So(err, ShouldBeNil)
+
+			Convey("Then the consecutive detections are merged into one episode", func() {
+				So(anomalies, ShouldHaveLength, 3)
+				So(anomalies[0].Name, ShouldEqual, "payments")
+				So(anomalies[0].StartDateUTC, ShouldEqual, start)
+				So(anomalies[0].EndDateUTC, ShouldEqual, next)
+				So(anomalies[0].Detections, ShouldEqual, 2)
+				So(anomalies[0].Score, ShouldEqual, 8)
+				So(anomalies[0].Severity, ShouldEqual, AnomalySeverityCritical)
+			})
+
+			Convey("Then other series and later detections start their own episodes", func() {
+				So(anomalies[1].Name, ShouldEqual, "billing")
+				So(anomalies[1].Detections, ShouldEqual, 1)
+				So(anomalies[2].Name, ShouldEqual, "payments")
+				So(anomalies[2].StartDateUTC, ShouldEqual, last)
+				So(anomalies[2].Detections, ShouldEqual, 1)
+			})
+		})
+	})
+}
@@ -31,6 +31,15 @@ const (
 	RRDStorageStep300Secs = 300
 	// RRDStorageStep3600Secs constant defining a 1-hour storage step for RRD databases
 	RRDStorageStep3600Secs = 3600
+	// RRDStorageStep86400Secs constant defining a 1-day storage step for RRD databases
+	RRDStorageStep86400Secs = 86400
+)
+
+const (
+	// RRDHourlyRetention is the retention of the 1-hour resolution archive of RRD databases
+	RRDHourlyRetention = 8880 * time.Hour
+	// RRDDailyRetention is the retention of the 1-day resolution archive of RRD databases
+	RRDDailyRetention = 800 * 24 * time.Hour
 )
 
 // UsageDb holds a wrapper on a RRD database file along with appropriated settinfgs to store a usage data
@@ -84,6 +93,7 @@ func (m *UsageDb) CreateRRD() error {
 	rrdCreator := rrd.NewCreator(m.RRDFile, now(), m.Step)
 	rrdCreator.RRA("AVERAGE", 0.5, 1, 4032)               // 14 days - 5-minute resolution
 	rrdCreator.RRA("AVERAGE", 0.5, 12 /* 1 hour */, 8880) // 1 year - 1-hour resolution
+	rrdCreator.RRA("AVERAGE", 0.5, 288 /* 1 day */, 800)  // 2 years - 1-day resolution
 	if m.MaxValue == math.MaxFloat64 {
 		rrdCreator.DS("cpu_usage", "GAUGE", m.Step, m.MinValue, "U")
 		rrdCreator.DS("mem_usage", "GAUGE", m.Step, m.MinValue, "U")
@@ -135,7 +145,7 @@ func (m *UsageDb) FetchUsageMonthly(startTimeUTC time.Time, endTimeUTC time.Time
 }
 
 // FetchUsage retrieves from the given RRD file
-// data between startTimeUTC and endTimeUTC and a step
+// data between startTimeUTC and endTimeUTC and a step. Rows finer than the step are averaged per step
 func (m *UsageDb) FetchUsage(startTimeUTC time.Time, endTimeUTC time.Time, step time.Duration) (*UsageHistory, error) {
 	rrdEndTime := RoundTime(endTimeUTC, step)
 	rrdStartTime := RoundTime(startTimeUTC, step)
@@ -164,9 +174,35 @@ func (m *UsageDb) FetchUsage(startTimeUTC time.Time, endTimeUTC time.Time, step
 		rrdRow++
 	}
 
+	if step > rrdFetchRes.Step {
+		cpuUsage, memUsage = resampleUsage(cpuUsage, step), resampleUsage(memUsage, step)
+	}
 	return &UsageHistory{cpuUsage, memUsage}, nil
 }
 
+// resampleUsage averages usage items per step, each average being dated at the end of its step as RRD rows are
+func resampleUsage(items []*ResourceUsageItem, step time.Duration) []*ResourceUsageItem {
+	var resampled []*ResourceUsageItem
+	var count float64
+	for _, item := range items {
+		stepEnd := RoundTime(item.DateUTC.Add(step-time.Nanosecond), step)
+		if last := len(resampled) - 1; last >= 0 && resampled[last].DateUTC.Equal(stepEnd) {
+			resampled[last].Value += item.Value
+			count++
+			continue
+		}
+		if last := len(resampled) - 1; last >= 0 {
+			resampled[last].Value /= count
+		}
+		resampled = append(resampled, &ResourceUsageItem{DateUTC: stepEnd, Value: item.Value})
+		count = 1
+	}
+	if last := len(resampled) - 1; last >= 0 {
+		resampled[last].Value /= count
+	}
+	return resampled
+}
+
 // computeCumulativeMonth compute the cumulative data per month.
 func computeCumulativeMonth(items []*ResourceUsageItem) []*ResourceUsageItem {
 	usages := []*ResourceUsageItem{}
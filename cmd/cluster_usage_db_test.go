@@ -205,6 +205,54 @@ func TestUsageDb(t *testing.T) {
 	})
 }
 
+func TestFetchUsageStep(t *testing.T) {
+	Convey("Given a database updated every 5 minutes for 4 hours", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		origNow := now
+		start := date(c, "2020-06-01T00:00:00Z")
+		now = func() time.Time { return start }
+		usageDb := NewUsageDb(path.Join(tempDir, "test.db"), 100)
+		So(usageDb.CreateRRD(), ShouldBeNil)
+		end := start.Add(4 * time.Hour)
+		for ts := start.Add(5 * time.Minute); !ts.After(end); ts = ts.Add(5 * time.Minute) {
+			// the usage is the number of 5-minute steps elapsed in the hour
+			value := float64((ts.Sub(start) / (5 * time.Minute)) % 12)
+			So(usageDb.UpdateRRD(ts, value, value), ShouldBeNil)
+		}
+
+		Convey("When the usage is fetched with steps between the resolutions of the database", func() {
+			spacings := func(history *UsageHistory) map[time.Duration]bool {
+				spacing := make(map[time.Duration]bool)
+				for i := 1; i < len(history.CPUUsage); i++ {
+					spacing[history.CPUUsage[i].DateUTC.Sub(history.CPUUsage[i-1].DateUTC)] = true
+				}
+				return spacing
+			}
+
+			Convey("Then samples are spaced by the requested step", func() {
+				history, err := usageDb.FetchUsage(start, end, 15*time.Minute)
+				So(err, ShouldBeNil)
+				So(spacings(history), ShouldResemble, map[time.Duration]bool{15 * time.Minute: true})
+				So(history.CPUUsage, ShouldHaveLength, 16)
+				So(history.CPUUsage[0].DateUTC.Unix(), ShouldEqual, start.Add(15*time.Minute).Unix())
+				So(history.CPUUsage[0].Value, ShouldAlmostEqual, 2)
+
+				history, err = usageDb.FetchUsage(start, end, 2*time.Hour)
+				So(err, ShouldBeNil)
+				So(spacings(history), ShouldResemble, map[time.Duration]bool{2 * time.Hour: true})
+				So(history.CPUUsage, ShouldHaveLength, 2)
+				So(history.CPUUsage[1].DateUTC.Unix(), ShouldEqual, end.Unix())
+			})
+		})
+
+		Reset(func() {
+			now = origNow
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
+
 func TestComputeCumulativeMonth(t *testing.T) {
 	Convey("Given a a set of history data", t, func(c C) {
 		type args struct {
@@ -0,0 +1,252 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ForecastMethodLinear      = "linear"
+	ForecastMethodHoltWinters = "holtwinters"
+
+	// forecastConfidenceZ is the z-score of the 95% confidence bands
+	forecastConfidenceZ = 1.96
+
+	holtWintersAlpha = 0.5
+	holtWintersBeta  = 0.01
+	holtWintersGamma = 0.3
+)
+
+// errNotEnoughHistory is returned when the usage history is too short to forecast
+var errNotEnoughHistory = errors.New("not enough usage history to forecast")
+
+// UsageForecastItem holds a predicted resource usage at a timestamp, along with its confidence band
+type UsageForecastItem struct {
+	DateUTC time.Time `json:"dateUTC"`
+	Value   float64   `json:"value"`
+	Lower   float64   `json:"lower"`
+	Upper   float64   `json:"upper"`
+}
+
+// ResourceForecast holds the forecast of a resource usage
+type ResourceForecast struct {
+	Method               string               `json:"method"`
+	Threshold            float64              `json:"threshold"`
+	ThresholdCrossingUTC *time.Time           `json:"thresholdCrossingUTC,omitempty"`
+	Items                []*UsageForecastItem `json:"items"`
+}
+
+// UsageForecast holds forecasts for all kinds of managed resources (CPU, memory)
+type UsageForecast struct {
+	CPUForecast *ResourceForecast `json:"cpuForecast"`
+	MEMForecast *ResourceForecast `json:"memForecast"`
+}
+
+// parseHorizon parses a forecast horizon expressed in hours, days or weeks (e.g. 12h, 30d, 2w)
+func parseHorizon(horizon string) (time.Duration, error) {
+	horizon = strings.TrimSpace(strings.ToLower(horizon))
+	if len(horizon) < 2 {
+		return 0, fmt.Errorf("invalid horizon '%s'", horizon)
+	}
+	count, err := strconv.Atoi(horizon[:len(horizon)-1])
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("invalid horizon '%s'", horizon)
+	}
+	switch horizon[len(horizon)-1] {
+	case 'h':
+		return time.Duration(count) * time.Hour, nil
+	case 'd':
+		return time.Duration(count) * 24 * time.Hour, nil
+	case 'w':
+		return time.Duration(count) * 7 * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid unit for horizon '%s'. Valid units are: 'h', 'd', 'w'", horizon)
+}
+
+// forecastUsage forecasts hourly CPU and memory usage over the given horizon
+func forecastUsage(history *UsageHistory, horizon time.Duration, method string, seasonHours int, threshold float64) (*UsageForecast, error) {
+	cpuForecast, err := forecastResourceUsage(history.CPUUsage, horizon, method, seasonHours, threshold)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed forecasting CPU usage")
+	}
+	memForecast, err := forecastResourceUsage(history.MEMUsage, horizon, method, seasonHours, threshold)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed forecasting memory usage")
+	}
+	return &UsageForecast{CPUForecast: cpuForecast, MEMForecast: memForecast}, nil
+}
+
+// forecastResourceUsage forecasts a resource usage with the given method. When no method is
+// set, Holt-Winters is used if the history covers at least two seasons, linear trend otherwise
+func forecastResourceUsage(items []*ResourceUsageItem, horizon time.Duration, method string, seasonHours int, threshold float64) (*ResourceForecast, error) {
+	series := fillHourlyGaps(items)
+	if len(series) < 2 {
+		return nil, errNotEnoughHistory
+	}
+	steps := int(horizon / time.Hour)
+	if method == "" {
+		method = ForecastMethodLinear
+		if seasonHours > 1 && len(series) >= 2*seasonHours {
+			method = ForecastMethodHoltWinters
+		}
+	}
+
+	var values, deviations []float64
+	switch method {
+	case ForecastMethodLinear:
+		values, deviations = forecastLinear(usageValues(series), steps)
+	case ForecastMethodHoltWinters:
+		if seasonHours <= 1 || len(series) < 2*seasonHours {
+			return nil, fmt.Errorf("holt-winters requires at least two seasons of %d hours of data", seasonHours)
+		}
+		values, deviations = forecastHoltWinters(usageValues(series), seasonHours, steps)
+	default:
+		return nil, fmt.Errorf("invalid forecast method '%s'. Valid values are: 'linear', 'holtwinters'", method)
+	}
+
+	forecast := &ResourceForecast{
+		Method:    method,
+		Threshold: threshold,
+		Items:     make([]*UsageForecastItem, steps),
+	}
+	lastDate := series[len(series)-1].DateUTC
+	for i := 0; i < steps; i++ {
+		ts := lastDate.Add(time.Duration(i+1) * time.Hour)
+		value := math.Max(values[i], 0)
+		forecast.Items[i] = &UsageForecastItem{
+			DateUTC: ts,
+			Value:   value,
+			Lower:   math.Max(values[i]-forecastConfidenceZ*deviations[i], 0),
+			Upper:   values[i] + forecastConfidenceZ*deviations[i],
+		}
+		if forecast.ThresholdCrossingUTC == nil && value >= threshold {
+			forecast.ThresholdCrossingUTC = &ts
+		}
+	}
+	return forecast, nil
+}
+
+// fillHourlyGaps returns a regular hourly series, where missing samples are linearly interpolated
+func fillHourlyGaps(items []*ResourceUsageItem) []*ResourceUsageItem {
+	var series []*ResourceUsageItem
+	for _, item := range items {
+		if len(series) > 0 {
+			prev := series[len(series)-1]
+			gap := int(item.DateUTC.Sub(prev.DateUTC) / time.Hour)
+			if gap <= 0 {
+				continue
+			}
+			for i := 1; i < gap; i++ {
+				series = append(series, &ResourceUsageItem{
+					DateUTC: prev.DateUTC.Add(time.Duration(i) * time.Hour),
+					Value:   prev.Value + (item.Value-prev.Value)*float64(i)/float64(gap),
+				})
+			}
+		}
+		series = append(series, item)
+	}
+	return series
+}
+
+// forecastLinear fits a least-squares line and returns forecasts along with the standard
+// deviation of the prediction at each step
+func forecastLinear(values []float64, steps int) ([]float64, []float64) {
+	n := float64(len(values))
+	meanX := (n - 1) / 2
+	meanY := 0.0
+	for _, v := range values {
+		meanY += v
+	}
+	meanY /= n
+
+	sxx, sxy := 0.0, 0.0
+	for i, v := range values {
+		dx := float64(i) - meanX
+		sxx += dx * dx
+		sxy += dx * (v - meanY)
+	}
+	slope := sxy / sxx
+	intercept := meanY - slope*meanX
+
+	sse := 0.0
+	for i, v := range values {
+		residual := v - (intercept + slope*float64(i))
+		sse += residual * residual
+	}
+	sigma := 0.0
+	if n > 2 {
+		sigma = math.Sqrt(sse / (n - 2))
+	}
+
+	forecasts := make([]float64, steps)
+	deviations := make([]float64, steps)
+	for h := 0; h < steps; h++ {
+		x := n + float64(h)
+		forecasts[h] = intercept + slope*x
+		deviations[h] = sigma * math.Sqrt(1+1/n+(x-meanX)*(x-meanX)/sxx)
+	}
+	return forecasts, deviations
+}
+
+// forecastHoltWinters applies additive Holt-Winters smoothing and returns forecasts along with
+// the standard deviation of the prediction at each step, estimated from one-step-ahead errors
+func forecastHoltWinters(values []float64, season int, steps int) ([]float64, []float64) {
+	// initialize level and trend from the first two seasons, and seasonal indices from the first one
+	level := 0.0
+	for i := 0; i < season; i++ {
+		level += values[i]
+	}
+	level /= float64(season)
+	trend := 0.0
+	for i := 0; i < season; i++ {
+		trend += (values[season+i] - values[i]) / float64(season)
+	}
+	trend /= float64(season)
+	seasonals := make([]float64, season)
+	for i := 0; i < season; i++ {
+		seasonals[i] = values[i] - level
+	}
+
+	sse := 0.0
+	for i := season; i < len(values); i++ {
+		seasonal := seasonals[i%season]
+		residual := values[i] - (level + trend + seasonal)
+		sse += residual * residual
+
+		prevLevel := level
+		level = holtWintersAlpha*(values[i]-seasonal) + (1-holtWintersAlpha)*(level+trend)
+		trend = holtWintersBeta*(level-prevLevel) + (1-holtWintersBeta)*trend
+		seasonals[i%season] = holtWintersGamma*(values[i]-level) + (1-holtWintersGamma)*seasonal
+	}
+	sigma := math.Sqrt(sse / float64(len(values)-season))
+
+	forecasts := make([]float64, steps)
+	deviations := make([]float64, steps)
+	for h := 0; h < steps; h++ {
+		forecasts[h] = level + float64(h+1)*trend + seasonals[(len(values)+h)%season]
+		deviations[h] = sigma * math.Sqrt(1+float64(h)*holtWintersAlpha*holtWintersAlpha)
+	}
+	return forecasts, deviations
+}
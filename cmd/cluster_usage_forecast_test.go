@@ -0,0 +1,167 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestParseHorizon(t *testing.T) {
+	Convey("Given horizon expressions", t, func() {
+		Convey("Then hours, days and weeks are supported", func() {
+			horizon, err := parseHorizon("12h")
+			So(err, ShouldBeNil)
+			So(horizon, ShouldEqual, 12*time.Hour)
+			horizon, err = parseHorizon("30d")
+			So(err, ShouldBeNil)
+			So(horizon, ShouldEqual, 30*24*time.Hour)
+			horizon, err = parseHorizon("2w")
+			So(err, ShouldBeNil)
+			So(horizon, ShouldEqual, 14*24*time.Hour)
+		})
+
+		Convey("Then invalid expressions are rejected", func() {
+			for _, horizon := range []string{"", "d", "-1d", "10m", "abc"} {
+				_, err := parseHorizon(horizon)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestForecastResourceUsage(t *testing.T) {
+	Convey("Given an hourly usage history", t, func() {
+		start := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+		newItems := func(hours int, value func(int) float64) []*ResourceUsageItem {
+			var items []*ResourceUsageItem
+			for i := 0; i < hours; i++ {
+				items = append(items, &ResourceUsageItem{DateUTC: start.Add(time.Duration(i) * time.Hour), Value: value(i)})
+			}
+			return items
+		}
+
+		Convey("When the usage grows linearly", func() {
+			items := newItems(48, func(i int) float64 { return 10 + 0.5*float64(i) })
+			forecast, err := forecastResourceUsage(items, 48*time.Hour, ForecastMethodLinear, 24, 50)
+
+			Convey("Then the linear trend is extended and the threshold crossing date is found", func() {
+				So(err, ShouldBeNil)
+				So(forecast.Items, ShouldHaveLength, 48)
+				So(forecast.Items[0].DateUTC, ShouldEqual, start.Add(48*time.Hour))
+				So(forecast.Items[0].Value, ShouldAlmostEqual, 34)
+				So(forecast.Items[0].Lower, ShouldAlmostEqual, 34)
+				So(forecast.ThresholdCrossingUTC, ShouldNotBeNil)
+				So(*forecast.ThresholdCrossingUTC, ShouldEqual, start.Add(80*time.Hour))
+			})
+		})
+
+		Convey("When the usage follows a daily pattern", func() {
+			daily := func(i int) float64 { return 40 + 10*math.Sin(2*math.Pi*float64(i%24)/24) }
+			items := newItems(24*7, daily)
+			forecast, err := forecastResourceUsage(items, 24*time.Hour, "", 24, 80)
+
+			Convey("Then Holt-Winters is selected and reproduces the pattern", func() {
+				So(err, ShouldBeNil)
+				So(forecast.Method, ShouldEqual, ForecastMethodHoltWinters)
+				for i, item := range forecast.Items {
+					So(item.Value, ShouldAlmostEqual, daily(24*7+i), 0.5)
+					So(item.Lower, ShouldBeLessThanOrEqualTo, item.Value)
+					So(item.Upper, ShouldBeGreaterThanOrEqualTo, item.Value)
+				}
+				So(forecast.ThresholdCrossingUTC, ShouldBeNil)
+			})
+		})
+
+		Convey("When samples are missing", func() {
+			items := []*ResourceUsageItem{
+				{DateUTC: start, Value: 10},
+				{DateUTC: start.Add(3 * time.Hour), Value: 40},
+			}
+
+			Convey("Then gaps are linearly interpolated", func() {
+				series := fillHourlyGaps(items)
+				So(series, ShouldHaveLength, 4)
+				So(series[1].Value, ShouldAlmostEqual, 20)
+				So(series[2].Value, ShouldAlmostEqual, 30)
+			})
+		})
+	})
+}
+
+func TestForecastHandler(t *testing.T) {
+	Convey("Given an API router and the history database of a cluster tracked for one hour", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_historydb_dir", tempDir)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+		origNow := now
+		now = func() time.Time { return date(c, "2020-06-30T23:00:00Z") }
+		usageDb := NewUsageDb(getHistoryDbPath("prod"), 100)
+		So(usageDb.CreateRRD(), ShouldBeNil)
+		So(usageDb.UpdateRRD(date(c, "2020-06-30T23:55:00Z"), 10, 20), ShouldBeNil)
+		nowUTC := date(c, "2020-07-01T00:00:00Z")
+		now = func() time.Time { return nowUTC }
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(target string) (*httptest.ResponseRecorder, *GetForecastResp) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+			forecastResp := &GetForecastResp{}
+			_ = json.Unmarshal(resp.Body.Bytes(), forecastResp)
+			return resp, forecastResp
+		}
+
+		Convey("When forecasts are requested", func() {
+			Convey("Then invalid and unknown clusters are rejected", func() {
+				resp, _ := serve("/api/forecast?cluster=..%2Fprod")
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				resp, forecastResp := serve("/api/forecast?cluster=staging")
+				So(resp.Code, ShouldEqual, http.StatusNotFound)
+				So(forecastResp.Message, ShouldEqual, "cluster not found => staging")
+				So(fileExists(getHistoryDbPath("staging")), ShouldBeFalse)
+			})
+
+			Convey("Then clusters without enough history are reported as such", func() {
+				resp, forecastResp := serve("/api/forecast?cluster=prod")
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				So(forecastResp.Message, ShouldStartWith, "not enough usage history to forecast")
+				resp, _ = serve("/api/v2/forecast?cluster=prod")
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				So(resp.Body.String(), ShouldContainSubstring, ErrorCodeInsufficientData)
+			})
+		})
+
+		Reset(func() {
+			now = origNow
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Options of the export commands
+var (
+	exportFormat    string
+	exportOutput    string
+	exportStartDate string
+	exportEndDate   string
+	exportCluster   string
+	exportPeriod    string
+	exportNodes     []string
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the stored usage history in a bulk analytics format",
+}
+
+var exportUsageHistoryCmd = &cobra.Command{
+	Use:   "usagehistory",
+	Short: "Export the usage history of all clusters, or of the namespaces of a cluster",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !isBulkExportFormat(exportFormat) {
+			return fmt.Errorf("invalid format '%s'. Valid values are: 'ndjson', 'parquet'", exportFormat)
+		}
+		if exportPeriod != "hourly" && exportPeriod != "monthly" {
+			return fmt.Errorf("invalid period '%s'. Valid values are: 'hourly', 'monthly'", exportPeriod)
+		}
+		startDateUTC, endDateUTC, err := parseExportPeriod(exportStartDate, exportEndDate)
+		if err != nil {
+			return err
+		}
+		historyDbs, err := listStoredHistoryDbs(exportCluster)
+		if err != nil {
+			return errors.Wrap(err, "failed listing history databases")
+		}
+		return writeExport(exportOutput, func(w io.Writer) error {
+			return exportUsageHistory(w, exportFormat, historyDbs, exportPeriod, startDateUTC, endDateUTC, 0)
+		})
+	},
+}
+
+var exportNodesUsageCmd = &cobra.Command{
+	Use:   "nodesusage",
+	Short: "Export the capacity, allocatable and usage by pods history of nodes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !isBulkExportFormat(exportFormat) {
+			return fmt.Errorf("invalid format '%s'. Valid values are: 'ndjson', 'parquet'", exportFormat)
+		}
+		startDateUTC, endDateUTC, err := parseExportPeriod(exportStartDate, exportEndDate)
+		if err != nil {
+			return err
+		}
+		nodeNames := exportNodes
+		if len(nodeNames) == 0 {
+			if nodeNames, err = listStoredNodeNames(); err != nil {
+				return errors.Wrap(err, "failed listing node databases")
+			}
+		}
+		step := nodeUsageStep(startDateUTC, endDateUTC)
+		return writeExport(exportOutput, func(w io.Writer) error {
+			return exportNodesUsage(w, exportFormat, nodeNames, startDateUTC, endDateUTC, step)
+		})
+	},
+}
+
+var exportOpenMetricsCmd = &cobra.Command{
+	Use:   "openmetrics",
+	Short: "Export the history of clusters, namespaces and nodes in the OpenMetrics format, to backfill Prometheus",
+	Long: `Export the history of clusters, namespaces and nodes in the OpenMetrics text format.
+The output can be turned into Prometheus TSDB blocks with:
+  promtool tsdb create-blocks-from openmetrics <file> <data dir>`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		startDateUTC, endDateUTC, err := parseExportPeriod(exportStartDate, exportEndDate)
+		if err != nil {
+			return err
+		}
+		return writeExport(exportOutput, func(w io.Writer) error {
+			return exportOpenMetrics(w, startDateUTC, endDateUTC)
+		})
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{exportUsageHistoryCmd, exportNodesUsageCmd, exportOpenMetricsCmd} {
+		cmd.Flags().StringVarP(&exportOutput, "output", "o", "-", "output file, - for the standard output")
+		cmd.Flags().StringVar(&exportStartDate, "start", "", "start of the period as a UTC date formatted as 2006-01-02T15:04:05, a RFC 3339 date, a Unix timestamp or relative to now such as -7d (default 24 hours before the end)")
+		cmd.Flags().StringVar(&exportEndDate, "end", "", "end of the period as a UTC date formatted as 2006-01-02T15:04:05, a RFC 3339 date, a Unix timestamp or relative to now such as now-1h (default now)")
+		cmd.SilenceUsage, cmd.SilenceErrors = true, true
+		exportCmd.AddCommand(cmd)
+	}
+	exportUsageHistoryCmd.Flags().StringVar(&exportFormat, "format", ExportFormatNDJSON, "export format: ndjson or parquet")
+	exportNodesUsageCmd.Flags().StringVar(&exportFormat, "format", ExportFormatNDJSON, "export format: ndjson or parquet")
+	exportUsageHistoryCmd.Flags().StringVar(&exportCluster, "cluster", "", "export the namespaces of this cluster instead of all clusters")
+	exportUsageHistoryCmd.Flags().StringVar(&exportPeriod, "period", "hourly", "resolution of the history: hourly or monthly")
+	exportNodesUsageCmd.Flags().StringSliceVar(&exportNodes, "node", nil, "nodes to export, all nodes having a database by default")
+}
+
+// parseExportPeriod returns the period of an export, the last 24 hours by default. Dates are parsed as in API queries
+func parseExportPeriod(startDate string, endDate string) (startDateUTC time.Time, endDateUTC time.Time, err error) {
+	now := time.Now().UTC()
+	endDateUTC = now
+	if endDate != "" {
+		if endDateUTC, err = parseQueryTime(endDate, now, time.UTC); err != nil {
+			return startDateUTC, endDateUTC, errors.Wrap(err, "invalid end date")
+		}
+	}
+	startDateUTC = endDateUTC.Add(-24 * time.Hour)
+	if startDate != "" {
+		if startDateUTC, err = parseQueryTime(startDate, now, time.UTC); err != nil {
+			return startDateUTC, endDateUTC, errors.Wrap(err, "invalid start date")
+		}
+	}
+	if startDateUTC.After(endDateUTC) {
+		return startDateUTC, endDateUTC, fmt.Errorf("the start date %v is after the end date %v", startDate, endDate)
+	}
+	return startDateUTC, endDateUTC, nil
+}
+
+// writeExport runs an export to a file, or to the standard output when the output is '-'. An incomplete file is
+// removed
+func writeExport(output string, export func(w io.Writer) error) error {
+	if output == "-" {
+		out := bufio.NewWriter(os.Stdout)
+		if err := export(out); err != nil {
+			return err
+		}
+		return out.Flush()
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return errors.Wrap(err, "failed creating output file")
+	}
+	out := bufio.NewWriter(file)
+	err = export(out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(output)
+	}
+	return err
+}
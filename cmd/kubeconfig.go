@@ -18,12 +18,14 @@
 package cmd
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -50,11 +52,35 @@ type KubeConfig struct {
 
 // ManagedCluster holds an object describing managed clusters
 type ManagedCluster struct {
-	Name        string         `json:"name,omitempty"`
-	APIEndpoint string         `json:"apiEndpoint,omitempty"`
-	AuthInfo    *kapi.AuthInfo `json:"authInfo,omitempty"`
-	CaData      []byte         `json:"cacert,omitempty"`
-	AuthType    int            `json:"authType,omitempty"`
+	Name           string         `json:"name,omitempty"`
+	APIEndpoint    string         `json:"apiEndpoint,omitempty"`
+	AuthInfo       *kapi.AuthInfo `json:"authInfo,omitempty"`
+	CaData         []byte         `json:"cacert,omitempty"`
+	AuthType       int            `json:"authType,omitempty"`
+	KubeConfigPath string         `json:"kubeconfigPath,omitempty"`
+	Disabled       bool           `json:"disabled,omitempty"`
+}
+
+var (
+	defaultKubeConfigOnce sync.Once
+	defaultKubeConfigPath string
+)
+
+// getDefaultKubeConfigPath returns the path set by the kubeconfig flag. The flag is defined and parsed once, since
+// the API loads the configuration at each request, concurrently
+func getDefaultKubeConfigPath() string {
+	defaultKubeConfigOnce.Do(func() {
+		if flag.Lookup("kubeconfig") == nil {
+			if home := UserHomeDir(); home != "" {
+				flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+			} else {
+				flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+			}
+			flag.Parse()
+		}
+		defaultKubeConfigPath = flag.Lookup("kubeconfig").Value.String()
+	})
+	return defaultKubeConfigPath
 }
 
 // NewKubeConfig creates a new KubeConfig object
@@ -69,18 +95,11 @@ func NewKubeConfig() *KubeConfig {
 		return config
 	}
 
-	var defaultKubeConfig *string
-	if home := UserHomeDir(); home != "" {
-		defaultKubeConfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+	defaultKubeConfig := getDefaultKubeConfigPath()
+	if _, err := os.Stat(defaultKubeConfig); err != nil {
+		log.WithError(err).Debugln("ignoring the default KUBECONFIG path", defaultKubeConfig)
 	} else {
-		defaultKubeConfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-	}
-	flag.Parse()
-
-	if _, err := os.Stat(*defaultKubeConfig); err != nil {
-		log.WithError(err).Debugln("ignoring the default KUBECONFIG path", *defaultKubeConfig)
-	} else {
-		config.Paths = append(config.Paths, *defaultKubeConfig)
+		config.Paths = append(config.Paths, defaultKubeConfig)
 	}
 
 	kconfigDir := viper.GetString("krossboard_kubeconfig_dir")
@@ -109,32 +128,62 @@ func (m *KubeConfig) ListClusters() map[string]*ManagedCluster {
 			log.WithError(err).Errorln("failed reading KUBECONFIG", path)
 			continue
 		}
+		addManagedClusters(managedClusters, config, path)
+	}
 
-		authInfos := make(map[string]string)
-		for user, authInfo := range config.AuthInfos {
-			authInfos[user] = authInfo.Token
-		}
+	disabledClusters, err := loadDisabledClusters()
+	if err != nil {
+		log.WithError(err).Errorln("failed reading disabled clusters")
+	}
+	for clusterName, cluster := range managedClusters {
+		cluster.Disabled = disabledClusters[clusterName]
+	}
+	return managedClusters
+}
 
-		for clusterName, clusterInfo := range config.Clusters {
-			clusterNameEscaped := strings.ReplaceAll(clusterName, "/", "@")
-			managedClusters[clusterNameEscaped] = &ManagedCluster{
-				Name:        clusterNameEscaped,
-				APIEndpoint: clusterInfo.Server,
-				CaData:      clusterInfo.CertificateAuthorityData,
-			}
+// addManagedClusters adds the clusters of a KUBECONFIG loaded from path, along with the AuthInfo of their context
+func addManagedClusters(managedClusters map[string]*ManagedCluster, config *kapi.Config, path string) {
+	for clusterName, clusterInfo := range config.Clusters {
+		clusterNameEscaped := strings.ReplaceAll(clusterName, "/", "@")
+		managedClusters[clusterNameEscaped] = &ManagedCluster{
+			Name:           clusterNameEscaped,
+			APIEndpoint:    clusterInfo.Server,
+			CaData:         clusterInfo.CertificateAuthorityData,
+			KubeConfigPath: path,
 		}
-		for _, context := range config.Contexts {
-			clusterNameEscaped := strings.ReplaceAll(context.Cluster, "/", "@")
-			if cluster, found := managedClusters[clusterNameEscaped]; found {
-				cluster.AuthInfo = config.AuthInfos[context.AuthInfo]
-			}
+	}
+	for _, context := range config.Contexts {
+		clusterNameEscaped := strings.ReplaceAll(context.Cluster, "/", "@")
+		if cluster, found := managedClusters[clusterNameEscaped]; found {
+			cluster.AuthInfo = config.AuthInfos[context.AuthInfo]
 		}
 	}
-	return managedClusters
+}
+
+// detectAuthType returns the type of credentials the cluster credentials handler can get from an AuthInfo,
+// without running authentication hooks
+func detectAuthType(authInfo *kapi.AuthInfo) int {
+	switch {
+	case authInfo == nil:
+		return AuthTypeUnknown
+	case authInfo.Token != "" || authInfo.AuthProvider != nil || authInfo.Exec != nil:
+		return AuthTypeBearerToken
+	case len(authInfo.ClientCertificateData) != 0 && len(authInfo.ClientKeyData) != 0:
+		return AuthTypeX509Cert
+	case authInfo.Username != "" && authInfo.Password != "":
+		return AuthTypeBasicToken
+	}
+	return AuthTypeUnknown
 }
 
 // GetAccessToken retrieves access token from AuthInfo
 func (m *KubeConfig) GetAccessToken(authInfo *kapi.AuthInfo) (string, error) {
+	return m.GetAccessTokenContext(context.Background(), authInfo)
+}
+
+// GetAccessTokenContext retrieves access token from AuthInfo, killing the authentication command when the context
+// is done
+func (m *KubeConfig) GetAccessTokenContext(ctx context.Context, authInfo *kapi.AuthInfo) (string, error) {
 	if authInfo == nil {
 		return "", errors.New("no AuthInfo provided")
 	}
@@ -170,7 +219,7 @@ func (m *KubeConfig) GetAccessToken(authInfo *kapi.AuthInfo) (string, error) {
 	if err != nil {
 		return "", errors.New(fmt.Sprintf("authHookCmd (%s) not found in PATH", authHookCmdName))
 	}
-	cmd := exec.Command(authHookCmdAbsPath, args...)
+	cmd := exec.CommandContext(ctx, authHookCmdAbsPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", errors.Wrap(err, string(out))
@@ -0,0 +1,140 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var kubeConfigCmd = &cobra.Command{
+	Use:   "kubeconfig",
+	Short: "Manage the KUBECONFIG files uploaded to the KUBECONFIG directory and the processed clusters",
+}
+
+var kubeConfigListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the KUBECONFIG files with the clusters and contexts they define",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kubeConfigs, err := listKubeConfigFiles()
+		if err != nil {
+			return errors.Wrap(err, "failed listing KUBECONFIG files")
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "NAME\tMODIFIED\tCLUSTERS\tCONTEXTS")
+		for _, kubeConfig := range kubeConfigs {
+			clusters := make([]string, 0, len(kubeConfig.Clusters))
+			for _, cluster := range kubeConfig.Clusters {
+				if cluster.Enabled {
+					clusters = append(clusters, cluster.Name)
+				} else {
+					clusters = append(clusters, cluster.Name+" (disabled)")
+				}
+			}
+			contexts := make([]string, 0, len(kubeConfig.Contexts))
+			for _, context := range kubeConfig.Contexts {
+				contexts = append(contexts, context.Name)
+			}
+			if kubeConfig.Error != "" {
+				clusters = []string{"invalid: " + kubeConfig.Error}
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", kubeConfig.Name, kubeConfig.ModifiedUTC.Format(queryTimeLayout),
+				strings.Join(clusters, ","), strings.Join(contexts, ","))
+		}
+		return out.Flush()
+	},
+}
+
+var kubeConfigShowCmd = &cobra.Command{
+	Use:   "show NAME",
+	Short: "Print a KUBECONFIG file with credentials redacted",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kubeConfig, content, err := showKubeConfig(args[0])
+		if err != nil {
+			return err
+		}
+		if kubeConfig.Error != "" {
+			return fmt.Errorf("invalid KUBECONFIG content: %s", kubeConfig.Error)
+		}
+		fmt.Print(content)
+		return nil
+	},
+}
+
+var kubeConfigReplaceCmd = &cobra.Command{
+	Use:   "replace NAME FILE",
+	Short: "Replace the content of a KUBECONFIG file",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		return replaceKubeConfig(args[0], data)
+	},
+}
+
+var kubeConfigDeleteCmd = &cobra.Command{
+	Use:   "delete NAME",
+	Short: "Delete a KUBECONFIG file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return deleteKubeConfig(args[0])
+	},
+}
+
+var kubeConfigEnableCmd = &cobra.Command{
+	Use:   "enable CLUSTER",
+	Short: "Resume the processing of a cluster",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setKubeConfigClusterEnabled(args[0], true)
+	},
+}
+
+var kubeConfigDisableCmd = &cobra.Command{
+	Use:   "disable CLUSTER",
+	Short: "Stop processing a cluster, its data being kept",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setKubeConfigClusterEnabled(args[0], false)
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{kubeConfigListCmd, kubeConfigShowCmd, kubeConfigReplaceCmd, kubeConfigDeleteCmd, kubeConfigEnableCmd, kubeConfigDisableCmd} {
+		cmd.SilenceUsage, cmd.SilenceErrors = true, true
+		kubeConfigCmd.AddCommand(cmd)
+	}
+}
+
+// setKubeConfigClusterEnabled enables or disables a cluster found in KUBECONFIG
+func setKubeConfigClusterEnabled(clusterName string, enabled bool) error {
+	if _, found := NewKubeConfig().ListClusters()[clusterName]; !found && !enabled {
+		return fmt.Errorf("cluster '%s' not found in KUBECONFIG", clusterName)
+	}
+	return setClusterEnabled(clusterName, enabled)
+}
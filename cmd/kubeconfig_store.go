@@ -0,0 +1,355 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	kclient "k8s.io/client-go/tools/clientcmd"
+	kapi "k8s.io/client-go/tools/clientcmd/api"
+	kapiv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// redactedValue replaces secrets in the KUBECONFIG files returned to users
+const redactedValue = "REDACTED"
+
+// disabledClustersLockTimeout bounds the wait for the lock of the disabled clusters file, after which a lock left
+// by a crashed process is dropped
+const disabledClustersLockTimeout = 10 * time.Second
+
+// disabledClustersMu serializes the updates of the disabled clusters file within the process
+var disabledClustersMu sync.Mutex
+
+// KubeConfigCluster describes a cluster defined in a KUBECONFIG file
+type KubeConfigCluster struct {
+	Name    string `json:"name"`
+	Server  string `json:"server"`
+	Enabled bool   `json:"enabled"`
+}
+
+// KubeConfigContext describes a context defined in a KUBECONFIG file
+type KubeConfigContext struct {
+	Name    string `json:"name"`
+	Cluster string `json:"cluster"`
+	User    string `json:"user"`
+}
+
+// KubeConfigFileInfo describes a KUBECONFIG file of the KUBECONFIG directory
+type KubeConfigFileInfo struct {
+	Name           string               `json:"name"`
+	SizeBytes      int64                `json:"sizeBytes"`
+	ModifiedUTC    time.Time            `json:"modifiedUTC"`
+	CurrentContext string               `json:"currentContext,omitempty"`
+	Clusters       []*KubeConfigCluster `json:"clusters"`
+	Contexts       []*KubeConfigContext `json:"contexts"`
+	Error          string               `json:"error,omitempty"`
+}
+
+func getDisabledClustersPath() string {
+	return fmt.Sprintf("%s/.disabled-clusters.json", viper.GetString("krossboard_kubeconfig_dir"))
+}
+
+func getDisabledClustersLockPath() string {
+	return fmt.Sprintf("%s/.disabled-clusters.lock", viper.GetString("krossboard_kubeconfig_dir"))
+}
+
+// lockDisabledClusters serializes the updates of the disabled clusters file, across processes since both the API
+// and the command line update it. The returned function releases the lock
+func lockDisabledClusters() (func(), error) {
+	disabledClustersMu.Lock()
+	lockPath := getDisabledClustersLockPath()
+	deadline := time.Now().Add(disabledClustersLockTimeout)
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_ = lockFile.Close()
+			return func() {
+				_ = os.Remove(lockPath)
+				disabledClustersMu.Unlock()
+			}, nil
+		}
+		if !os.IsExist(err) {
+			disabledClustersMu.Unlock()
+			return nil, err
+		}
+		if stat, err := os.Stat(lockPath); err == nil && time.Since(stat.ModTime()) > disabledClustersLockTimeout {
+			log.WithField("path", lockPath).Warnln("dropping an expired lock of the disabled clusters file")
+			_ = os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			disabledClustersMu.Unlock()
+			return nil, fmt.Errorf("timed out waiting for the lock %s", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// getKubeConfigFilePath returns the path of a file of the KUBECONFIG directory, rejecting names that would point
+// outside of it or to hidden files
+func getKubeConfigFilePath(name string) (string, error) {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return "", &invalidKubeConfigError{fmt.Sprintf("name '%s'", name)}
+	}
+	return fmt.Sprintf("%s/%s", viper.GetString("krossboard_kubeconfig_dir"), name), nil
+}
+
+// loadDisabledClusters returns the names of the clusters excluded from processing
+func loadDisabledClusters() (map[string]bool, error) {
+	disabledClusters := make(map[string]bool)
+	data, err := ioutil.ReadFile(getDisabledClustersPath())
+	if os.IsNotExist(err) {
+		return disabledClusters, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var clusterNames []string
+	if err := json.Unmarshal(data, &clusterNames); err != nil {
+		return nil, errors.Wrap(err, "invalid disabled clusters file")
+	}
+	for _, clusterName := range clusterNames {
+		disabledClusters[clusterName] = true
+	}
+	return disabledClusters, nil
+}
+
+// setClusterEnabled enables or disables the processing of a cluster
+func setClusterEnabled(clusterName string, enabled bool) error {
+	if err := createDirIfNotExists(viper.GetString("krossboard_kubeconfig_dir")); err != nil {
+		return err
+	}
+	unlock, err := lockDisabledClusters()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	disabledClusters, err := loadDisabledClusters()
+	if err != nil {
+		return err
+	}
+	if enabled {
+		delete(disabledClusters, clusterName)
+	} else {
+		disabledClusters[clusterName] = true
+	}
+	clusterNames := make([]string, 0, len(disabledClusters))
+	for name := range disabledClusters {
+		clusterNames = append(clusterNames, name)
+	}
+	sort.Strings(clusterNames)
+	serializedData, _ := json.Marshal(clusterNames)
+	return writeFileAtomically(getDisabledClustersPath(), serializedData, 0644)
+}
+
+// describeKubeConfig lists the clusters and contexts of a KUBECONFIG, sorted by name
+func describeKubeConfig(info *KubeConfigFileInfo, config *kapi.Config, disabledClusters map[string]bool) {
+	info.CurrentContext = config.CurrentContext
+	info.Clusters = []*KubeConfigCluster{}
+	info.Contexts = []*KubeConfigContext{}
+	for clusterName, cluster := range config.Clusters {
+		clusterNameEscaped := strings.ReplaceAll(clusterName, "/", "@")
+		info.Clusters = append(info.Clusters, &KubeConfigCluster{
+			Name:    clusterNameEscaped,
+			Server:  cluster.Server,
+			Enabled: !disabledClusters[clusterNameEscaped],
+		})
+	}
+	for contextName, context := range config.Contexts {
+		info.Contexts = append(info.Contexts, &KubeConfigContext{
+			Name:    contextName,
+			Cluster: strings.ReplaceAll(context.Cluster, "/", "@"),
+			User:    context.AuthInfo,
+		})
+	}
+	sort.Slice(info.Clusters, func(i, j int) bool { return info.Clusters[i].Name < info.Clusters[j].Name })
+	sort.Slice(info.Contexts, func(i, j int) bool { return info.Contexts[i].Name < info.Contexts[j].Name })
+}
+
+// getKubeConfigFileInfo describes a file of the KUBECONFIG directory along with its parsed content
+func getKubeConfigFileInfo(name string, disabledClusters map[string]bool) (*KubeConfigFileInfo, *kapi.Config, error) {
+	path, err := getKubeConfigFilePath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &KubeConfigFileInfo{
+		Name:        name,
+		SizeBytes:   stat.Size(),
+		ModifiedUTC: stat.ModTime().UTC(),
+		Clusters:    []*KubeConfigCluster{},
+		Contexts:    []*KubeConfigContext{},
+	}
+	config, err := kclient.Load(data)
+	if err != nil {
+		info.Error = err.Error()
+		return info, nil, nil
+	}
+	describeKubeConfig(info, config, disabledClusters)
+	return info, config, nil
+}
+
+// listKubeConfigFiles describes the files of the KUBECONFIG directory, sorted by name
+func listKubeConfigFiles() ([]*KubeConfigFileInfo, error) {
+	kubeConfigFiles, err := listRegularFiles(viper.GetString("krossboard_kubeconfig_dir"))
+	if os.IsNotExist(err) {
+		return []*KubeConfigFileInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	disabledClusters, err := loadDisabledClusters()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*KubeConfigFileInfo, 0, len(kubeConfigFiles))
+	for _, kubeConfigFile := range kubeConfigFiles {
+		info, _, err := getKubeConfigFileInfo(filepath.Base(kubeConfigFile), disabledClusters)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// redactKubeConfig replaces the credentials of a KUBECONFIG by a placeholder. Client keys are removed and
+// referenced as a redacted file, since key data would be base64-encoded
+func redactKubeConfig(config *kapi.Config) {
+	for _, authInfo := range config.AuthInfos {
+		if authInfo.Token != "" {
+			authInfo.Token = redactedValue
+		}
+		if authInfo.Password != "" {
+			authInfo.Password = redactedValue
+		}
+		if len(authInfo.ClientKeyData) != 0 {
+			authInfo.ClientKeyData = nil
+			authInfo.ClientKey = redactedValue
+		}
+		if authInfo.AuthProvider != nil {
+			for key := range authInfo.AuthProvider.Config {
+				lowerKey := strings.ToLower(key)
+				// cmd-args holds the arguments of the gcp provider command, which may include credentials
+				if strings.Contains(lowerKey, "token") || strings.Contains(lowerKey, "secret") || lowerKey == "cmd-args" {
+					authInfo.AuthProvider.Config[key] = redactedValue
+				}
+			}
+		}
+		if authInfo.Exec != nil {
+			for i := range authInfo.Exec.Env {
+				authInfo.Exec.Env[i].Value = redactedValue
+			}
+			for i, arg := range authInfo.Exec.Args {
+				authInfo.Exec.Args[i] = redactExecArg(arg)
+			}
+		}
+	}
+}
+
+// redactExecArg redacts an argument of a credentials plugin command, keeping flag names so that the
+// command stays readable
+func redactExecArg(arg string) string {
+	if !strings.HasPrefix(arg, "-") {
+		return redactedValue
+	}
+	if i := strings.Index(arg, "="); i >= 0 {
+		return arg[:i+1] + redactedValue
+	}
+	return arg
+}
+
+// showKubeConfig returns the description of a file of the KUBECONFIG directory and its content with
+// credentials redacted
+func showKubeConfig(name string) (*KubeConfigFileInfo, string, error) {
+	disabledClusters, err := loadDisabledClusters()
+	if err != nil {
+		return nil, "", err
+	}
+	info, config, err := getKubeConfigFileInfo(name, disabledClusters)
+	if err != nil || config == nil {
+		return info, "", err
+	}
+	redactKubeConfig(config)
+	// the v1 config is encoded with encoding/json, as kclient.Write relies on json-iterator
+	v1Config := &kapiv1.Config{}
+	if err := kapiv1.Convert_api_Config_To_v1_Config(config, v1Config, nil); err != nil {
+		return nil, "", errors.Wrap(err, "failed converting KUBECONFIG")
+	}
+	v1Config.APIVersion, v1Config.Kind = "v1", "Config"
+	content, err := yaml.Marshal(v1Config)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed encoding KUBECONFIG")
+	}
+	return info, string(content), nil
+}
+
+// replaceKubeConfig replaces the content of an existing file of the KUBECONFIG directory, once validated
+func replaceKubeConfig(name string, data []byte) error {
+	path, err := getKubeConfigFilePath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	if _, err := kclient.Load(data); err != nil {
+		return &invalidKubeConfigError{fmt.Sprintf("content: %v", err)}
+	}
+	return writeFileAtomically(path, data, 0600)
+}
+
+// deleteKubeConfig removes a file of the KUBECONFIG directory
+func deleteKubeConfig(name string) error {
+	path, err := getKubeConfigFilePath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// invalidKubeConfigError reports an invalid KUBECONFIG name or content
+type invalidKubeConfigError struct {
+	reason string
+}
+
+func (m *invalidKubeConfigError) Error() string {
+	return "invalid KUBECONFIG " + m.reason
+}
@@ -0,0 +1,233 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestKubeConfigStore(t *testing.T) {
+	Convey("Given a KUBECONFIG directory with an uploaded file", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_kubeconfig_dir", tempDir)
+		viper.Set(KubeConfigKey, "")
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+
+		So(ioutil.WriteFile(tempDir+"/kubeconfig-uploaded-1", []byte(`
+apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- cluster: {server: "https://prod.example.com"}
+  name: prod
+- cluster: {server: "https://dev.example.com"}
+  name: dev
+contexts:
+- context: {cluster: prod, user: prod-admin}
+  name: prod
+- context: {cluster: dev, user: dev-admin}
+  name: dev
+users:
+- name: prod-admin
+  user: {token: s3cr3t-token, client-key-data: czNjcjN0LWtleQ==}
+- name: dev-admin
+  user:
+    username: admin
+    password: s3cr3t-password
+    auth-provider: {name: gcp, config: {client-id: krossboard, id-token: s3cr3t-id, cmd-args: "--key s3cr3t-cmd-arg"}}
+- name: ci
+  user:
+    exec: {apiVersion: client.authentication.k8s.io/v1beta1, command: get-token, args: [--cluster=prod, --secret=s3cr3t-exec-arg, s3cr3t-positional, --verbose]}
+`), 0600), ShouldBeNil)
+		So(ioutil.WriteFile(tempDir+"/kubeconfig-uploaded-2", []byte("not: [a kubeconfig"), 0600), ShouldBeNil)
+
+		useTestAdminAPIKey(c, tempDir)
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(method string, target string, kubeconfig []byte) *httptest.ResponseRecorder {
+			body := &bytes.Buffer{}
+			contentType := ""
+			if kubeconfig != nil {
+				form := multipart.NewWriter(body)
+				part, _ := form.CreateFormFile("kubeconfig", "kubeconfig")
+				_, _ = part.Write(kubeconfig)
+				_ = form.Close()
+				contentType = form.FormDataContentType()
+			}
+			req := httptest.NewRequest(method, target, body)
+			req.Header.Set("X-API-Key", testAdminAPIKey)
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("When the files are listed", func() {
+			resp := serve("GET", "/api/kubeconfigs", nil)
+			kubeConfigsResp := &GetKubeConfigsResp{}
+			err := json.Unmarshal(resp.Body.Bytes(), kubeConfigsResp)
+
+			Convey("Then their clusters and contexts are described", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(err, ShouldBeNil)
+				So(kubeConfigsResp.KubeConfigs, ShouldHaveLength, 2)
+				uploaded := kubeConfigsResp.KubeConfigs[0]
+				So(uploaded.Name, ShouldEqual, "kubeconfig-uploaded-1")
+				So(uploaded.CurrentContext, ShouldEqual, "prod")
+				So(uploaded.Clusters, ShouldResemble, []*KubeConfigCluster{
+					{Name: "dev", Server: "https://dev.example.com", Enabled: true},
+					{Name: "prod", Server: "https://prod.example.com", Enabled: true},
+				})
+				So(uploaded.Contexts[1], ShouldResemble, &KubeConfigContext{Name: "prod", Cluster: "prod", User: "prod-admin"})
+				So(kubeConfigsResp.KubeConfigs[1].Error, ShouldNotBeEmpty)
+			})
+		})
+
+		Convey("When a file is shown", func() {
+			resp := serve("GET", "/api/kubeconfigs/kubeconfig-uploaded-1", nil)
+			kubeConfigResp := &GetKubeConfigResp{}
+			err := json.Unmarshal(resp.Body.Bytes(), kubeConfigResp)
+
+			Convey("Then its credentials are redacted", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(err, ShouldBeNil)
+				So(kubeConfigResp.KubeConfig.Name, ShouldEqual, "kubeconfig-uploaded-1")
+				So(kubeConfigResp.Content, ShouldContainSubstring, "https://prod.example.com")
+				So(kubeConfigResp.Content, ShouldContainSubstring, "client-id: krossboard")
+				So(kubeConfigResp.Content, ShouldContainSubstring, redactedValue)
+				So(kubeConfigResp.Content, ShouldContainSubstring, "command: get-token")
+				So(kubeConfigResp.Content, ShouldContainSubstring, "--secret="+redactedValue)
+				So(kubeConfigResp.Content, ShouldContainSubstring, "--verbose")
+				So(kubeConfigResp.Content, ShouldNotContainSubstring, "s3cr3t")
+				So(kubeConfigResp.Content, ShouldNotContainSubstring, "czNjcjN0LWtleQ==")
+			})
+		})
+
+		Convey("When a file is replaced", func() {
+			invalidResp := serve("PUT", "/api/kubeconfigs/kubeconfig-uploaded-1", []byte("not: [a kubeconfig"))
+			missingResp := serve("PUT", "/api/kubeconfigs/kubeconfig-uploaded-3", []byte("apiVersion: v1\nkind: Config\n"))
+			resp := serve("PUT", "/api/kubeconfigs/kubeconfig-uploaded-2", []byte(`
+apiVersion: v1
+kind: Config
+clusters:
+- cluster: {server: "https://ops.example.com"}
+  name: ops
+`))
+
+			Convey("Then only valid content replaces existing files", func() {
+				So(invalidResp.Code, ShouldEqual, http.StatusBadRequest)
+				So(missingResp.Code, ShouldEqual, http.StatusNotFound)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(NewKubeConfig().ListClusters(), ShouldContainKey, "ops")
+				So(NewKubeConfig().ListClusters(), ShouldContainKey, "prod")
+			})
+		})
+
+		Convey("When a file is deleted", func() {
+			resp := serve("DELETE", "/api/kubeconfigs/kubeconfig-uploaded-1", nil)
+
+			Convey("Then its clusters are no longer managed", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(NewKubeConfig().ListClusters(), ShouldBeEmpty)
+				So(serve("DELETE", "/api/kubeconfigs/kubeconfig-uploaded-1", nil).Code, ShouldEqual, http.StatusNotFound)
+				So(serve("GET", "/api/kubeconfigs/.disabled-clusters.json", nil).Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Convey("When a cluster is disabled", func() {
+			resp := serve("POST", "/api/clusters/prod/disable", nil)
+
+			Convey("Then it's flagged until enabled again", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(NewKubeConfig().ListClusters()["prod"].Disabled, ShouldBeTrue)
+				So(NewKubeConfig().ListClusters()["dev"].Disabled, ShouldBeFalse)
+				kubeConfigs, err := listKubeConfigFiles()
+				So(err, ShouldBeNil)
+				So(kubeConfigs, ShouldHaveLength, 2)
+				So(kubeConfigs[0].Clusters[1].Enabled, ShouldBeFalse)
+
+				So(serve("POST", "/api/clusters/unknown/disable", nil).Code, ShouldEqual, http.StatusNotFound)
+				So(serve("POST", "/api/clusters/prod/enable", nil).Code, ShouldEqual, http.StatusOK)
+				So(NewKubeConfig().ListClusters()["prod"].Disabled, ShouldBeFalse)
+			})
+		})
+
+		Convey("When clusters are disabled concurrently", func() {
+			var wg sync.WaitGroup
+			errs := make([]error, 10)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = setClusterEnabled("cluster-"+strconv.Itoa(i), false)
+				}(i)
+			}
+			wg.Wait()
+
+			Convey("Then no update is lost", func() {
+				So(errs, ShouldResemble, make([]error, 10))
+				disabledClusters, err := loadDisabledClusters()
+				So(err, ShouldBeNil)
+				So(disabledClusters, ShouldHaveLength, 10)
+				_, err = os.Stat(getDisabledClustersLockPath())
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the disabled clusters file is locked by another process", func() {
+			So(ioutil.WriteFile(getDisabledClustersLockPath(), nil, 0600), ShouldBeNil)
+
+			Convey("Then the lock is only dropped once expired", func() {
+				expiredDate := time.Now().Add(-2 * disabledClustersLockTimeout)
+				done := make(chan error)
+				go func() { done <- setClusterEnabled("prod", false) }()
+				select {
+				case <-done:
+					So("updated while locked", ShouldBeEmpty)
+				case <-time.After(200 * time.Millisecond):
+				}
+				So(os.Chtimes(getDisabledClustersLockPath(), expiredDate, expiredDate), ShouldBeNil)
+				So(<-done, ShouldBeNil)
+				So(NewKubeConfig().ListClusters()["prod"].Disabled, ShouldBeTrue)
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
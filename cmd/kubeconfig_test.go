@@ -21,6 +21,7 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/spf13/viper"
 	"io/ioutil"
+	"sync"
 	"testing"
 )
 
@@ -85,4 +86,29 @@ users:
 			So(cfg.Paths[1], ShouldNotBeEmpty)
 		})
 	})
-}
\ No newline at end of file
+}
+func TestNewKubeConfigConcurrently(t *testing.T) {
+	Convey("Given no KUBECONFIG setting", t, func() {
+		viper.Set(KubeConfigKey, "")
+		viper.Set("krossboard_kubeconfig_dir", "/nonexistent")
+
+		Convey("When configurations are loaded concurrently, as API requests do", func() {
+			var wg sync.WaitGroup
+			configs := make([]*KubeConfig, 8)
+			for i := range configs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					configs[i] = NewKubeConfig()
+				}(i)
+			}
+			wg.Wait()
+
+			Convey("Then they all resolve the same default path", func() {
+				for _, config := range configs {
+					So(config.Paths, ShouldResemble, configs[0].Paths)
+				}
+			})
+		})
+	})
+}
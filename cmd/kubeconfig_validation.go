@@ -0,0 +1,244 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/version"
+	kapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Validation modes of the uploaded KUBECONFIG files
+const (
+	KubeConfigValidationNone   = "none"
+	KubeConfigValidationWarn   = "warn"
+	KubeConfigValidationStrict = "strict"
+)
+
+// kubeConfigValidationMaxTimeout bounds the validation of the clusters of a KUBECONFIG, so that reports are
+// returned before the API write timeout
+const kubeConfigValidationMaxTimeout = apiWriteTimeout - 5*time.Second
+
+// koaRequiredPermissions holds the permissions kube-opex-analytics needs on the clusters it watches
+var koaRequiredPermissions = []*authv1.ResourceAttributes{
+	{Verb: "list", Resource: "nodes"},
+	{Verb: "list", Resource: "pods"},
+}
+
+// ClusterPermissionCheck holds the result of a SelfSubjectAccessReview
+type ClusterPermissionCheck struct {
+	Verb     string `json:"verb"`
+	Resource string `json:"resource"`
+	Allowed  bool   `json:"allowed"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ClusterValidationReport describes whether Krossboard can connect to a cluster with the credentials of a
+// KUBECONFIG and get the permissions kube-opex-analytics needs
+type ClusterValidationReport struct {
+	Cluster       string                    `json:"cluster"`
+	APIEndpoint   string                    `json:"apiEndpoint"`
+	AuthType      string                    `json:"authType"`
+	ServerVersion string                    `json:"serverVersion,omitempty"`
+	Permissions   []*ClusterPermissionCheck `json:"permissions"`
+	Passed        bool                      `json:"passed"`
+	Errors        []string                  `json:"errors,omitempty"`
+}
+
+// validateUploadedKubeConfig checks the clusters of an uploaded KUBECONFIG according to a validation mode, within
+// the validation timeout. It returns false when the upload must be rejected
+func validateUploadedKubeConfig(ctx context.Context, mode string, config *kapi.Config) ([]*ClusterValidationReport, bool) {
+	if mode == "" || mode == KubeConfigValidationNone {
+		return nil, true
+	}
+	timeout := time.Duration(viper.GetInt("krossboard_kubeconfig_validation_timeout_seconds")) * time.Second
+	if timeout <= 0 || timeout > kubeConfigValidationMaxTimeout {
+		timeout = kubeConfigValidationMaxTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	reports := validateKubeConfigClusters(ctx, config)
+	for _, report := range reports {
+		if !report.Passed {
+			return reports, mode == KubeConfigValidationWarn
+		}
+	}
+	return reports, true
+}
+
+// validateKubeConfigClusters checks in parallel the connectivity and the permissions of each cluster of a
+// KUBECONFIG, until the context is done. Reports are sorted by cluster name
+func validateKubeConfigClusters(ctx context.Context, config *kapi.Config) []*ClusterValidationReport {
+	managedClusters := make(map[string]*ManagedCluster)
+	addManagedClusters(managedClusters, config, "")
+
+	reports := make([]*ClusterValidationReport, 0, len(managedClusters))
+	var reportsMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, managedCluster := range managedClusters {
+		wg.Add(1)
+		go func(managedCluster *ManagedCluster) {
+			defer wg.Done()
+			report := validateCluster(ctx, managedCluster)
+			reportsMu.Lock()
+			reports = append(reports, report)
+			reportsMu.Unlock()
+		}(managedCluster)
+	}
+	wg.Wait()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Cluster < reports[j].Cluster })
+	return reports
+}
+
+// validateCluster calls the version and the SelfSubjectAccessReview APIs of a cluster
+func validateCluster(ctx context.Context, managedCluster *ManagedCluster) *ClusterValidationReport {
+	report := &ClusterValidationReport{
+		Cluster:     managedCluster.Name,
+		APIEndpoint: managedCluster.APIEndpoint,
+		AuthType:    authTypeNames[AuthTypeUnknown],
+		Permissions: []*ClusterPermissionCheck{},
+	}
+	client, authType, err := newClusterClient(managedCluster)
+	report.AuthType = authTypeNames[authType]
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+
+	serverVersion := &version.Info{}
+	if err := client.do(ctx, "GET", "/version", nil, serverVersion); err != nil {
+		report.Errors = append(report.Errors, errors.Wrap(err, "failed getting server version").Error())
+		return report
+	}
+	report.ServerVersion = serverVersion.GitVersion
+
+	for _, permission := range koaRequiredPermissions {
+		review := &authv1.SelfSubjectAccessReview{Spec: authv1.SelfSubjectAccessReviewSpec{ResourceAttributes: permission}}
+		review.APIVersion, review.Kind = "authorization.k8s.io/v1", "SelfSubjectAccessReview"
+		check := &ClusterPermissionCheck{Verb: permission.Verb, Resource: permission.Resource}
+		report.Permissions = append(report.Permissions, check)
+		if err := client.do(ctx, "POST", "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", review, review); err != nil {
+			report.Errors = append(report.Errors, errors.Wrapf(err, "failed reviewing permission to %s %s", permission.Verb, permission.Resource).Error())
+			continue
+		}
+		check.Allowed, check.Reason = review.Status.Allowed, review.Status.Reason
+		if !check.Allowed {
+			report.Errors = append(report.Errors, fmt.Sprintf("permission to %s %s denied", permission.Verb, permission.Resource))
+		}
+	}
+	report.Passed = len(report.Errors) == 0
+	return report
+}
+
+// clusterClient calls the API of a cluster with the credentials of a KUBECONFIG
+type clusterClient struct {
+	endpoint  string
+	client    *http.Client
+	authorize func(req *http.Request)
+}
+
+// newClusterClient resolves the credentials of a cluster as the cluster credentials handler does, except that the
+// commands of exec and auth-provider plugins are never run, as they come from the uploaded file
+func newClusterClient(managedCluster *ManagedCluster) (*clusterClient, int, error) {
+	authInfo := managedCluster.AuthInfo
+	if authInfo == nil {
+		return nil, AuthTypeUnknown, errors.New("no AuthInfo found for the cluster")
+	}
+	tlsConfig := &tls.Config{}
+	if len(managedCluster.CaData) != 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(managedCluster.CaData) {
+			return nil, AuthTypeUnknown, errors.New("invalid certificate authority data")
+		}
+	}
+	client := &clusterClient{
+		endpoint:  strings.TrimSuffix(managedCluster.APIEndpoint, "/"),
+		authorize: func(req *http.Request) {},
+	}
+
+	authType := AuthTypeUnknown
+	if authInfo.Token != "" {
+		authType = AuthTypeBearerToken
+		client.authorize = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+authInfo.Token) }
+	} else if authInfo.AuthProvider != nil || authInfo.Exec != nil {
+		return nil, AuthTypeBearerToken, errors.New("credentials not validated, authentication plugins are not run on uploaded files")
+	} else if len(authInfo.ClientCertificateData) != 0 && len(authInfo.ClientKeyData) != 0 {
+		cert, err := tls.X509KeyPair(authInfo.ClientCertificateData, authInfo.ClientKeyData)
+		if err != nil {
+			return nil, AuthTypeX509Cert, errors.Wrap(err, "invalid client certificate")
+		}
+		authType = AuthTypeX509Cert
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if authInfo.Username != "" && authInfo.Password != "" {
+		authType = AuthTypeBasicToken
+		client.authorize = func(req *http.Request) { req.SetBasicAuth(authInfo.Username, authInfo.Password) }
+	} else {
+		return nil, AuthTypeUnknown, errors.New("failed getting cluster credentials")
+	}
+
+	client.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return client, authType, nil
+}
+
+// do calls an API of the cluster until the context is done, encoding the request body and decoding the response
+// as JSON
+func (m *clusterClient) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, m.endpoint+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	m.authorize(req)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.Unmarshal(respBody, result)
+}
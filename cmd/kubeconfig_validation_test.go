@@ -0,0 +1,258 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	authv1 "k8s.io/api/authorization/v1"
+	kclient "k8s.io/client-go/tools/clientcmd"
+)
+
+// newFakeAPIServer serves the version and SelfSubjectAccessReview APIs, admin-token being allowed everything,
+// viewer-token only listing nodes and slow-token answering after 3 seconds. onRequest is called on each request
+func newFakeAPIServer(onRequest func()) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		onRequest()
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if token == "slow-token" {
+			select {
+			case <-time.After(3 * time.Second):
+			case <-req.Context().Done():
+			}
+			token = "admin-token"
+		}
+		if token != "admin-token" && token != "viewer-token" {
+			http.Error(w, `{"kind":"Status","code":401}`, http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/version":
+			_, _ = w.Write([]byte(`{"major":"1","minor":"21","gitVersion":"v1.21.0"}`))
+		case "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews":
+			review := &authv1.SelfSubjectAccessReview{}
+			if req.Method != "POST" || json.NewDecoder(req.Body).Decode(review) != nil || review.Spec.ResourceAttributes == nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			review.Status.Allowed = token == "admin-token" || review.Spec.ResourceAttributes.Resource == "nodes"
+			_ = json.NewEncoder(w).Encode(review)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+}
+
+func TestKubeConfigValidation(t *testing.T) {
+	Convey("Given a KUBECONFIG targeting a fake API server with credentials of various permissions", t, func() {
+		var storedFilesDuringValidation int32
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		server := newFakeAPIServer(func() {
+			files, _ := listRegularFiles(tempDir)
+			atomic.AddInt32(&storedFilesDuringValidation, int32(len(files)))
+		})
+		caData := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+		kubeConfig := func(users map[string]string) []byte {
+			var clusters, contexts, authInfos string
+			for cluster, token := range users {
+				clusters += fmt.Sprintf("- cluster: {server: %q, certificate-authority-data: %s}\n  name: %s\n", server.URL, caData, cluster)
+				contexts += fmt.Sprintf("- context: {cluster: %s, user: %s-user}\n  name: %s\n", cluster, cluster, cluster)
+				authInfos += fmt.Sprintf("- name: %s-user\n  user: {token: %s}\n", cluster, token)
+			}
+			return []byte("apiVersion: v1\nkind: Config\nclusters:\n" + clusters + "contexts:\n" + contexts + "users:\n" + authInfos)
+		}
+		allClusters := kubeConfig(map[string]string{"prod": "admin-token", "staging": "viewer-token", "dev": "expired-token"})
+
+		viper.Set("krossboard_kubeconfig_dir", tempDir)
+		viper.Set("krossboard_kubeconfig_max_size_kb", 10)
+		viper.Set("krossboard_kubeconfig_validation_timeout_seconds", 5)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+
+		Convey("When the clusters are validated", func() {
+			config, err := kclient.Load(allClusters)
+			So(err, ShouldBeNil)
+			reports := validateKubeConfigClusters(context.Background(), config)
+
+			Convey("Then connectivity and permissions are reported per cluster", func() {
+				So(reports, ShouldHaveLength, 3)
+				dev, prod, staging := reports[0], reports[1], reports[2]
+
+				So(prod.Cluster, ShouldEqual, "prod")
+				So(prod.Passed, ShouldBeTrue)
+				So(prod.AuthType, ShouldEqual, "bearerToken")
+				So(prod.ServerVersion, ShouldEqual, "v1.21.0")
+				So(prod.Permissions, ShouldResemble, []*ClusterPermissionCheck{
+					{Verb: "list", Resource: "nodes", Allowed: true},
+					{Verb: "list", Resource: "pods", Allowed: true},
+				})
+
+				So(staging.Passed, ShouldBeFalse)
+				So(staging.Permissions[0].Allowed, ShouldBeTrue)
+				So(staging.Permissions[1].Allowed, ShouldBeFalse)
+				So(staging.Errors, ShouldResemble, []string{"permission to list pods denied"})
+
+				So(dev.Passed, ShouldBeFalse)
+				So(dev.ServerVersion, ShouldBeEmpty)
+				So(dev.Errors[0], ShouldContainSubstring, "401")
+			})
+		})
+
+		Convey("When clusters authenticated by plugins are validated", func() {
+			marker := tempDir + "/plugin-executed"
+			config, err := kclient.Load([]byte(fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+clusters:
+- cluster: {server: %q, certificate-authority-data: %s}
+  name: eks
+- cluster: {server: %q, certificate-authority-data: %s}
+  name: gke
+contexts:
+- context: {cluster: eks, user: eks-user}
+  name: eks
+- context: {cluster: gke, user: gke-user}
+  name: gke
+users:
+- name: eks-user
+  user:
+    exec: {apiVersion: client.authentication.k8s.io/v1beta1, command: sh, args: ["-c", "touch %s"]}
+- name: gke-user
+  user:
+    auth-provider: {name: gcp, config: {cmd-path: sh, cmd-args: "-c exit"}}
+`, server.URL, caData, server.URL, caData, marker)))
+			So(err, ShouldBeNil)
+			reports := validateKubeConfigClusters(context.Background(), config)
+
+			Convey("Then their commands are not run and their credentials are reported as not validated", func() {
+				So(reports, ShouldHaveLength, 2)
+				for _, report := range reports {
+					So(report.Passed, ShouldBeFalse)
+					So(report.AuthType, ShouldEqual, "bearerToken")
+					So(report.Errors[0], ShouldStartWith, "credentials not validated")
+				}
+				_, err := os.Stat(marker)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("When slow clusters are validated", func() {
+			viper.Set("krossboard_kubeconfig_validation_timeout_seconds", 1)
+			config, err := kclient.Load(kubeConfig(map[string]string{"eu": "slow-token", "us": "slow-token", "asia": "slow-token"}))
+			So(err, ShouldBeNil)
+			startTime := time.Now()
+			reports, accepted := validateUploadedKubeConfig(context.Background(), KubeConfigValidationStrict, config)
+
+			Convey("Then they are checked in parallel within the validation timeout", func() {
+				So(time.Since(startTime), ShouldBeLessThan, 2*time.Second)
+				So(accepted, ShouldBeFalse)
+				So(reports, ShouldHaveLength, 3)
+				for _, report := range reports {
+					So(report.Passed, ShouldBeFalse)
+					So(report.Errors[0], ShouldContainSubstring, "context deadline exceeded")
+				}
+			})
+		})
+
+		Convey("When a KUBECONFIG is uploaded with a validation mode", func(c C) {
+			useTestAdminAPIKey(c, tempDir)
+			router, err := newAPIRouter()
+			So(err, ShouldBeNil)
+			upload := func(method string, target string, kubeconfig []byte) (*httptest.ResponseRecorder, *KubeConfigUploadResp) {
+				body := &bytes.Buffer{}
+				form := multipart.NewWriter(body)
+				part, _ := form.CreateFormFile("kubeconfig", "kubeconfig")
+				_, _ = part.Write(kubeconfig)
+				_ = form.Close()
+				req := httptest.NewRequest(method, target, body)
+				req.Header.Set("Content-Type", form.FormDataContentType())
+				req.Header.Set("X-API-Key", testAdminAPIKey)
+				resp := httptest.NewRecorder()
+				router.ServeHTTP(resp, req)
+				uploadResp := &KubeConfigUploadResp{}
+				_ = json.Unmarshal(resp.Body.Bytes(), uploadResp)
+				return resp, uploadResp
+			}
+			storedFiles := func() []string {
+				files, _ := listRegularFiles(tempDir)
+				return files
+			}
+
+			Convey("Then strict validation rejects files with failing clusters", func() {
+				resp, uploadResp := upload("POST", "/api/kubeconfig?validation=strict", allClusters)
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(uploadResp.Validation, ShouldHaveLength, 3)
+				So(storedFiles(), ShouldBeEmpty)
+				So(atomic.LoadInt32(&storedFilesDuringValidation), ShouldEqual, 0)
+
+				resp, uploadResp = upload("POST", "/api/kubeconfig?validation=strict", kubeConfig(map[string]string{"prod": "admin-token"}))
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(uploadResp.Validation[0].Passed, ShouldBeTrue)
+				So(storedFiles(), ShouldHaveLength, 1)
+			})
+
+			Convey("Then warnings are returned with accepted files", func() {
+				resp, uploadResp := upload("POST", "/api/kubeconfig?validation=warn", allClusters)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(uploadResp.Validation, ShouldHaveLength, 3)
+				So(storedFiles(), ShouldHaveLength, 1)
+				So(uploadResp.Name, ShouldStartWith, "kubeconfig-uploaded-")
+
+				resp, uploadResp = upload("PUT", "/api/kubeconfigs/"+uploadResp.Name+"?validation=strict", allClusters)
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(uploadResp.Validation[2].Errors, ShouldNotBeEmpty)
+			})
+
+			Convey("Then clusters aren't contacted by default", func() {
+				resp, uploadResp := upload("POST", "/api/kubeconfig", allClusters)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(uploadResp.Validation, ShouldBeNil)
+			})
+
+			Convey("Then unknown validation modes are rejected", func() {
+				resp, _ := upload("POST", "/api/kubeconfig?validation=lenient", allClusters)
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(storedFiles(), ShouldBeEmpty)
+			})
+		})
+
+		Reset(func() {
+			server.Close()
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,215 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NodeRecommendation holds the rightsizing analysis of a single node
+type NodeRecommendation struct {
+	Name               string  `json:"name"`
+	CPUAllocatable     float64 `json:"cpuAllocatable"`
+	MEMAllocatable     float64 `json:"memAllocatable"`
+	CPUUsageP95        float64 `json:"cpuUsageP95"`
+	MEMUsageP95        float64 `json:"memUsageP95"`
+	CPUUsageP95Percent float64 `json:"cpuUsageP95Percent"`
+	MEMUsageP95Percent float64 `json:"memUsageP95Percent"`
+	Samples            int     `json:"samples"`
+	Underused          bool    `json:"underused"`
+	Removable          bool    `json:"removable"`
+	Removed            bool    `json:"removed,omitempty"`
+}
+
+// ClusterRecommendation holds the consolidation analysis of the nodes of a cluster
+type ClusterRecommendation struct {
+	ClusterName          string                `json:"clusterName"`
+	StartDateUTC         time.Time             `json:"startDateUTC"`
+	EndDateUTC           time.Time             `json:"endDateUTC"`
+	HeadroomPercent      float64               `json:"headroomPercent"`
+	UnderusePercent      float64               `json:"underusePercent"`
+	NodeCount            int                   `json:"nodeCount"`
+	RecommendedNodeCount int                   `json:"recommendedNodeCount"`
+	RemovableNodeCount   int                   `json:"removableNodeCount"`
+	CPUAllocatable       float64               `json:"cpuAllocatable"`
+	MEMAllocatable       float64               `json:"memAllocatable"`
+	CPUUsageP95          float64               `json:"cpuUsageP95"`
+	MEMUsageP95          float64               `json:"memUsageP95"`
+	CPURequired          float64               `json:"cpuRequired"`
+	MEMRequired          float64               `json:"memRequired"`
+	Nodes                []*NodeRecommendation `json:"nodes"`
+}
+
+// nodeUsageHistory holds the history of a node as needed to compute recommendations. Removed is set when the node
+// left the cluster before the end of the period
+type nodeUsageHistory struct {
+	Allocatable *UsageHistory
+	UsageByPods *UsageHistory
+	Removed     bool
+}
+
+// flagRemovedNodes flags the nodes last seen more than an hour before the end of a period as removed
+func flagRemovedNodes(nodesHistory map[string]*nodeUsageHistory, nodesMetadata map[string]*NodeMetadata, endTimeUTC time.Time) {
+	for nodeName, history := range nodesHistory {
+		if metadata := nodesMetadata[nodeName]; metadata != nil {
+			history.Removed = metadata.LastSeenUTC.Before(endTimeUTC.Add(-time.Duration(RRDStorageStep3600Secs) * time.Second))
+		}
+	}
+}
+
+// fetchNodesUsageHistory retrieves allocatable and usage-by-pods history of a set of nodes
+func fetchNodesUsageHistory(nodeNames []string, startTimeUTC time.Time, endTimeUTC time.Time) map[string]*nodeUsageHistory {
+	step := time.Duration(RRDStorageStep3600Secs) * time.Second
+	nodesHistory := make(map[string]*nodeUsageHistory)
+	for _, nodeName := range nodeNames {
+		nodeUsageDb, err := openNodeUsageDB(nodeName)
+		if err != nil {
+			log.WithError(err).Debugln("skipping node without usage databases", nodeName)
+			continue
+		}
+		allocatableHistory, err := nodeUsageDb.AllocatableDb.FetchUsage(startTimeUTC, endTimeUTC, step)
+		if err != nil {
+			log.WithError(err).Errorln("failed retrieving node allocatable history", nodeUsageDb.AllocatableDb.RRDFile)
+			continue
+		}
+		usageByPodsHistory, err := nodeUsageDb.UsageByPodsDb.FetchUsage(startTimeUTC, endTimeUTC, step)
+		if err != nil {
+			log.WithError(err).Errorln("failed retrieving usage by pods for node", nodeUsageDb.UsageByPodsDb.RRDFile)
+			continue
+		}
+		nodesHistory[nodeName] = &nodeUsageHistory{
+			Allocatable: allocatableHistory,
+			UsageByPods: usageByPodsHistory,
+		}
+	}
+	return nodesHistory
+}
+
+// computeClusterRecommendation flags nodes whose p95 usage stays below underusePercent of their
+// allocatable resources, and estimates how many nodes can be removed while keeping enough
+// allocatable resources for the cluster p95 usage increased by headroomPercent. The usage of removed nodes
+// accounts for the cluster usage, but not their allocatable resources
+func computeClusterRecommendation(clusterName string, nodesHistory map[string]*nodeUsageHistory, headroomPercent float64, underusePercent float64) *ClusterRecommendation {
+	recommendation := &ClusterRecommendation{
+		ClusterName:     clusterName,
+		HeadroomPercent: headroomPercent,
+		UnderusePercent: underusePercent,
+		Nodes:           []*NodeRecommendation{},
+	}
+
+	var clusterUsage []*UsageHistory
+	for nodeName, history := range nodesHistory {
+		if len(history.Allocatable.CPUUsage) == 0 || len(history.UsageByPods.CPUUsage) == 0 {
+			log.Debugln("no recent data for node", nodeName)
+			continue
+		}
+		node := &NodeRecommendation{
+			Name:           nodeName,
+			CPUAllocatable: history.Allocatable.CPUUsage[len(history.Allocatable.CPUUsage)-1].Value,
+			MEMAllocatable: history.Allocatable.MEMUsage[len(history.Allocatable.MEMUsage)-1].Value,
+			CPUUsageP95:    percentile(usageValues(history.UsageByPods.CPUUsage), 95),
+			MEMUsageP95:    percentile(usageValues(history.UsageByPods.MEMUsage), 95),
+			Samples:        len(history.UsageByPods.CPUUsage),
+			Removed:        history.Removed,
+		}
+		if node.CPUAllocatable > 0 {
+			node.CPUUsageP95Percent = 100 * node.CPUUsageP95 / node.CPUAllocatable
+		}
+		if node.MEMAllocatable > 0 {
+			node.MEMUsageP95Percent = 100 * node.MEMUsageP95 / node.MEMAllocatable
+		}
+		recommendation.Nodes = append(recommendation.Nodes, node)
+		clusterUsage = append(clusterUsage, history.UsageByPods)
+		if node.Removed {
+			continue
+		}
+		node.Underused = node.CPUUsageP95Percent < underusePercent && node.MEMUsageP95Percent < underusePercent
+		recommendation.NodeCount++
+		recommendation.CPUAllocatable += node.CPUAllocatable
+		recommendation.MEMAllocatable += node.MEMAllocatable
+	}
+
+	totalUsage := sumUsageHistories(clusterUsage)
+	recommendation.CPUUsageP95 = percentile(usageValues(totalUsage.CPUUsage), 95)
+	recommendation.MEMUsageP95 = percentile(usageValues(totalUsage.MEMUsage), 95)
+	recommendation.CPURequired = recommendation.CPUUsageP95 * (1 + headroomPercent/100)
+	recommendation.MEMRequired = recommendation.MEMUsageP95 * (1 + headroomPercent/100)
+
+	// try removing the least used nodes first
+	candidates := make([]*NodeRecommendation, 0, len(recommendation.Nodes))
+	for _, node := range recommendation.Nodes {
+		if !node.Removed {
+			candidates = append(candidates, node)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		iLoad := math.Max(candidates[i].CPUUsageP95Percent, candidates[i].MEMUsageP95Percent)
+		jLoad := math.Max(candidates[j].CPUUsageP95Percent, candidates[j].MEMUsageP95Percent)
+		if iLoad == jLoad {
+			return candidates[i].Name < candidates[j].Name
+		}
+		return iLoad < jLoad
+	})
+	remainingCPU := recommendation.CPUAllocatable
+	remainingMEM := recommendation.MEMAllocatable
+	for _, node := range candidates {
+		if recommendation.NodeCount-recommendation.RemovableNodeCount <= 1 {
+			break
+		}
+		if remainingCPU-node.CPUAllocatable >= recommendation.CPURequired && remainingMEM-node.MEMAllocatable >= recommendation.MEMRequired {
+			remainingCPU -= node.CPUAllocatable
+			remainingMEM -= node.MEMAllocatable
+			node.Removable = true
+			recommendation.RemovableNodeCount++
+		}
+	}
+	recommendation.RecommendedNodeCount = recommendation.NodeCount - recommendation.RemovableNodeCount
+
+	sort.Slice(recommendation.Nodes, func(i, j int) bool { return recommendation.Nodes[i].Name < recommendation.Nodes[j].Name })
+	return recommendation
+}
+
+func usageValues(items []*ResourceUsageItem) []float64 {
+	values := make([]float64, len(items))
+	for i, item := range items {
+		values[i] = item.Value
+	}
+	return values
+}
+
+// percentile returns the p-th percentile of values, using linear interpolation between closest ranks
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
@@ -0,0 +1,173 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestPercentile(t *testing.T) {
+	Convey("Given a set of values", t, func() {
+		values := []float64{5, 1, 4, 2, 3}
+
+		Convey("Then percentiles are interpolated between closest ranks", func() {
+			So(percentile(values, 0), ShouldEqual, 1)
+			So(percentile(values, 50), ShouldEqual, 3)
+			So(percentile(values, 95), ShouldAlmostEqual, 4.8)
+			So(percentile(values, 100), ShouldEqual, 5)
+			So(percentile(nil, 95), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestComputeClusterRecommendation(t *testing.T) {
+	Convey("Given three nodes with 4 cores and 16 GiB allocatable each", t, func() {
+		const gib = 1 << 30
+		start := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+		newHistory := func(cpu float64, mem float64) *UsageHistory {
+			history := &UsageHistory{}
+			for i := 0; i < 24; i++ {
+				ts := start.Add(time.Duration(i) * time.Hour)
+				history.CPUUsage = append(history.CPUUsage, &ResourceUsageItem{DateUTC: ts, Value: cpu})
+				history.MEMUsage = append(history.MEMUsage, &ResourceUsageItem{DateUTC: ts, Value: mem})
+			}
+			return history
+		}
+		nodesHistory := map[string]*nodeUsageHistory{
+			"node-a": {Allocatable: newHistory(4, 16*gib), UsageByPods: newHistory(3, 8*gib)},
+			"node-b": {Allocatable: newHistory(4, 16*gib), UsageByPods: newHistory(0.2, 1*gib)},
+			"node-c": {Allocatable: newHistory(4, 16*gib), UsageByPods: newHistory(0.3, 1*gib)},
+		}
+
+		Convey("When computing recommendations with a 20% headroom", func() {
+			recommendation := computeClusterRecommendation("cluster", nodesHistory, 20, 30)
+
+			Convey("Then the lightly used nodes are flagged as underused", func() {
+				So(recommendation.NodeCount, ShouldEqual, 3)
+				So(recommendation.Nodes[0].Underused, ShouldBeFalse)
+				So(recommendation.Nodes[1].Underused, ShouldBeTrue)
+				So(recommendation.Nodes[2].Underused, ShouldBeTrue)
+			})
+
+			Convey("Then only one node can be removed while keeping the headroom", func() {
+				So(recommendation.CPUUsageP95, ShouldAlmostEqual, 3.5)
+				So(recommendation.CPURequired, ShouldAlmostEqual, 4.2)
+				So(recommendation.RemovableNodeCount, ShouldEqual, 1)
+				So(recommendation.RecommendedNodeCount, ShouldEqual, 2)
+				So(recommendation.Nodes[1].Removable, ShouldBeTrue)
+				So(recommendation.Nodes[2].Removable, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestFetchNodesUsageHistory(t *testing.T) {
+	Convey("Given a node without usage databases", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tempDir)
+		viper.Set("krossboard_rawdb_dir", tempDir)
+
+		Convey("When its history is fetched", func() {
+			nodesHistory := fetchNodesUsageHistory([]string{"node-1"}, time.Now().Add(-time.Hour), time.Now())
+
+			Convey("Then the node is skipped and its databases are not created", func() {
+				So(nodesHistory, ShouldBeEmpty)
+				files, err := ioutil.ReadDir(tempDir)
+				So(err, ShouldBeNil)
+				So(files, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestRecommendationsHandler(t *testing.T) {
+	Convey("Given a cluster whose node-3 was removed in the middle of the period", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		for _, key := range []string{"krossboard_rawdb_dir", "krossboard_run_dir"} {
+			dir := filepath.Join(tempDir, key)
+			So(os.Mkdir(dir, 0755), ShouldBeNil)
+			viper.Set(key, dir)
+		}
+		viper.Set("krossboard_recommendations_headroom_percent", 20)
+		viper.Set("krossboard_recommendations_underuse_percent", 30)
+		apiAccessPolicy = nil
+		origNow := now
+		start := date(c, "2020-06-01T00:00:00Z")
+		end, removal := start.Add(24*time.Hour), start.Add(12*time.Hour)
+		now = func() time.Time { return start }
+		for nodeName, cpuUsage := range map[string]float64{"node-1": 3, "node-2": 0.2, "node-3": 2} {
+			capacityDbPath, allocatableDbPath, usageByPodsDbPath := getNodeUsageDbPaths(nodeName)
+			for _, dbPath := range []string{capacityDbPath, allocatableDbPath, usageByPodsDbPath} {
+				So(NewUsageDb(dbPath, math.MaxFloat64).CreateRRD(), ShouldBeNil)
+			}
+			lastSample := end
+			if nodeName == "node-3" {
+				lastSample = removal
+			}
+			for ts := start.Add(5 * time.Minute); !ts.After(lastSample); ts = ts.Add(5 * time.Minute) {
+				So(NewUsageDb(allocatableDbPath, math.MaxFloat64).UpdateRRD(ts, 4, 16), ShouldBeNil)
+				So(NewUsageDb(usageByPodsDbPath, math.MaxFloat64).UpdateRRD(ts, cpuUsage, 1), ShouldBeNil)
+			}
+		}
+		allNodes := map[string]NodeUsage{"node-1": {}, "node-2": {}, "node-3": {}}
+		So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": allNodes}, start.Add(5*time.Minute)), ShouldBeNil)
+		So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": allNodes}, removal), ShouldBeNil)
+		So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-1": {}, "node-2": {}}}, end), ShouldBeNil)
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/recommendations/{clustername}", GetRecommendationsHandler)
+
+		Convey("When recommendations are requested over the period", func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", "/api/recommendations/prod?startDateUTC="+
+				start.Format(time.RFC3339)+"&endDateUTC="+end.Format(time.RFC3339), nil))
+			recommendationsResp := &GetRecommendationsResp{}
+			So(json.Unmarshal(resp.Body.Bytes(), recommendationsResp), ShouldBeNil)
+			recommendation := recommendationsResp.Recommendations
+
+			Convey("Then the usage of the removed node accounts for the cluster usage, but not its resources", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(recommendation.Nodes, ShouldHaveLength, 3)
+				So(recommendation.Nodes[2].Removed, ShouldBeTrue)
+				So(recommendation.NodeCount, ShouldEqual, 2)
+				So(recommendation.CPUAllocatable, ShouldAlmostEqual, 8)
+				So(recommendation.CPUUsageP95, ShouldAlmostEqual, 5.2)
+				So(recommendation.RemovableNodeCount, ShouldEqual, 0)
+			})
+		})
+
+		Reset(func() {
+			now = origNow
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
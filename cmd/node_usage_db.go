@@ -18,9 +18,12 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
+	"sort"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -43,17 +46,58 @@ type NodeUsage struct {
 	} `json:"podsRunning,omitempty"`
 }
 
+// NodeMetadata holds when a node of a cluster has been seen by the consolidator
+type NodeMetadata struct {
+	FirstSeenUTC time.Time `json:"firstSeenUTC"`
+	LastSeenUTC  time.Time `json:"lastSeenUTC"`
+}
+
+// NodeUsageHistory holds the capacity, allocatable and usage by pods history of a node along with its metadata
+type NodeUsageHistory struct {
+	FirstSeenUTC     time.Time    `json:"firstSeenUTC"`
+	LastSeenUTC      time.Time    `json:"lastSeenUTC"`
+	CapacityItems    UsageHistory `json:"capacityItems"`
+	AllocatableItems UsageHistory `json:"allocatableItems"`
+	UsageByPodItems  UsageHistory `json:"usageByPodItems"`
+}
+
+// listLiveClusterNodes returns the nodes currently running in a cluster, it's overridden in tests
+var listLiveClusterNodes = getRecentNodesUsage
+
+// nodesMetadataRetention matches the retention of node usage databases
+const nodesMetadataRetention = RRDDailyRetention
+
 type NodeUsageDb struct {
 	AllocatableDb *UsageDb
 	CapacityDb    *UsageDb
 	UsageByPodsDb *UsageDb
 }
 
-func NewNodeUsageDB(nodeName string) *NodeUsageDb {
+// getNodeUsageDbPaths returns the paths of the capacity, allocatable and usage by pods databases of a node
+func getNodeUsageDbPaths(nodeName string) (capacityDbPath string, allocatableDbPath string, usageByPodsDbPath string) {
 	dbDir := viper.GetString("krossboard_rawdb_dir")
-	capacityDbPath := fmt.Sprintf("%s/.nodeusage_%s_capacity", dbDir, nodeName)
-	allocatableDbPath := fmt.Sprintf("%s/.nodeusage_%s_allocatable", dbDir, nodeName)
-	usageByPodsDbPath := fmt.Sprintf("%s/.nodeusage_%s_usage_by_pods", dbDir, nodeName)
+	return fmt.Sprintf("%s/.nodeusage_%s_capacity", dbDir, nodeName),
+		fmt.Sprintf("%s/.nodeusage_%s_allocatable", dbDir, nodeName),
+		fmt.Sprintf("%s/.nodeusage_%s_usage_by_pods", dbDir, nodeName)
+}
+
+// openNodeUsageDB returns the existing databases of a node, unlike NewNodeUsageDB that creates missing ones
+func openNodeUsageDB(nodeName string) (*NodeUsageDb, error) {
+	capacityDbPath, allocatableDbPath, usageByPodsDbPath := getNodeUsageDbPaths(nodeName)
+	for _, dbPath := range []string{capacityDbPath, allocatableDbPath, usageByPodsDbPath} {
+		if _, err := os.Stat(dbPath); err != nil {
+			return nil, err
+		}
+	}
+	return &NodeUsageDb{
+		CapacityDb:    NewUsageDb(capacityDbPath, math.MaxFloat64),
+		AllocatableDb: NewUsageDb(allocatableDbPath, math.MaxFloat64),
+		UsageByPodsDb: NewUsageDb(usageByPodsDbPath, math.MaxFloat64),
+	}, nil
+}
+
+func NewNodeUsageDB(nodeName string) *NodeUsageDb {
+	capacityDbPath, allocatableDbPath, usageByPodsDbPath := getNodeUsageDbPaths(nodeName)
 
 	dbSet := &NodeUsageDb{
 		CapacityDb:    NewUsageDb(capacityDbPath, math.MaxFloat64),
@@ -97,3 +141,171 @@ func NewNodeUsageDB(nodeName string) *NodeUsageDb {
 	}
 	return dbSet
 }
+
+// loadNodesMetadata reads the metadata of the nodes seen by the consolidator, indexed by cluster and node names
+func loadNodesMetadata() (map[string]map[string]*NodeMetadata, error) {
+	data, err := ioutil.ReadFile(getNodesMetadataPath())
+	if err != nil {
+		return nil, err
+	}
+	nodesMetadata := make(map[string]map[string]*NodeMetadata)
+	err = json.Unmarshal(data, &nodesMetadata)
+	return nodesMetadata, err
+}
+
+// getNodeClusters returns the cluster of each stored node from the nodes metadata, completed by the latest nodes
+// usage for nodes not tracked in the metadata yet
+func getNodeClusters() map[string]string {
+	nodeClusters := make(map[string]string)
+	lastSeen := make(map[string]time.Time)
+	nodesMetadata, err := loadNodesMetadata()
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warnln("failed reading nodes metadata")
+	}
+	for clusterName, clusterNodes := range nodesMetadata {
+		for nodeName, metadata := range clusterNodes {
+			// a node moved between clusters is reported in the last one
+			if _, found := nodeClusters[nodeName]; !found || metadata.LastSeenUTC.After(lastSeen[nodeName]) {
+				nodeClusters[nodeName] = clusterName
+				lastSeen[nodeName] = metadata.LastSeenUTC
+			}
+		}
+	}
+	nodesUsage, err := loadNodesUsage()
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warnln("failed reading nodes usage")
+	}
+	for clusterName, clusterNodes := range nodesUsage {
+		for nodeName := range clusterNodes {
+			if _, found := nodeClusters[nodeName]; !found {
+				nodeClusters[nodeName] = clusterName
+			}
+		}
+	}
+	return nodeClusters
+}
+
+// getNodeUsageDbSeenDates returns the dates of the first and of the last samples of the databases of a node
+func getNodeUsageDbSeenDates(nodeName string) (time.Time, time.Time, error) {
+	nodeUsageDb, err := openNodeUsageDB(nodeName)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	lastUpdate, err := rrdLastUpdate(nodeUsageDb.CapacityDb.RRDFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	history, err := nodeUsageDb.CapacityDb.FetchUsage(lastUpdate.Add(-nodesMetadataRetention), lastUpdate, time.Duration(RRDStorageStep3600Secs)*time.Second)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	firstSeen := lastUpdate
+	if len(history.CPUUsage) > 0 && history.CPUUsage[0].DateUTC.Before(lastUpdate) {
+		firstSeen = history.CPUUsage[0].DateUTC
+	}
+	return firstSeen, lastUpdate, nil
+}
+
+// seedNodesMetadata builds the metadata of the nodes having usage databases from the dates of their samples, for
+// the nodes whose cluster is known. It's used until the consolidator has recorded nodes metadata
+func seedNodesMetadata(nodeClusters map[string]string) map[string]map[string]*NodeMetadata {
+	nodesMetadata := make(map[string]map[string]*NodeMetadata)
+	nodeNames, err := listStoredNodeNames()
+	if err != nil {
+		log.WithError(err).Warnln("failed listing node usage databases")
+		return nodesMetadata
+	}
+	for _, nodeName := range nodeNames {
+		clusterName, found := nodeClusters[nodeName]
+		if !found {
+			log.Debugln("ignoring node with unknown cluster", nodeName)
+			continue
+		}
+		firstSeen, lastSeen, err := getNodeUsageDbSeenDates(nodeName)
+		if err != nil {
+			log.WithError(err).Warnln("failed reading node usage databases", nodeName)
+			continue
+		}
+		if nodesMetadata[clusterName] == nil {
+			nodesMetadata[clusterName] = make(map[string]*NodeMetadata)
+		}
+		nodesMetadata[clusterName][nodeName] = &NodeMetadata{FirstSeenUTC: firstSeen, LastSeenUTC: lastSeen}
+	}
+	return nodesMetadata
+}
+
+// saveNodesMetadata records that the given nodes of clusters have been seen at sampleTimeUTC. Nodes that have not
+// been seen during the retention of node databases are forgotten
+func saveNodesMetadata(nodesUsage map[string]map[string]NodeUsage, sampleTimeUTC time.Time) error {
+	nodesMetadata, err := loadNodesMetadata()
+	if os.IsNotExist(err) {
+		// first run, nodes already having databases keep the dates of their samples
+		nodeClusters := getNodeClusters()
+		for clusterName, clusterNodes := range nodesUsage {
+			for nodeName := range clusterNodes {
+				nodeClusters[nodeName] = clusterName
+			}
+		}
+		nodesMetadata = seedNodesMetadata(nodeClusters)
+	} else if err != nil {
+		log.WithError(err).Warnln("resetting unreadable nodes metadata file")
+		nodesMetadata = make(map[string]map[string]*NodeMetadata)
+	}
+
+	for clusterName, clusterNodes := range nodesUsage {
+		if nodesMetadata[clusterName] == nil {
+			nodesMetadata[clusterName] = make(map[string]*NodeMetadata)
+		}
+		for nodeName := range clusterNodes {
+			metadata, found := nodesMetadata[clusterName][nodeName]
+			if !found {
+				metadata = &NodeMetadata{FirstSeenUTC: sampleTimeUTC}
+				nodesMetadata[clusterName][nodeName] = metadata
+			}
+			metadata.LastSeenUTC = sampleTimeUTC
+		}
+	}
+	retentionLimit := sampleTimeUTC.Add(-nodesMetadataRetention)
+	for clusterName, clusterNodes := range nodesMetadata {
+		for nodeName, metadata := range clusterNodes {
+			if metadata.LastSeenUTC.Before(retentionLimit) {
+				delete(clusterNodes, nodeName)
+			}
+		}
+		if len(clusterNodes) == 0 {
+			delete(nodesMetadata, clusterName)
+		}
+	}
+
+	serializedData, _ := json.Marshal(nodesMetadata)
+	return writeFileAtomically(getNodesMetadataPath(), serializedData, 0644)
+}
+
+// listClusterNodes returns the names of the nodes of a cluster seen between startDateUTC and endDateUTC, in
+// alphabetical order, along with their metadata
+func listClusterNodes(clusterName string, startDateUTC time.Time, endDateUTC time.Time) ([]string, map[string]*NodeMetadata, error) {
+	nodesMetadata, err := loadNodesMetadata()
+	if os.IsNotExist(err) {
+		// the consolidator hasn't recorded nodes metadata yet, nodes are listed from their databases, including
+		// the nodes currently running in the cluster
+		nodeClusters := getNodeClusters()
+		liveNodes, liveErr := listLiveClusterNodes(clusterName)
+		if liveErr != nil {
+			log.WithError(liveErr).Warnln("failed getting recent cluster nodes")
+		}
+		for nodeName := range liveNodes {
+			nodeClusters[nodeName] = clusterName
+		}
+		nodesMetadata = seedNodesMetadata(nodeClusters)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var nodeNames []string
+	for nodeName, metadata := range nodesMetadata[clusterName] {
+		if !metadata.LastSeenUTC.Before(startDateUTC) && !metadata.FirstSeenUTC.After(endDateUTC) {
+			nodeNames = append(nodeNames, nodeName)
+		}
+	}
+	sort.Strings(nodeNames)
+	return nodeNames, nodesMetadata[clusterName], nil
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestNodesMetadata(t *testing.T) {
+	Convey("Given nodes seen by the consolidator over time", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_rawdb_dir", tempDir)
+		apiAccessPolicy = nil
+
+		t1, t2, t3 := date(c, "2020-06-01T10:00:00Z"), date(c, "2020-06-01T11:00:00Z"), date(c, "2020-06-01T12:00:00Z")
+		So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-1": {}, "node-2": {}}}, t1), ShouldBeNil)
+		So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-1": {}}, "dev": {"node-3": {}}}, t2), ShouldBeNil)
+		So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-1": {}, "node-4": {}}}, t3), ShouldBeNil)
+
+		Convey("When the metadata is loaded", func() {
+			nodesMetadata, err := loadNodesMetadata()
+
+			Convey("Then first and last seen dates are tracked per cluster", func() {
+				So(err, ShouldBeNil)
+				So(nodesMetadata["prod"]["node-1"], ShouldResemble, &NodeMetadata{FirstSeenUTC: t1, LastSeenUTC: t3})
+				So(nodesMetadata["prod"]["node-2"], ShouldResemble, &NodeMetadata{FirstSeenUTC: t1, LastSeenUTC: t1})
+				So(nodesMetadata["dev"]["node-3"], ShouldResemble, &NodeMetadata{FirstSeenUTC: t2, LastSeenUTC: t2})
+			})
+		})
+
+		Convey("When the nodes of a cluster are listed for a period", func() {
+			Convey("Then only the nodes seen during the period are returned", func() {
+				nodeNames, _, err := listClusterNodes("prod", t1, t3)
+				So(err, ShouldBeNil)
+				So(nodeNames, ShouldResemble, []string{"node-1", "node-2", "node-4"})
+				nodeNames, _, _ = listClusterNodes("prod", t2, t2)
+				So(nodeNames, ShouldResemble, []string{"node-1"})
+				nodeNames, _, _ = listClusterNodes("prod", t3.Add(nodesMetadataRetention), t3.Add(nodesMetadataRetention))
+				So(nodeNames, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a node hasn't been seen for longer than the retention", func() {
+			So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-4": {}}}, t1.Add(nodesMetadataRetention).Add(90*time.Minute)), ShouldBeNil)
+			nodesMetadata, err := loadNodesMetadata()
+
+			Convey("Then it's forgotten", func() {
+				So(err, ShouldBeNil)
+				So(nodesMetadata["prod"], ShouldContainKey, "node-1")
+				So(nodesMetadata["prod"], ShouldNotContainKey, "node-2")
+				So(nodesMetadata, ShouldNotContainKey, "dev")
+			})
+		})
+
+		Convey("When the usage of the nodes is requested while kube-opex-analytics is unreachable", func() {
+			for _, nodeName := range []string{"node-1", "node-4"} {
+				capacityDbPath, allocatableDbPath, usageByPodsDbPath := getNodeUsageDbPaths(nodeName)
+				for _, dbPath := range []string{capacityDbPath, allocatableDbPath, usageByPodsDbPath} {
+					So(ioutil.WriteFile(dbPath, nil, 0644), ShouldBeNil)
+				}
+			}
+			So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-5": {}}}, t3), ShouldBeNil)
+			resp := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/api/nodesusage/prod?startDateUTC=2020-06-01T10:30:00&endDateUTC=2020-06-01T13:00:00", nil)
+			GetNodesUsageHandler(resp, mux.SetURLVars(req, map[string]string{"clustername": "prod"}))
+			nodesUsage := make(map[string]*NodeUsageHistory)
+			err := json.Unmarshal(resp.Body.Bytes(), &nodesUsage)
+
+			Convey("Then the stored nodes of the period are returned with their metadata", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(err, ShouldBeNil)
+				So(nodesUsage, ShouldHaveLength, 2)
+				So(nodesUsage["node-1"].FirstSeenUTC, ShouldEqual, t1)
+				So(nodesUsage["node-1"].LastSeenUTC, ShouldEqual, t3)
+				So(nodesUsage["node-4"].FirstSeenUTC, ShouldEqual, t3)
+			})
+
+			Convey("Then nodes without databases are skipped and their databases are not created", func() {
+				So(nodesUsage, ShouldNotContainKey, "node-5")
+				_, _, usageByPodsDbPath := getNodeUsageDbPaths("node-5")
+				So(fileExists(usageByPodsDbPath), ShouldBeFalse)
+			})
+		})
+
+		Convey("When a caller not allowed on the cluster requests the usage of its nodes", func() {
+			rulesFile := filepath.Join(tempDir, "access.json")
+			data, _ := json.Marshal(&AccessControlFile{Rules: []*AccessRule{{Users: []string{"john@example.com"}, Clusters: []string{"dev"}}}})
+			So(ioutil.WriteFile(rulesFile, data, 0600), ShouldBeNil)
+			policy, err := newAccessPolicy(rulesFile)
+			So(err, ShouldBeNil)
+			apiAccessPolicy = policy
+			defer func() { apiAccessPolicy = nil }()
+
+			Convey("Then the cluster is not found, whatever the format", func() {
+				for _, format := range []string{"", ExportFormatJSON, ExportFormatCSV, ExportFormatNDJSON, ExportFormatParquet} {
+					resp := httptest.NewRecorder()
+					req := httptest.NewRequest("GET", "/api/nodesusage/prod?format="+format, nil).WithContext(context.WithValue(context.Background(),
+						principalContextKey{}, &Principal{Name: "john@example.com", Scope: AuthScopeReadOnly, AuthMethod: AuthMethodJWT}))
+					GetNodesUsageHandler(resp, mux.SetURLVars(req, map[string]string{"clustername": "prod"}))
+					So(resp.Code, ShouldEqual, http.StatusNotFound)
+					So(resp.Body.String(), ShouldContainSubstring, "cluster not found")
+				}
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
+
+func TestNodesMetadataSeeding(t *testing.T) {
+	Convey("Given node databases filled before nodes metadata were recorded", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		for _, key := range []string{"krossboard_rawdb_dir", "krossboard_run_dir"} {
+			dir := filepath.Join(tempDir, key)
+			So(os.Mkdir(dir, 0755), ShouldBeNil)
+			viper.Set(key, dir)
+		}
+		origNow, origListLiveClusterNodes := now, listLiveClusterNodes
+		start := date(c, "2020-06-01T10:00:00Z")
+		end := start.Add(3 * time.Hour)
+		now = func() time.Time { return start }
+		for _, nodeName := range []string{"node-1", "node-2", "node-3", "node-4"} {
+			capacityDbPath, allocatableDbPath, usageByPodsDbPath := getNodeUsageDbPaths(nodeName)
+			for _, dbPath := range []string{capacityDbPath, allocatableDbPath, usageByPodsDbPath} {
+				usageDb := NewUsageDb(dbPath, math.MaxFloat64)
+				So(usageDb.CreateRRD(), ShouldBeNil)
+				for ts := start.Add(5 * time.Minute); !ts.After(end); ts = ts.Add(5 * time.Minute) {
+					So(usageDb.UpdateRRD(ts, 4, 8589934592), ShouldBeNil)
+				}
+			}
+		}
+		// node-1 and node-2 are in the latest nodes usage, node-3 is only known by kube-opex-analytics
+		So(ioutil.WriteFile(getNodesUsagePath(), []byte(`{"prod":{"node-1":{},"node-2":{}}}`), 0644), ShouldBeNil)
+		listLiveClusterNodes = func(clusterName string) (map[string]NodeUsage, error) {
+			return map[string]NodeUsage{"node-3": {}}, nil
+		}
+
+		Convey("When the nodes of a cluster are listed", func() {
+			nodeNames, nodesMetadata, err := listClusterNodes("prod", start, end)
+
+			Convey("Then they are listed from their databases and the running nodes", func() {
+				So(err, ShouldBeNil)
+				So(nodeNames, ShouldResemble, []string{"node-1", "node-2", "node-3"})
+				So(nodesMetadata["node-3"].FirstSeenUTC, ShouldHappenOnOrBetween, start, start.Add(time.Hour))
+				So(nodesMetadata["node-3"].LastSeenUTC, ShouldEqual, end)
+			})
+		})
+
+		Convey("When the consolidator records nodes metadata for the first time", func() {
+			sampleTime := end.Add(5 * time.Minute)
+			So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-1": {}}}, sampleTime), ShouldBeNil)
+			nodesMetadata, err := loadNodesMetadata()
+
+			Convey("Then nodes keep the dates of their samples", func() {
+				So(err, ShouldBeNil)
+				So(nodesMetadata["prod"]["node-1"].FirstSeenUTC, ShouldHappenOnOrBetween, start, start.Add(time.Hour))
+				So(nodesMetadata["prod"]["node-1"].LastSeenUTC, ShouldEqual, sampleTime)
+				So(nodesMetadata["prod"]["node-2"].LastSeenUTC, ShouldEqual, end)
+			})
+
+			Convey("Then nodes of unknown cluster are ignored", func() {
+				So(nodesMetadata["prod"], ShouldNotContainKey, "node-4")
+				So(nodesMetadata, ShouldHaveLength, 1)
+			})
+		})
+
+		Reset(func() {
+			now, listLiveClusterNodes = origNow, origListLiveClusterNodes
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
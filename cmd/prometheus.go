@@ -0,0 +1,133 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PrometheusGauge = "gauge"
+
+	// prometheusContentType is the content type of the Prometheus text exposition format
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// openMetricsContentType is the content type of the OpenMetrics text format
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// prometheusMetricFamily describes a metric whose samples are written by an openMetricsWriter
+type prometheusMetricFamily struct {
+	name string
+	help string
+	kind string
+	unit string
+}
+
+// newPrometheusMetricFamily creates a metric family
+func newPrometheusMetricFamily(name string, kind string, help string) *prometheusMetricFamily {
+	return &prometheusMetricFamily{name: name, kind: kind, help: help}
+}
+
+// withUnit sets the unit of the family, which must be the suffix of its name in OpenMetrics
+func (m *prometheusMetricFamily) withUnit(unit string) *prometheusMetricFamily {
+	m.unit = unit
+	return m
+}
+
+// openMetricsWriter writes samples in the OpenMetrics text format as they are read, with their timestamps in
+// seconds. The samples of a family must be written contiguously and those of a series in chronological order
+type openMetricsWriter struct {
+	out           *bufio.Writer
+	family        *prometheusMetricFamily
+	headerWritten bool
+}
+
+// newOpenMetricsWriter creates a writer of OpenMetrics samples
+func newOpenMetricsWriter(w io.Writer) *openMetricsWriter {
+	return &openMetricsWriter{out: bufio.NewWriter(w)}
+}
+
+// startFamily sets the family of the next samples. Its metadata are written along with its first sample, so that
+// empty families are skipped
+func (m *openMetricsWriter) startFamily(family *prometheusMetricFamily) {
+	m.family = family
+	m.headerWritten = false
+}
+
+// writeSample writes a sample of the current family, labels being given as name/value pairs
+func (m *openMetricsWriter) writeSample(ts time.Time, value float64, labels ...string) {
+	if !m.headerWritten {
+		fmt.Fprintf(m.out, "# TYPE %s %s\n", m.family.name, m.family.kind)
+		if m.family.unit != "" {
+			fmt.Fprintf(m.out, "# UNIT %s %s\n", m.family.name, m.family.unit)
+		}
+		fmt.Fprintf(m.out, "# HELP %s %s\n", m.family.name, escapePrometheusLabel(m.family.help))
+		m.headerWritten = true
+	}
+	m.out.WriteString(m.family.name + formatPrometheusLabels(labels))
+	m.out.WriteString(" " + formatPrometheusValue(value) + " " + strconv.FormatInt(ts.Unix(), 10) + "\n")
+}
+
+// err returns the first error met while writing, after which nothing more is written
+func (m *openMetricsWriter) err() error {
+	// writes are no-ops once the buffered writer has failed, and a zero-length write reports its error
+	_, err := m.out.Write(nil)
+	return err
+}
+
+// close ends the exposition and flushes the buffered samples
+func (m *openMetricsWriter) close() error {
+	m.out.WriteString("# EOF\n")
+	return m.out.Flush()
+}
+
+// formatPrometheusValue formats a sample value as expected by the exposition format
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapePrometheusLabel escapes a label value
+func escapePrometheusLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatPrometheusLabels formats the labels of a sample, an empty string when it has none
+func formatPrometheusLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapePrometheusLabel(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -19,6 +19,7 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -55,6 +56,9 @@ var startConsolidatorServiceCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Infoln("starting analytics consolidation")
 		processConsolidatedUsage()
+		if err := writeMetricsTextfile("consolidator"); err != nil {
+			log.WithError(err).Errorln("failed exporting metrics")
+		}
 		log.Infoln("analytics consolidation completed")
 	},
 }
@@ -65,6 +69,9 @@ var startClusterCredentialsHandlerCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Infoln("starting cluster credentials handler")
 		processClusterCredentials()
+		if err := writeMetricsTextfile("cluster-credentials-handler"); err != nil {
+			log.WithError(err).Errorln("failed exporting metrics")
+		}
 		log.Infoln("cluster credentials handler completed")
 	},
 }
@@ -81,6 +88,8 @@ func init() {
 	rootCmd.AddCommand(startAPIServiceCmd)
 	rootCmd.AddCommand(startConsolidatorServiceCmd)
 	rootCmd.AddCommand(startClusterCredentialsHandlerCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(kubeConfigCmd)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -96,6 +105,23 @@ func initConfig() {
 	viper.SetDefault("krossboard_koainstance_token_dir", "/var/run/secrets/kubernetes.io/serviceaccount")
 	viper.SetDefault("krossboard_cost_model", "CUMULATIVE_RATIO")
 	viper.SetDefault("krossboard_cors_origins", "*")
+	viper.SetDefault("krossboard_api_tls_cert_file", "")
+	viper.SetDefault("krossboard_api_tls_key_file", "")
+	viper.SetDefault("krossboard_api_tls_min_version", "1.2")
+	viper.SetDefault("krossboard_api_tls_client_ca_file", "")
+	viper.SetDefault("krossboard_api_tls_client_auth", "none")
+	viper.SetDefault("krossboard_api_keys_file", "")
+	viper.SetDefault("krossboard_jwt_issuer", "")
+	viper.SetDefault("krossboard_jwt_audience", "krossboard")
+	viper.SetDefault("krossboard_jwt_jwks", "")
+	viper.SetDefault("krossboard_jwt_jwks_cache_ttl", "1h")
+	viper.SetDefault("krossboard_jwt_username_claim", "sub")
+	viper.SetDefault("krossboard_jwt_groups_claim", "groups")
+	viper.SetDefault("krossboard_jwt_admin_groups", "")
+	viper.SetDefault("krossboard_access_control_file", "")
+	viper.SetDefault("krossboard_api_cache_max_entries", 1000)
+	viper.SetDefault("krossboard_api_cache_instances_ttl", "30s")
+	viper.SetDefault("krossboard_stream_heartbeat_interval", "15s")
 	viper.SetDefault("docker_api_version", "1.39")
 	viper.SetDefault("krossboard_awscli_command", "aws")
 	viper.SetDefault("krossboard_aws_metadata_service", "http://169.254.169.254")
@@ -111,8 +137,24 @@ func initConfig() {
 	viper.SetDefault("krossboard_credentials_dir", fmt.Sprintf("%s/.cred", viper.GetString("krossboard_root_dir")))
 	viper.SetDefault("krossboard_kubeconfig_dir", fmt.Sprintf("%s/kubeconfig.d", viper.GetString("krossboard_root_dir")))
 	viper.SetDefault("krossboard_kubeconfig_max_size_kb", 10)
+	viper.SetDefault("krossboard_kubeconfig_validation_timeout_seconds", 10)
+	viper.SetDefault("krossboard_credentials_max_age_minutes", 60)
+	viper.SetDefault("krossboard_metrics_textfile_dir", "")
+	viper.SetDefault("krossboard_readiness_max_usage_age_minutes", 15)
+	viper.SetDefault("krossboard_readiness_check_operator", false)
 	viper.SetDefault("krossboard_k8s_api_endpoint", "https://kubernetes.default.svc")
 	viper.SetDefault("krossboard_operator_api_version", "v1alpha1")
+	viper.SetDefault("krossboard_budgets_file", fmt.Sprintf("%s/budgets.json", viper.GetString("krossboard_root_dir")))
+	viper.SetDefault("krossboard_budget_warning_percent", 80)
+	viper.SetDefault("krossboard_recommendations_lookback_days", 14)
+	viper.SetDefault("krossboard_recommendations_headroom_percent", 20)
+	viper.SetDefault("krossboard_recommendations_underuse_percent", 30)
+	viper.SetDefault("krossboard_forecast_lookback_days", 28)
+	viper.SetDefault("krossboard_forecast_season_hours", 24)
+	viper.SetDefault("krossboard_forecast_threshold_percent", 80)
+	viper.SetDefault("krossboard_anomalies_lookback_weeks", 4)
+	viper.SetDefault("krossboard_anomalies_threshold", 3.5)
+	viper.SetDefault("krossboard_anomalies_retention_days", 30)
 
 	customFormatter := new(log.TextFormatter)
 	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
@@ -139,6 +181,27 @@ func createDirIfNotExists(path string) error {
 	return nil
 }
 
+// writeFileAtomically writes a file through a temporary file renamed once complete, so that readers never
+// get a partially written file
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpFile.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
 // RoundTime rounds the given time to the provided resolution.
 func RoundTime(t time.Time, resolution time.Duration) time.Time {
 	return time.Unix(0, (t.UnixNano()/resolution.Nanoseconds())*resolution.Nanoseconds())
@@ -152,6 +215,22 @@ func getCurrentClusterUsagePath() string {
 	return fmt.Sprintf("%s/currentusage.json", viper.GetString("krossboard_run_dir"))
 }
 
+func getBudgetsStatusPath() string {
+	return fmt.Sprintf("%s/budgets.json", viper.GetString("krossboard_run_dir"))
+}
+
+func getNodesUsagePath() string {
+	return fmt.Sprintf("%s/nodesusage.json", viper.GetString("krossboard_run_dir"))
+}
+
+func getNodesMetadataPath() string {
+	return fmt.Sprintf("%s/.nodes_metadata.json", viper.GetString("krossboard_rawdb_dir"))
+}
+
+func getAnomaliesPath() string {
+	return fmt.Sprintf("%s/anomalies.json", viper.GetString("krossboard_run_dir"))
+}
+
 func listRegularFiles(folder string) ([]string, error) {
 	if _, err := os.Stat(folder); err != nil {
 		return nil, err
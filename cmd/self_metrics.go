@@ -0,0 +1,175 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// defaultDurationBuckets are the upper bounds, in seconds, of the buckets of duration histograms
+var defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// selfMetricsRegistry holds the metrics describing the data processor itself
+var selfMetricsRegistry = prometheus.NewRegistry()
+
+// Metrics describing the data processor itself
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "krossboard_http_requests_total",
+		Help: "Number of HTTP requests served by the API.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "krossboard_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests served by the API.",
+		Buckets: defaultDurationBuckets,
+	}, []string{"route", "method"})
+	upstreamRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "krossboard_upstream_requests_total",
+		Help: "Number of calls to upstream services (kube-opex-analytics, Kubernetes API).",
+	}, []string{"upstream", "operation", "outcome"})
+	upstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "krossboard_upstream_request_duration_seconds",
+		Help:    "Duration of calls to upstream services.",
+		Buckets: defaultDurationBuckets,
+	}, []string{"upstream", "operation"})
+	consolidatorDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "krossboard_consolidator_duration_seconds",
+		Help: "Duration of the last consolidation run.",
+	})
+	consolidatorClusterDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "krossboard_consolidator_cluster_duration_seconds",
+		Help: "Duration of the consolidation of each cluster during the last run.",
+	}, []string{"cluster"})
+	consolidatorLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "krossboard_consolidator_last_success_timestamp_seconds",
+		Help: "Time of the last successful consolidation run.",
+	})
+	rrdUpdateFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "krossboard_rrd_update_failures_total",
+		Help: "Number of failed updates of RRD databases.",
+	}, []string{"cluster", "kind"})
+	credentialsRefreshTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "krossboard_credentials_refresh_total",
+		Help: "Number of cluster credentials refreshes by outcome.",
+	}, []string{"cluster", "outcome"})
+)
+
+func init() {
+	selfMetricsRegistry.MustRegister(httpRequestsTotal, httpRequestDuration, upstreamRequestsTotal, upstreamRequestDuration,
+		consolidatorDuration, consolidatorClusterDuration, consolidatorLastSuccess, rrdUpdateFailuresTotal, credentialsRefreshTotal)
+}
+
+const (
+	UpstreamKOA        = "koa"
+	UpstreamKubernetes = "kubernetes"
+)
+
+// observeUpstreamCall records the outcome and the duration of a call to an upstream service
+func observeUpstreamCall(upstream string, operation string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	upstreamRequestsTotal.WithLabelValues(upstream, operation, outcome).Inc()
+	upstreamRequestDuration.WithLabelValues(upstream, operation).Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder captures the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (m *statusRecorder) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *statusRecorder) Write(data []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	return m.ResponseWriter.Write(data)
+}
+
+// Flush keeps streaming responses working through the recorder
+func (m *statusRecorder) Flush() {
+	if flusher, ok := m.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket connections be upgraded through the recorder
+func (m *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := m.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection hijacking is not supported")
+	}
+	if m.status == 0 {
+		m.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// newHTTPMetricsMiddleware records the count, the status and the duration of requests per route
+func newHTTPMetricsMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, req)
+
+			route := "unknown"
+			if currentRoute := mux.CurrentRoute(req); currentRoute != nil {
+				if tpl, err := currentRoute.GetPathTemplate(); err == nil {
+					route = tpl
+				}
+			}
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			httpRequestsTotal.WithLabelValues(route, req.Method, strconv.Itoa(recorder.status)).Inc()
+			httpRequestDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// writeMetricsTextfile writes the self-instrumentation metrics of a one-shot command to the textfile
+// collector directory, if set. The file is replaced atomically so that partial files are never collected
+func writeMetricsTextfile(command string) error {
+	textfileDir := viper.GetString("krossboard_metrics_textfile_dir")
+	if textfileDir == "" {
+		return nil
+	}
+	target := filepath.Join(textfileDir, fmt.Sprintf("krossboard_%s.prom", strings.ReplaceAll(command, "-", "_")))
+	return errors.Wrap(prometheus.WriteToTextfile(target, selfMetricsRegistry), "failed writing metrics textfile")
+}
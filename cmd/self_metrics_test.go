@@ -0,0 +1,91 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	Convey("Given a router instrumented with the HTTP metrics middleware", t, func() {
+		router := mux.NewRouter()
+		router.Use(newHTTPMetricsMiddleware())
+		router.HandleFunc("/api/test/{name}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+
+		Convey("When a request is served", func() {
+			requests := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/api/test/{name}", "GET", "418"))
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/test/foo", nil))
+			families, err := selfMetricsRegistry.Gather()
+			So(err, ShouldBeNil)
+
+			Convey("Then it is counted by route template and status", func() {
+				So(testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/api/test/{name}", "GET", "418")), ShouldEqual, requests+1)
+				var durationCount uint64
+				for _, family := range families {
+					if family.GetName() != "krossboard_http_request_duration_seconds" {
+						continue
+					}
+					for _, metric := range family.GetMetric() {
+						if len(metric.GetLabel()) == 2 && metric.GetLabel()[1].GetValue() == "/api/test/{name}" {
+							durationCount = metric.GetHistogram().GetSampleCount()
+						}
+					}
+				}
+				So(durationCount, ShouldBeGreaterThan, 0)
+			})
+		})
+	})
+
+	Convey("Given a textfile collector directory", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_metrics_textfile_dir", tempDir)
+		credentialsRefreshTotal.WithLabelValues("prod", "success").Inc()
+
+		Convey("When a one-shot command exports its metrics", func() {
+			So(writeMetricsTextfile("cluster-credentials-handler"), ShouldBeNil)
+
+			Convey("Then they are written to a single file named after the command", func() {
+				files, err := ioutil.ReadDir(tempDir)
+				So(err, ShouldBeNil)
+				So(files, ShouldHaveLength, 1)
+				So(files[0].Name(), ShouldEqual, "krossboard_cluster_credentials_handler.prom")
+				data, err := ioutil.ReadFile(filepath.Join(tempDir, files[0].Name()))
+				So(err, ShouldBeNil)
+				So(string(data), ShouldContainSubstring, `krossboard_credentials_refresh_total{cluster="prod",outcome="success"} `)
+			})
+		})
+
+		Reset(func() {
+			viper.Set("krossboard_metrics_textfile_dir", "")
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
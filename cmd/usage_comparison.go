@@ -0,0 +1,237 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Periods usage can be compared with
+const (
+	UsageComparisonPreviousPeriod = "previousPeriod"
+	UsageComparisonPreviousYear   = "previousYear"
+)
+
+// PeriodUsageStats holds the usage of a cluster over a period. Averages and peaks are percentages of the cluster
+// capacity, totals require the capacity of the cluster to be known from its nodes or the budgets file. Coverage is
+// the percentage of the expected samples actually recorded
+type PeriodUsageStats struct {
+	StartDateUTC    time.Time `json:"startDateUTC"`
+	EndDateUTC      time.Time `json:"endDateUTC"`
+	ExpectedSamples int       `json:"expectedSamples"`
+	Samples         int       `json:"samples"`
+	Coverage        float64   `json:"coverage"`
+	CPUAverage      float64   `json:"cpuAverage"`
+	CPUPeak         float64   `json:"cpuPeak"`
+	MEMAverage      float64   `json:"memAverage"`
+	MEMPeak         float64   `json:"memPeak"`
+	CPUCoreHours    *float64  `json:"cpuCoreHours,omitempty"`
+	MEMGiBHours     *float64  `json:"memGiBHours,omitempty"`
+}
+
+// UsageDelta holds the change of a statistic between two periods. Percent is unset when the previous value is zero
+type UsageDelta struct {
+	Absolute float64  `json:"absolute"`
+	Percent  *float64 `json:"percent,omitempty"`
+}
+
+// UsageComparison holds the usage of a cluster over two periods, and the changes of each statistic
+type UsageComparison struct {
+	Cluster  string                 `json:"cluster"`
+	Current  *PeriodUsageStats      `json:"current"`
+	Previous *PeriodUsageStats      `json:"previous"`
+	Deltas   map[string]*UsageDelta `json:"deltas"`
+}
+
+// getComparisonPeriod returns the period a period is compared with, which must be within the retention of history
+// databases
+func getComparisonPeriod(startDateUTC time.Time, endDateUTC time.Time, compareTo string) (time.Time, time.Time, error) {
+	var previousStartDateUTC, previousEndDateUTC time.Time
+	switch compareTo {
+	case "", UsageComparisonPreviousPeriod:
+		previousStartDateUTC, previousEndDateUTC = startDateUTC.Add(-endDateUTC.Sub(startDateUTC)), startDateUTC
+	case UsageComparisonPreviousYear:
+		previousStartDateUTC, previousEndDateUTC = startDateUTC.AddDate(-1, 0, 0), endDateUTC.AddDate(-1, 0, 0)
+	default:
+		return startDateUTC, endDateUTC, fmt.Errorf("invalid value '%s' for query parameter 'compareTo'. Valid values are: '%s', '%s'",
+			compareTo, UsageComparisonPreviousPeriod, UsageComparisonPreviousYear)
+	}
+	if retentionLimit := now().UTC().Add(-RRDDailyRetention); previousStartDateUTC.Before(retentionLimit) {
+		return previousStartDateUTC, previousEndDateUTC, fmt.Errorf("the period to compare with starts before %s, the retention limit of usage history",
+			retentionLimit.Format(time.RFC3339))
+	}
+	return previousStartDateUTC, previousEndDateUTC, nil
+}
+
+// computePeriodUsageStats aggregates a usage history sampled every step. Totals are computed from the capacity of
+// the cluster at each sample, summed from the capacity of its nodes (cores and bytes), or the capacity set in the
+// budgets file for samples without node capacity
+func computePeriodUsageStats(history *UsageHistory, startDateUTC time.Time, endDateUTC time.Time, step time.Duration, capacityHistory *UsageHistory, capacity *ClusterCapacity) *PeriodUsageStats {
+	stats := &PeriodUsageStats{
+		StartDateUTC:    startDateUTC,
+		EndDateUTC:      endDateUTC,
+		ExpectedSamples: int(RoundTime(endDateUTC, step).Sub(RoundTime(startDateUTC, step)) / step),
+	}
+	// aggregate returns the average and the peak of usage percentages, and the total of resource-hours when the
+	// capacity is known at some samples
+	aggregate := func(items []*ResourceUsageItem, capacities []*ResourceUsageItem, defaultCapacity float64) (average float64, peak float64, total *float64) {
+		capacityAt := make(map[int64]float64)
+		for _, item := range capacities {
+			capacityAt[item.DateUTC.Unix()] = item.Value
+		}
+		var sum, resourceHours float64
+		var withCapacity bool
+		for _, item := range items {
+			sum += item.Value
+			if item.Value > peak {
+				peak = item.Value
+			}
+			itemCapacity, found := capacityAt[item.DateUTC.Unix()]
+			if !found {
+				itemCapacity, found = defaultCapacity, defaultCapacity > 0
+			}
+			if found {
+				resourceHours += item.Value / 100 * itemCapacity * step.Hours()
+				withCapacity = true
+			}
+		}
+		if len(items) > 0 {
+			average = sum / float64(len(items))
+		}
+		if withCapacity {
+			total = &resourceHours
+		}
+		return average, peak, total
+	}
+
+	if capacityHistory == nil {
+		capacityHistory = &UsageHistory{}
+	}
+	// node memory capacities are in bytes
+	memGiBCapacities := make([]*ResourceUsageItem, 0, len(capacityHistory.MEMUsage))
+	for _, item := range capacityHistory.MEMUsage {
+		memGiBCapacities = append(memGiBCapacities, &ResourceUsageItem{DateUTC: item.DateUTC, Value: item.Value / (1 << 30)})
+	}
+	var defaultCPUCores, defaultMemGiB float64
+	if capacity != nil {
+		defaultCPUCores, defaultMemGiB = capacity.CPUCores, capacity.MemGiB
+	}
+	if history != nil {
+		stats.Samples = len(history.CPUUsage)
+		stats.CPUAverage, stats.CPUPeak, stats.CPUCoreHours = aggregate(history.CPUUsage, capacityHistory.CPUUsage, defaultCPUCores)
+		stats.MEMAverage, stats.MEMPeak, stats.MEMGiBHours = aggregate(history.MEMUsage, memGiBCapacities, defaultMemGiB)
+	}
+	if stats.ExpectedSamples > 0 {
+		stats.Coverage = 100 * float64(stats.Samples) / float64(stats.ExpectedSamples)
+	}
+	return stats
+}
+
+// getComparisonStep returns the resolution of the usage compared over two periods, hourly unless the previous
+// period is beyond the retention of the hourly archive of usage databases
+func getComparisonStep(previousStartDateUTC time.Time) time.Duration {
+	if previousStartDateUTC.Before(now().UTC().Add(-RRDHourlyRetention)) {
+		return time.Duration(RRDStorageStep86400Secs) * time.Second
+	}
+	return time.Duration(RRDStorageStep3600Secs) * time.Second
+}
+
+// fetchClusterCapacityHistory sums the capacity history of the nodes of a cluster seen over a period
+func fetchClusterCapacityHistory(clusterName string, startDateUTC time.Time, endDateUTC time.Time, step time.Duration) (*UsageHistory, error) {
+	nodeNames, _, err := listClusterNodes(clusterName, startDateUTC, endDateUTC)
+	if err != nil {
+		return nil, err
+	}
+	var capacityHistories []*UsageHistory
+	for _, nodeName := range nodeNames {
+		nodeUsageDb, err := openNodeUsageDB(nodeName)
+		if err != nil {
+			log.WithError(err).Debugln("skipping node without usage databases", nodeName)
+			continue
+		}
+		capacityHistory, err := nodeUsageDb.CapacityDb.FetchUsage(startDateUTC, endDateUTC, step)
+		if err != nil {
+			log.WithError(err).Errorln("failed retrieving node capacity history", nodeUsageDb.CapacityDb.RRDFile)
+			continue
+		}
+		capacityHistories = append(capacityHistories, capacityHistory)
+	}
+	return sumUsageHistories(capacityHistories), nil
+}
+
+// compareClusterUsage compares the usage of a cluster over two periods, hourly or daily for periods beyond the
+// retention of the hourly archive
+func compareClusterUsage(clusterName string, dbfile string, startDateUTC time.Time, endDateUTC time.Time, previousStartDateUTC time.Time, previousEndDateUTC time.Time, capacity *ClusterCapacity) (*UsageComparison, error) {
+	step := getComparisonStep(previousStartDateUTC)
+	usageDb := NewUsageDb(dbfile, 100)
+	currentUsage, err := usageDb.FetchUsage(startDateUTC, endDateUTC, step)
+	if err != nil {
+		return nil, err
+	}
+	previousUsage, err := usageDb.FetchUsage(previousStartDateUTC, previousEndDateUTC, step)
+	if err != nil {
+		return nil, err
+	}
+	currentCapacity, err := fetchClusterCapacityHistory(clusterName, startDateUTC, endDateUTC, step)
+	if err != nil {
+		log.WithError(err).Warnln("failed listing cluster nodes, totals are computed from the budgets file", clusterName)
+	}
+	previousCapacity, err := fetchClusterCapacityHistory(clusterName, previousStartDateUTC, previousEndDateUTC, step)
+	if err != nil {
+		log.WithError(err).Warnln("failed listing cluster nodes, totals are computed from the budgets file", clusterName)
+	}
+	current := computePeriodUsageStats(currentUsage, startDateUTC, endDateUTC, step, currentCapacity, capacity)
+	previous := computePeriodUsageStats(previousUsage, previousStartDateUTC, previousEndDateUTC, step, previousCapacity, capacity)
+	return &UsageComparison{
+		Cluster:  clusterName,
+		Current:  current,
+		Previous: previous,
+		Deltas:   compareUsageStats(current, previous),
+	}, nil
+}
+
+// compareUsageStats returns the changes of each statistic from the previous period to the current one, none
+// when a period has no samples. Totals are only compared when both periods have the same coverage, since missing
+// samples lower them
+func compareUsageStats(current *PeriodUsageStats, previous *PeriodUsageStats) map[string]*UsageDelta {
+	deltas := make(map[string]*UsageDelta)
+	if current.Samples == 0 || previous.Samples == 0 {
+		return deltas
+	}
+	addDelta := func(name string, currentValue float64, previousValue float64) {
+		delta := &UsageDelta{Absolute: currentValue - previousValue}
+		if previousValue != 0 {
+			percent := 100 * delta.Absolute / previousValue
+			delta.Percent = &percent
+		}
+		deltas[name] = delta
+	}
+	addDelta("cpuAverage", current.CPUAverage, previous.CPUAverage)
+	addDelta("cpuPeak", current.CPUPeak, previous.CPUPeak)
+	addDelta("memAverage", current.MEMAverage, previous.MEMAverage)
+	addDelta("memPeak", current.MEMPeak, previous.MEMPeak)
+	if current.CPUCoreHours != nil && previous.CPUCoreHours != nil &&
+		current.Samples*previous.ExpectedSamples == previous.Samples*current.ExpectedSamples {
+		addDelta("cpuCoreHours", *current.CPUCoreHours, *previous.CPUCoreHours)
+		addDelta("memGiBHours", *current.MEMGiBHours, *previous.MEMGiBHours)
+	}
+	return deltas
+}
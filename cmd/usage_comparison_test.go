@@ -0,0 +1,184 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestUsageComparison(t *testing.T) {
+	Convey("Given a period of ten days", t, func(c C) {
+		start, end := date(c, "2020-06-11T00:00:00Z"), date(c, "2020-06-21T00:00:00Z")
+		origNow := now
+		now = func() time.Time { return end }
+
+		Convey("When comparison periods are requested", func() {
+			Convey("Then the previous period and the same period last year are returned", func() {
+				previousStart, previousEnd, err := getComparisonPeriod(start, end, "")
+				So(err, ShouldBeNil)
+				So(previousStart, ShouldEqual, date(c, "2020-06-01T00:00:00Z"))
+				So(previousEnd, ShouldEqual, start)
+				previousStart, previousEnd, _ = getComparisonPeriod(start, end, UsageComparisonPreviousYear)
+				So(previousStart, ShouldEqual, date(c, "2019-06-11T00:00:00Z"))
+				So(previousEnd, ShouldEqual, date(c, "2019-06-21T00:00:00Z"))
+				_, _, err = getComparisonPeriod(start, end, "lastWeek")
+				So(err.Error(), ShouldContainSubstring, "query parameter 'compareTo'")
+			})
+
+			Convey("Then periods beyond the hourly archive of history databases are compared daily", func() {
+				now = func() time.Time { return date(c, "2020-07-01T00:00:00Z") }
+				previousStart, _, err := getComparisonPeriod(start, end, UsageComparisonPreviousYear)
+				So(err, ShouldBeNil)
+				So(getComparisonStep(previousStart), ShouldEqual, 24*time.Hour)
+				previousStart, _, _ = getComparisonPeriod(start, end, "")
+				So(getComparisonStep(previousStart), ShouldEqual, time.Hour)
+			})
+
+			Convey("Then periods beyond the retention of history databases are rejected", func() {
+				now = func() time.Time { return date(c, "2021-12-01T00:00:00Z") }
+				_, _, err := getComparisonPeriod(start, end, UsageComparisonPreviousYear)
+				So(err.Error(), ShouldContainSubstring, "retention limit")
+			})
+		})
+
+		Convey("When the hourly usage of a 10 cores/40 GiB cluster is aggregated", func() {
+			history := func(cpu []float64, mem []float64) *UsageHistory {
+				usage := &UsageHistory{}
+				for i := range cpu {
+					usage.CPUUsage = append(usage.CPUUsage, &ResourceUsageItem{DateUTC: start.Add(time.Duration(i) * time.Hour), Value: cpu[i]})
+					usage.MEMUsage = append(usage.MEMUsage, &ResourceUsageItem{DateUTC: start.Add(time.Duration(i) * time.Hour), Value: mem[i]})
+				}
+				return usage
+			}
+			capacity := &ClusterCapacity{CPUCores: 10, MemGiB: 40}
+			current := computePeriodUsageStats(history([]float64{40, 60, 80}, []float64{50, 50, 50}), start, end, time.Hour, nil, capacity)
+			// the previous period is shorter, with the same coverage
+			previous := computePeriodUsageStats(history([]float64{20, 60}, []float64{50, 0}), start, start.Add(160*time.Hour), time.Hour, nil, capacity)
+
+			Convey("Then averages, peaks and totals are computed", func() {
+				So(current.ExpectedSamples, ShouldEqual, 240)
+				So(current.Samples, ShouldEqual, 3)
+				So(current.Coverage, ShouldAlmostEqual, 1.25)
+				So(current.CPUAverage, ShouldAlmostEqual, 60)
+				So(current.CPUPeak, ShouldAlmostEqual, 80)
+				So(current.MEMAverage, ShouldAlmostEqual, 50)
+				So(*current.CPUCoreHours, ShouldAlmostEqual, 18)
+				So(*current.MEMGiBHours, ShouldAlmostEqual, 60)
+			})
+
+			Convey("Then absolute and percentage deltas are returned", func() {
+				deltas := compareUsageStats(current, previous)
+				So(deltas["cpuAverage"].Absolute, ShouldAlmostEqual, 20)
+				So(*deltas["cpuAverage"].Percent, ShouldAlmostEqual, 50)
+				So(deltas["cpuPeak"].Absolute, ShouldAlmostEqual, 20)
+				So(deltas["cpuCoreHours"].Absolute, ShouldAlmostEqual, 10)
+				So(*deltas["cpuCoreHours"].Percent, ShouldAlmostEqual, 125)
+				So(*deltas["memGiBHours"].Percent, ShouldAlmostEqual, 200)
+			})
+
+			Convey("Then totals are not compared when the coverages differ", func() {
+				previous := computePeriodUsageStats(history([]float64{20, 60}, []float64{50, 0}), start, end, time.Hour, nil, capacity)
+				deltas := compareUsageStats(current, previous)
+				So(deltas, ShouldContainKey, "cpuAverage")
+				So(deltas, ShouldNotContainKey, "cpuCoreHours")
+				So(deltas, ShouldNotContainKey, "memGiBHours")
+			})
+
+			Convey("Then totals follow the capacity of the nodes when it's known", func() {
+				// the cluster grows from 10 to 20 cores and from 32 to 64 GiB at the second sample
+				capacityHistory := history([]float64{10, 20}, []float64{32 << 30, 64 << 30})
+				stats := computePeriodUsageStats(history([]float64{40, 60, 80}, []float64{50, 50, 50}), start, end, time.Hour, capacityHistory, capacity)
+				So(*stats.CPUCoreHours, ShouldAlmostEqual, 4+12+8)
+				So(*stats.MEMGiBHours, ShouldAlmostEqual, 16+32+20)
+				stats = computePeriodUsageStats(history([]float64{40}, []float64{50}), start, end, time.Hour, capacityHistory, nil)
+				So(*stats.CPUCoreHours, ShouldAlmostEqual, 4)
+			})
+
+			Convey("Then totals are omitted when the capacity is unknown", func() {
+				stats := computePeriodUsageStats(history([]float64{40}, []float64{50}), start, end, time.Hour, nil, nil)
+				So(stats.CPUCoreHours, ShouldBeNil)
+				So(compareUsageStats(stats, stats), ShouldNotContainKey, "cpuCoreHours")
+			})
+
+			Convey("Then no delta is returned for periods without samples", func() {
+				So(compareUsageStats(current, computePeriodUsageStats(&UsageHistory{}, start, end, time.Hour, nil, capacity)), ShouldBeEmpty)
+			})
+		})
+
+		Reset(func() {
+			now = origNow
+		})
+	})
+
+	Convey("Given an API router without history databases", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_historydb_dir", tempDir)
+		viper.Set("krossboard_budgets_file", tempDir+"/budgets.json")
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+		origNow := now
+		now = time.Now
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+		serve := func(target string) (*httptest.ResponseRecorder, *GetUsageComparisonResp) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+			comparisonResp := &GetUsageComparisonResp{}
+			_ = json.Unmarshal(resp.Body.Bytes(), comparisonResp)
+			return resp, comparisonResp
+		}
+
+		Convey("When usage comparisons are requested", func() {
+			Convey("Then clusters and periods are validated", func() {
+				resp, comparisonResp := serve("/api/usagecomparison")
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(comparisonResp.Comparisons, ShouldBeEmpty)
+
+				resp, _ = serve("/api/usagecomparison?cluster=prod")
+				So(resp.Code, ShouldEqual, http.StatusNotFound)
+				resp, _ = serve("/api/usagecomparison?compareTo=lastWeek")
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				resp, comparisonResp = serve("/api/usagecomparison?startDateUTC=now")
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(comparisonResp.Message, ShouldEqual, "the period is empty")
+				resp, comparisonResp = serve("/api/usagecomparison?startDateUTC=2000-01-01&endDateUTC=2000-02-01")
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(comparisonResp.Message, ShouldContainSubstring, "retention limit")
+				resp, _ = serve("/api/usagecomparison?cluster=..%2Fprod")
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Reset(func() {
+			now = origNow
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CSVLayoutLong writes one row per item and date
+	CSVLayoutLong = "long"
+	// CSVLayoutWide writes one row per date, with the columns of all items side by side
+	CSVLayoutWide = "wide"
+
+	// usageCSVContentType is the media type of CSV exports, which always start with a header
+	usageCSVContentType = "text/csv; charset=utf-8; header=present"
+)
+
+// csvDelimiters maps the values of the 'delimiter' query parameter to field delimiters
+var csvDelimiters = map[string]rune{
+	"comma":     ',',
+	"semicolon": ';',
+	"tab":       '\t',
+	"pipe":      '|',
+}
+
+// formatCSVValue formats a sample value, empty when there is no sample
+func formatCSVValue(values map[string]float64, column string) string {
+	value, found := values[column]
+	if !found {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// parseCSVDelimiter returns the delimiter matching a 'delimiter' query parameter, a comma by default
+func parseCSVDelimiter(name string) (rune, error) {
+	if name == "" {
+		return ',', nil
+	}
+	delimiter, found := csvDelimiters[name]
+	if !found {
+		return 0, fmt.Errorf("invalid value '%s' for query parameter 'delimiter'. Valid values are: 'comma', 'semicolon', 'tab', 'pipe'", name)
+	}
+	return delimiter, nil
+}
+
+// parseCSVLayout validates a 'layout' query parameter, long by default
+func parseCSVLayout(layout string) (string, error) {
+	switch layout {
+	case "":
+		return CSVLayoutLong, nil
+	case CSVLayoutLong, CSVLayoutWide:
+		return layout, nil
+	}
+	return "", fmt.Errorf("invalid value '%s' for query parameter 'layout'. Valid values are: 'long', 'wide'", layout)
+}
+
+// parseCSVOptions returns the layout and the delimiter of CSV responses set by query parameters
+func parseCSVOptions(queryParams url.Values) (layout string, delimiter rune, err error) {
+	layout, err = parseCSVLayout(strings.ToLower(queryParams.Get("layout")))
+	if err != nil {
+		return "", 0, err
+	}
+	delimiter, err = parseCSVDelimiter(strings.ToLower(queryParams.Get("delimiter")))
+	if err != nil {
+		return "", 0, err
+	}
+	return layout, delimiter, nil
+}
+
+// writeUsageCSV writes series as RFC 4180 CSV with a single header. The long layout has one row per item and
+// date, sorted by item then date. The wide layout has one row per date, with a '<item>:<column>' column for each
+// item and column. Missing samples are left empty
+func writeUsageCSV(w io.Writer, series []*usageSeries, columns []string, layout string, delimiter rune) error {
+	sort.Slice(series, func(i, j int) bool { return series[i].name < series[j].name })
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Comma = delimiter
+	csvWriter.UseCRLF = true
+
+	if layout == CSVLayoutWide {
+		header := []string{"dateUTC"}
+		samples := make([]map[int64]map[string]float64, len(series))
+		allDates := make(map[int64]map[string]float64)
+		for i, item := range series {
+			for _, column := range columns {
+				header = append(header, fmt.Sprintf("%s:%s", item.name, column))
+			}
+			samples[i] = item.samplesByDate()
+			for ts := range samples[i] {
+				allDates[ts] = nil
+			}
+		}
+		if err := csvWriter.Write(header); err != nil {
+			return err
+		}
+		for _, ts := range sortedDates(allDates) {
+			row := []string{formatExportDate(ts)}
+			for i := range series {
+				for _, column := range columns {
+					row = append(row, formatCSVValue(samples[i][ts], column))
+				}
+			}
+			if err := csvWriter.Write(row); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := csvWriter.Write(append([]string{"name", "dateUTC"}, columns...)); err != nil {
+			return err
+		}
+		for _, item := range series {
+			samples := item.samplesByDate()
+			for _, ts := range sortedDates(samples) {
+				row := []string{item.name, formatExportDate(ts)}
+				for _, column := range columns {
+					row = append(row, formatCSVValue(samples[ts], column))
+				}
+				if err := csvWriter.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
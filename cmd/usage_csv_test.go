@@ -0,0 +1,110 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestUsageCSV(t *testing.T) {
+	Convey("Given the usage history of a cluster and of a namespace whose name needs quoting", t, func(c C) {
+		t1, t2 := date(c, "2020-06-01T10:00:00Z"), date(c, "2020-06-01T10:05:00Z")
+		series := func() []*usageSeries {
+			return []*usageSeries{
+				newUsageHistorySeries("staging", &UsageHistory{
+					CPUUsage: []*ResourceUsageItem{{DateUTC: t2, Value: 0.5}},
+					MEMUsage: []*ResourceUsageItem{{DateUTC: t2, Value: 1024}},
+				}),
+				newUsageHistorySeries(`team "a", b`, &UsageHistory{
+					CPUUsage: []*ResourceUsageItem{{DateUTC: t1, Value: 1.25}, {DateUTC: t2, Value: 2}},
+					MEMUsage: []*ResourceUsageItem{{DateUTC: t1, Value: 2048}},
+				}),
+			}
+		}
+
+		Convey("When it's written with the long layout", func() {
+			var buf bytes.Buffer
+			So(writeUsageCSV(&buf, series(), usageHistoryColumns, CSVLayoutLong, ','), ShouldBeNil)
+
+			Convey("Then there is a single header, quoted names, ISO dates and one row per item and date", func() {
+				So(buf.String(), ShouldEqual, "name,dateUTC,cpuUsage,memUsage\r\n"+
+					"staging,2020-06-01T10:05:00Z,0.5,1024\r\n"+
+					`"team ""a"", b",2020-06-01T10:00:00Z,1.25,2048`+"\r\n"+
+					`"team ""a"", b",2020-06-01T10:05:00Z,2,`+"\r\n")
+				records, err := csv.NewReader(&buf).ReadAll()
+				So(err, ShouldBeNil)
+				So(records, ShouldHaveLength, 4)
+				So(records[2][0], ShouldEqual, `team "a", b`)
+			})
+		})
+
+		Convey("When it's written with the wide layout and semicolons", func() {
+			var buf bytes.Buffer
+			So(writeUsageCSV(&buf, series(), usageHistoryColumns, CSVLayoutWide, ';'), ShouldBeNil)
+
+			Convey("Then there is one row per date with the columns of all items", func() {
+				So(buf.String(), ShouldEqual, `dateUTC;staging:cpuUsage;staging:memUsage;"team ""a"", b:cpuUsage";"team ""a"", b:memUsage"`+"\r\n"+
+					"2020-06-01T10:00:00Z;;;1.25;2048\r\n"+
+					"2020-06-01T10:05:00Z;0.5;1024;2;\r\n")
+			})
+		})
+
+		Convey("When CSV options are parsed", func() {
+			Convey("Then defaults and named delimiters are accepted and other values are rejected", func() {
+				layout, delimiter, err := parseCSVOptions(map[string][]string{})
+				So(err, ShouldBeNil)
+				So(layout, ShouldEqual, CSVLayoutLong)
+				So(delimiter, ShouldEqual, ',')
+				layout, delimiter, err = parseCSVOptions(map[string][]string{"layout": {"wide"}, "delimiter": {"tab"}})
+				So(err, ShouldBeNil)
+				So(layout, ShouldEqual, CSVLayoutWide)
+				So(delimiter, ShouldEqual, '\t')
+				_, _, err = parseCSVOptions(map[string][]string{"delimiter": {","}})
+				So(err, ShouldNotBeNil)
+				_, _, err = parseCSVOptions(map[string][]string{"layout": {"tall"}})
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given an API router", t, func() {
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+
+		Convey("When the CSV of nodes usage is requested with an unknown delimiter", func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", "/api/nodesusage/prod?format=csv&delimiter=colon", nil))
+
+			Convey("Then the request is rejected", func() {
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(resp.Body.String(), ShouldContainSubstring, "delimiter")
+			})
+		})
+	})
+}
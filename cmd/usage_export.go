@@ -0,0 +1,352 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Formats of usage exports
+const (
+	ExportFormatJSON    = "json"
+	ExportFormatCSV     = "csv"
+	ExportFormatNDJSON  = "ndjson"
+	ExportFormatParquet = "parquet"
+)
+
+// Media types of bulk exports
+const (
+	usageNDJSONContentType  = "application/x-ndjson"
+	usageParquetContentType = "application/vnd.apache.parquet"
+)
+
+// parquetRowGroupSize bounds the rows buffered in memory before a Parquet row group is written out
+const parquetRowGroupSize = 8 * 1024 * 1024
+
+// Columns of the usage exports
+var (
+	usageHistoryColumns = []string{"cpuUsage", "memUsage"}
+	nodeUsageColumns    = []string{"cpuCapacity", "cpuAllocatable", "cpuUsageByPods", "memCapacity", "memAllocatable", "memUsageByPods"}
+)
+
+// usageSeries holds the samples of an item (a cluster, a namespace or a node) for each column of an export
+type usageSeries struct {
+	name    string
+	columns map[string][]*ResourceUsageItem
+}
+
+// newUsageHistorySeries returns the export series of a usage history
+func newUsageHistorySeries(name string, usageHistory *UsageHistory) *usageSeries {
+	return &usageSeries{name: name, columns: map[string][]*ResourceUsageItem{
+		"cpuUsage": usageHistory.CPUUsage,
+		"memUsage": usageHistory.MEMUsage,
+	}}
+}
+
+// newNodeUsageSeries returns the export series of the capacity, allocatable and usage by pods histories of a node
+func newNodeUsageSeries(name string, capacity *UsageHistory, allocatable *UsageHistory, usageByPods *UsageHistory) *usageSeries {
+	return &usageSeries{name: name, columns: map[string][]*ResourceUsageItem{
+		"cpuCapacity":    capacity.CPUUsage,
+		"cpuAllocatable": allocatable.CPUUsage,
+		"cpuUsageByPods": usageByPods.CPUUsage,
+		"memCapacity":    capacity.MEMUsage,
+		"memAllocatable": allocatable.MEMUsage,
+		"memUsageByPods": usageByPods.MEMUsage,
+	}}
+}
+
+// samplesByDate indexes the samples of a series by date and column
+func (m *usageSeries) samplesByDate() map[int64]map[string]float64 {
+	samples := make(map[int64]map[string]float64)
+	for column, items := range m.columns {
+		for _, item := range items {
+			ts := item.DateUTC.Unix()
+			if samples[ts] == nil {
+				samples[ts] = make(map[string]float64)
+			}
+			samples[ts][column] = item.Value
+		}
+	}
+	return samples
+}
+
+// sortedDates returns the dates of indexed samples in chronological order
+func sortedDates(samples map[int64]map[string]float64) []int64 {
+	dates := make([]int64, 0, len(samples))
+	for ts := range samples {
+		dates = append(dates, ts)
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i] < dates[j] })
+	return dates
+}
+
+// formatExportDate formats the date of a sample as RFC 3339 in UTC
+func formatExportDate(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// isBulkExportFormat tells whether a format is written series by series instead of as a single document
+func isBulkExportFormat(format string) bool {
+	return format == ExportFormatNDJSON || format == ExportFormatParquet
+}
+
+// isBulkExportRequest tells whether a request asks for a bulk export, which isn't bound by the API write timeout
+func isBulkExportRequest(req *http.Request) bool {
+	return !isAPIv2Request(req) && isBulkExportFormat(strings.ToLower(req.URL.Query().Get("format")))
+}
+
+// bulkExportContentType returns the media type of a bulk export format
+func bulkExportContentType(format string) string {
+	if format == ExportFormatParquet {
+		return usageParquetContentType
+	}
+	return usageNDJSONContentType
+}
+
+// usageExporter writes usage series in a bulk export format, one row per item and date
+type usageExporter interface {
+	write(series *usageSeries) error
+	close() error
+}
+
+// newUsageExporter returns an exporter writing the given columns in a bulk export format
+func newUsageExporter(w io.Writer, format string, columns []string) (usageExporter, error) {
+	switch format {
+	case ExportFormatNDJSON:
+		return &ndjsonUsageExporter{w: w, columns: columns}, nil
+	case ExportFormatParquet:
+		return newParquetUsageExporter(w, columns)
+	}
+	return nil, fmt.Errorf("unsupported export format '%s'", format)
+}
+
+// ndjsonUsageExporter writes a JSON object per line, flushing the output after each series
+type ndjsonUsageExporter struct {
+	w       io.Writer
+	columns []string
+}
+
+func (m *ndjsonUsageExporter) write(series *usageSeries) error {
+	name, err := json.Marshal(series.name)
+	if err != nil {
+		return err
+	}
+	samples := series.samplesByDate()
+	var line bytes.Buffer
+	for _, ts := range sortedDates(samples) {
+		line.Reset()
+		line.WriteString(`{"name":`)
+		line.Write(name)
+		line.WriteString(`,"dateUTC":"`)
+		line.WriteString(formatExportDate(ts))
+		line.WriteByte('"')
+		for _, column := range m.columns {
+			line.WriteString(`,"`)
+			line.WriteString(column)
+			line.WriteString(`":`)
+			if value, found := samples[ts][column]; found {
+				line.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+			} else {
+				line.WriteString("null")
+			}
+		}
+		line.WriteString("}\n")
+		if _, err := m.w.Write(line.Bytes()); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := m.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (m *ndjsonUsageExporter) close() error {
+	return nil
+}
+
+// parquetUsageExporter writes a Parquet file with a 'name' string column, a 'dateUTC' timestamp column and a
+// nullable double column per usage column
+type parquetUsageExporter struct {
+	pw      *writer.CSVWriter
+	columns []string
+}
+
+func newParquetUsageExporter(w io.Writer, columns []string) (*parquetUsageExporter, error) {
+	schema := []string{
+		"name=name, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED",
+		"name=dateUTC, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=REQUIRED",
+	}
+	for _, column := range columns {
+		schema = append(schema, fmt.Sprintf("name=%s, type=DOUBLE, repetitiontype=OPTIONAL", column))
+	}
+	pw, err := writer.NewCSVWriterFromWriter(schema, w, 1)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating Parquet writer")
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetUsageExporter{pw: pw, columns: columns}, nil
+}
+
+func (m *parquetUsageExporter) write(series *usageSeries) error {
+	samples := series.samplesByDate()
+	for _, ts := range sortedDates(samples) {
+		row := []interface{}{series.name, ts * 1000}
+		for _, column := range m.columns {
+			if value, found := samples[ts][column]; found {
+				row = append(row, value)
+			} else {
+				row = append(row, nil)
+			}
+		}
+		if err := m.pw.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *parquetUsageExporter) close() error {
+	return m.pw.WriteStop()
+}
+
+// exportUsageHistory writes the usage history of a set of databases, keyed by item name, in a bulk export
+// format. Databases are read one at a time so that the whole export is never held in memory
+func exportUsageHistory(w io.Writer, format string, historyDbs map[string]string, period string, startDateUTC time.Time, endDateUTC time.Time, step time.Duration) error {
+	exporter, err := newUsageExporter(w, format, usageHistoryColumns)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(historyDbs))
+	for name := range historyDbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		usageHistory, err := fetchUsageHistory(NewUsageDb(historyDbs[name], 100), period, startDateUTC, endDateUTC, step)
+		if err != nil {
+			log.WithError(err).Errorln("failed retrieving data from rrd file", historyDbs[name])
+			continue
+		}
+		if err := exporter.write(newUsageHistorySeries(name, usageHistory)); err != nil {
+			return err
+		}
+	}
+	return exporter.close()
+}
+
+// fetchUsageHistory reads a usage history at the given step, or at the resolution of the period when the step is zero
+func fetchUsageHistory(usageDb *UsageDb, period string, startDateUTC time.Time, endDateUTC time.Time, step time.Duration) (*UsageHistory, error) {
+	switch {
+	case period == "monthly":
+		return usageDb.FetchUsageMonthly(startDateUTC, endDateUTC)
+	case step > 0:
+		return usageDb.FetchUsage(startDateUTC, endDateUTC, step)
+	}
+	return usageDb.FetchUsageHourly(startDateUTC, endDateUTC)
+}
+
+// nodeUsageStep returns the resolution of node usage histories, fine-grained for periods of up to 24 hours
+func nodeUsageStep(startDateUTC time.Time, endDateUTC time.Time) time.Duration {
+	if endDateUTC.Sub(startDateUTC) <= 24*time.Hour {
+		return time.Duration(RRDStorageStep300Secs) * time.Second
+	}
+	return time.Duration(RRDStorageStep3600Secs) * time.Second
+}
+
+// exportNodesUsage writes the capacity, allocatable and usage by pods history of nodes in a bulk export format
+func exportNodesUsage(w io.Writer, format string, nodeNames []string, startDateUTC time.Time, endDateUTC time.Time, step time.Duration) error {
+	exporter, err := newUsageExporter(w, format, nodeUsageColumns)
+	if err != nil {
+		return err
+	}
+	sort.Strings(nodeNames)
+	for _, nodeName := range nodeNames {
+		nodeUsageDb, err := openNodeUsageDB(nodeName)
+		if err != nil {
+			return errors.Wrapf(err, "no usage databases for node %s", nodeName)
+		}
+		var histories []*UsageHistory
+		for _, usageDb := range []*UsageDb{nodeUsageDb.CapacityDb, nodeUsageDb.AllocatableDb, nodeUsageDb.UsageByPodsDb} {
+			usageHistory, err := usageDb.FetchUsage(startDateUTC, endDateUTC, step)
+			if err != nil {
+				log.WithError(err).Errorln("failed retrieving node usage history", usageDb.RRDFile)
+				usageHistory = &UsageHistory{}
+			}
+			histories = append(histories, usageHistory)
+		}
+		if err := exporter.write(newNodeUsageSeries(nodeName, histories[0], histories[1], histories[2])); err != nil {
+			return err
+		}
+	}
+	return exporter.close()
+}
+
+// listStoredHistoryDbs returns the history databases of all clusters keyed by cluster name, or those of the
+// namespaces of a cluster keyed by database file, as served by the usage history API
+func listStoredHistoryDbs(clusterName string) (map[string]string, error) {
+	historyDbs := make(map[string]string)
+	if clusterName == "" || strings.ToLower(clusterName) == "all" {
+		dbFiles, err := filepath.Glob(getHistoryDbPath("*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, dbFile := range dbFiles {
+			historyDbs[strings.TrimPrefix(filepath.Base(dbFile), "historydb-")] = dbFile
+		}
+		return historyDbs, nil
+	}
+	dbFiles, err := listRegularFiles(fmt.Sprintf("%s/%s", viper.GetString("krossboard_rawdb_dir"), clusterName))
+	if err != nil {
+		return nil, err
+	}
+	for _, dbFile := range dbFiles {
+		historyDbs[dbFile] = dbFile
+	}
+	return historyDbs, nil
+}
+
+// listStoredNodeNames returns the names of the nodes having usage databases
+func listStoredNodeNames() ([]string, error) {
+	const prefix, suffix = ".nodeusage_", "_capacity"
+	dbFiles, err := filepath.Glob(fmt.Sprintf("%s/%s*%s", viper.GetString("krossboard_rawdb_dir"), prefix, suffix))
+	if err != nil {
+		return nil, err
+	}
+	var nodeNames []string
+	for _, dbFile := range dbFiles {
+		nodeNames = append(nodeNames, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dbFile), prefix), suffix))
+	}
+	return nodeNames, nil
+}
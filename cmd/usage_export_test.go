@@ -0,0 +1,182 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// parquetUsageHistoryRow matches the schema of Parquet usage history exports
+type parquetUsageHistoryRow struct {
+	Name     string   `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DateUTC  int64    `parquet:"name=dateUTC, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	CPUUsage *float64 `parquet:"name=cpuUsage, type=DOUBLE, repetitiontype=OPTIONAL"`
+	MEMUsage *float64 `parquet:"name=memUsage, type=DOUBLE, repetitiontype=OPTIONAL"`
+}
+
+func TestUsageExport(t *testing.T) {
+	Convey("Given the usage history of two clusters", t, func(c C) {
+		t1, t2 := date(c, "2020-06-01T10:00:00Z"), date(c, "2020-06-01T10:05:00Z")
+		series := []*usageSeries{
+			newUsageHistorySeries("prod", &UsageHistory{
+				CPUUsage: []*ResourceUsageItem{{DateUTC: t1, Value: 1.25}, {DateUTC: t2, Value: 2}},
+				MEMUsage: []*ResourceUsageItem{{DateUTC: t1, Value: 2048}},
+			}),
+			newUsageHistorySeries("staging", &UsageHistory{
+				CPUUsage: []*ResourceUsageItem{{DateUTC: t2, Value: 0.5}},
+				MEMUsage: []*ResourceUsageItem{{DateUTC: t2, Value: 1024}},
+			}),
+		}
+		export := func(format string) *bytes.Buffer {
+			var buf bytes.Buffer
+			exporter, err := newUsageExporter(&buf, format, usageHistoryColumns)
+			c.So(err, ShouldBeNil)
+			for _, item := range series {
+				c.So(exporter.write(item), ShouldBeNil)
+			}
+			c.So(exporter.close(), ShouldBeNil)
+			return &buf
+		}
+
+		Convey("When it's exported as NDJSON", func() {
+			lines := strings.Split(strings.TrimSuffix(export(ExportFormatNDJSON).String(), "\n"), "\n")
+
+			Convey("Then there is a JSON object per item and date, with null for missing samples", func() {
+				So(lines, ShouldResemble, []string{
+					`{"name":"prod","dateUTC":"2020-06-01T10:00:00Z","cpuUsage":1.25,"memUsage":2048}`,
+					`{"name":"prod","dateUTC":"2020-06-01T10:05:00Z","cpuUsage":2,"memUsage":null}`,
+					`{"name":"staging","dateUTC":"2020-06-01T10:05:00Z","cpuUsage":0.5,"memUsage":1024}`,
+				})
+				for _, line := range lines {
+					So(json.Valid([]byte(line)), ShouldBeTrue)
+				}
+			})
+		})
+
+		Convey("When it's exported as Parquet", func() {
+			parquetFile, err := buffer.NewBufferFile(export(ExportFormatParquet).Bytes())
+			So(err, ShouldBeNil)
+			pr, err := reader.NewParquetReader(parquetFile, new(parquetUsageHistoryRow), 1)
+			So(err, ShouldBeNil)
+			rows := make([]parquetUsageHistoryRow, pr.GetNumRows())
+			So(pr.Read(&rows), ShouldBeNil)
+			pr.ReadStop()
+
+			Convey("Then it holds typed rows per item and date", func() {
+				So(rows, ShouldHaveLength, 3)
+				So(rows[0].Name, ShouldEqual, "prod")
+				So(rows[0].DateUTC, ShouldEqual, t1.UnixNano()/int64(time.Millisecond))
+				So(*rows[0].CPUUsage, ShouldEqual, 1.25)
+				So(*rows[0].MEMUsage, ShouldEqual, 2048)
+				So(rows[1].MEMUsage, ShouldBeNil)
+				So(rows[2].Name, ShouldEqual, "staging")
+				So(*rows[2].CPUUsage, ShouldEqual, 0.5)
+			})
+		})
+
+		Convey("When an unknown format is requested", func() {
+			_, err := newUsageExporter(&bytes.Buffer{}, ExportFormatCSV, usageHistoryColumns)
+
+			Convey("Then no exporter is returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given an API router and a cluster without history database", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		viper.Set("krossboard_historydb_dir", tempDir)
+		viper.Set("krossboard_rawdb_dir", tempDir)
+		viper.Set("krossboard_jwt_issuer", "")
+		viper.Set("krossboard_api_keys_file", "")
+		viper.Set("krossboard_access_control_file", "")
+		apiAccessPolicy = nil
+		origLastUpdate, origInstancesCache := rrdLastUpdate, apiInstancesCache
+		lastUpdate := date(c, "2020-06-01T10:00:00Z")
+		rrdLastUpdate = func(string) (time.Time, error) { return lastUpdate, nil }
+		apiInstancesCache = &krossboardInstancesCache{list: func() (*KbInstancesK8sList, error) {
+			instances := &KbInstancesK8sList{}
+			_ = json.Unmarshal([]byte(`{"items":[{"status":{"koaInstances":[{"clusterName":"prod"}]}}]}`), instances)
+			return instances, nil
+		}}
+		router, err := newAPIRouter()
+		So(err, ShouldBeNil)
+
+		Convey("When its history is requested as NDJSON", func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", "/api/usagehistory?format=ndjson&startDateUTC=2020-06-01T00:00:00&endDateUTC=2020-06-01T12:00:00", nil))
+
+			Convey("Then an empty NDJSON attachment is streamed", func() {
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(resp.Header().Get("Content-Type"), ShouldEqual, usageNDJSONContentType)
+				So(resp.Header().Get("Content-Disposition"), ShouldEndWith, `.ndjson"`)
+				So(resp.Body.Len(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the history of an unknown cluster is requested", func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", "/api/usagehistory?cluster=staging&format=ndjson", nil))
+
+			Convey("Then the cluster is not found", func() {
+				So(resp.Code, ShouldEqual, http.StatusNotFound)
+				So(resp.Body.String(), ShouldContainSubstring, "cluster not found")
+			})
+		})
+
+		Convey("When a node without databases is exported", func() {
+			err := exportNodesUsage(&bytes.Buffer{}, ExportFormatNDJSON, []string{"node-1"}, lastUpdate.Add(-time.Hour), lastUpdate, time.Hour)
+
+			Convey("Then the export fails without creating the databases", func() {
+				So(err, ShouldNotBeNil)
+				files, err := ioutil.ReadDir(tempDir)
+				So(err, ShouldBeNil)
+				So(files, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a bulk format is requested from the v2 API", func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", "/api/v2/usagehistory?format=parquet", nil))
+
+			Convey("Then the format is ignored and JSON is returned", func() {
+				So(isBulkExportRequest(httptest.NewRequest("GET", "/api/v2/usagehistory?format=parquet", nil)), ShouldBeFalse)
+				So(resp.Header().Get("Content-Type"), ShouldStartWith, "application/json")
+			})
+		})
+
+		Reset(func() {
+			rrdLastUpdate, apiInstancesCache = origLastUpdate, origInstancesCache
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}
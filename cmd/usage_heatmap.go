@@ -0,0 +1,94 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HeatmapMatrix holds a value for each day of week (rows, Sunday first) and hour of day (columns)
+type HeatmapMatrix [7][24]float64
+
+// ResourceHeatmap holds the mean and max usage of a resource by day of week and hour of day
+type ResourceHeatmap struct {
+	Mean HeatmapMatrix `json:"mean"`
+	Max  HeatmapMatrix `json:"max"`
+}
+
+// UsageHeatmap holds usage patterns for all kinds of managed resources (CPU, memory), days and hours being
+// those of the time zone
+type UsageHeatmap struct {
+	TimeZone   string          `json:"timeZone"`
+	Days       []string        `json:"days"`
+	Samples    [7][24]int      `json:"samples"`
+	CPUHeatmap ResourceHeatmap `json:"cpuHeatmap"`
+	MEMHeatmap ResourceHeatmap `json:"memHeatmap"`
+}
+
+// computeUsageHeatmap aggregates a usage history into day of week × hour of day matrices, in a time zone
+func computeUsageHeatmap(history *UsageHistory, loc *time.Location) *UsageHeatmap {
+	heatmap := &UsageHeatmap{TimeZone: loc.String()}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		heatmap.Days = append(heatmap.Days, day.String())
+	}
+
+	aggregate := func(items []*ResourceUsageItem, resourceHeatmap *ResourceHeatmap, samples *[7][24]int) {
+		for _, item := range items {
+			localDate := item.DateUTC.In(loc)
+			day, hour := localDate.Weekday(), localDate.Hour()
+			resourceHeatmap.Mean[day][hour] += item.Value
+			if samples[day][hour] == 0 || item.Value > resourceHeatmap.Max[day][hour] {
+				resourceHeatmap.Max[day][hour] = item.Value
+			}
+			samples[day][hour]++
+		}
+		for day := range samples {
+			for hour, count := range samples[day] {
+				if count > 0 {
+					resourceHeatmap.Mean[day][hour] /= float64(count)
+				}
+			}
+		}
+	}
+
+	var memSamples [7][24]int
+	aggregate(history.CPUUsage, &heatmap.CPUHeatmap, &heatmap.Samples)
+	aggregate(history.MEMUsage, &heatmap.MEMHeatmap, &memSamples)
+	return heatmap
+}
+
+// formatHeatmapCSV serializes a heatmap as CSV, with one row per day of week and hour of day
+func formatHeatmapCSV(heatmap *UsageHeatmap) string {
+	var csvBuf strings.Builder
+	fmt.Fprintf(&csvBuf, "Day,Hour,Samples,CPU Mean,CPU Max,Memory Mean,Memory Max\n")
+	for day := range heatmap.Samples {
+		for hour := range heatmap.Samples[day] {
+			fmt.Fprintf(&csvBuf, "%v,%v,%v,%v,%v,%v,%v\n",
+				heatmap.Days[day],
+				hour,
+				heatmap.Samples[day][hour],
+				heatmap.CPUHeatmap.Mean[day][hour],
+				heatmap.CPUHeatmap.Max[day][hour],
+				heatmap.MEMHeatmap.Mean[day][hour],
+				heatmap.MEMHeatmap.Max[day][hour])
+		}
+	}
+	return csvBuf.String()
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestComputeUsageHeatmap(t *testing.T) {
+	Convey("Given usage samples on two Mondays at 9 AM and one Sunday at midnight", t, func(c C) {
+		history := &UsageHistory{
+			CPUUsage: []*ResourceUsageItem{
+				{DateUTC: date(c, "2020-04-06T09:00:00Z"), Value: 10},
+				{DateUTC: date(c, "2020-04-13T09:00:00Z"), Value: 30},
+				{DateUTC: date(c, "2020-04-12T00:00:00Z"), Value: 5},
+			},
+			MEMUsage: []*ResourceUsageItem{
+				{DateUTC: date(c, "2020-04-06T09:00:00Z"), Value: 40},
+				{DateUTC: date(c, "2020-04-13T09:00:00Z"), Value: 20},
+				{DateUTC: date(c, "2020-04-12T00:00:00Z"), Value: 7},
+			},
+		}
+
+		Convey("When computing the heatmap", func() {
+			heatmap := computeUsageHeatmap(history, time.UTC)
+
+			Convey("Then samples are aggregated by day of week and hour of day", func() {
+				So(heatmap.Days[1], ShouldEqual, "Monday")
+				So(heatmap.Samples[1][9], ShouldEqual, 2)
+				So(heatmap.CPUHeatmap.Mean[1][9], ShouldEqual, 20)
+				So(heatmap.CPUHeatmap.Max[1][9], ShouldEqual, 30)
+				So(heatmap.MEMHeatmap.Mean[1][9], ShouldEqual, 30)
+				So(heatmap.MEMHeatmap.Max[1][9], ShouldEqual, 40)
+				So(heatmap.Samples[0][0], ShouldEqual, 1)
+				So(heatmap.CPUHeatmap.Mean[0][0], ShouldEqual, 5)
+				So(heatmap.Samples[1][10], ShouldEqual, 0)
+			})
+
+			Convey("Then the CSV export holds a header and one row per cell", func() {
+				lines := strings.Split(strings.TrimSpace(formatHeatmapCSV(heatmap)), "\n")
+				So(lines, ShouldHaveLength, 1+7*24)
+				So(lines[1+24+9], ShouldEqual, "Monday,9,2,20,30,30,40")
+			})
+		})
+
+		Convey("When computing the heatmap in the time zone of New York", func() {
+			loc, err := time.LoadLocation("America/New_York")
+			So(err, ShouldBeNil)
+			heatmap := computeUsageHeatmap(history, loc)
+
+			Convey("Then samples are aggregated by local day of week and hour of day", func() {
+				So(heatmap.TimeZone, ShouldEqual, "America/New_York")
+				So(heatmap.Samples[1][5], ShouldEqual, 2)
+				So(heatmap.CPUHeatmap.Mean[1][5], ShouldEqual, 20)
+				// midnight UTC on Sunday is 8 PM on Saturday in New York
+				So(heatmap.Samples[6][20], ShouldEqual, 1)
+				So(heatmap.Samples[0][0], ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestUsageHeatmapHandler(t *testing.T) {
+	Convey("Given empty data directories", t, func() {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tempDir)
+		for _, key := range []string{"krossboard_rawdb_dir", "krossboard_historydb_dir"} {
+			dir := filepath.Join(tempDir, key)
+			So(os.Mkdir(dir, 0755), ShouldBeNil)
+			viper.Set(key, dir)
+		}
+		serve := func(target string) int {
+			resp := httptest.NewRecorder()
+			GetUsageHeatmapHandler(resp, httptest.NewRequest("GET", target, nil))
+			return resp.Code
+		}
+		countFiles := func() int {
+			count := 0
+			_ = filepath.Walk(tempDir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					count++
+				}
+				return nil
+			})
+			return count
+		}
+
+		Convey("When items are named with path elements", func() {
+			codes := []int{
+				serve("/api/heatmap?node=../../x"),
+				serve("/api/heatmap?cluster=prod&namespace=../staging/default"),
+				serve("/api/heatmap?cluster=..%5Cprod"),
+			}
+
+			Convey("Then the requests are rejected", func() {
+				So(codes, ShouldResemble, []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest})
+			})
+		})
+
+		Convey("When a node is requested with a cluster it doesn't belong to", func() {
+			for _, nodeName := range []string{"node-1", "node-2"} {
+				capacityDbPath, allocatableDbPath, usageByPodsDbPath := getNodeUsageDbPaths(nodeName)
+				for _, dbPath := range []string{capacityDbPath, allocatableDbPath, usageByPodsDbPath} {
+					So(NewUsageDb(dbPath, math.MaxFloat64).CreateRRD(), ShouldBeNil)
+				}
+			}
+			So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-1": {}}, "dev": {"node-2": {}}}, time.Now().UTC()), ShouldBeNil)
+
+			Convey("Then it's not found", func() {
+				So(serve("/api/heatmap?cluster=prod&node=node-2"), ShouldEqual, http.StatusNotFound)
+				So(serve("/api/heatmap?cluster=prod&node=node-1"), ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When a caller restricted to a namespace requests cluster-level heatmaps", func() {
+			rulesFile := filepath.Join(tempDir, "access.json")
+			data, _ := json.Marshal(&AccessControlFile{Rules: []*AccessRule{
+				{Users: []string{"john@example.com"}, Clusters: []string{"prod"}, Namespaces: []string{"payments"}},
+			}})
+			So(ioutil.WriteFile(rulesFile, data, 0600), ShouldBeNil)
+			policy, err := newAccessPolicy(rulesFile)
+			So(err, ShouldBeNil)
+			apiAccessPolicy = policy
+			defer func() { apiAccessPolicy = nil }()
+			So(NewUsageDb(getHistoryDbPath("prod"), 100).CreateRRD(), ShouldBeNil)
+			serveAsJohn := func(target string) int {
+				resp := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", target, nil).WithContext(context.WithValue(context.Background(), principalContextKey{},
+					&Principal{Name: "john@example.com", Scope: AuthScopeReadOnly, AuthMethod: AuthMethodJWT}))
+				GetUsageHeatmapHandler(resp, req)
+				return resp.Code
+			}
+
+			Convey("Then the cluster and its nodes are not found", func() {
+				So(serveAsJohn("/api/heatmap?cluster=prod"), ShouldEqual, http.StatusNotFound)
+				So(serveAsJohn("/api/heatmap?cluster=prod&namespace=payments&node=node-1"), ShouldEqual, http.StatusNotFound)
+				So(serveAsJohn("/api/heatmap?node=node-1"), ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("When items without databases are requested", func() {
+			codes := []int{
+				serve("/api/heatmap?node=node-1"),
+				serve("/api/heatmap?cluster=prod&namespace=default"),
+				serve("/api/heatmap?cluster=prod"),
+			}
+
+			Convey("Then they are not found and no database is created", func() {
+				So(codes, ShouldResemble, []int{http.StatusNotFound, http.StatusNotFound, http.StatusNotFound})
+				So(countFiles(), ShouldEqual, 0)
+			})
+		})
+	})
+}
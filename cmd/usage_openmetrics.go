@@ -0,0 +1,189 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// openMetricsSeries reads the usage history of a series from its database
+type openMetricsSeries struct {
+	usageDb *UsageDb
+	fetch   func(startTimeUTC time.Time, endTimeUTC time.Time) (*UsageHistory, error)
+	labels  []string
+}
+
+// newNodeOpenMetricsSeries returns a series read from a node database with the given step
+func newNodeOpenMetricsSeries(usageDb *UsageDb, step time.Duration, labels []string) *openMetricsSeries {
+	fetch := func(startTimeUTC time.Time, endTimeUTC time.Time) (*UsageHistory, error) {
+		return usageDb.FetchUsage(startTimeUTC, endTimeUTC, step)
+	}
+	return &openMetricsSeries{usageDb, fetch, labels}
+}
+
+// writeUsageFamily writes a family while reading the databases of its series one after another, so that only the
+// history of one series is held in memory. The CPU or the memory usage is written depending on cpu
+func writeUsageFamily(out *openMetricsWriter, family *prometheusMetricFamily, series []*openMetricsSeries, cpu bool, startDateUTC time.Time, endDateUTC time.Time) error {
+	out.startFamily(family)
+	for _, s := range series {
+		usageHistory, err := s.fetch(startDateUTC, endDateUTC)
+		if err != nil {
+			log.WithError(err).Errorln("failed retrieving data from rrd file", s.usageDb.RRDFile)
+			continue
+		}
+		items := usageHistory.MEMUsage
+		if cpu {
+			items = usageHistory.CPUUsage
+		}
+		for _, item := range items {
+			out.writeSample(item.DateUTC, item.Value, s.labels...)
+		}
+		if err := out.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listStoredNamespaceDbs returns the namespace databases of all clusters, keyed by cluster then namespace name
+func listStoredNamespaceDbs() (map[string]map[string]string, error) {
+	rawDbDir := viper.GetString("krossboard_rawdb_dir")
+	clusterDirs, err := ioutil.ReadDir(rawDbDir)
+	if err != nil {
+		return nil, err
+	}
+	namespaceDbs := make(map[string]map[string]string)
+	for _, clusterDir := range clusterDirs {
+		if !clusterDir.IsDir() {
+			continue
+		}
+		dbFiles, err := listRegularFiles(fmt.Sprintf("%s/%s", rawDbDir, clusterDir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, dbFile := range dbFiles {
+			if filepath.Base(dbFile) == "non-allocatable" {
+				// already accounted in the cluster history
+				continue
+			}
+			if namespaceDbs[clusterDir.Name()] == nil {
+				namespaceDbs[clusterDir.Name()] = make(map[string]string)
+			}
+			namespaceDbs[clusterDir.Name()][filepath.Base(dbFile)] = dbFile
+		}
+	}
+	return namespaceDbs, nil
+}
+
+// sortedDbNames returns the names of a set of databases in alphabetical order
+func sortedDbNames(dbs map[string]string) []string {
+	keys := make([]string, 0, len(dbs))
+	for key := range dbs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// exportOpenMetrics writes the usage history of clusters, namespaces and nodes in the OpenMetrics text format,
+// so that it can be backfilled into Prometheus with 'promtool tsdb create-blocks-from openmetrics'. Families are
+// streamed one after another, each database being read once per family it feeds
+func exportOpenMetrics(w io.Writer, startDateUTC time.Time, endDateUTC time.Time) error {
+	clusterDbs, err := listStoredHistoryDbs("")
+	if err != nil {
+		return err
+	}
+	var clusterSeries []*openMetricsSeries
+	for _, clusterName := range sortedDbNames(clusterDbs) {
+		usageDb := NewUsageDb(clusterDbs[clusterName], 100)
+		clusterSeries = append(clusterSeries, &openMetricsSeries{usageDb, usageDb.FetchUsageHourly, []string{"cluster", clusterName}})
+	}
+
+	namespaceDbs, err := listStoredNamespaceDbs()
+	if err != nil {
+		log.WithError(err).Warnln("failed listing namespace databases")
+	}
+	clusterNames := make([]string, 0, len(namespaceDbs))
+	for clusterName := range namespaceDbs {
+		clusterNames = append(clusterNames, clusterName)
+	}
+	sort.Strings(clusterNames)
+	var namespaceSeries []*openMetricsSeries
+	for _, clusterName := range clusterNames {
+		for _, namespace := range sortedDbNames(namespaceDbs[clusterName]) {
+			usageDb := NewUsageDb(namespaceDbs[clusterName][namespace], 100)
+			namespaceSeries = append(namespaceSeries, &openMetricsSeries{usageDb, usageDb.FetchUsageHourly, []string{"cluster", clusterName, "namespace", namespace}})
+		}
+	}
+
+	nodeNames, err := listStoredNodeNames()
+	if err != nil {
+		return err
+	}
+	sort.Strings(nodeNames)
+	nodeClusters := getNodeClusters()
+	step := nodeUsageStep(startDateUTC, endDateUTC)
+	var capacitySeries, allocatableSeries, usageByPodsSeries []*openMetricsSeries
+	for _, nodeName := range nodeNames {
+		nodeUsageDb, err := openNodeUsageDB(nodeName)
+		if err != nil {
+			log.WithError(err).Warnln("skipping node with incomplete usage databases", nodeName)
+			continue
+		}
+		// labels match those of the /metrics endpoint, the cluster of nodes seen before its tracking is unknown
+		labels := []string{"node", nodeName}
+		if clusterName, found := nodeClusters[nodeName]; found {
+			labels = []string{"cluster", clusterName, "node", nodeName}
+		}
+		capacitySeries = append(capacitySeries, newNodeOpenMetricsSeries(nodeUsageDb.CapacityDb, step, labels))
+		allocatableSeries = append(allocatableSeries, newNodeOpenMetricsSeries(nodeUsageDb.AllocatableDb, step, labels))
+		usageByPodsSeries = append(usageByPodsSeries, newNodeOpenMetricsSeries(nodeUsageDb.UsageByPodsDb, step, labels))
+	}
+
+	// names match those of the /metrics endpoint when the same quantity is exposed there
+	out := newOpenMetricsWriter(w)
+	for _, family := range []struct {
+		family *prometheusMetricFamily
+		series []*openMetricsSeries
+		cpu    bool
+	}{
+		{newPrometheusMetricFamily("krossboard_cluster_cpu_usage_percent", PrometheusGauge, "Percentage of the cluster CPU capacity used by pods or not allocatable.").withUnit("percent"), clusterSeries, true},
+		{newPrometheusMetricFamily("krossboard_cluster_memory_usage_percent", PrometheusGauge, "Percentage of the cluster memory capacity used by pods or not allocatable.").withUnit("percent"), clusterSeries, false},
+		{newPrometheusMetricFamily("krossboard_namespace_cpu_usage_percent", PrometheusGauge, "Percentage of the cluster CPU capacity used by the pods of the namespace.").withUnit("percent"), namespaceSeries, true},
+		{newPrometheusMetricFamily("krossboard_namespace_memory_usage_percent", PrometheusGauge, "Percentage of the cluster memory capacity used by the pods of the namespace.").withUnit("percent"), namespaceSeries, false},
+		{newPrometheusMetricFamily("krossboard_node_cpu_capacity_cores", PrometheusGauge, "CPU capacity of the node.").withUnit("cores"), capacitySeries, true},
+		{newPrometheusMetricFamily("krossboard_node_cpu_allocatable_cores", PrometheusGauge, "Allocatable CPU of the node.").withUnit("cores"), allocatableSeries, true},
+		{newPrometheusMetricFamily("krossboard_node_cpu_usage_by_pods_cores", PrometheusGauge, "CPU used by the pods running on the node.").withUnit("cores"), usageByPodsSeries, true},
+		{newPrometheusMetricFamily("krossboard_node_memory_capacity_bytes", PrometheusGauge, "Memory capacity of the node.").withUnit("bytes"), capacitySeries, false},
+		{newPrometheusMetricFamily("krossboard_node_memory_allocatable_bytes", PrometheusGauge, "Allocatable memory of the node.").withUnit("bytes"), allocatableSeries, false},
+		{newPrometheusMetricFamily("krossboard_node_memory_usage_by_pods_bytes", PrometheusGauge, "Memory used by the pods running on the node.").withUnit("bytes"), usageByPodsSeries, false},
+	} {
+		if err := writeUsageFamily(out, family.family, family.series, family.cpu, startDateUTC, endDateUTC); err != nil {
+			return err
+		}
+	}
+	return out.close()
+}
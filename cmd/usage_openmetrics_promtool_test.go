@@ -0,0 +1,60 @@
+//go:build promtool
+// +build promtool
+
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// TestOpenMetricsPromtoolBackfill requires promtool, it's run with 'make test-promtool'
+func TestOpenMetricsPromtoolBackfill(t *testing.T) {
+	Convey("Given the OpenMetrics export of the history of a cluster and of a node", t, func(c C) {
+		buf := writeOpenMetricsFixture(c)
+		promtool, err := exec.LookPath("promtool")
+		So(err, ShouldBeNil)
+
+		Convey("When promtool creates TSDB blocks from the export", func() {
+			tempDir, err := ioutil.TempDir("", "tests")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(tempDir)
+			exportFile := tempDir + "/export.om"
+			So(ioutil.WriteFile(exportFile, buf.Bytes(), 0644), ShouldBeNil)
+			out, err := exec.Command(promtool, "tsdb", "create-blocks-from", "openmetrics", exportFile, tempDir+"/data").CombinedOutput()
+			So(err, ShouldBeNil)
+			// dumps read the write-ahead log, which blocks created from a backfill don't have
+			So(os.MkdirAll(tempDir+"/data/wal", 0755), ShouldBeNil)
+			dump, err := exec.Command(promtool, "tsdb", "dump", tempDir+"/data").Output()
+			So(err, ShouldBeNil)
+
+			Convey("Then the blocks hold the exported samples", func() {
+				So(string(out), ShouldNotContainSubstring, "error")
+				So(string(dump), ShouldContainSubstring, `{__name__="krossboard_cluster_cpu_usage_percent", cluster="prod \"eu\""} 42.5 1591005600000`)
+				So(string(dump), ShouldContainSubstring, `{__name__="krossboard_cluster_cpu_usage_percent", cluster="prod \"eu\""} 40 1591009200000`)
+				So(string(dump), ShouldContainSubstring, `{__name__="krossboard_node_memory_capacity_bytes", node="node-1"} 8.589934592e+09 1591005600000`)
+			})
+		})
+	})
+}
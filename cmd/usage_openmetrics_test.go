@@ -0,0 +1,218 @@
+/*
+   Copyright (C) 2020  2ALCHEMISTS SAS.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as
+   published by the Free Software Foundation, either version 3 of the
+   License, or (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// openMetricsSampleRegexp matches a sample line with a timestamp: name, labels, value and timestamp
+var openMetricsSampleRegexp = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{.*\})? (\S+) (\d+)$`)
+
+// openMetricsLabelRegexp matches a label pair in the labels of a sample
+var openMetricsLabelRegexp = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\.)*)"`)
+
+// parseOpenMetricsSamples parses a backfill file, enforcing the rules checked by promtool: metadata before samples,
+// contiguous families, samples of a series in chronological order and a final EOF. Samples are returned as
+// 'series value timestamp' lines, series being formatted as 'name{label="value",...}' with sorted labels
+func parseOpenMetricsSamples(data []byte) ([]string, error) {
+	var samples []string
+	seenFamilies := make(map[string]bool)
+	lastTimestamps := make(map[string]int64)
+	family, eof := "", false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if eof {
+			return nil, fmt.Errorf("data after EOF: %s", line)
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+		if strings.HasPrefix(line, "# ") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("invalid metadata: %s", line)
+			}
+			if fields[2] != family {
+				if seenFamilies[fields[2]] {
+					return nil, fmt.Errorf("interleaved family %s", fields[2])
+				}
+				family = fields[2]
+				seenFamilies[family] = true
+			}
+			if fields[1] == "UNIT" && !strings.HasSuffix(family, "_"+fields[3]) {
+				return nil, fmt.Errorf("unit %s is not a suffix of %s", fields[3], family)
+			}
+			continue
+		}
+		match := openMetricsSampleRegexp.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("invalid sample: %s", line)
+		}
+		if match[1] != family {
+			return nil, fmt.Errorf("sample of %s without metadata", match[1])
+		}
+		var labels []string
+		for _, pair := range openMetricsLabelRegexp.FindAllStringSubmatch(match[2], -1) {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, pair[1], pair[2]))
+		}
+		sort.Strings(labels)
+		series := match[1] + "{" + strings.Join(labels, ",") + "}"
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			return nil, err
+		}
+		timestamp, _ := strconv.ParseInt(match[4], 10, 64)
+		if last, found := lastTimestamps[series]; found && timestamp <= last {
+			return nil, fmt.Errorf("out of order sample for %s", series)
+		}
+		lastTimestamps[series] = timestamp
+		samples = append(samples, fmt.Sprintf("%s %v %d", series, value, timestamp))
+	}
+	if !eof {
+		return nil, fmt.Errorf("missing EOF")
+	}
+	return samples, scanner.Err()
+}
+
+// writeOpenMetricsFixture writes the history of two clusters and of a node, with a label value to escape and an
+// empty family
+func writeOpenMetricsFixture(c C) *bytes.Buffer {
+	t1, t2 := date(c, "2020-06-01T10:00:00Z"), date(c, "2020-06-01T11:00:00Z")
+	var buf bytes.Buffer
+	out := newOpenMetricsWriter(&buf)
+	out.startFamily(newPrometheusMetricFamily("krossboard_cluster_cpu_usage_percent", PrometheusGauge, "Percentage of the cluster CPU capacity used.").withUnit("percent"))
+	out.writeSample(t1, 42.5, "cluster", `prod "eu"`)
+	out.writeSample(t2, 40, "cluster", `prod "eu"`)
+	out.writeSample(t1, 10, "cluster", "staging")
+	out.startFamily(newPrometheusMetricFamily("krossboard_namespace_cpu_usage_percent", PrometheusGauge, "Unused."))
+	out.startFamily(newPrometheusMetricFamily("krossboard_node_memory_capacity_bytes", PrometheusGauge, "Memory capacity of the node.").withUnit("bytes"))
+	out.writeSample(t1, 8589934592, "node", "node-1")
+	c.So(out.err(), ShouldBeNil)
+	c.So(out.close(), ShouldBeNil)
+	return &buf
+}
+
+func TestOpenMetricsExport(t *testing.T) {
+	Convey("Given the history of a cluster and of a node", t, func(c C) {
+		buf := writeOpenMetricsFixture(c)
+
+		Convey("When the OpenMetrics export is parsed back", func() {
+			samples, err := parseOpenMetricsSamples(buf.Bytes())
+
+			Convey("Then it's valid and holds every sample with its labels and timestamp", func() {
+				So(err, ShouldBeNil)
+				So(buf.String(), ShouldStartWith, "# TYPE krossboard_cluster_cpu_usage_percent gauge\n# UNIT krossboard_cluster_cpu_usage_percent percent\n")
+				So(buf.String(), ShouldNotContainSubstring, "krossboard_namespace_cpu_usage_percent")
+				So(samples, ShouldResemble, []string{
+					`krossboard_cluster_cpu_usage_percent{cluster="prod \"eu\""} 42.5 1591005600`,
+					`krossboard_cluster_cpu_usage_percent{cluster="prod \"eu\""} 40 1591009200`,
+					`krossboard_cluster_cpu_usage_percent{cluster="staging"} 10 1591005600`,
+					`krossboard_node_memory_capacity_bytes{node="node-1"} 8.589934592e+09 1591005600`,
+				})
+			})
+		})
+	})
+}
+
+func TestExportOpenMetrics(t *testing.T) {
+	Convey("Given the databases of a cluster, of a namespace and of nodes filled with constant usage", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "tests")
+		So(err, ShouldBeNil)
+		for _, key := range []string{"krossboard_rawdb_dir", "krossboard_historydb_dir", "krossboard_run_dir"} {
+			dir := filepath.Join(tempDir, key)
+			So(os.Mkdir(dir, 0755), ShouldBeNil)
+			viper.Set(key, dir)
+		}
+		So(os.Mkdir(filepath.Join(viper.GetString("krossboard_rawdb_dir"), "prod"), 0755), ShouldBeNil)
+		origNow := now
+		start := date(c, "2020-06-01T10:00:00Z")
+		now = func() time.Time { return start }
+
+		fill := func(usageDb *UsageDb, cpuUsage float64, memUsage float64) {
+			c.So(usageDb.CreateRRD(), ShouldBeNil)
+			for ts := start.Add(5 * time.Minute); !ts.After(start.Add(2 * time.Hour)); ts = ts.Add(5 * time.Minute) {
+				c.So(usageDb.UpdateRRD(ts, cpuUsage, memUsage), ShouldBeNil)
+			}
+		}
+		fill(NewUsageDb(getHistoryDbPath("prod"), 100), 40, 60)
+		fill(NewUsageDb(filepath.Join(viper.GetString("krossboard_rawdb_dir"), "prod", "default"), 100), 10, 20)
+		for _, nodeName := range []string{"node-1", "node-2", "node-3"} {
+			capacityDbPath, allocatableDbPath, usageByPodsDbPath := getNodeUsageDbPaths(nodeName)
+			fill(NewUsageDb(capacityDbPath, math.MaxFloat64), 4, 8589934592)
+			fill(NewUsageDb(allocatableDbPath, math.MaxFloat64), 3.5, 7516192768)
+			fill(NewUsageDb(usageByPodsDbPath, math.MaxFloat64), 2, 4294967296)
+		}
+		// node-1 is tracked in the nodes metadata, node-2 only in the latest nodes usage, node-3 in none of them
+		So(saveNodesMetadata(map[string]map[string]NodeUsage{"prod": {"node-1": {}}}, start), ShouldBeNil)
+		So(ioutil.WriteFile(getNodesUsagePath(), []byte(`{"staging":{"node-2":{}}}`), 0644), ShouldBeNil)
+
+		Convey("When they are exported in the OpenMetrics format", func() {
+			var buf bytes.Buffer
+			So(exportOpenMetrics(&buf, start, start.Add(2*time.Hour)), ShouldBeNil)
+			samples, err := parseOpenMetricsSamples(buf.Bytes())
+			So(err, ShouldBeNil)
+			seriesValues := make(map[string]map[string]bool)
+			for _, sample := range samples {
+				fields := strings.Split(sample, " ")
+				if seriesValues[fields[0]] == nil {
+					seriesValues[fields[0]] = make(map[string]bool)
+				}
+				seriesValues[fields[0]][fields[1]] = true
+			}
+
+			Convey("Then each series holds its constant value", func() {
+				So(seriesValues[`krossboard_cluster_cpu_usage_percent{cluster="prod"}`], ShouldResemble, map[string]bool{"40": true})
+				So(seriesValues[`krossboard_cluster_memory_usage_percent{cluster="prod"}`], ShouldResemble, map[string]bool{"60": true})
+				So(seriesValues[`krossboard_namespace_cpu_usage_percent{cluster="prod",namespace="default"}`], ShouldResemble, map[string]bool{"10": true})
+				So(seriesValues[`krossboard_namespace_memory_usage_percent{cluster="prod",namespace="default"}`], ShouldResemble, map[string]bool{"20": true})
+				So(seriesValues[`krossboard_node_cpu_capacity_cores{cluster="prod",node="node-1"}`], ShouldResemble, map[string]bool{"4": true})
+				So(seriesValues[`krossboard_node_cpu_allocatable_cores{cluster="prod",node="node-1"}`], ShouldResemble, map[string]bool{"3.5": true})
+				So(seriesValues[`krossboard_node_memory_usage_by_pods_bytes{cluster="prod",node="node-1"}`], ShouldResemble, map[string]bool{"4.294967296e+09": true})
+			})
+
+			Convey("Then nodes are labelled with their cluster when it's known", func() {
+				So(seriesValues, ShouldContainKey, `krossboard_node_cpu_capacity_cores{cluster="staging",node="node-2"}`)
+				So(seriesValues, ShouldContainKey, `krossboard_node_cpu_capacity_cores{node="node-3"}`)
+				So(seriesValues, ShouldHaveLength, 4+6*3)
+			})
+		})
+
+		Reset(func() {
+			now = origNow
+			_ = os.RemoveAll(tempDir)
+		})
+	})
+}